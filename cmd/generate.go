@@ -309,6 +309,20 @@ func main() {
 	}
 	erpCmd.AddCommand(updateDBCmd)
 
+	var openAPICmd = &cobra.Command{
+		Use:   "openapi [OUTPUT_FILE]",
+		Short: "Generate the OpenAPI specification of the REST API",
+		Long: "Generate the OpenAPI specification of the REST API in OUTPUT_FILE, or on the standard output if omitted.",
+		Run: func(c *cobra.Command, args []string) {
+			var output string
+			if len(args) > 0 {
+				output = args[0]
+			}
+			cmd.GenerateOpenAPI(output)
+		},
+	}
+	erpCmd.AddCommand(openAPICmd)
+
 	cobra.OnInitialize(cmd.InitConfig)
 
 	if err := erpCmd.Execute(); err != nil {
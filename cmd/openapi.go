@@ -0,0 +1,68 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/Pedro-lmso-erp/erp/src/controllers"
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/Pedro-lmso-erp/erp/src/server"
+	"github.com/spf13/cobra"
+)
+
+// openAPIFileName is the name of the OpenAPI specification file generated in the project directory
+const openAPIFileName = "openapi.json"
+
+var openAPICmd = &cobra.Command{
+	Use:   "openapi [PROJECT_DIR]",
+	Short: "Generate the OpenAPI specification of the REST API",
+	Long: `Generate the OpenAPI specification of the REST API of the project in 'projectDir'
+from the model registry, and save it in the openapi.json file of the project.
+If projectDir is omitted, defaults to the current directory.
+This command must be rerun after each modification of the models. Note that the
+specification served by the server at ` + controllers.OpenAPIPath + ` is always up to date.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		projectDir := "."
+		if len(args) > 0 {
+			projectDir = args[0]
+		}
+		output, err := filepath.Abs(filepath.Join(projectDir, openAPIFileName))
+		if err != nil {
+			panic(err)
+		}
+		runProject(projectDir, "openapi", []string{output})
+	},
+}
+
+// GenerateOpenAPI writes the OpenAPI specification of the REST API in the given
+// file, or on the standard output if output is empty. It is meant to be called
+// from a project start file which imports all the project's module.
+//
+// Models are bootstrapped without database connection, since the specification
+// only depends on the model registry.
+func GenerateOpenAPI(output string) {
+	setupLogger()
+	server.PreInit()
+	models.BootStrap()
+	spec, err := json.MarshalIndent(server.OpenAPISpec(controllers.RESTPath), "", "  ")
+	if err != nil {
+		log.Panic("Unable to marshal OpenAPI specification", "error", err)
+	}
+	if output == "" {
+		fmt.Println(string(spec))
+		return
+	}
+	if err := ioutil.WriteFile(output, spec, 0644); err != nil {
+		log.Panic("Unable to write OpenAPI specification", "error", err, "file", output)
+	}
+	log.Info("OpenAPI specification generated", "file", output)
+}
+
+func init() {
+	generateCmd.AddCommand(openAPICmd)
+}
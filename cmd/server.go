@@ -1,20 +1,27 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/Pedro-lmso-erp/erp/src/actions"
 	"github.com/Pedro-lmso-erp/erp/src/controllers"
 	"github.com/Pedro-lmso-erp/erp/src/i18n"
 	"github.com/Pedro-lmso-erp/erp/src/menus"
 	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
 	"github.com/Pedro-lmso-erp/erp/src/reports"
 	"github.com/Pedro-lmso-erp/erp/src/server"
 	"github.com/Pedro-lmso-erp/erp/src/templates"
 	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
+	"github.com/Pedro-lmso-erp/erp/src/tools/password"
+	"github.com/Pedro-lmso-erp/erp/src/tools/tracing"
 	"github.com/Pedro-lmso-erp/erp/src/views"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
@@ -58,6 +65,9 @@ func StartServer() {
 	setupLogger()
 	defer log.Sync()
 	setupDebug()
+	setupTracing()
+	server.EnableMonitoring(viper.GetBool("Server.Metrics"))
+	setupPasswords()
 	resourceDir, err := filepath.Abs(viper.GetString("ResourceDir"))
 	if err != nil {
 		log.Panic("Unable to find Resource directory", "error", err)
@@ -65,6 +75,9 @@ func StartServer() {
 	server.ResourceDir = resourceDir
 	server.PreInit()
 	connectToDB()
+	if size := viper.GetInt("Models.PrefetchSize"); size > 0 {
+		models.PrefetchSize = size
+	}
 	i18n.BootStrap()
 	models.BootStrap()
 	models.RunWorkerLoop()
@@ -82,14 +95,44 @@ func StartServer() {
 	cert := viper.GetString("Server.Certificate")
 	key := viper.GetString("Server.PrivateKey")
 	domain := viper.GetString("Server.Domain")
-	switch {
-	case cert != "":
-		srv.RunTLS(address, cert, key)
-	case domain != "":
-		srv.RunAutoTLS(domain)
-	default:
-		srv.Run(address)
+	stopped := make(chan error, 1)
+	go func() {
+		switch {
+		case cert != "":
+			stopped <- srv.RunTLS(address, cert, key)
+		case domain != "":
+			stopped <- srv.RunAutoTLS(domain)
+		default:
+			stopped <- srv.Run(address)
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Info("Shutting down erp server", "signal", sig.String())
+	case <-stopped:
+	}
+	shutdownServer(srv)
+}
+
+// shutdownServer gracefully stops the given server: it drains the in-flight
+// requests within the shutdown timeout, stops the worker loop, runs the
+// shutdown hooks of the modules and closes the database.
+func shutdownServer(srv *server.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("Server.ShutdownTimeout"))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warn("Unable to drain all in-flight requests", "error", err)
+	}
+	models.StopWorkerLoop()
+	server.Shutdown()
+	models.DBClose()
+	if traceExporter != nil {
+		tracing.SetExporter(nil)
+		traceExporter.Close()
 	}
+	log.Info("erp server stopped")
 }
 
 // setupLogger initializes the logger
@@ -105,6 +148,52 @@ func setupDebug() {
 	}
 	gin.SetMode(gin.DebugMode)
 	pprof.Register(server.GetServer().Engine)
+	server.EnableQueryProfiling(viper.GetDuration("Profiler.SlowThreshold"), viper.GetBool("Profiler.Explain"))
+}
+
+// traceExporter is the exporter of the spans if tracing is enabled
+var traceExporter *tracing.WriterExporter
+
+// setupTracing enables tracing if an exporter is configured.
+// The spans are written to the standard output if the exporter is
+// "stdout" or appended to the file with the given path otherwise.
+func setupTracing() {
+	switch output := viper.GetString("Tracing.Exporter"); output {
+	case "":
+		return
+	case "stdout":
+		traceExporter = tracing.NewStdoutExporter()
+	default:
+		var err error
+		traceExporter, err = tracing.NewFileExporter(output)
+		if err != nil {
+			log.Panic("Unable to setup tracing", "error", err)
+		}
+	}
+	tracing.SetExporter(traceExporter)
+	log.Info("Tracing enabled", "exporter", viper.GetString("Tracing.Exporter"))
+}
+
+// setupPasswords sets the password hashing algorithm, the password policy
+// and the login throttling
+func setupPasswords() {
+	algorithm := password.Algorithm(viper.GetString("Security.PasswordAlgorithm"))
+	switch algorithm {
+	case "":
+	case password.PBKDF2SHA512, password.Argon2id:
+		password.DefaultAlgorithm = algorithm
+	default:
+		log.Panic("Unknown password hashing algorithm", "algorithm", algorithm)
+	}
+	password.DefaultPolicy = password.Policy{
+		MinLength:        viper.GetInt("Security.PasswordMinLength"),
+		MinClasses:       viper.GetInt("Security.PasswordMinClasses"),
+		BreachedListFile: viper.GetString("Security.PasswordBreachedList"),
+	}
+	if viper.GetBool("Security.LoginThrottling") {
+		security.AuthenticationRegistry.SetThrottler(security.NewMemoryThrottler(
+			security.DefaultLoginThrottlePolicy, security.DefaultIPThrottlePolicy))
+	}
 }
 
 // connectToDB creates the connection to the database
@@ -137,6 +226,28 @@ func SetServerFlags(c *cobra.Command) {
 	viper.BindPFlag("Server.Certificate", c.PersistentFlags().Lookup("certificate"))
 	c.PersistentFlags().StringP("private-key", "K", "", "Private key file for HTTPS.")
 	viper.BindPFlag("Server.PrivateKey", c.PersistentFlags().Lookup("private-key"))
+	c.PersistentFlags().Duration("shutdown-timeout", 30*time.Second, "Maximum time to wait for in-flight requests to complete when the server receives SIGINT or SIGTERM.")
+	viper.BindPFlag("Server.ShutdownTimeout", c.PersistentFlags().Lookup("shutdown-timeout"))
+	c.PersistentFlags().Bool("metrics", false, "Expose the metrics of the server in Prometheus text format on /metrics. This route is not authenticated and should not be reachable from untrusted networks.")
+	viper.BindPFlag("Server.Metrics", c.PersistentFlags().Lookup("metrics"))
+	c.PersistentFlags().String("trace", "", "Enable tracing and export the spans as JSON lines to 'stdout' or to the given file.")
+	viper.BindPFlag("Tracing.Exporter", c.PersistentFlags().Lookup("trace"))
+	c.PersistentFlags().Duration("profiler-slow-threshold", 100*time.Millisecond, "In debug mode, queries of profiled requests slower than this threshold are reported as slow queries.")
+	viper.BindPFlag("Profiler.SlowThreshold", c.PersistentFlags().Lookup("profiler-slow-threshold"))
+	c.PersistentFlags().Bool("profiler-explain", false, "In debug mode, capture the execution plan of the slow queries of profiled requests with EXPLAIN ANALYZE.")
+	viper.BindPFlag("Profiler.Explain", c.PersistentFlags().Lookup("profiler-explain"))
+	c.PersistentFlags().Int("prefetch-size", models.PrefetchSize, "Maximum number of records loaded at once when reading a field of a record taken from a larger record set.")
+	viper.BindPFlag("Models.PrefetchSize", c.PersistentFlags().Lookup("prefetch-size"))
+	c.PersistentFlags().String("password-algorithm", string(password.DefaultAlgorithm), "Algorithm used to hash new passwords: 'pbkdf2-sha512' or 'argon2id'. Existing hashes are upgraded at login.")
+	viper.BindPFlag("Security.PasswordAlgorithm", c.PersistentFlags().Lookup("password-algorithm"))
+	c.PersistentFlags().Int("password-min-length", password.DefaultPolicy.MinLength, "Minimum number of characters of new passwords.")
+	viper.BindPFlag("Security.PasswordMinLength", c.PersistentFlags().Lookup("password-min-length"))
+	c.PersistentFlags().Int("password-min-classes", password.DefaultPolicy.MinClasses, "Minimum number of character classes (lowercase, uppercase, digits, symbols) of new passwords.")
+	viper.BindPFlag("Security.PasswordMinClasses", c.PersistentFlags().Lookup("password-min-classes"))
+	c.PersistentFlags().String("password-breached-list", "", "Path of a file listing forbidden passwords or their SHA1, one per line.")
+	viper.BindPFlag("Security.PasswordBreachedList", c.PersistentFlags().Lookup("password-breached-list"))
+	c.PersistentFlags().Bool("login-throttling", true, "Delay and temporarily lock out logins after repeated failed attempts per login and per IP address.")
+	viper.BindPFlag("Security.LoginThrottling", c.PersistentFlags().Lookup("login-throttling"))
 }
 
 func runCommand(c string, args ...string) error {
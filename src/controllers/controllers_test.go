@@ -144,3 +144,36 @@ func TestControllers(t *testing.T) {
 		})
 	})
 }
+
+func TestREST(t *testing.T) {
+	Convey("Testing REST API routes", t, func() {
+		defer func(registry *Group) { Registry = registry }(Registry)
+		Registry = newGroup("/")
+		group := EnableREST()
+		So(group, ShouldEqual, Registry.MustGetGroup(RESTPath))
+		So(group.HasController(http.MethodGet, "/:model"), ShouldBeTrue)
+		So(group.HasController(http.MethodPost, "/:model"), ShouldBeTrue)
+		So(group.HasController(http.MethodGet, "/:model/:id"), ShouldBeTrue)
+		So(group.HasController(http.MethodPatch, "/:model/:id"), ShouldBeTrue)
+		So(group.HasController(http.MethodDelete, "/:model/:id"), ShouldBeTrue)
+		So(group.HasController(http.MethodPost, "/:model/call/:method"), ShouldBeTrue)
+		So(func() { EnableREST() }, ShouldPanic)
+	})
+	Convey("Testing OpenAPI route", t, func() {
+		defer func(registry *Group) { Registry = registry }(Registry)
+		Registry = newGroup("/")
+		group := EnableOpenAPI()
+		So(group, ShouldEqual, Registry.MustGetGroup(OpenAPIPath))
+		So(group.HasController(http.MethodGet, ""), ShouldBeTrue)
+		So(func() { EnableOpenAPI() }, ShouldPanic)
+	})
+	Convey("Testing GraphQL routes", t, func() {
+		defer func(registry *Group) { Registry = registry }(Registry)
+		Registry = newGroup("/")
+		group := EnableGraphQL()
+		So(group, ShouldEqual, Registry.MustGetGroup(GraphQLPath))
+		So(group.HasController(http.MethodGet, ""), ShouldBeTrue)
+		So(group.HasController(http.MethodPost, ""), ShouldBeTrue)
+		So(func() { EnableGraphQL() }, ShouldPanic)
+	})
+}
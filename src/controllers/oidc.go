@@ -0,0 +1,24 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security/oidcauth"
+	"github.com/Pedro-lmso-erp/erp/src/server"
+)
+
+// OIDCPath is the path of the group of the OpenID Connect login routes:
+// <OIDCPath>/login starts the login and <OIDCPath>/callback is the redirect
+// URL to register at the identity provider.
+const OIDCPath = "/auth/oidc"
+
+// EnableOIDC adds the OpenID Connect login routes of the given backend to
+// the Registry. Users are redirected to successPath after login.
+func EnableOIDC(backend *oidcauth.Backend, successPath string) {
+	group := Registry.AddGroup(OIDCPath)
+	group.AddController(http.MethodGet, "/login", server.OIDCLogin(backend))
+	group.AddController(http.MethodGet, "/callback", server.OIDCCallback(backend, successPath))
+}
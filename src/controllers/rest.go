@@ -0,0 +1,65 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/Pedro-lmso-erp/erp/src/server"
+)
+
+const (
+	// RESTPath is the path of the group of the REST API routes
+	RESTPath = "/api/v1"
+	// OpenAPIPath is the path of the OpenAPI specification of the REST API
+	OpenAPIPath = "/api/openapi.json"
+	// GraphQLPath is the path of the GraphQL API
+	GraphQLPath = "/api/graphql"
+)
+
+// EnableREST adds the REST API routes for all exposed models to the Registry:
+//
+//	GET    <RESTPath>/<model>                searches records (see server.RESTSearch)
+//	POST   <RESTPath>/<model>                creates a record
+//	GET    <RESTPath>/<model>/<id>           reads a record
+//	PATCH  <RESTPath>/<model>/<id>           updates a record
+//	DELETE <RESTPath>/<model>/<id>           deletes a record
+//	POST   <RESTPath>/<model>/call/<method>  calls an exposed method
+//
+// Requests are executed as the user of the session or of the API key. The
+// returned Group allows to add middlewares to the API, typically
+// server.ScopedBearerAuthentication, server.RateLimit, and
+// server.CSRFProtection if the API is also used with session cookies.
+func EnableREST() *Group {
+	group := Registry.AddGroup(RESTPath)
+	group.AddController(http.MethodGet, "/:model", server.RESTSearch)
+	group.AddController(http.MethodPost, "/:model", server.RESTCreate)
+	group.AddController(http.MethodGet, "/:model/:id", server.RESTRead)
+	group.AddController(http.MethodPatch, "/:model/:id", server.RESTUpdate)
+	group.AddController(http.MethodDelete, "/:model/:id", server.RESTDelete)
+	group.AddController(http.MethodPost, "/:model/call/:method", server.RESTCall)
+	return group
+}
+
+// EnableOpenAPI adds the route serving the OpenAPI specification of the REST
+// API at OpenAPIPath (see server.OpenAPISpec). The specification is only
+// served to authenticated users, so the returned Group typically needs the
+// same authentication middlewares as the REST API.
+func EnableOpenAPI() *Group {
+	group := Registry.AddGroup(OpenAPIPath)
+	group.AddController(http.MethodGet, "", server.OpenAPI(RESTPath))
+	return group
+}
+
+// EnableGraphQL adds the GraphQL API routes for all exposed models to the
+// Registry at GraphQLPath, for GET and POST requests (see server.GraphQL).
+// The schema is generated by server.PostInit. As for EnableREST, the returned
+// Group allows to add middlewares to the API.
+func EnableGraphQL() *Group {
+	handler := server.GraphQL()
+	group := Registry.AddGroup(GraphQLPath)
+	group.AddController(http.MethodGet, "", handler)
+	group.AddController(http.MethodPost, "", handler)
+	return group
+}
@@ -85,6 +85,8 @@ func declareCommonMixin() {
 	commonMixin.addMethod("SortedDefault", commonMixinSortedDefault)
 	commonMixin.addMethod("SortedByField", commonMixinSortedByField)
 	commonMixin.addMethod("Filtered", commonMixinFiltered)
+	commonMixin.addMethod("FilteredOn", commonMixinFilteredOn)
+	commonMixin.addMethod("Matches", commonMixinMatches)
 	commonMixin.addMethod("GetRecord", commonMixinGetRecord)
 	commonMixin.addMethod("CheckExecutionPermission", commonMixinCheckExecutionPermission)
 	commonMixin.addMethod("SQLFromCondition", commonMixinSQLFromCondition)
@@ -205,7 +207,7 @@ func commonMixinNameGet(rc *RecordCollection) string {
 		case fmt.Stringer:
 			return name.String()
 		default:
-			log.Panic("Name field is neither a string nor a fmt.Stringer", "model", rc.model)
+			rc.logger().Panic("Name field is neither a string nor a fmt.Stringer", "model", rc.model)
 		}
 	}
 	return rc.String()
@@ -528,6 +530,24 @@ func commonMixinFiltered(rc *RecordCollection, test func(rs RecordSet) bool) *Re
 	return rc.Filtered(test)
 }
 
+// FilteredOn returns a new record set with only the records of this record set
+// that satisfy the given condition.
+//
+// The condition is evaluated in memory on the values in cache. Records
+// for which a needed value is not in cache are checked in the database.
+func commonMixinFilteredOn(rc *RecordCollection, cond Conditioner) *RecordCollection {
+	return rc.FilteredOn(cond.Underlying())
+}
+
+// Matches returns true if all the records of this record set satisfy
+// the given condition.
+//
+// The condition is evaluated in memory on the values in cache. Records
+// for which a needed value is not in cache are checked in the database.
+func commonMixinMatches(rc *RecordCollection, cond Conditioner) bool {
+	return rc.Matches(cond.Underlying())
+}
+
 // GetRecord returns the Recordset with the given externalID. It panics if the externalID does not exist.
 func commonMixinGetRecord(rc *RecordCollection, externalID string) *RecordCollection {
 	return rc.GetRecord(externalID)
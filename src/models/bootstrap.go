@@ -65,6 +65,9 @@ func BootStrap() {
 	checkComputeMethodsSignature()
 	setupSecurity()
 	RegisterWorker(NewWorkerFunction(FreeTransientModels, freeTransientPeriod))
+	RegisterWorker(NewWorkerFunction(processDueWebhookDeliveries, webhookDeliveryPeriod))
+	RegisterWorker(NewWorkerFunction(RunScheduledJobs, scheduledJobsPeriod))
+	RegisterWorker(NewWorkerFunction(processJobQueue, jobQueuePeriod))
 
 	Registry.bootstrapped = true
 }
@@ -197,6 +200,9 @@ func addMixinMethods(mixinModel, model *Model) {
 				emi.nextLayer[&ml] = firstMixedLayer
 				firstMixedLayer = &ml
 			}
+			if methInfo.exposed {
+				emi.exposed = true
+			}
 			if emi.topLayer == nil {
 				// The existing method was empty
 				emi.topLayer = firstMixedLayer
@@ -19,7 +19,9 @@ import (
 	"time"
 
 	"github.com/Pedro-lmso-erp/erp/src/models/operator"
+	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
 	"github.com/Pedro-lmso-erp/erp/src/tools/strutils"
+	"github.com/Pedro-lmso-erp/erp/src/tools/tracing"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -112,6 +114,19 @@ type dbAdapter interface {
 	// isSerializationError returns true if the given error is a serialization error
 	// and that the failed transaction should be retried.
 	isSerializationError(err error) bool
+	// explainQuery returns a query that returns the execution plan of the given
+	// query with actual run times, one line per row.
+	explainQuery(query string) string
+	// tryAdvisoryLockQuery returns a query that tries to acquire the advisory
+	// lock with the int64 key given as placeholder until the end of the
+	// transaction. The query returns true if the lock has been acquired.
+	tryAdvisoryLockQuery() string
+	// backendIDQuery returns a query that returns the int64 ID of the database
+	// backend serving the current transaction.
+	backendIDQuery() string
+	// cancelBackendQuery returns a query that cancels the query being executed
+	// by the database backend whose ID is given as placeholder.
+	cancelBackendQuery() string
 }
 
 // registerDBAdapter adds a adapter to the adapters registry
@@ -122,34 +137,95 @@ func registerDBAdapter(name string, adapter dbAdapter) {
 
 // Cursor is a wrapper around a database transaction
 type Cursor struct {
-	tx *sqlx.Tx
+	tx       *sqlx.Tx
+	profiler *QueryProfiler
+	// span is the current span of the transaction
+	span *tracing.Span
+	// logger is the logger of the queries of the transaction
+	logger logging.Logger
+	// afterCommit are the functions to call after the transaction is committed
+	afterCommit []func()
 }
 
 // Execute a query without returning any rows. It panics in case of error.
 // The args are for any placeholder parameters in the query.
 func (c *Cursor) Execute(query string, args ...interface{}) sql.Result {
-	return dbExecute(c.tx, query, args...)
+	if span := c.startQuerySpan(query); span != nil {
+		defer func() { endSpan(span, recover()) }()
+	}
+	t := time.Now()
+	res := dbExecute(c.logger, c.tx, query, args...)
+	c.profile(t, query, args...)
+	return res
 }
 
 // Get queries a row into the database and maps the result into dest.
 // The query must return only one row. Get panics on errors
 func (c *Cursor) Get(dest interface{}, query string, args ...interface{}) {
-	dbGet(c.tx, dest, query, args...)
+	if span := c.startQuerySpan(query); span != nil {
+		defer func() { endSpan(span, recover()) }()
+	}
+	t := time.Now()
+	dbGet(c.logger, c.tx, dest, query, args...)
+	c.profile(t, query, args...)
 }
 
 // Select queries multiple rows and map the result into dest which must be a slice.
 // Select panics on errors.
 func (c *Cursor) Select(dest interface{}, query string, args ...interface{}) {
-	dbSelect(c.tx, dest, query, args...)
+	if span := c.startQuerySpan(query); span != nil {
+		defer func() { endSpan(span, recover()) }()
+	}
+	t := time.Now()
+	dbSelect(c.logger, c.tx, dest, query, args...)
+	c.profile(t, query, args...)
+}
+
+// query queries multiple rows and returns them as sqlx.Rows.
+// It panics on errors.
+func (c *Cursor) query(query string, args ...interface{}) *sqlx.Rows {
+	if span := c.startQuerySpan(query); span != nil {
+		defer func() { endSpan(span, recover()) }()
+	}
+	t := time.Now()
+	rows := dbQuery(c.logger, c.tx, query, args...)
+	// Rows are still open on the connection, so we cannot explain the query
+	c.profileNoExplain(t, query, args...)
+	return rows
+}
+
+// Profiler returns the QueryProfiler that records the queries of this
+// Cursor or nil if queries are not profiled.
+func (c *Cursor) Profiler() *QueryProfiler {
+	return c.profiler
+}
+
+// profile records the given query started at start time in the profiler
+// of this Cursor, if any.
+func (c *Cursor) profile(start time.Time, query string, args ...interface{}) {
+	if c.profiler == nil {
+		return
+	}
+	c.profiler.record(c, time.Now().Sub(start), query, args...)
+}
+
+// profileNoExplain records the given query started at start time in the
+// profiler of this Cursor, if any, without capturing its execution plan.
+func (c *Cursor) profileNoExplain(start time.Time, query string, args ...interface{}) {
+	if c.profiler == nil {
+		return
+	}
+	c.profiler.record(nil, time.Now().Sub(start), query, args...)
 }
 
 // newCursor returns a new db cursor on the given database
 func newCursor(db *sqlx.DB) *Cursor {
 	adapter := adapters[db.DriverName()]
 	tx := db.MustBegin()
-	dbExecute(tx, adapter.setTransactionIsolation())
+	dbExecute(log, tx, adapter.setTransactionIsolation())
 	return &Cursor{
-		tx: tx,
+		tx:     tx,
+		logger: log,
 	}
 }
 
@@ -175,11 +251,11 @@ func DBClose() {
 
 // dbExecute is a wrapper around sqlx.MustExec
 // It executes a query that returns no row
-func dbExecute(cr *sqlx.Tx, query string, args ...interface{}) sql.Result {
+func dbExecute(logger logging.Logger, cr *sqlx.Tx, query string, args ...interface{}) sql.Result {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
 	res, err := cr.Exec(query, args...)
-	logSQLResult(err, t, query, args...)
+	logSQLResult(logger, err, t, query, args...)
 	return res
 }
 
@@ -188,18 +264,18 @@ func dbExecuteNoTx(query string, args ...interface{}) sql.Result {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
 	res, err := db.Exec(query, args...)
-	logSQLResult(err, t, query, args...)
+	logSQLResult(log, err, t, query, args...)
 	return res
 }
 
 // dbGet is a wrapper around sqlx.Get
 // It gets the value of a single row found by the given query and arguments
 // It panics in case of error
-func dbGet(cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
+func dbGet(logger logging.Logger, cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
 	err := cr.Get(dest, query, args...)
-	logSQLResult(err, t, query, args)
+	logSQLResult(logger, err, t, query, args)
 }
 
 // dbGetNoTx is a wrapper around sqlx.Get outside a transaction
@@ -209,17 +285,17 @@ func dbGetNoTx(dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
 	err := db.Get(dest, query, args...)
-	logSQLResult(err, t, query, args)
+	logSQLResult(log, err, t, query, args)
 }
 
 // dbSelect is a wrapper around sqlx.Select
 // It gets the value of a multiple rows found by the given query and arguments
 // dest must be a slice. It panics in case of error
-func dbSelect(cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
+func dbSelect(logger logging.Logger, cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
 	err := cr.Select(dest, query, args...)
-	logSQLResult(err, t, query, args)
+	logSQLResult(logger, err, t, query, args)
 }
 
 // dbSelect is a wrapper around sqlx.Select outside a transaction
@@ -229,17 +305,17 @@ func dbSelectNoTx(dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
 	err := db.Select(dest, query, args...)
-	logSQLResult(err, t, query, args)
+	logSQLResult(log, err, t, query, args)
 }
 
 // dbQuery is a wrapper around sqlx.Queryx
 // It returns a sqlx.Rowsx found by the given query and arguments
 // It panics in case of error
-func dbQuery(cr *sqlx.Tx, query string, args ...interface{}) *sqlx.Rows {
+func dbQuery(logger logging.Logger, cr *sqlx.Tx, query string, args ...interface{}) *sqlx.Rows {
 	query, args = sanitizeQuery(query, args...)
 	t := time.Now()
 	rows, err := cr.Queryx(query, args...)
-	logSQLResult(err, t, query, args)
+	logSQLResult(logger, err, t, query, args)
 	return rows
 }
 
@@ -256,9 +332,12 @@ func sanitizeQuery(query string, args ...interface{}) (string, []interface{}) {
 }
 
 // Log the result of the given sql query started at start time with the
-// given args, and error. This function panics after logging if error is not nil.
-func logSQLResult(err error, start time.Time, query string, args ...interface{}) {
-	logCtx := log.New("query", query, "args", strutils.TrimArgs(args), "duration", time.Now().Sub(start))
+// given args, and error with the given logger. This function panics after
+// logging if error is not nil.
+func logSQLResult(logger logging.Logger, err error, start time.Time, query string, args ...interface{}) {
+	duration := time.Now().Sub(start)
+	recordQuery(duration, err)
+	logCtx := logger.New("query", query, "args", strutils.TrimArgs(args), "duration", duration)
 	if err != nil {
 		// We don't log.Panic to keep db error information in recovery
 		logCtx.Error("Error while executing query", "error", err)
@@ -251,6 +251,12 @@ func (d *postgresAdapter) setTransactionIsolation() string {
 	return "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE"
 }
 
+// explainQuery returns a query that returns the execution plan of the given
+// query with actual run times, one line per row.
+func (d *postgresAdapter) explainQuery(query string) string {
+	return fmt.Sprintf("EXPLAIN ANALYZE %s", query)
+}
+
 // childrenIdsQuery returns a query that finds all descendant of the given
 // a record from table including itself. The query has a placeholder for the
 // record's ID
@@ -291,4 +297,23 @@ func (d *postgresAdapter) isSerializationError(err error) bool {
 	return false
 }
 
+// tryAdvisoryLockQuery returns a query that tries to acquire the advisory
+// lock with the int64 key given as placeholder until the end of the
+// transaction. The query returns true if the lock has been acquired.
+func (d *postgresAdapter) tryAdvisoryLockQuery() string {
+	return "SELECT pg_try_advisory_xact_lock(?)"
+}
+
+// backendIDQuery returns a query that returns the int64 ID of the database
+// backend serving the current transaction.
+func (d *postgresAdapter) backendIDQuery() string {
+	return "SELECT pg_backend_pid()"
+}
+
+// cancelBackendQuery returns a query that cancels the query being executed
+// by the database backend whose ID is given as placeholder.
+func (d *postgresAdapter) cancelBackendQuery() string {
+	return "SELECT pg_cancel_backend(?)"
+}
+
 var _ dbAdapter = new(postgresAdapter)
@@ -0,0 +1,431 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/fieldtype"
+	"github.com/Pedro-lmso-erp/erp/src/models/operator"
+	"github.com/Pedro-lmso-erp/erp/src/tools/nbutils"
+)
+
+// Domain logical operators in polish notation
+const (
+	domainAnd = "&"
+	domainOr  = "|"
+	domainNot = "!"
+)
+
+// ParseDomain parses the given domain string and returns the corresponding
+// Condition on this model.
+//
+// The domain must be a list in polish notation, as sent by the web client
+// or set in actions, written either in JSON or as a Python literal, e.g.
+//
+//	['|', ('name', 'ilike', 'john'), '!', ('profile_id.age', '>', 18)]
+//
+// An empty domain returns an empty Condition. Field paths are checked against
+// this model and an error is returned if the domain cannot be parsed.
+func (m *Model) ParseDomain(domain string) (*Condition, error) {
+	if strings.TrimSpace(domain) == "" {
+		return newCondition(), nil
+	}
+	val, err := parseDomainLiteral(domain)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("domain must be a list, got %T", val)
+	}
+	return m.ConditionFromDomain(list)
+}
+
+// ConditionFromDomain returns the Condition on this model corresponding to
+// the given domain, which must be a list in polish notation such as the
+// result of Condition.Serialize() or the JSON decoding of a client domain.
+//
+// Top level terms that are not combined with a logical operator are joined
+// with AND.
+func (m *Model) ConditionFromDomain(domain []interface{}) (*Condition, error) {
+	dp := domainParser{model: m, domain: domain}
+	res := newCondition()
+	for dp.pos < len(dp.domain) {
+		cond, err := dp.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		res = res.AndCond(cond)
+	}
+	if len(res.predicates) == 1 && res.predicates[0].isCond && !res.predicates[0].isNot {
+		// Only one term, no need to wrap it
+		return res.predicates[0].cond, nil
+	}
+	return res, nil
+}
+
+// A domainParser reads a domain list term by term
+type domainParser struct {
+	model  *Model
+	domain []interface{}
+	pos    int
+}
+
+// parseTerm parses the term starting at the current position of the parser
+// and returns the corresponding Condition.
+func (dp *domainParser) parseTerm() (*Condition, error) {
+	if dp.pos >= len(dp.domain) {
+		return nil, fmt.Errorf("unexpected end of domain, missing operand")
+	}
+	term := dp.domain[dp.pos]
+	dp.pos++
+	switch t := term.(type) {
+	case string:
+		switch t {
+		case domainNot:
+			cond, err := dp.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			return newCondition().AndNotCond(cond), nil
+		case domainAnd, domainOr:
+			left, err := dp.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			right, err := dp.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			if t == domainAnd {
+				return newCondition().AndCond(left).AndCond(right), nil
+			}
+			// OR predicates are serialized in reverse order
+			return newCondition().AndCond(right).OrCond(left), nil
+		default:
+			return nil, fmt.Errorf("unknown domain operator '%s' at position %d", t, dp.pos-1)
+		}
+	case []interface{}:
+		return dp.parseLeaf(t)
+	default:
+		return nil, fmt.Errorf("unexpected term %v (%T) at position %d", term, term, dp.pos-1)
+	}
+}
+
+// parseLeaf returns the Condition for a leaf of the domain
+// i.e. a [field, operator, argument] list
+func (dp *domainParser) parseLeaf(leaf []interface{}) (*Condition, error) {
+	if len(leaf) != 3 {
+		return nil, fmt.Errorf("domain leaf %v must have 3 elements", leaf)
+	}
+	path, ok := leaf[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("field path of domain leaf %v must be a string", leaf)
+	}
+	field, fi, err := dp.model.validateFieldPath(path)
+	if err != nil {
+		return nil, err
+	}
+	var op operator.Operator
+	switch o := leaf[1].(type) {
+	case string:
+		op = operator.Operator(strings.ToLower(o))
+	case operator.Operator:
+		op = o
+	default:
+		return nil, fmt.Errorf("operator of domain leaf %v must be a string", leaf)
+	}
+	if !op.IsValid() {
+		return nil, fmt.Errorf("unknown operator '%s' in domain leaf %v", op, leaf)
+	}
+	arg, err := domainArgument(fi, op, leaf[2])
+	if err != nil {
+		return nil, err
+	}
+	if ids, isSlice := arg.([]int64); isSlice && op == operator.ChildOf {
+		// child_of a list of ids is the union of each child_of
+		res := newCondition()
+		for i, id := range ids {
+			if i == 0 {
+				res = res.AndCond(dp.model.Field(field).ChildOf(id))
+				continue
+			}
+			res = res.OrCond(dp.model.Field(field).ChildOf(id))
+		}
+		return res, nil
+	}
+	return dp.model.Field(field).AddOperator(op, arg), nil
+}
+
+// validateFieldPath checks that the given dot separated path, made of field names or
+// JSON names, exists in this model and returns the corresponding FieldName and
+// the Field at the end of the path.
+func (m *Model) validateFieldPath(path string) (FieldName, *Field, error) {
+	exprs := strings.Split(path, ExprSep)
+	names := make([]string, len(exprs))
+	jsons := make([]string, len(exprs))
+	var fi *Field
+	curModel := m
+	for i, expr := range exprs {
+		if curModel == nil {
+			return nil, nil, fmt.Errorf("field '%s' of path '%s' is not a relation field in model %s", exprs[i-1], path, m.name)
+		}
+		var ok bool
+		fi, ok = curModel.fields.Get(expr)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown field '%s' in model %s", expr, curModel.name)
+		}
+		names[i] = fi.name
+		jsons[i] = fi.json
+		curModel = fi.relatedModel
+	}
+	return fieldName{name: strings.Join(names, ExprSep), json: strings.Join(jsons, ExprSep)}, fi, nil
+}
+
+// domainArgument converts the given domain argument to a value suitable
+// for the given field and operator.
+//
+// Numbers are converted to int64 for integer and relation fields, and
+// lists of such numbers to []int64.
+func domainArgument(fi *Field, op operator.Operator, arg interface{}) (interface{}, error) {
+	if arg == nil {
+		return nil, nil
+	}
+	toInt := fi.fieldType == fieldtype.Integer || fi.isRelationField()
+	if list, ok := domainList(arg); ok {
+		if !op.IsMulti() && op != operator.ChildOf {
+			return nil, fmt.Errorf("operator '%s' cannot be used with a list argument (field %s)", op, fi.name)
+		}
+		if !toInt {
+			return list, nil
+		}
+		ids := make([]int64, len(list))
+		for i, v := range list {
+			id, err := domainIntArgument(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value in list for field %s: %s", fi.name, err)
+			}
+			ids[i] = id
+		}
+		return ids, nil
+	}
+	if op.IsMulti() {
+		return nil, fmt.Errorf("operator '%s' expects a list argument (field %s)", op, fi.name)
+	}
+	if _, isBool := arg.(bool); isBool || !toInt {
+		return arg, nil
+	}
+	if _, isStr := arg.(string); isStr {
+		// Name search on relation fields
+		return arg, nil
+	}
+	return domainIntArgument(arg)
+}
+
+// domainList returns the given argument as a []interface{} if it is a
+// slice (other than a byte slice) and true, or nil and false otherwise.
+func domainList(arg interface{}) ([]interface{}, bool) {
+	if list, ok := arg.([]interface{}); ok {
+		return list, true
+	}
+	val := reflect.ValueOf(arg)
+	if val.Kind() != reflect.Slice || val.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	res := make([]interface{}, val.Len())
+	for i := 0; i < val.Len(); i++ {
+		res[i] = val.Index(i).Interface()
+	}
+	return res, true
+}
+
+// domainIntArgument returns the given numeric value as an int64
+func domainIntArgument(val interface{}) (int64, error) {
+	switch v := val.(type) {
+	case bool:
+		return 0, fmt.Errorf("value %v is not an integer", val)
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, fmt.Errorf("value %v is not an integer", val)
+		}
+		return int64(v), nil
+	}
+	return nbutils.CastToInteger(val)
+}
+
+// parseDomainLiteral parses the given string which must be a JSON or Python
+// literal and returns it as nested []interface{}, string, int64, float64, bool
+// and nil values. Python tuples are returned as lists.
+func parseDomainLiteral(str string) (interface{}, error) {
+	lp := literalParser{input: []rune(str)}
+	res, err := lp.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	lp.skipSpaces()
+	if lp.pos < len(lp.input) {
+		return nil, fmt.Errorf("unexpected character '%c' at position %d", lp.input[lp.pos], lp.pos)
+	}
+	return res, nil
+}
+
+// A literalParser parses JSON and Python literals
+type literalParser struct {
+	input []rune
+	pos   int
+}
+
+// skipSpaces advances the parser position to the next non space character
+func (lp *literalParser) skipSpaces() {
+	for lp.pos < len(lp.input) && unicode.IsSpace(lp.input[lp.pos]) {
+		lp.pos++
+	}
+}
+
+// parseValue parses the value at the current position
+func (lp *literalParser) parseValue() (interface{}, error) {
+	lp.skipSpaces()
+	if lp.pos >= len(lp.input) {
+		return nil, fmt.Errorf("unexpected end of domain string")
+	}
+	switch c := lp.input[lp.pos]; {
+	case c == '[':
+		return lp.parseList(']')
+	case c == '(':
+		return lp.parseList(')')
+	case c == '\'' || c == '"':
+		return lp.parseString(c)
+	case c == '-' || c == '+' || c == '.' || unicode.IsDigit(c):
+		return lp.parseNumber()
+	case unicode.IsLetter(c):
+		return lp.parseKeyword()
+	default:
+		return nil, fmt.Errorf("unexpected character '%c' at position %d", c, lp.pos)
+	}
+}
+
+// parseList parses a list or a tuple ending with the given closing character
+func (lp *literalParser) parseList(closing rune) (interface{}, error) {
+	lp.pos++
+	res := make([]interface{}, 0)
+	for {
+		lp.skipSpaces()
+		if lp.pos >= len(lp.input) {
+			return nil, fmt.Errorf("unexpected end of domain string, expected '%c'", closing)
+		}
+		if lp.input[lp.pos] == closing {
+			lp.pos++
+			return res, nil
+		}
+		val, err := lp.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, val)
+		lp.skipSpaces()
+		if lp.pos >= len(lp.input) {
+			return nil, fmt.Errorf("unexpected end of domain string, expected '%c'", closing)
+		}
+		switch lp.input[lp.pos] {
+		case ',':
+			lp.pos++
+		case closing:
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at position %d, expected ',' or '%c'", lp.input[lp.pos], lp.pos, closing)
+		}
+	}
+}
+
+// parseString parses a string delimited by the given quote character
+func (lp *literalParser) parseString(quote rune) (interface{}, error) {
+	start := lp.pos
+	lp.pos++
+	var sb strings.Builder
+	for lp.pos < len(lp.input) {
+		c := lp.input[lp.pos]
+		lp.pos++
+		switch c {
+		case quote:
+			return sb.String(), nil
+		case '\\':
+			if lp.pos >= len(lp.input) {
+				return nil, fmt.Errorf("unterminated string starting at position %d", start)
+			}
+			esc := lp.input[lp.pos]
+			lp.pos++
+			switch esc {
+			case 'n':
+				sb.WriteRune('\n')
+			case 't':
+				sb.WriteRune('\t')
+			case 'r':
+				sb.WriteRune('\r')
+			case 'u':
+				if lp.pos+4 > len(lp.input) {
+					return nil, fmt.Errorf("invalid unicode escape at position %d", lp.pos)
+				}
+				code, err := strconv.ParseUint(string(lp.input[lp.pos:lp.pos+4]), 16, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid unicode escape at position %d", lp.pos)
+				}
+				sb.WriteRune(rune(code))
+				lp.pos += 4
+			default:
+				sb.WriteRune(esc)
+			}
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	return nil, fmt.Errorf("unterminated string starting at position %d", start)
+}
+
+// parseNumber parses an integer or a float number
+func (lp *literalParser) parseNumber() (interface{}, error) {
+	start := lp.pos
+	isFloat := false
+	for lp.pos < len(lp.input) {
+		c := lp.input[lp.pos]
+		if c == '.' || c == 'e' || c == 'E' {
+			isFloat = true
+		} else if !unicode.IsDigit(c) && c != '-' && c != '+' {
+			break
+		}
+		lp.pos++
+	}
+	str := string(lp.input[start:lp.pos])
+	if !isFloat {
+		if res, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return res, nil
+		}
+	}
+	res, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number '%s' at position %d", str, start)
+	}
+	return res, nil
+}
+
+// parseKeyword parses the JSON and Python constants
+func (lp *literalParser) parseKeyword() (interface{}, error) {
+	start := lp.pos
+	for lp.pos < len(lp.input) && (unicode.IsLetter(lp.input[lp.pos]) || unicode.IsDigit(lp.input[lp.pos]) || lp.input[lp.pos] == '_') {
+		lp.pos++
+	}
+	word := string(lp.input[start:lp.pos])
+	switch word {
+	case "True", "true":
+		return true, nil
+	case "False", "false":
+		return false, nil
+	case "None", "null":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported expression '%s' at position %d", word, start)
+}
@@ -16,7 +16,9 @@ package models
 
 import (
 	"fmt"
+	"sync/atomic"
 
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
 	"github.com/Pedro-lmso-erp/erp/src/models/types"
 	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
 )
@@ -30,6 +32,9 @@ const DBSerializationMaxRetries uint8 = 5
 // during a transaction.
 const maxRecursionDepth uint8 = 100
 
+// savepointsCounter is used to give unique names to savepoints
+var savepointsCounter uint64
+
 // An Environment stores various contextual data used by the models:
 // - the database cursor (current open transaction),
 // - the current user ID (for access rights checking)
@@ -45,6 +50,7 @@ type Environment struct {
 	previousMethod *Method
 	recursions     uint8
 	nextNegativeID int64
+	groupsScope    map[*security.Group]bool
 }
 
 // Cr returns a pointer to the Cursor of the Environment
@@ -62,13 +68,46 @@ func (env Environment) Context() *types.Context {
 	return env.context
 }
 
+// Sudo returns a copy of this Environment with the given userId
+// or the superuser id if not specified. The copy shares the
+// transaction and the cache of this Environment.
+func (env Environment) Sudo(userId ...int64) Environment {
+	uid := security.SuperUserID
+	if len(userId) > 0 {
+		uid = userId[0]
+	}
+	env.uid = uid
+	env.groupsScope = nil
+	return env
+}
+
 // commit the transaction of this environment.
 //
 // WARNING: Do NOT call Commit on Environment instances that you
 // did not create yourself with NewEnvironment. The framework will
 // automatically commit the Environment.
 func (env Environment) commit() {
-	env.Cr().tx.Commit()
+	err := env.Cr().tx.Commit()
+	env.cr.span.SetError(err)
+	env.cr.span.End()
+	if err != nil {
+		env.Logger().Warn("Unable to commit transaction", "error", err)
+		return
+	}
+	for _, fnct := range env.cr.afterCommit {
+		fnct()
+	}
+}
+
+// AfterCommit registers the given fnct to be called once the transaction
+// of this Environment has been successfully committed. It is not called
+// if the transaction is rolled back, including when rolled back to a
+// savepoint created after the registration (see ExecuteInSavepoint).
+//
+// fnct is called synchronously at the end of ExecuteInNewEnvironment and
+// should therefore not block.
+func (env Environment) AfterCommit(fnct func()) {
+	env.cr.afterCommit = append(env.cr.afterCommit, fnct)
 }
 
 // rollback the transaction of this environment.
@@ -78,12 +117,13 @@ func (env Environment) commit() {
 // for the framework to roll back automatically for you.
 func (env Environment) rollback() {
 	env.Cr().tx.Rollback()
+	env.cr.span.End()
 }
 
 // checkRecursion panics if the recursion depth limit is reached
 func (env Environment) checkRecursion() {
 	if env.recursions > maxRecursionDepth {
-		log.Panic("Max recursion depth exceeded")
+		env.Logger().Panic("Max recursion depth exceeded")
 	}
 }
 
@@ -115,18 +155,111 @@ func (env Environment) DumpCache() string {
 	return res
 }
 
+// An EnvOption customizes a new Environment before it is
+// handed over to the caller.
+type EnvOption func(*Environment)
+
+// WithQueryProfiler returns an EnvOption that records all the
+// queries of the new Environment in the given QueryProfiler.
+func WithQueryProfiler(profiler *QueryProfiler) EnvOption {
+	return func(env *Environment) {
+		env.cr.profiler = profiler
+	}
+}
+
+// QueryProfiler returns the QueryProfiler of this Environment
+// or nil if its queries are not profiled.
+func (env Environment) QueryProfiler() *QueryProfiler {
+	return env.cr.profiler
+}
+
+// requestIDContextKey is the key of the request ID in the Context of an Environment
+const requestIDContextKey = "erp_request_id"
+
+// WithRequestID returns an EnvOption that sets the ID of the request the new
+// Environment is created for. The request ID is set in the context of the
+// Environment and added to all the messages logged by the Environment,
+// including its queries.
+func WithRequestID(requestID string) EnvOption {
+	return func(env *Environment) {
+		env.context = env.context.WithKey(requestIDContextKey, requestID)
+		env.cr.logger = logging.ForRequest(log, requestID)
+	}
+}
+
+// RequestID returns the ID of the request this Environment has been
+// created for, or an empty string if it is not set.
+func (env Environment) RequestID() string {
+	return env.context.GetString(requestIDContextKey)
+}
+
+// Logger returns the logger of this Environment. Messages logged with it
+// include the request ID of the Environment if any.
+func (env Environment) Logger() logging.Logger {
+	if env.cr == nil {
+		return log
+	}
+	return env.cr.logger
+}
+
+// WithGroupsScope returns an EnvOption that restricts the user of the new
+// Environment to the given groups (and the groups they imply) among the
+// groups the user belongs to. This is typically used for API keys scoped
+// to a set of groups.
+//
+// The scope is dropped by Sudo, which changes the user of the Environment.
+func WithGroupsScope(groups ...*security.Group) EnvOption {
+	return func(env *Environment) {
+		env.groupsScope = make(map[*security.Group]bool)
+		var addGroup func(*security.Group)
+		addGroup = func(group *security.Group) {
+			if env.groupsScope[group] {
+				return
+			}
+			env.groupsScope[group] = true
+			for _, implied := range group.ImpliedGroups() {
+				addGroup(implied)
+			}
+		}
+		addGroup(security.GroupEveryone)
+		for _, group := range groups {
+			addGroup(group)
+		}
+	}
+}
+
+// userGroups returns the groups of the user of this Environment,
+// restricted to the groups scope of this Environment if any.
+func (env Environment) userGroups() map[*security.Group]security.InheritanceInfo {
+	groups := security.Registry.UserGroups(env.uid)
+	if env.groupsScope == nil {
+		return groups
+	}
+	for group := range groups {
+		if !env.groupsScope[group] {
+			delete(groups, group)
+		}
+	}
+	return groups
+}
+
 // newEnvironment returns a new Environment for the given user ID
+// customized with the given options.
 //
 // WARNING: Callers to newEnvironment should ensure to either call commit()
 // or rollback() on the returned Environment after operation to release
 // the database connection.
-func newEnvironment(uid int64) Environment {
+func newEnvironment(uid int64, options ...EnvOption) Environment {
 	env := Environment{
 		cr:      newCursor(db),
 		uid:     uid,
 		context: types.NewContext(),
 		cache:   newCache(),
 	}
+	for _, option := range options {
+		option(&env)
+	}
+	env.startTransactionSpan()
 	return env
 }
 
@@ -137,12 +270,14 @@ func newEnvironment(uid int64) Environment {
 // rolls it back otherwise, returning an arror. Database serialization
 // errors are automatically retried several times before returning an
 // error if they still occur.
-func ExecuteInNewEnvironment(uid int64, fnct func(Environment)) error {
-	return doExecuteInNewEnvironment(uid, 0, fnct)
+//
+// The new Environment can be customized with the given options.
+func ExecuteInNewEnvironment(uid int64, fnct func(Environment), options ...EnvOption) error {
+	return doExecuteInNewEnvironment(uid, 0, fnct, options...)
 }
 
-func doExecuteInNewEnvironment(uid int64, retries uint8, fnct func(Environment)) (rError error) {
-	env := newEnvironment(uid)
+func doExecuteInNewEnvironment(uid int64, retries uint8, fnct func(Environment), options ...EnvOption) (rError error) {
+	env := newEnvironment(uid, options...)
 	defer func() {
 		if r := recover(); r != nil {
 			env.rollback()
@@ -150,13 +285,14 @@ func doExecuteInNewEnvironment(uid int64, retries uint8, fnct func(Environment))
 				// Transaction error
 				retries++
 				if retries < DBSerializationMaxRetries {
-					if doExecuteInNewEnvironment(uid, retries, fnct) == nil {
+					recordTransactionRetry()
+					if doExecuteInNewEnvironment(uid, retries, fnct, options...) == nil {
 						rError = nil
 						return
 					}
 				}
 			}
-			rError = logging.LogPanicData(r)
+			rError = logging.LogPanicDataWith(env.Logger(), r)
 			return
 		}
 		env.commit()
@@ -170,12 +306,14 @@ func doExecuteInNewEnvironment(uid int64, retries uint8, fnct func(Environment))
 //
 // This function always rolls back the transaction but returns an error
 // only if fnct panicked during its execution.
-func SimulateInNewEnvironment(uid int64, fnct func(Environment)) error {
-	return doSimulateInNewEnvironment(uid, 0, fnct)
+//
+// The new Environment can be customized with the given options.
+func SimulateInNewEnvironment(uid int64, fnct func(Environment), options ...EnvOption) error {
+	return doSimulateInNewEnvironment(uid, 0, fnct, options...)
 }
 
-func doSimulateInNewEnvironment(uid int64, retries uint8, fnct func(Environment)) (rError error) {
-	env := newEnvironment(uid)
+func doSimulateInNewEnvironment(uid int64, retries uint8, fnct func(Environment), options ...EnvOption) (rError error) {
+	env := newEnvironment(uid, options...)
 	defer func() {
 		env.rollback()
 		if r := recover(); r != nil {
@@ -184,13 +322,13 @@ func doSimulateInNewEnvironment(uid int64, retries uint8, fnct func(Environment)
 				// to be as close as ExecuteInNewEnvironment as possible
 				retries++
 				if retries < DBSerializationMaxRetries {
-					if doSimulateInNewEnvironment(uid, retries, fnct) == nil {
+					if doSimulateInNewEnvironment(uid, retries, fnct, options...) == nil {
 						rError = nil
 						return
 					}
 				}
 			}
-			rError = logging.LogPanicData(r)
+			rError = logging.LogPanicDataWith(env.Logger(), r)
 			return
 		}
 	}()
@@ -198,6 +336,35 @@ func doSimulateInNewEnvironment(uid int64, retries uint8, fnct func(Environment)
 	return
 }
 
+// ExecuteInSavepoint executes the given fnct in the given Environment
+// within a savepoint of its transaction.
+//
+// If fnct panics, the changes made by fnct are rolled back and the
+// error is returned, but the transaction of env remains usable, so
+// that the caller can go on and commit its other changes. The cache
+// of env is cleared in this case. Serialization errors are panicked
+// again for the whole transaction to be retried.
+func ExecuteInSavepoint(env Environment, fnct func(Environment)) (rError error) {
+	name := fmt.Sprintf("erp_savepoint_%d", atomic.AddUint64(&savepointsCounter, 1))
+	env.cr.Execute(fmt.Sprintf("SAVEPOINT %s", name))
+	afterCommitLen := len(env.cr.afterCommit)
+	defer func() {
+		if r := recover(); r != nil {
+			if err, ok := r.(error); ok && adapters[db.DriverName()].isSerializationError(err) {
+				panic(r)
+			}
+			env.cr.Execute(fmt.Sprintf("ROLLBACK TO SAVEPOINT %s", name))
+			env.cr.afterCommit = env.cr.afterCommit[:afterCommitLen]
+			*env.cache = *newCache()
+			rError = logging.LogPanicDataWith(env.Logger(), r)
+			return
+		}
+		env.cr.Execute(fmt.Sprintf("RELEASE SAVEPOINT %s", name))
+	}()
+	fnct(env)
+	return nil
+}
+
 // Pool returns an empty RecordCollection for the given modelName
 func (env Environment) Pool(modelName string) *RecordCollection {
 	return newRecordCollection(env, modelName)
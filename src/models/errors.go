@@ -0,0 +1,40 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import "github.com/Pedro-lmso-erp/erp/src/tools/logging"
+
+// An AccessError is the value with which the ORM panics when the current
+// user is not allowed to execute a method or to access some records.
+//
+// Its message does not hold the details of the denied access, which are
+// logged instead, so that it can be returned to the client.
+type AccessError struct {
+	Message string
+}
+
+// Error returns the message of the AccessError
+func (e AccessError) Error() string {
+	return e.Message
+}
+
+// A NotFoundError is the value with which the ORM panics when a record
+// that is referenced does not exist.
+//
+// As for AccessError, its message can be returned to the client.
+type NotFoundError struct {
+	Message string
+}
+
+// Error returns the message of the NotFoundError
+func (e NotFoundError) Error() string {
+	return e.Message
+}
+
+// panicWithError logs the message of err with the given context as an
+// error with the given logger and panics with err.
+func panicWithError(logger logging.Logger, err error, ctx ...interface{}) {
+	logger.Error(err.Error(), ctx...)
+	panic(err)
+}
@@ -44,4 +44,8 @@ func init() {
 	declareCommonMixin()
 	declareBaseMixin()
 	declareModelMixin()
+	// declare system models
+	declareWebhookDeliveryModel()
+	declareScheduledJobModel()
+	declareQueueJobModel()
 }
@@ -0,0 +1,548 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/fieldtype"
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+	"github.com/Pedro-lmso-erp/erp/src/models/types/dates"
+)
+
+const (
+	// QueueJobModel is the name of the model that stores the jobs
+	// of the job queue with their state and result.
+	QueueJobModel = "QueueJob"
+	// jobQueuePeriod is the period of the worker that runs
+	// the due jobs and requeues the jobs of dead workers.
+	jobQueuePeriod = 5 * time.Second
+	// jobBaseRetryDelay is the delay before retrying a job after
+	// its first failure. It is doubled at each new failure.
+	jobBaseRetryDelay = 30 * time.Second
+	// jobMaxRetryDelay is the maximum delay before retrying a failed job
+	jobMaxRetryDelay = time.Hour
+	// jobWatchdogPeriod is the period at which the queries of a job that
+	// exceeded its timeout are cancelled until the job returns.
+	jobWatchdogPeriod = time.Second
+)
+
+// States of the QueueJob records
+const (
+	JobPending = "pending"
+	JobStarted = "started"
+	JobDone    = "done"
+	// JobFailed is the state of jobs that failed more
+	// than their maximum number of attempts.
+	JobFailed = "failed"
+)
+
+// JobOptions customize a job enqueued with DelayWithOptions
+type JobOptions struct {
+	// Priority of the job. Jobs with a lower value run first.
+	Priority int64
+	// ETA is the time before which the job must not run.
+	// The job is due immediately if ETA is zero.
+	ETA time.Time
+	// MaxAttempts is the number of times the job is tried before
+	// being set in the JobFailed state.
+	MaxAttempts int64
+	// Timeout is the maximum duration of a run of the job. A run that
+	// takes longer is rolled back and counts as a failed attempt.
+	//
+	// The queries of a job are cancelled once its timeout has elapsed, so
+	// that a job waiting for the database is interrupted at the deadline.
+	// A job that does not query the database is only rolled back when it
+	// returns.
+	Timeout time.Duration
+}
+
+// DefaultJobOptions are the options of the jobs enqueued with Delay.
+// Zero values of the options given to DelayWithOptions are taken from there.
+var DefaultJobOptions = JobOptions{
+	Priority:    10,
+	MaxAttempts: 5,
+	Timeout:     10 * time.Minute,
+}
+
+// JobQueueWorkers is the maximum number of jobs that are run concurrently
+// by each server. It must be set before the first job is enqueued.
+var JobQueueWorkers = 4
+
+var (
+	jobWorkerSlots     chan struct{}
+	jobWorkerSlotsOnce sync.Once
+)
+
+// Delay enqueues the call of the given method with the given arguments on
+// this RecordCollection in the job queue with the DefaultJobOptions, and
+// returns the QueueJob record of the job.
+//
+// See DelayWithOptions for details.
+func (rc *RecordCollection) Delay(methName string, args ...interface{}) *RecordCollection {
+	return rc.DelayWithOptions(DefaultJobOptions, methName, args...)
+}
+
+// DelayWithOptions enqueues the call of the given method with the given
+// arguments on this RecordCollection in the job queue with the given options,
+// and returns the QueueJob record of the job.
+//
+// The job is created in the transaction of this RecordCollection, so that it
+// is enqueued only if the transaction is committed. It is then run in the
+// background by the worker goroutines of the job queue with the user,
+// groups scope and context of this RecordCollection. Failed jobs are
+// retried with an exponential backoff.
+//
+// Arguments are stored as JSON: RecordSet arguments are stored as their ids,
+// RecordData as their FieldMap and Conditions as domains. Other arguments
+// must be marshallable with the encoding/json package. The result of the
+// method is stored the same way in the Result field of the job.
+func (rc *RecordCollection) DelayWithOptions(options JobOptions, methName string, args ...interface{}) *RecordCollection {
+	meth := rc.model.methods.MustGet(methName)
+	if err := meth.checkArgsCount(len(args)); err != nil {
+		rc.logger().Panic("Invalid arguments for delayed method", "model", rc.model.name, "method", methName, "error", err)
+	}
+	jsonArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		jsonArgs[i] = encodeJSONValue(arg)
+	}
+	argsData, err := json.Marshal(jsonArgs)
+	if err != nil {
+		rc.logger().Panic("Unable to marshal delayed method arguments", "model", rc.model.name, "method", methName, "error", err)
+	}
+	idsData, _ := json.Marshal(append([]int64{}, rc.Ids()...))
+	contextData, err := json.Marshal(rc.env.context)
+	if err != nil {
+		rc.logger().Panic("Unable to marshal delayed method context", "model", rc.model.name, "method", methName, "error", err)
+	}
+	options = options.withDefaults()
+	eta := dates.Now()
+	if !options.ETA.IsZero() {
+		eta = dates.DateTime{Time: options.ETA.UTC()}
+	}
+	jobs := rc.env.Pool(QueueJobModel).Sudo()
+	job := jobs.Call("Create", NewModelData(jobs.model, FieldMap{
+		"Model":       rc.model.name,
+		"Method":      methName,
+		"RecordIDs":   string(idsData),
+		"Args":        string(argsData),
+		"UserID":      rc.env.uid,
+		"Context":     string(contextData),
+		"GroupsScope": jobGroupsScope(*rc.env),
+		"RequestID":   rc.env.RequestID(),
+		"Priority":    options.Priority,
+		"State":       JobPending,
+		"MaxAttempts": options.MaxAttempts,
+		"Timeout":     int64(options.Timeout / time.Second),
+		"ETA":         eta,
+	})).(RecordSet).Collection()
+	rc.env.AfterCommit(startJobWorkers)
+	return job
+}
+
+// jobGroupsScope returns the IDs of the groups of the scope of the given
+// Environment as a JSON array, or an empty string if it has no groups scope.
+func jobGroupsScope(env Environment) string {
+	if env.groupsScope == nil {
+		return ""
+	}
+	groupIDs := make([]string, 0, len(env.groupsScope))
+	for group := range env.groupsScope {
+		groupIDs = append(groupIDs, group.ID())
+	}
+	sort.Strings(groupIDs)
+	data, _ := json.Marshal(groupIDs)
+	return string(data)
+}
+
+// withDefaults returns a copy of these JobOptions where
+// zero values are replaced by the DefaultJobOptions.
+func (o JobOptions) withDefaults() JobOptions {
+	if o.Priority == 0 {
+		o.Priority = DefaultJobOptions.Priority
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultJobOptions.MaxAttempts
+	}
+	if o.Timeout < time.Second {
+		o.Timeout = DefaultJobOptions.Timeout
+	}
+	return o
+}
+
+// encodeJSONValue returns the given argument or result of a method in a
+// form that can be marshalled to JSON and decoded with DecodeJSONArgs.
+func encodeJSONValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case RecordSet:
+		return append([]int64{}, val.Collection().Ids()...)
+	case Conditioner:
+		return val.Underlying().Serialize()
+	}
+	return value
+}
+
+// jobRetryDelay returns the time to wait before the next attempt
+// of a job after the given number of failed attempts.
+func jobRetryDelay(attempts int64) time.Duration {
+	delay := jobBaseRetryDelay
+	for i := int64(1); i < attempts && delay < jobMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > jobMaxRetryDelay {
+		delay = jobMaxRetryDelay
+	}
+	return delay
+}
+
+// processJobQueue requeues the jobs of dead workers and starts the workers
+// of the job queue. It is the worker function of the job queue.
+func processJobQueue() {
+	requeueStaleJobs()
+	startJobWorkers()
+}
+
+// startJobWorkers starts worker goroutines that run the due jobs of the queue
+// until there is none left, up to JobQueueWorkers goroutines at a time.
+func startJobWorkers() {
+	jobWorkerSlotsOnce.Do(func() {
+		jobWorkerSlots = make(chan struct{}, JobQueueWorkers)
+	})
+	for {
+		select {
+		case jobWorkerSlots <- struct{}{}:
+			// Workers are part of the worker group so that StopWorkerLoop waits for them
+			workerGroup.Add(1)
+			go func() {
+				defer func() {
+					<-jobWorkerSlots
+					workerGroup.Done()
+				}()
+				ProcessJobs()
+			}()
+		default:
+			return
+		}
+	}
+}
+
+// ProcessJobs runs the due jobs of the queue one after the other until there
+// is none left.
+//
+// Each job is claimed in its own transaction which is committed before the
+// job runs, so that the job is visible in the JobStarted state, and that
+// this function can be called concurrently. This function is called by the
+// worker goroutines of the job queue.
+func ProcessJobs() {
+	for runNextJob() {
+	}
+}
+
+// runNextJob claims and runs the next due job of the queue.
+// It returns false if there is no due job.
+func runNextJob() bool {
+	var (
+		id        int64
+		requestID string
+	)
+	err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		job := claimNextJob(env)
+		if job.IsEmpty() {
+			return
+		}
+		id = job.ids[0]
+		requestID = job.Get(job.model.FieldName("RequestID")).(string)
+	})
+	if err != nil {
+		log.Warn("Unable to claim a job", "error", err)
+		return false
+	}
+	if id == 0 {
+		return false
+	}
+	err = ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		job := lockStartedJob(env, id)
+		if job.IsEmpty() {
+			// The job has been requeued in the meantime
+			return
+		}
+		executeJob(job)
+	}, WithRequestID(requestID))
+	if err != nil {
+		// The job stays in the started state until it is requeued after its deadline
+		log.Warn("Error while running job", "job", id, "error", err)
+	}
+	return true
+}
+
+// claimNextJob returns the next pending job whose ETA is due and sets it in
+// the JobStarted state. Jobs locked by other transactions are skipped.
+func claimNextJob(env Environment) *RecordCollection {
+	var res []int64
+	env.Cr().Select(&res, `SELECT id FROM queue_job WHERE state = ? AND eta <= ? ORDER BY priority, eta, id LIMIT 1 FOR UPDATE SKIP LOCKED`,
+		JobPending, dates.Now())
+	job := env.Pool(QueueJobModel).Call("Browse", res).(RecordSet).Collection()
+	if job.IsEmpty() {
+		return job
+	}
+	model := job.model
+	now := dates.Now()
+	job.Call("Write", NewModelData(model, FieldMap{
+		"State":      JobStarted,
+		"Attempts":   job.Get(model.FieldName("Attempts")).(int64) + 1,
+		"StartedAt":  now,
+		"Deadline":   now.Add(jobTimeout(job)),
+		"FinishedAt": dates.DateTime{},
+	}))
+	return job
+}
+
+// lockStartedJob returns the job with the given id if it is in the
+// JobStarted state and locks it until the end of the transaction.
+func lockStartedJob(env Environment, id int64) *RecordCollection {
+	var res []int64
+	env.Cr().Select(&res, `SELECT id FROM queue_job WHERE id = ? AND state = ? FOR UPDATE`, id, JobStarted)
+	return env.Pool(QueueJobModel).Call("Browse", res).(RecordSet).Collection()
+}
+
+// executeJob runs the method of the given started job within a savepoint
+// and updates the job with the result.
+func executeJob(job *RecordCollection) {
+	model := job.model
+	env := job.Env()
+	timeout := jobTimeout(job)
+	start := time.Now()
+	var (
+		result   interface{}
+		timedOut bool
+	)
+	err := ExecuteInSavepoint(env, func(env Environment) {
+		watchdog := startJobWatchdog(env, timeout)
+		// The watchdog must be stopped before the savepoint is rolled back
+		defer func() {
+			timedOut = watchdog.stop()
+		}()
+		result = callJobMethod(env, job)
+		if time.Since(start) > timeout {
+			log.Panic("Job timed out", "timeout", timeout)
+		}
+	})
+	values := FieldMap{
+		"FinishedAt": dates.Now(),
+	}
+	if err != nil && timedOut {
+		err = fmt.Errorf("Job timed out after %s: %v", timeout, err)
+	}
+	if err != nil {
+		log.Info("Job failed", "job", job.ids[0], "model", job.Get(model.FieldName("Model")),
+			"method", job.Get(model.FieldName("Method")), "error", err)
+		failJob(job, err.Error(), values)
+		return
+	}
+	resultData, err := json.Marshal(encodeJSONValue(result))
+	if err != nil {
+		resultData, _ = json.Marshal(fmt.Sprintf("%v", result))
+	}
+	values["State"] = JobDone
+	values["Result"] = string(resultData)
+	values["Error"] = ""
+	job.Call("Write", NewModelData(model, values))
+}
+
+// callJobMethod calls the method of the given job with the user, groups scope
+// and context of the job in the given Environment and returns its first
+// result, if any.
+func callJobMethod(env Environment, job *RecordCollection) interface{} {
+	model := job.model
+	modelName := job.Get(model.FieldName("Model")).(string)
+	methName := job.Get(model.FieldName("Method")).(string)
+	recModel, ok := Registry.Get(modelName)
+	if !ok {
+		log.Panic("Unknown model for job", "model", modelName)
+	}
+	meth, ok := recModel.methods.Get(methName)
+	if !ok {
+		log.Panic("Unknown method for job", "model", modelName, "method", methName)
+	}
+	var (
+		ids     []int64
+		rawArgs []json.RawMessage
+	)
+	unmarshalJobData(job, "RecordIDs", &ids)
+	unmarshalJobData(job, "Args", &rawArgs)
+	userEnv := jobEnvironment(env, job)
+	args, err := meth.DecodeJSONArgs(userEnv, rawArgs)
+	if err != nil {
+		log.Panic("Unable to decode job arguments", "error", err)
+	}
+	records := userEnv.Pool(modelName).Call("Browse", ids).(RecordSet).Collection()
+	res := records.CallMulti(methName, args...)
+	if len(res) == 0 {
+		return nil
+	}
+	return res[0]
+}
+
+// jobEnvironment returns a copy of the given Environment with the user,
+// groups scope and context of the given job.
+func jobEnvironment(env Environment, job *RecordCollection) Environment {
+	model := job.model
+	context := types.NewContext()
+	unmarshalJobData(job, "Context", context)
+	res := env.Sudo(job.Get(model.FieldName("UserID")).(int64))
+	res.context = context
+	if job.Get(model.FieldName("GroupsScope")).(string) == "" {
+		return res
+	}
+	var groupIDs []string
+	unmarshalJobData(job, "GroupsScope", &groupIDs)
+	var groups []*security.Group
+	for _, groupID := range groupIDs {
+		// Groups removed since the job has been enqueued are left out of the scope
+		if group := security.Registry.GetGroup(groupID); group != nil {
+			groups = append(groups, group)
+		}
+	}
+	WithGroupsScope(groups...)(&res)
+	return res
+}
+
+// unmarshalJobData decodes the JSON value of the given field of the given job into target
+func unmarshalJobData(job *RecordCollection, field string, target interface{}) {
+	if err := json.Unmarshal([]byte(job.Get(job.model.FieldName(field)).(string)), target); err != nil {
+		log.Panic("Unable to unmarshal job data", "field", field, "error", err)
+	}
+}
+
+// failJob adds to values the fields to update the given job after a failed
+// attempt with the given error message, and writes them. The job is retried
+// later unless it has reached its maximum number of attempts.
+func failJob(job *RecordCollection, errMsg string, values FieldMap) {
+	model := job.model
+	attempts := job.Get(model.FieldName("Attempts")).(int64)
+	values["Error"] = errMsg
+	values["State"] = JobFailed
+	if attempts < job.Get(model.FieldName("MaxAttempts")).(int64) {
+		values["State"] = JobPending
+		values["ETA"] = dates.Now().Add(jobRetryDelay(attempts))
+	}
+	job.Call("Write", NewModelData(model, values))
+}
+
+// jobTimeout returns the timeout of the given job
+func jobTimeout(job *RecordCollection) time.Duration {
+	return time.Duration(job.Get(job.model.FieldName("Timeout")).(int64)) * time.Second
+}
+
+// A jobWatchdog cancels the queries of the transaction of a job once the
+// timeout of the job has elapsed, and then periodically until it is stopped.
+type jobWatchdog struct {
+	sync.Mutex
+	backendID int64
+	timer     *time.Timer
+	fired     bool
+	stopped   bool
+}
+
+// startJobWatchdog starts a jobWatchdog for the transaction of the given
+// Environment with the given timeout.
+func startJobWatchdog(env Environment, timeout time.Duration) *jobWatchdog {
+	w := new(jobWatchdog)
+	env.Cr().Get(&w.backendID, adapters[db.DriverName()].backendIDQuery())
+	w.Lock()
+	defer w.Unlock()
+	w.timer = time.AfterFunc(timeout, w.cancel)
+	return w
+}
+
+// cancel cancels the query being executed by the transaction of the job
+// and schedules the next cancellation.
+func (w *jobWatchdog) cancel() {
+	w.Lock()
+	defer w.Unlock()
+	if w.stopped {
+		return
+	}
+	w.fired = true
+	query, args := sanitizeQuery(adapters[db.DriverName()].cancelBackendQuery(), w.backendID)
+	if _, err := db.Exec(query, args...); err != nil {
+		log.Warn("Unable to cancel the queries of a timed out job", "backend", w.backendID, "error", err)
+	}
+	w.timer.Reset(jobWatchdogPeriod)
+}
+
+// stop stops this jobWatchdog. No query is cancelled once it has returned.
+// It returns true if the timeout had elapsed.
+func (w *jobWatchdog) stop() bool {
+	w.Lock()
+	defer w.Unlock()
+	w.stopped = true
+	w.timer.Stop()
+	return w.fired
+}
+
+// requeueStaleJobs handles the started jobs whose deadline has passed and
+// that are not locked by a running transaction, i.e. whose worker died or
+// failed to record the result, as failed attempts.
+func requeueStaleJobs() {
+	err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		var res []int64
+		env.Cr().Select(&res, `SELECT id FROM queue_job WHERE state = ? AND deadline < ? FOR UPDATE SKIP LOCKED`,
+			JobStarted, dates.Now())
+		for _, job := range env.Pool(QueueJobModel).Call("Browse", res).(RecordSet).Collection().Records() {
+			log.Info("Requeuing stale job", "job", job.ids[0])
+			failJob(job, "the job did not complete before its deadline", FieldMap{})
+		}
+	})
+	if err != nil {
+		log.Warn("Unable to requeue stale jobs", "error", err)
+	}
+}
+
+// declareQueueJobModel creates the system model that stores the jobs of the job queue
+func declareQueueJobModel() {
+	model := getOrCreateModel(QueueJobModel, SystemModel)
+	model.InheritModel(Registry.MustGet("BaseMixin"))
+	for _, fi := range []*Field{
+		{name: "Model", json: "model", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")},
+			required: true},
+		{name: "Method", json: "method", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")},
+			required: true},
+		{name: "RecordIDs", json: "record_ids", fieldType: fieldtype.Text, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "Args", json: "args", fieldType: fieldtype.Text, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "UserID", json: "user_id", fieldType: fieldtype.Integer, structField: reflect.StructField{Type: reflect.TypeOf(int64(0))}},
+		{name: "Context", json: "context", fieldType: fieldtype.Text, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "GroupsScope", json: "groups_scope", fieldType: fieldtype.Text, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "RequestID", json: "request_id", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "Priority", json: "priority", fieldType: fieldtype.Integer, structField: reflect.StructField{Type: reflect.TypeOf(int64(0))}},
+		{name: "State", json: "state", fieldType: fieldtype.Selection, structField: reflect.StructField{Type: reflect.TypeOf("")},
+			selection: types.Selection{JobPending: "Pending", JobStarted: "Started", JobDone: "Done", JobFailed: "Failed"},
+			required:  true, index: true},
+		{name: "Attempts", json: "attempts", fieldType: fieldtype.Integer, structField: reflect.StructField{Type: reflect.TypeOf(int64(0))}},
+		{name: "MaxAttempts", json: "max_attempts", fieldType: fieldtype.Integer,
+			structField: reflect.StructField{Type: reflect.TypeOf(int64(0))}},
+		{name: "Timeout", json: "timeout", fieldType: fieldtype.Integer, structField: reflect.StructField{Type: reflect.TypeOf(int64(0))}},
+		{name: "ETA", json: "eta", fieldType: fieldtype.DateTime,
+			structField: reflect.StructField{Type: reflect.TypeOf(dates.DateTime{})}, index: true},
+		{name: "StartedAt", json: "started_at", fieldType: fieldtype.DateTime,
+			structField: reflect.StructField{Type: reflect.TypeOf(dates.DateTime{})}},
+		{name: "Deadline", json: "deadline", fieldType: fieldtype.DateTime,
+			structField: reflect.StructField{Type: reflect.TypeOf(dates.DateTime{})}},
+		{name: "FinishedAt", json: "finished_at", fieldType: fieldtype.DateTime,
+			structField: reflect.StructField{Type: reflect.TypeOf(dates.DateTime{})}},
+		{name: "Result", json: "result", fieldType: fieldtype.Text, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "Error", json: "error", fieldType: fieldtype.Text, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+	} {
+		fi.model = model
+		fi.description = fi.name
+		fi.noCopy = true
+		model.fields.add(fi)
+	}
+}
@@ -16,6 +16,7 @@ package models
 
 import (
 	"reflect"
+	"sort"
 	"sync"
 
 	"github.com/Pedro-lmso-erp/erp/src/models/security"
@@ -92,6 +93,20 @@ func (mc *MethodsCollection) set(methodName string, methInfo *Method) {
 	}
 }
 
+// Exposed returns the exposed methods of this collection sorted by name
+func (mc *MethodsCollection) Exposed() []*Method {
+	var res []*Method
+	for _, meth := range mc.registry {
+		if meth.IsExposed() {
+			res = append(res, meth)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+	return res
+}
+
 // AllowAllToGroup grants the given group access to all the CRUD methods of this collection
 func (mc *MethodsCollection) AllowAllToGroup(group *security.Group) {
 	for mName := range unauthorizedMethods {
@@ -139,6 +154,7 @@ type Method struct {
 	nextLayer     map[*methodLayer]*methodLayer
 	groups        map[*security.Group]bool
 	groupsCallers map[callerGroup]bool
+	exposed       bool
 }
 
 // MethodType returns the methodType of a Method
@@ -205,6 +221,22 @@ func (m *Method) RevokeGroup(group *security.Group) *Method {
 	return m
 }
 
+// Expose marks this method as callable by clients, e.g. through the REST API.
+// Execution permissions still apply.
+func (m *Method) Expose() *Method {
+	m.Lock()
+	defer m.Unlock()
+	m.exposed = true
+	return m
+}
+
+// IsExposed returns true if this method can be called by clients
+func (m *Method) IsExposed() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.exposed
+}
+
 // Underlying returns the underlysing method data object
 func (m *Method) Underlying() *Method {
 	return m
@@ -241,6 +273,7 @@ func copyMethod(m *Model, method *Method) *Method {
 		nextLayer:     make(map[*methodLayer]*methodLayer),
 		groups:        make(map[*security.Group]bool),
 		groupsCallers: make(map[callerGroup]bool),
+		exposed:       method.exposed,
 	}
 }
 
@@ -0,0 +1,135 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+)
+
+var (
+	recordSetType   = reflect.TypeOf((*RecordSet)(nil)).Elem()
+	recordDataType  = reflect.TypeOf((*RecordData)(nil)).Elem()
+	conditionerType = reflect.TypeOf((*Conditioner)(nil)).Elem()
+)
+
+// ModelOfType returns the model of the given typed RecordSet, RecordData or
+// Condition type as generated in the pool (e.g. m.UserSet, m.UserData or
+// q.UserCondition), or nil if typ is not such a type.
+func ModelOfType(typ reflect.Type) *Model {
+	var name string
+	switch {
+	case typ.Implements(recordSetType) && strings.HasSuffix(typ.Name(), "Set"):
+		name = strings.TrimSuffix(typ.Name(), "Set")
+	case typ.Implements(recordDataType) && strings.HasSuffix(typ.Name(), "Data"):
+		name = strings.TrimSuffix(typ.Name(), "Data")
+	case typ.Name() == "Condition" && reflect.PtrTo(typ).Implements(conditionerType):
+		// Typed conditions are defined in a package named after the model
+		name = path.Base(typ.PkgPath())
+	}
+	if name == "" {
+		return nil
+	}
+	model, ok := Registry.Get(name)
+	if !ok {
+		return nil
+	}
+	return model
+}
+
+// DecodeJSONArgs decodes the given JSON encoded arguments into values of the
+// types of the arguments of this method, so that they can be passed to Call.
+//
+// RecordSet arguments are given as an id or a list of ids, RecordData arguments
+// as an object indexed by field names and Condition arguments as a domain. Other
+// arguments are decoded with the encoding/json package.
+func (m *Method) DecodeJSONArgs(env Environment, args []json.RawMessage) ([]interface{}, error) {
+	if err := m.checkArgsCount(len(args)); err != nil {
+		return nil, err
+	}
+	res := make([]interface{}, len(args))
+	for i, arg := range args {
+		val, err := decodeJSONArg(env, m.methodType.In(i+1), arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %d of method %s: %s", i+1, m.name, err)
+		}
+		res[i] = val
+	}
+	return res, nil
+}
+
+// checkArgsCount returns an error if this method cannot be called with
+// the given number of arguments.
+func (m *Method) checkArgsCount(count int) error {
+	nArgs := m.methodType.NumIn() - 1
+	if count > nArgs || (count < nArgs && !(m.methodType.IsVariadic() && count == nArgs-1)) {
+		return fmt.Errorf("method %s of %s expects %d arguments, got %d", m.name, m.model.name, nArgs, count)
+	}
+	return nil
+}
+
+// decodeJSONArg decodes the given JSON encoded argument into a value of type typ.
+// See DecodeJSONArgs for details.
+func decodeJSONArg(env Environment, typ reflect.Type, data json.RawMessage) (interface{}, error) {
+	model := ModelOfType(typ)
+	switch {
+	case model != nil && typ.Implements(recordSetType):
+		var ids interface{}
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return nil, err
+		}
+		if err := checkJSONIds(ids); err != nil {
+			return nil, err
+		}
+		rs := env.Pool(model.name)
+		if err := rs.Scan(ids); err != nil {
+			return nil, err
+		}
+		return rs, nil
+	case model != nil && typ.Implements(recordDataType):
+		var values FieldMap
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+		for field := range values {
+			if _, ok := model.fields.Get(field); !ok {
+				return nil, fmt.Errorf("unknown field '%s' in model %s", field, model.name)
+			}
+		}
+		return NewModelDataFromRS(env.Pool(model.name), values), nil
+	case model != nil:
+		var domain []interface{}
+		if err := json.Unmarshal(data, &domain); err != nil {
+			return nil, err
+		}
+		return model.ConditionFromDomain(domain)
+	case typ.Implements(recordSetType), typ.Implements(recordDataType), reflect.PtrTo(typ).Implements(conditionerType):
+		return nil, fmt.Errorf("unsupported argument type %s", typ)
+	}
+	val := reflect.New(typ)
+	if err := json.Unmarshal(data, val.Interface()); err != nil {
+		return nil, err
+	}
+	return val.Elem().Interface(), nil
+}
+
+// checkJSONIds returns an error if the given decoded JSON value
+// is neither null, a number nor a list of numbers.
+func checkJSONIds(ids interface{}) error {
+	switch val := ids.(type) {
+	case nil, float64:
+		return nil
+	case []interface{}:
+		for _, id := range val {
+			if _, ok := id.(float64); !ok {
+				return fmt.Errorf("invalid id %v", id)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("expected an id or a list of ids, got %v", ids)
+}
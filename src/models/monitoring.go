@@ -0,0 +1,235 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
+)
+
+// Stats are the cumulative statistics of the ORM since the start of the process
+type Stats struct {
+	// Queries is the number of queries sent to the database
+	Queries uint64
+	// QueryErrors is the number of queries that failed
+	QueryErrors uint64
+	// QueriesDuration is the total time spent executing queries
+	QueriesDuration time.Duration
+	// TransactionRetries is the number of transactions that have been
+	// retried because of a serialization error
+	TransactionRetries uint64
+	// Workers are the statistics of the worker functions, by worker name
+	Workers map[string]WorkerStats
+}
+
+// WorkerStats are the cumulative statistics and the status of a worker function
+type WorkerStats struct {
+	// Runs is the number of times the worker function has been run
+	Runs uint64
+	// Failures is the number of runs that panicked
+	Failures uint64
+	// Duration is the total time spent running the worker function
+	Duration time.Duration
+	// Skipped is the number of runs that have been skipped
+	// because the previous run was still active.
+	Skipped uint64
+	// Running is true while the worker function is running
+	Running bool
+	// LastRun is the start time of the last completed run
+	LastRun time.Time
+	// LastDuration is the duration of the last completed run
+	LastDuration time.Duration
+	// LastError is the error of the last completed run if it
+	// panicked, or an empty string otherwise.
+	LastError string
+}
+
+// stats holds the statistics of the ORM. Counters are updated atomically
+// and workers statistics are protected by the mutex.
+var stats struct {
+	queries            uint64
+	queryErrors        uint64
+	queriesDuration    int64
+	transactionRetries uint64
+	sync.Mutex
+	workers map[string]WorkerStats
+}
+
+// schemaUpToDate is set to 1 once CheckDatabaseSchema succeeded
+var schemaUpToDate int32
+
+// GetStats returns a snapshot of the cumulative statistics of the ORM
+func GetStats() Stats {
+	res := Stats{
+		Queries:            atomic.LoadUint64(&stats.queries),
+		QueryErrors:        atomic.LoadUint64(&stats.queryErrors),
+		QueriesDuration:    time.Duration(atomic.LoadInt64(&stats.queriesDuration)),
+		TransactionRetries: atomic.LoadUint64(&stats.transactionRetries),
+		Workers:            make(map[string]WorkerStats),
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	for name, ws := range stats.workers {
+		res.Workers[name] = ws
+	}
+	return res
+}
+
+// recordQuery updates the statistics with a query that took the given duration
+func recordQuery(duration time.Duration, err error) {
+	atomic.AddUint64(&stats.queries, 1)
+	atomic.AddInt64(&stats.queriesDuration, int64(duration))
+	if err != nil {
+		atomic.AddUint64(&stats.queryErrors, 1)
+	}
+}
+
+// recordTransactionRetry updates the statistics with a transaction retry
+func recordTransactionRetry() {
+	atomic.AddUint64(&stats.transactionRetries, 1)
+}
+
+// startWorkerRun marks the worker with the given name as running. It
+// returns false and counts a skipped run if the worker is already running.
+func startWorkerRun(name string) bool {
+	stats.Lock()
+	defer stats.Unlock()
+	if stats.workers == nil {
+		stats.workers = make(map[string]WorkerStats)
+	}
+	ws := stats.workers[name]
+	if ws.Running {
+		ws.Skipped++
+		stats.workers[name] = ws
+		return false
+	}
+	ws.Running = true
+	stats.workers[name] = ws
+	return true
+}
+
+// recordWorkerRun updates the statistics of the given worker with a run
+// started at start that took the given duration and failed with the given
+// error if not nil.
+func recordWorkerRun(name string, start time.Time, duration time.Duration, err error) {
+	stats.Lock()
+	defer stats.Unlock()
+	ws := stats.workers[name]
+	ws.Running = false
+	ws.Runs++
+	ws.Duration += duration
+	ws.LastRun = start
+	ws.LastDuration = duration
+	ws.LastError = ""
+	if err != nil {
+		ws.Failures++
+		ws.LastError = err.Error()
+	}
+	stats.workers[name] = ws
+}
+
+// executeWorker runs the given WorkerFunction which has been marked as
+// running with startWorkerRun, and records its statistics. A panic in the
+// worker function is logged and counted as a failure instead of crashing
+// the process.
+func executeWorker(name string, wf WorkerFunction) {
+	start := time.Now()
+	defer func() {
+		var err error
+		if r := recover(); r != nil {
+			err = logging.LogPanicData(r)
+			log.Error("Worker function failed", "worker", name, "error", err)
+		}
+		recordWorkerRun(name, start, time.Now().Sub(start), err)
+	}()
+	wf.Run()
+}
+
+// workerName returns the name of the given WorkerFunction used in statistics.
+// This is the given name for a WorkerFunction created with
+// NewNamedWorkerFunction, the name of the function for a WorkerFunction
+// created with NewWorkerFunction, and the result of the Name method for other
+// implementations that have one. Other implementations are named after their
+// type, and their address if they are pointers, so that several instances of
+// the same type have distinct names.
+func workerName(wf WorkerFunction) string {
+	switch w := wf.(type) {
+	case *workerFunction:
+		if w.name != "" {
+			return w.name
+		}
+		if fnct := runtime.FuncForPC(reflect.ValueOf(w.fnct).Pointer()); fnct != nil {
+			name := fnct.Name()
+			return name[strings.LastIndex(name, "/")+1:]
+		}
+	case interface{ Name() string }:
+		return w.Name()
+	}
+	if reflect.ValueOf(wf).Kind() == reflect.Ptr {
+		return fmt.Sprintf("%T@%p", wf, wf)
+	}
+	return fmt.Sprintf("%T", wf)
+}
+
+// DBPing checks that the database is reachable within the deadline of ctx
+func DBPing(ctx context.Context) error {
+	if db == nil {
+		return errors.New("database not connected")
+	}
+	return db.PingContext(ctx)
+}
+
+// CheckDatabaseSchema returns an error if the database schema does not
+// match the models, i.e. if a table or a column of a stored field is missing
+// or has a wrong type. This is the case when the database has not been
+// updated after a change in the models.
+//
+// The check is only performed until it succeeds once.
+func CheckDatabaseSchema() (rError error) {
+	if atomic.LoadInt32(&schemaUpToDate) == 1 {
+		return nil
+	}
+	if !Registry.bootstrapped {
+		return errors.New("models are not bootstrapped")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			rError = logging.LogPanicData(r)
+		}
+	}()
+	adapter := adapters[db.DriverName()]
+	dbTables := adapter.tables()
+	for tableName, model := range Registry.registryByTableName {
+		if model.IsMixin() || model.IsManual() {
+			continue
+		}
+		if !dbTables[tableName] {
+			return fmt.Errorf("table %s of model %s does not exist", tableName, model.name)
+		}
+		dbColumns := adapter.columns(tableName)
+		for colName, fi := range model.fields.registryByJSON {
+			if !fi.isStored() {
+				continue
+			}
+			dbColData, ok := dbColumns[colName]
+			if !ok {
+				return fmt.Errorf("column %s.%s of field %s does not exist", tableName, colName, fi.name)
+			}
+			if colName != "id" && dbColData.DataType != adapter.typeSQL(fi) {
+				return fmt.Errorf("column %s.%s has type %s instead of %s", tableName, colName, dbColData.DataType, adapter.typeSQL(fi))
+			}
+		}
+	}
+	atomic.StoreInt32(&schemaUpToDate, 1)
+	return nil
+}
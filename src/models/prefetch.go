@@ -0,0 +1,174 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+// PrefetchSize is the maximum number of records loaded at once when a
+// field of a record is read and is not in cache. The field is then also
+// loaded for the other records of the prefetch set of this record, that
+// is the record set it was taken from with Records(), Filtered() or by
+// following a relation field.
+var PrefetchSize = 1000
+
+// prefetchSource returns the record set that should be used as prefetch
+// set for the records derived from this RecordCollection.
+func (rc *RecordCollection) prefetchSource() *RecordCollection {
+	if rc.prefetchRC != nil {
+		return rc.prefetchRC
+	}
+	return rc
+}
+
+// prefetchData holds the data computed once for a prefetch set and shared by
+// all the records derived from it, so that iterating over the prefetch set
+// does not scan it for each record.
+type prefetchData struct {
+	// ids are the ids of the prefetch set the data was computed for
+	ids []int64
+	// index is the position of each id in ids
+	index map[int64]int
+	// related are the prefetch sets of relation fields computed for a
+	// window of the prefetch set, by field JSON name and context slug.
+	related map[string]relatedPrefetchData
+}
+
+// relatedPrefetchData is the prefetch set of a relation field,
+// computed for the window starting at the start position.
+type relatedPrefetchData struct {
+	start int
+	rc    *RecordCollection
+}
+
+// prefetchInfo returns the prefetchData of this prefetch set,
+// computing it if necessary.
+func (rc *RecordCollection) prefetchInfo() *prefetchData {
+	pd := rc.prefetchData
+	if pd != nil && len(pd.ids) == len(rc.ids) && (len(rc.ids) == 0 || &pd.ids[0] == &rc.ids[0]) {
+		return pd
+	}
+	pd = &prefetchData{
+		ids:     rc.ids,
+		index:   make(map[int64]int, len(rc.ids)),
+		related: make(map[string]relatedPrefetchData),
+	}
+	for i := len(rc.ids) - 1; i >= 0; i-- {
+		pd.index[rc.ids[i]] = i
+	}
+	rc.prefetchData = pd
+	return pd
+}
+
+// prefetchStart returns the position of the first record of rc in its
+// prefetch set, or 0 if it is not found.
+func (rc *RecordCollection) prefetchStart() int {
+	if len(rc.ids) == 0 {
+		return 0
+	}
+	return rc.prefetchRC.prefetchInfo().index[rc.ids[0]]
+}
+
+// forEachPrefetchID calls fnct with the ids of rc's prefetch set, starting
+// from the first record of rc and wrapping around, so that iterating over a
+// large record set loads consecutive batches. It stops when fnct returns false.
+func (rc *RecordCollection) forEachPrefetchID(fnct func(int64) bool) {
+	prefetchIds := rc.prefetchRC.ids
+	start := rc.prefetchStart()
+	for i := range prefetchIds {
+		if !fnct(prefetchIds[(start+i)%len(prefetchIds)]) {
+			return
+		}
+	}
+}
+
+// prefetchBatch returns a RecordCollection with the records of rc and other
+// records of its prefetch set for which the given fields are not in cache yet,
+// up to PrefetchSize records.
+func (rc *RecordCollection) prefetchBatch(fieldNames []FieldName) *RecordCollection {
+	if len(fieldNames) == 0 {
+		fieldNames = rc.model.fields.storedFieldNames()
+	}
+	fields := make([]string, len(fieldNames))
+	for i, f := range fieldNames {
+		fields[i] = f.JSON()
+	}
+	ctxSlug := rc.query.ctxArgsSlug()
+	ids := make([]int64, len(rc.ids))
+	copy(ids, rc.ids)
+	idsMap := make(map[int64]bool)
+	for _, id := range rc.ids {
+		idsMap[id] = true
+	}
+	rc.forEachPrefetchID(func(id int64) bool {
+		if len(ids) >= PrefetchSize {
+			return false
+		}
+		if id <= 0 || idsMap[id] {
+			return true
+		}
+		idsMap[id] = true
+		if !rc.env.cache.checkIfInCache(rc.model, []int64{id}, fields, ctxSlug, true) {
+			ids = append(ids, id)
+		}
+		return true
+	})
+	return newRecordCollection(rc.Env(), rc.ModelName()).withIds(ids)
+}
+
+// relatedPrefetch returns the prefetch set of the records of the relation
+// field given by fieldName, that is the records referenced by this field
+// in cache for rc and the next records of its prefetch set, up to
+// PrefetchSize records.
+//
+// When rc is a single record, the result is computed once for a window of
+// the prefetch set and a copy of it is returned for the records in the first
+// half of this window. It returns nil if rc has no prefetch set.
+func (rc *RecordCollection) relatedPrefetch(fieldName FieldName, relatedModelName string) *RecordCollection {
+	if rc.prefetchRC == nil {
+		return nil
+	}
+	ctxSlug := rc.query.ctxArgsSlug()
+	key := fieldName.JSON() + "|" + ctxSlug
+	pd := rc.prefetchRC.prefetchInfo()
+	start := rc.prefetchStart()
+	if cached, ok := pd.related[key]; ok && len(rc.ids) == 1 && start >= cached.start && start < cached.start+PrefetchSize/2 {
+		res := cached.rc.clone()
+		env := rc.Env()
+		res.env = &env
+		return res
+	}
+	fields := []string{fieldName.JSON()}
+	var relIds []int64
+	addRelatedIds := func(id int64) {
+		if id <= 0 || !rc.env.cache.checkIfInCache(rc.model, []int64{id}, fields, ctxSlug, false) {
+			return
+		}
+		ids, ok := relationIds(rc.env.cache.get(rc.model, id, fieldName.JSON(), ctxSlug))
+		if !ok {
+			return
+		}
+		for _, relID := range ids {
+			if relID > 0 {
+				relIds = append(relIds, relID)
+			}
+		}
+	}
+	for _, id := range rc.ids {
+		addRelatedIds(id)
+	}
+	var count int
+	rc.forEachPrefetchID(func(id int64) bool {
+		if count >= PrefetchSize {
+			return false
+		}
+		count++
+		addRelatedIds(id)
+		return true
+	})
+	res := newRecordCollection(rc.Env(), relatedModelName).withIds(relIds)
+	if len(rc.ids) == 1 {
+		// Index the prefetch set now, so that its copies share the index
+		res.prefetchInfo()
+		pd.related[key] = relatedPrefetchData{start: start, rc: res.clone()}
+	}
+	return res
+}
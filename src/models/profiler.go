@@ -0,0 +1,238 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/strutils"
+)
+
+// modelsPackagePath is the import path of this package. It is used
+// to find the caller of a query outside the ORM.
+var modelsPackagePath = reflect.TypeOf(Cursor{}).PkgPath()
+
+// poolPackagePath is the import path prefix of the generated pool packages
+const poolPackagePath = "github.com/Pedro-lmso-erp/pool/"
+
+// A QueryProfiler records the queries executed by the Environments
+// it is attached to. It is safe for concurrent use.
+type QueryProfiler struct {
+	sync.Mutex
+	slowThreshold time.Duration
+	explain       bool
+	count         int
+	duration      time.Duration
+	queries       map[string]*queryStats
+	order         []string
+	slowQueries   []SlowQuery
+}
+
+// queryStats holds the statistics of a query text
+type queryStats struct {
+	count     int
+	duration  time.Duration
+	args      map[string]int
+	callSites map[string]int
+}
+
+// A RepeatedQuery is a query text that has been executed several times,
+// typically in a loop where records should have been prefetched.
+type RepeatedQuery struct {
+	Query string `json:"query"`
+	Count int    `json:"count"`
+	// Duplicates is the number of executions with the exact same arguments
+	// as a previous execution.
+	Duplicates int            `json:"duplicates"`
+	DurationMS float64        `json:"duration_ms"`
+	CallSites  map[string]int `json:"call_sites"`
+}
+
+// A SlowQuery is a query that took longer than the profiler's threshold.
+type SlowQuery struct {
+	Query      string  `json:"query"`
+	Args       string  `json:"args"`
+	DurationMS float64 `json:"duration_ms"`
+	CallSite   string  `json:"call_site"`
+	Plan       string  `json:"plan,omitempty"`
+}
+
+// A QueryProfile is the summary of the queries recorded by a QueryProfiler
+type QueryProfile struct {
+	QueriesCount    int             `json:"queries_count"`
+	DurationMS      float64         `json:"duration_ms"`
+	RepeatedQueries []RepeatedQuery `json:"repeated_queries"`
+	SlowQueries     []SlowQuery     `json:"slow_queries"`
+}
+
+// NewQueryProfiler returns a new QueryProfiler.
+//
+// Queries taking longer than slowThreshold are reported as slow queries.
+// If explain is set, the execution plan of slow SELECT queries is captured
+// with EXPLAIN ANALYZE. A zero slowThreshold disables slow queries reporting.
+func NewQueryProfiler(slowThreshold time.Duration, explain bool) *QueryProfiler {
+	return &QueryProfiler{
+		slowThreshold: slowThreshold,
+		explain:       explain,
+		queries:       make(map[string]*queryStats),
+	}
+}
+
+// record adds the given query executed on cr to this profiler.
+//
+// If cr is nil, the execution plan of the query is not captured.
+func (qp *QueryProfiler) record(cr *Cursor, duration time.Duration, query string, args ...interface{}) {
+	site := queryCallSite()
+	isSlow := qp.slowThreshold > 0 && duration >= qp.slowThreshold
+	var plan string
+	if isSlow && qp.explain && cr != nil {
+		plan = cr.explain(query, args...)
+	}
+	argsStr := fmt.Sprintf("%v", strutils.TrimArgs(args))
+	qp.Lock()
+	defer qp.Unlock()
+	qp.count++
+	qp.duration += duration
+	stats, ok := qp.queries[query]
+	if !ok {
+		stats = &queryStats{
+			args:      make(map[string]int),
+			callSites: make(map[string]int),
+		}
+		qp.queries[query] = stats
+		qp.order = append(qp.order, query)
+	}
+	stats.count++
+	stats.duration += duration
+	stats.args[argsStr]++
+	stats.callSites[site]++
+	if isSlow {
+		qp.slowQueries = append(qp.slowQueries, SlowQuery{
+			Query:      query,
+			Args:       argsStr,
+			DurationMS: durationMS(duration),
+			CallSite:   site,
+			Plan:       plan,
+		})
+	}
+}
+
+// Count returns the number of queries recorded by this profiler
+func (qp *QueryProfiler) Count() int {
+	qp.Lock()
+	defer qp.Unlock()
+	return qp.count
+}
+
+// Duration returns the total time spent in the queries recorded by this profiler
+func (qp *QueryProfiler) Duration() time.Duration {
+	qp.Lock()
+	defer qp.Unlock()
+	return qp.duration
+}
+
+// Profile returns a summary of the queries recorded by this profiler.
+//
+// Repeated queries are sorted by decreasing number of executions.
+func (qp *QueryProfiler) Profile() QueryProfile {
+	qp.Lock()
+	defer qp.Unlock()
+	res := QueryProfile{
+		QueriesCount:    qp.count,
+		DurationMS:      durationMS(qp.duration),
+		RepeatedQueries: []RepeatedQuery{},
+		SlowQueries:     make([]SlowQuery, len(qp.slowQueries)),
+	}
+	copy(res.SlowQueries, qp.slowQueries)
+	for _, query := range qp.order {
+		stats := qp.queries[query]
+		if stats.count < 2 {
+			continue
+		}
+		callSites := make(map[string]int)
+		for site, num := range stats.callSites {
+			callSites[site] = num
+		}
+		res.RepeatedQueries = append(res.RepeatedQueries, RepeatedQuery{
+			Query:      query,
+			Count:      stats.count,
+			Duplicates: stats.count - len(stats.args),
+			DurationMS: durationMS(stats.duration),
+			CallSites:  callSites,
+		})
+	}
+	sort.SliceStable(res.RepeatedQueries, func(i, j int) bool {
+		return res.RepeatedQueries[i].Count > res.RepeatedQueries[j].Count
+	})
+	return res
+}
+
+// durationMS returns the given duration in milliseconds
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// queryCallSite returns the location of the first caller
+// outside of the ORM (or in a test file) of the current query.
+func queryCallSite() string {
+	pcs := make([]uintptr, 64)
+	num := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:num])
+	var first string
+	for {
+		frame, more := frames.Next()
+		site := fmt.Sprintf("%s:%d (%s)", frame.File, frame.Line, frame.Function)
+		if first == "" {
+			first = site
+		}
+		switch {
+		case strings.HasSuffix(frame.File, "_test.go"):
+			return site
+		case strings.HasPrefix(frame.Function, modelsPackagePath+"."),
+			strings.HasPrefix(frame.Function, poolPackagePath),
+			strings.HasPrefix(frame.Function, "reflect."),
+			strings.HasPrefix(frame.Function, "runtime."):
+		default:
+			return site
+		}
+		if !more {
+			break
+		}
+	}
+	return first
+}
+
+// explain returns the execution plan of the given query with actual run times.
+//
+// Only SELECT and WITH queries are explained. The query is executed again
+// inside a savepoint which is always rolled back, so that neither a failure
+// nor the writes of a data-modifying WITH query affect the current
+// transaction.
+func (c *Cursor) explain(query string, args ...interface{}) string {
+	upperQuery := strings.ToUpper(strings.TrimSpace(query))
+	if !strings.HasPrefix(upperQuery, "SELECT") && !strings.HasPrefix(upperQuery, "WITH") {
+		return ""
+	}
+	query, args = sanitizeQuery(query, args...)
+	if _, err := c.tx.Exec("SAVEPOINT query_profiler"); err != nil {
+		log.Warn("Unable to create savepoint for explaining query", "error", err)
+		return ""
+	}
+	defer func() {
+		c.tx.Exec("ROLLBACK TO SAVEPOINT query_profiler")
+		c.tx.Exec("RELEASE SAVEPOINT query_profiler")
+	}()
+	var lines []string
+	if err := c.tx.Select(&lines, adapters[db.DriverName()].explainQuery(query), args...); err != nil {
+		log.Warn("Unable to explain query", "query", query, "error", err)
+		return ""
+	}
+	return strings.Join(lines, "\n")
+}
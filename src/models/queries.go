@@ -126,7 +126,10 @@ func (q *Query) conditionSQLClause(c *Condition) (string, SQLParams) {
 		switch {
 		case first:
 			sql = vSQL
-			if p.isNot {
+			switch {
+			case p.isNot && p.isCond:
+				sql = fmt.Sprintf("NOT (%s)", sql)
+			case p.isNot:
 				sql = "NOT " + sql
 			}
 		case p.isCond:
@@ -159,7 +159,7 @@ func (rc *RecordCollection) processInverseMethods(data RecordData) {
 			if typesutils.IsZero(val) || rc.Env().Context().GetBool("erp_ignore_computed_fields") {
 				continue
 			}
-			log.Panic("Trying to write a computed field without inverse method", "model", rc.model.name, "field", fieldName)
+			rc.logger().Panic("Trying to write a computed field without inverse method", "model", rc.model.name, "field", fieldName)
 		}
 		rc.Call(fi.inverse, val)
 	}
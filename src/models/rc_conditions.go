@@ -0,0 +1,562 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/operator"
+	"github.com/Pedro-lmso-erp/erp/src/models/types/dates"
+	"github.com/Pedro-lmso-erp/erp/src/tools/nbutils"
+	"github.com/Pedro-lmso-erp/erp/src/tools/typesutils"
+)
+
+// An sqlBool is a boolean value in SQL three-valued logic
+type sqlBool int8
+
+const (
+	sqlFalse sqlBool = -1
+	sqlNull  sqlBool = 0
+	sqlTrue  sqlBool = 1
+)
+
+// toSQLBool returns the sqlBool corresponding to the given bool
+func toSQLBool(b bool) sqlBool {
+	if b {
+		return sqlTrue
+	}
+	return sqlFalse
+}
+
+// and returns the SQL conjunction of b and other
+func (b sqlBool) and(other sqlBool) sqlBool {
+	if other < b {
+		return other
+	}
+	return b
+}
+
+// or returns the SQL disjunction of b and other
+func (b sqlBool) or(other sqlBool) sqlBool {
+	if other > b {
+		return other
+	}
+	return b
+}
+
+// not returns the SQL negation of b
+func (b sqlBool) not() sqlBool {
+	return -b
+}
+
+// Matches returns true if all the records of this RecordCollection satisfy
+// the given condition. An empty RecordCollection never matches.
+//
+// See FilteredOn for details on how the condition is evaluated.
+func (rc *RecordCollection) Matches(cond *Condition) bool {
+	if rc.IsEmpty() {
+		return false
+	}
+	return rc.FilteredOn(cond).Len() == rc.Len()
+}
+
+// FilteredOn returns a new RecordCollection with only the records of this
+// RecordCollection that satisfy the given condition.
+//
+// The condition is evaluated in memory against the values in cache, with the
+// same semantics as a Search in the database. Records for which a value required
+// by the condition is not in cache are checked in the database instead.
+// Records that only exist in memory (i.e. with a negative ID) are only evaluated
+// against the cache and do not match if a value is missing.
+//
+// Note that on a path through a One2Many or Many2Many field, a predicate is true
+// if it is true for at least one of the related records.
+func (rc *RecordCollection) FilteredOn(cond *Condition) *RecordCollection {
+	if !rc.IsValid() {
+		return rc
+	}
+	rc.Fetch()
+	if cond == nil || cond.IsEmpty() {
+		return rc
+	}
+	rc.CheckExecutionPermission(rc.model.methods.MustGet("Load"))
+	matched := make(map[int64]bool)
+	var toCheck []int64
+	for _, id := range rc.ids {
+		res, ok := rc.evaluateCondition(id, cond)
+		switch {
+		case !ok && id > 0:
+			toCheck = append(toCheck, id)
+		case ok && res == sqlTrue:
+			matched[id] = true
+		}
+	}
+	if len(toCheck) > 0 {
+		dbRecs := rc.withFilteredIds(toCheck).Search(cond)
+		for _, id := range dbRecs.Ids() {
+			matched[id] = true
+		}
+	}
+	var ids []int64
+	for _, id := range rc.ids {
+		if matched[id] {
+			ids = append(ids, id)
+		}
+	}
+	return rc.withFilteredIds(ids)
+}
+
+// withFilteredIds returns a new RecordCollection with the given ids of this
+// RecordCollection. It keeps the context condition of the query of rc, so
+// that values are read with the same context slug, and its prefetch set.
+func (rc *RecordCollection) withFilteredIds(ids []int64) *RecordCollection {
+	res := newRecordCollection(rc.Env(), rc.ModelName())
+	ctxCond := *rc.query.ctxCond
+	res.query.ctxCond = &ctxCond
+	res.query.ctxOrders = rc.query.ctxOrders
+	res = res.withIds(ids)
+	res.prefetchRC = rc.prefetchSource()
+	return res
+}
+
+// evaluateCondition evaluates the given condition for the record with the given id
+// of this RecordCollection model.
+//
+// The second returned value is false if a value needed for the evaluation is not in cache.
+func (rc *RecordCollection) evaluateCondition(id int64, cond *Condition) (sqlBool, bool) {
+	// We follow the SQL generated by conditionSQLClause: simple predicates
+	// are chained with AND precedence over OR, whereas sub conditions are
+	// combined with everything that precedes them.
+	orRes, andRes := sqlFalse, sqlTrue
+	for i, p := range cond.predicates {
+		val, ok := rc.evaluatePredicate(id, p)
+		if !ok {
+			return sqlNull, false
+		}
+		if p.isNot {
+			val = val.not()
+		}
+		switch {
+		case i == 0:
+			andRes = val
+		case p.isCond:
+			prev := orRes.or(andRes)
+			if p.isOr {
+				andRes = prev.or(val)
+			} else {
+				andRes = prev.and(val)
+			}
+			orRes = sqlFalse
+		case p.isOr:
+			orRes = orRes.or(andRes)
+			andRes = val
+		default:
+			andRes = andRes.and(val)
+		}
+	}
+	return orRes.or(andRes), true
+}
+
+// evaluatePredicate evaluates the given predicate for the record with the given id
+// of this RecordCollection model.
+//
+// The second returned value is false if a value needed for the evaluation is not in cache.
+func (rc *RecordCollection) evaluatePredicate(id int64, p predicate) (sqlBool, bool) {
+	if p.isCond {
+		return rc.evaluateCondition(id, p.cond)
+	}
+	path := rc.substituteRelatedInPath(joinFieldNames(p.exprs, ExprSep))
+	fi := rc.model.getRelatedFieldInfo(path)
+	arg := rc.query.evaluateConditionArgFunctions(p)
+	if fi.isRelationField() {
+		switch arg.(type) {
+		case bool:
+			arg = nil
+		case string:
+			path = joinFieldNames(addNameSearchToExprs(fi, splitFieldNames(path, ExprSep)), ExprSep)
+			fi = rc.model.getRelatedFieldInfo(path)
+		case ClientEvaluatedString:
+			return sqlNull, false
+		}
+	}
+	if fi.fieldType.IsFKRelationType() {
+		// If we have a relation type with a 0 as foreign key, we substitute for nil
+		if valInt, err := nbutils.CastToInteger(arg); err == nil && valInt == 0 {
+			arg = nil
+		}
+	}
+	values, ok := rc.cachedPathValues(rc.model, id, splitFieldNames(path, ExprSep))
+	if !ok {
+		return sqlNull, false
+	}
+	op := p.operator
+	if op == operator.ChildOf {
+		recModel := rc.model.getRelatedModelInfo(path)
+		if recModel.hasParentField() {
+			return rc.evaluateChildOf(recModel, values, arg)
+		}
+		// If we have no parent field, then we match only the "parent" record
+		op = operator.Equals
+	}
+	res := sqlFalse
+	for _, val := range values {
+		valRes, ok := evaluateOperator(fi, op, val, arg)
+		if !ok {
+			return sqlNull, false
+		}
+		res = res.or(valRes)
+	}
+	return res, true
+}
+
+// evaluateChildOf returns whether one of the given values is the record of model mi
+// given by arg or one of its descendants.
+func (rc *RecordCollection) evaluateChildOf(mi *Model, values []interface{}, arg interface{}) (sqlBool, bool) {
+	parentIds, ok := relationIds(arg)
+	if !ok {
+		return sqlNull, false
+	}
+	parents := make(map[int64]bool)
+	for _, id := range parentIds {
+		parents[id] = true
+	}
+	parentField := mi.fields.MustGet("Parent")
+	res := sqlFalse
+	for _, val := range values {
+		if val == nil {
+			res = res.or(sqlNull)
+			continue
+		}
+		cur, err := nbutils.CastToInteger(val)
+		if err != nil {
+			return sqlNull, false
+		}
+		visited := make(map[int64]bool)
+		for cur != 0 && !visited[cur] {
+			if parents[cur] {
+				return sqlTrue, true
+			}
+			visited[cur] = true
+			parentVal, ok := rc.cachedValue(mi, cur, parentField)
+			if !ok {
+				return sqlNull, false
+			}
+			cur = 0
+			if ids, _ := relationIds(parentVal); len(ids) > 0 {
+				cur = ids[0]
+			}
+		}
+	}
+	return res, true
+}
+
+// cachedPathValues returns the values in cache of the field given by exprs,
+// starting from the record with the given id of model mi.
+//
+// As in an SQL join, several values are returned if the path goes through
+// a x2many field, and a nil value is returned if there is no related record.
+// The second returned value is false if a value is not in cache.
+func (rc *RecordCollection) cachedPathValues(mi *Model, id int64, exprs []FieldName) ([]interface{}, bool) {
+	fi := mi.fields.MustGet(exprs[0].JSON())
+	val, ok := rc.cachedValue(mi, id, fi)
+	if !ok {
+		return nil, false
+	}
+	if !fi.isRelationField() {
+		return []interface{}{val}, true
+	}
+	relIds, _ := relationIds(val)
+	if len(relIds) == 0 {
+		return []interface{}{nil}, true
+	}
+	var res []interface{}
+	for _, relID := range relIds {
+		if len(exprs) == 1 {
+			res = append(res, relID)
+			continue
+		}
+		relValues, ok := rc.cachedPathValues(fi.relatedModel, relID, exprs[1:])
+		if !ok {
+			return nil, false
+		}
+		res = append(res, relValues...)
+	}
+	return res, true
+}
+
+// cachedValue returns the value of the given field for the record of model mi
+// with the given id. Non stored computed fields are computed.
+//
+// The second returned value is false if the value is not in cache.
+func (rc *RecordCollection) cachedValue(mi *Model, id int64, fi *Field) (interface{}, bool) {
+	if fi.json == "id" {
+		return id, true
+	}
+	if fi.isComputedField() && !fi.isStored() {
+		val := rc.env.Pool(mi.name).withIds([]int64{id}).Get(fieldName{name: fi.name, json: fi.json})
+		if rs, ok := val.(RecordSet); ok {
+			return rs.Ids(), true
+		}
+		return val, true
+	}
+	ctxSlug := rc.query.ctxArgsSlug()
+	if !rc.env.cache.isInCache(mi, id, fi.json, ctxSlug, true) {
+		return nil, false
+	}
+	return rc.env.cache.get(mi, id, fi.json, ctxSlug), true
+}
+
+// relationIds returns the ids given by val, which can be an int64, a
+// []int64, a RecordSet or nil. Zero ids are discarded.
+//
+// The second returned value is false if val is not of a valid type.
+func relationIds(val interface{}) ([]int64, bool) {
+	switch v := val.(type) {
+	case nil:
+		return nil, true
+	case RecordSet:
+		return v.Ids(), true
+	case []int64:
+		return v, true
+	}
+	list, isList := domainList(val)
+	if !isList {
+		list = []interface{}{val}
+	}
+	var res []int64
+	for _, item := range list {
+		id, err := nbutils.CastToInteger(item)
+		if err != nil {
+			return nil, false
+		}
+		if id != 0 {
+			res = append(res, id)
+		}
+	}
+	return res, true
+}
+
+// evaluateOperator returns the result of applying the given operator and argument
+// to the given value of field fi, with the same semantics as the SQL query.
+//
+// The second returned value is false if the evaluation cannot be done in memory.
+func evaluateOperator(fi *Field, op operator.Operator, val, arg interface{}) (sqlBool, bool) {
+	switch op {
+	case operator.Contains, operator.IContains, operator.NotContains, operator.NotIContains:
+		arg = fmt.Sprintf("%%%s%%", arg)
+	}
+	var isNullArg bool
+	switch a := arg.(type) {
+	case nil:
+		isNullArg = true
+	case string:
+		isNullArg = a == ""
+	case bool:
+		isNullArg = !a
+	}
+	// Zero values of these types are stored as NULL in the database
+	isNullVal := val == nil || (fi.fieldType.IsNullInDB() && typesutils.IsZero(val))
+	if isNullArg {
+		isEmpty := isNullVal || (!fi.isRelationField() && typesutils.IsZero(val))
+		switch op {
+		case operator.Equals, operator.Like, operator.ILike, operator.Contains, operator.IContains:
+			return toSQLBool(isEmpty), true
+		case operator.NotEquals, operator.NotContains, operator.NotIContains:
+			return toSQLBool(!isEmpty), true
+		default:
+			return sqlNull, false
+		}
+	}
+	if isNullVal {
+		if op.IsNegative() {
+			return sqlTrue, true
+		}
+		return sqlNull, true
+	}
+	switch op {
+	case operator.Equals, operator.NotEquals:
+		cmp, ok := compareValues(val, arg)
+		if !ok {
+			return sqlNull, false
+		}
+		return toSQLBool((cmp == 0) == (op == operator.Equals)), true
+	case operator.Greater, operator.GreaterOrEqual, operator.Lower, operator.LowerOrEqual:
+		cmp, ok := compareValues(val, arg)
+		if !ok {
+			return sqlNull, false
+		}
+		switch op {
+		case operator.Greater:
+			return toSQLBool(cmp > 0), true
+		case operator.GreaterOrEqual:
+			return toSQLBool(cmp >= 0), true
+		case operator.Lower:
+			return toSQLBool(cmp < 0), true
+		default:
+			return toSQLBool(cmp <= 0), true
+		}
+	case operator.Like, operator.Contains, operator.NotContains, operator.ILike, operator.IContains, operator.NotIContains:
+		insensitive := op == operator.ILike || op == operator.IContains || op == operator.NotIContains
+		match, ok := likeMatch(val, arg, insensitive)
+		if !ok {
+			return sqlNull, false
+		}
+		return toSQLBool(match != op.IsNegative()), true
+	case operator.In, operator.NotIn:
+		list, ok := domainList(arg)
+		if !ok {
+			list = []interface{}{arg}
+		}
+		var found bool
+		for _, item := range list {
+			cmp, ok := compareValues(val, item)
+			if !ok {
+				return sqlNull, false
+			}
+			if cmp == 0 {
+				found = true
+				break
+			}
+		}
+		return toSQLBool(found == (op == operator.In)), true
+	}
+	return sqlNull, false
+}
+
+// comparableValue returns the given value converted to one of int64, float64,
+// string, bool or time.Time, or nil if it cannot be converted.
+func comparableValue(val interface{}) interface{} {
+	if valuer, ok := val.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return nil
+		}
+		val = v
+	}
+	if t, ok := val.(time.Time); ok {
+		return t
+	}
+	rVal := reflect.ValueOf(val)
+	switch rVal.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rVal.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rVal.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rVal.Float()
+	case reflect.String:
+		return rVal.String()
+	case reflect.Bool:
+		return rVal.Bool()
+	}
+	return nil
+}
+
+// compareValues returns -1, 0 or 1 if val is respectively lower than, equal to or
+// greater than arg. The second returned value is false if values cannot be compared.
+func compareValues(val, arg interface{}) (int, bool) {
+	v1, v2 := comparableValue(val), comparableValue(arg)
+	switch t1 := v1.(type) {
+	case time.Time:
+		t2, ok := v2.(time.Time)
+		if !ok {
+			s, isStr := v2.(string)
+			if !isStr {
+				return 0, false
+			}
+			var err error
+			t2, err = time.Parse(dates.DefaultServerDateTimeFormat, s)
+			if err != nil {
+				t2, err = time.Parse(dates.DefaultServerDateFormat, s)
+			}
+			if err != nil {
+				return 0, false
+			}
+		}
+		switch {
+		case t1.Before(t2):
+			return -1, true
+		case t1.After(t2):
+			return 1, true
+		}
+		return 0, true
+	case string:
+		s2, ok := v2.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(t1, s2), true
+	case bool:
+		b2, ok := v2.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case t1 == b2:
+			return 0, true
+		case b2:
+			return -1, true
+		}
+		return 1, true
+	case int64, float64:
+		f1, err1 := nbutils.CastToFloat(t1)
+		f2, err2 := nbutils.CastToFloat(v2)
+		if err1 != nil || err2 != nil {
+			return 0, false
+		}
+		switch {
+		case f1 < f2:
+			return -1, true
+		case f1 > f2:
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// likeMatch returns true if the given value matches the given SQL LIKE pattern.
+// The second returned value is false if the value is not a string.
+func likeMatch(val, pattern interface{}, insensitive bool) (bool, bool) {
+	str, ok := comparableValue(val).(string)
+	if !ok {
+		return false, false
+	}
+	patternStr, ok := pattern.(string)
+	if !ok {
+		return false, false
+	}
+	var sb strings.Builder
+	if insensitive {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteString("(?s)^")
+	var escaped bool
+	for _, r := range patternStr {
+		switch {
+		case escaped:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			sb.WriteString(".*")
+		case r == '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return false, false
+	}
+	return re.MatchString(str), true
+}
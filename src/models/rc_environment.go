@@ -14,10 +14,7 @@
 
 package models
 
-import (
-	"github.com/Pedro-lmso-erp/erp/src/models/security"
-	"github.com/Pedro-lmso-erp/erp/src/models/types"
-)
+import "github.com/Pedro-lmso-erp/erp/src/models/types"
 
 // WithEnv returns a copy of the current RecordCollection with the given Environment.
 func (rc *RecordCollection) WithEnv(env Environment) *RecordCollection {
@@ -47,11 +44,5 @@ func (rc *RecordCollection) WithNewContext(context *types.Context) *RecordCollec
 // Sudo returns a new RecordCollection with the given userId
 // or the superuser id if not specified
 func (rc *RecordCollection) Sudo(userId ...int64) *RecordCollection {
-	uid := security.SuperUserID
-	if len(userId) > 0 {
-		uid = userId[0]
-	}
-	newEnv := *rc.env
-	newEnv.uid = uid
-	return rc.WithEnv(newEnv)
+	return rc.WithEnv(rc.env.Sudo(userId...))
 }
@@ -19,7 +19,6 @@ import (
 	"reflect"
 	"time"
 
-	"github.com/Pedro-lmso-erp/erp/src/models/security"
 	"github.com/Pedro-lmso-erp/erp/src/tools/strutils"
 )
 
@@ -36,22 +35,22 @@ func (rc *RecordCollection) Call(methName string, args ...interface{}) interface
 // CallMulti calls the given method name methName on the given RecordCollection
 // with the given arguments and return the result as []interface{}.
 func (rc *RecordCollection) CallMulti(methName string, args ...interface{}) []interface{} {
-	log.Debug("Calling Recordset method", "model", rc.model.name, "method", methName, "ids", rc.ids, "args", strutils.TrimArgs(args))
 	if !rc.IsValid() {
 		panic(fmt.Errorf("you cannot call a method on an invalid RecordSet. Model: %s, Method: %s", rc.model.name, methName))
 	}
+	rc.env.Logger().Debug("Calling Recordset method", "model", rc.model.name, "method", methName, "ids", rc.ids, "args", strutils.TrimArgs(args))
 	rc.env.checkRecursion()
 	startTime := time.Now()
 	methInfo, ok := rc.model.methods.Get(methName)
 	if !ok {
-		log.Panic("Unknown method in model", "method", methName, "model", rc.model.name)
+		rc.env.Logger().Panic("Unknown method in model", "method", methName, "model", rc.model.name)
 	}
 
 	methLayer := methInfo.topLayer
 	if rc.env.super {
 		methLayer = methInfo.getNextLayer(rc.env.currentLayer)
 		if methLayer == nil {
-			log.Panic("Missing layer", "method", methName, "model", rc.model.name)
+			rc.env.Logger().Panic("Missing layer", "method", methName, "model", rc.model.name)
 		}
 	}
 
@@ -60,10 +59,18 @@ func (rc *RecordCollection) CallMulti(methName string, args ...interface{}) []in
 	rSet := rc.WithEnv(newEnv)
 	rSet.env.currentLayer = methLayer
 	rSet.env.recursions += 1
+	defer rSet.traceMethod(methName)()
 	if rc.env.currentLayer != nil && rc.env.currentLayer.method != methInfo {
 		rSet.env.previousMethod = rc.env.currentLayer.method
 	}
+	var webhooksAfter func([]interface{})
+	if !rc.env.super {
+		webhooksAfter = rSet.webhooksBefore(methInfo, args)
+	}
 	res := rSet.callMulti(methLayer, args...)
+	if webhooksAfter != nil {
+		webhooksAfter(res)
+	}
 	for i, r := range res {
 		switch r.(type) {
 		case RecordSet:
@@ -75,7 +82,7 @@ func (rc *RecordCollection) CallMulti(methName string, args ...interface{}) []in
 			}
 		}
 	}
-	log.Debug("Called Recordset method", "model", rc.ModelName(), "method", methName, "ids", rc.ids, "duration", time.Now().Sub(startTime), "args", strutils.TrimArgs(args))
+	rc.env.Logger().Debug("Called Recordset method", "model", rc.ModelName(), "method", methName, "ids", rc.ids, "duration", time.Now().Sub(startTime), "args", strutils.TrimArgs(args))
 	return res
 }
 
@@ -104,7 +111,7 @@ func (rc *RecordCollection) Super() *RecordCollection {
 func (rc *RecordCollection) MethodType(methName string) reflect.Type {
 	methInfo, ok := rc.model.methods.Get(methName)
 	if !ok {
-		log.Panic("Unknown method in model", "model", rc.model.name, "method", methName)
+		rc.logger().Panic("Unknown method in model", "model", rc.model.name, "method", methName)
 	}
 	return methInfo.methodType
 }
@@ -146,7 +153,7 @@ func (rc *RecordCollection) CheckExecutionPermission(method *Method, dontPanic .
 		// We are calling Super on the same method, so it's ok
 		return true
 	}
-	userGroups := security.Registry.UserGroups(rc.env.uid)
+	userGroups := rc.env.userGroups()
 	for group := range userGroups {
 		if method.groups[group] {
 			return true
@@ -165,9 +172,9 @@ func (rc *RecordCollection) CheckExecutionPermission(method *Method, dontPanic .
 	if caller != nil {
 		methodCaller = fmt.Sprintf("%s.%s()", caller.model.name, caller.name)
 	}
-	log.Panic("You are not allowed to execute this method", "model", rc.ModelName(),
-		"method", fmt.Sprintf("%s.%s()", method.model.name, method.name), "uid", rc.env.uid,
-		"methodCaller", methodCaller)
+	panicWithError(rc.env.Logger(), AccessError{Message: "You are not allowed to execute this method"},
+		"model", rc.ModelName(), "method", fmt.Sprintf("%s.%s()", method.model.name, method.name),
+		"uid", rc.env.uid, "methodCaller", methodCaller)
 	// Unreachable
 	return false
 }
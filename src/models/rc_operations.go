@@ -17,7 +17,7 @@ func (rc *RecordCollection) Union(other RecordSet) *RecordCollection {
 		return rc
 	}
 	if rc.ModelName() != other.ModelName() {
-		log.Panic("Unable to union RecordCollections of different models", "this", rc.ModelName(),
+		rc.logger().Panic("Unable to union RecordCollections of different models", "this", rc.ModelName(),
 			"other", other.ModelName())
 	}
 	rc.Fetch()
@@ -47,7 +47,7 @@ func (rc *RecordCollection) Subtract(other RecordSet) *RecordCollection {
 		return rc
 	}
 	if rc.ModelName() != other.ModelName() {
-		log.Panic("Unable to subtract RecordCollections of different models", "this", rc.ModelName(),
+		rc.logger().Panic("Unable to subtract RecordCollections of different models", "this", rc.ModelName(),
 			"other", other.ModelName())
 	}
 	rc.Fetch()
@@ -77,7 +77,7 @@ func (rc *RecordCollection) Intersect(other RecordSet) *RecordCollection {
 		return rc
 	}
 	if rc.ModelName() != other.ModelName() {
-		log.Panic("Unable to intersect RecordCollections of different models", "this", rc.ModelName(),
+		rc.logger().Panic("Unable to intersect RecordCollections of different models", "this", rc.ModelName(),
 			"other", other.ModelName())
 	}
 	rc.Fetch()
@@ -178,7 +178,7 @@ func (rc *RecordCollection) SortedByField(name FieldName, reverse bool) *RecordC
 	return rc.Sorted(func(rs1 RecordSet, rs2 RecordSet) bool {
 		lt, err := typesutils.IsLessThan(rs1.Collection().Get(name), rs2.Collection().Get(name))
 		if err != nil {
-			log.Panic("Unable to sort recordset", "recordset", rc, "error", err)
+			rc.logger().Panic("Unable to sort recordset", "recordset", rc, "error", err)
 		}
 		if reverse {
 			return !lt
@@ -204,5 +204,6 @@ func (rc *RecordCollection) Filtered(test func(rs RecordSet) bool) *RecordCollec
 		}
 		res = res.Union(rec)
 	}
+	res.prefetchRC = rc.prefetchSource()
 	return res
 }
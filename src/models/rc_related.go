@@ -147,7 +147,7 @@ func (rc *RecordCollection) substituteRelatedInPath(path FieldName) FieldName {
 // createRelatedRecord creates Records at the given path, starting from this recordset.
 // This method does not check whether such a records already exists or not.
 func (rc *RecordCollection) createRelatedRecord(path FieldName, vals RecordData) *RecordCollection {
-	log.Debug("Creating related record", "recordset", rc, "path", path, "vals", vals)
+	rc.logger().Debug("Creating related record", "recordset", rc, "path", path, "vals", vals)
 	rc.EnsureOne()
 	fi := rc.model.getRelatedFieldInfo(path)
 	exprs := splitFieldNames(path, ExprSep)
@@ -161,7 +161,8 @@ func (rc *RecordCollection) createRelatedRecord(path FieldName, vals RecordData)
 		if len(exprs) > 1 {
 			target = rc.Get(joinFieldNames(exprs[:len(exprs)-1], ExprSep)).(RecordSet).Collection()
 			if target.IsEmpty() {
-				log.Panic("Target record does not exist", "recordset", rc, "path", joinFieldNames(exprs[:len(exprs)-1], ExprSep))
+				panicWithError(rc.env.Logger(), NotFoundError{Message: "Target record does not exist"},
+					"recordset", rc, "path", joinFieldNames(exprs[:len(exprs)-1], ExprSep))
 			}
 			target = target.Records()[0]
 		}
@@ -18,31 +18,108 @@ import "github.com/Pedro-lmso-erp/erp/src/models/security"
 
 // addRecordRuleConditions adds the RecordRule conditions on the query of this
 // RecordSet for the user with the given uid and for the given perm Permission.
+//
+// Only rules that apply to whole records are taken into account.
 func (rc *RecordCollection) addRecordRuleConditions(uid int64, perm security.Permission) *RecordCollection {
 	if rc.filtered {
 		return rc
 	}
 	rSet := rc
+	userGroups := security.Registry.UserGroups(uid)
+	if uid == rc.env.uid {
+		userGroups = rc.env.userGroups()
+	}
+	if cond, ok := rc.model.recordRulesCondition(userGroups, perm, nil); ok {
+		rSet = rSet.Search(cond)
+	}
+	rSet.filtered = true
+	*rc = *rSet
+	return rc
+}
+
+// recordRulesCondition returns the condition that records of this model must
+// match for a user belonging to userGroups to be granted the perm Permission.
+//
+// If field is nil, only rules that apply to whole records are taken into account.
+// Otherwise, only rules restricting the given field are taken into account.
+//
+// Global rules must all be matched, whereas matching one of the rules of the
+// user's groups is enough. Rules without condition are ignored.
+// The second returned value is false if no rule restricts the records.
+func (m *Model) recordRulesCondition(userGroups map[*security.Group]security.InheritanceInfo, perm security.Permission, field FieldName) (*Condition, bool) {
+	m.rulesRegistry.RLock()
+	defer m.rulesRegistry.RUnlock()
+	applies := func(rule *RecordRule) bool {
+		if perm&rule.Perms == 0 {
+			return false
+		}
+		if field == nil {
+			return len(rule.Fields) == 0
+		}
+		for _, f := range rule.Fields {
+			if f.JSON() == field.JSON() {
+				return true
+			}
+		}
+		return false
+	}
+	cond := newCondition()
 	// Add global rules
-	for _, rule := range rSet.model.rulesRegistry.globalRules {
-		if perm&rule.Perms > 0 {
-			rSet = rSet.Search(rule.Condition)
+	for _, rule := range m.rulesRegistry.globalRules {
+		if applies(rule) {
+			cond = cond.AndCond(rule.Condition)
 		}
 	}
 	// Add groups rules
-	userGroups := security.Registry.UserGroups(uid)
 	groupCondition := newCondition()
 	for group := range userGroups {
-		for _, rule := range rSet.model.rulesRegistry.rulesByGroup[group.ID()] {
-			if perm&rule.Perms > 0 {
+		for _, rule := range m.rulesRegistry.rulesByGroup[group.ID()] {
+			if applies(rule) {
 				groupCondition = groupCondition.OrCond(rule.Condition)
 			}
 		}
 	}
-	if !groupCondition.IsEmpty() {
-		rSet = rSet.Search(groupCondition)
+	cond = cond.AndCond(groupCondition)
+	return cond, !cond.IsEmpty()
+}
+
+// checkRecordRules panics if some records of this RecordCollection do not match
+// the rules granting the perm Permission on whole records to the current user.
+//
+// Records of this RecordCollection must exist in the database, typically because
+// they have just been created in the current transaction.
+func (rc *RecordCollection) checkRecordRules(perm security.Permission) {
+	rc.checkRecordRulesOnField(perm, nil)
+}
+
+// checkFieldsRecordRules panics if some records of this RecordCollection do not
+// match the rules restricting the writing of one of the given fields for the
+// current user.
+func (rc *RecordCollection) checkFieldsRecordRules(fields FieldNames) {
+	for _, field := range fields {
+		rc.checkRecordRulesOnField(security.Write, field)
 	}
-	rSet.filtered = true
-	*rc = *rSet
-	return rc
+}
+
+// checkRecordRulesOnField panics if some records of this RecordCollection do not
+// match the rules granting the perm Permission on the given field to the current
+// user. If field is nil, the rules on whole records are checked.
+func (rc *RecordCollection) checkRecordRulesOnField(perm security.Permission, field FieldName) {
+	if rc.hasNegIds || len(rc.ids) == 0 {
+		return
+	}
+	cond, ok := rc.model.recordRulesCondition(rc.env.userGroups(), perm, field)
+	if !ok {
+		return
+	}
+	allowed := newRecordCollection(rc.Env(), rc.ModelName()).withIds(rc.ids).Search(cond).SearchCount()
+	if allowed == len(rc.ids) {
+		return
+	}
+	fieldName := "*"
+	if field != nil {
+		fieldName = field.Name()
+	}
+	panicWithError(rc.env.Logger(), AccessError{Message: "You are not allowed to access these records"},
+		"model", rc.ModelName(), "ids", rc.ids, "uid", rc.env.uid, "permission", perm, "field", fieldName)
 }
@@ -25,6 +25,7 @@ import (
 	"github.com/Pedro-lmso-erp/erp/src/models/fieldtype"
 	"github.com/Pedro-lmso-erp/erp/src/models/security"
 	"github.com/Pedro-lmso-erp/erp/src/models/types/dates"
+	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -35,10 +36,13 @@ type RecordCollection struct {
 	query      *Query
 	env        *Environment
 	prefetchRC *RecordCollection
-	ids        []int64
-	fetched    bool
-	filtered   bool
-	hasNegIds  bool
+	// prefetchData is the data computed for the records
+	// which have this RecordCollection as prefetch set.
+	prefetchData *prefetchData
+	ids          []int64
+	fetched      bool
+	filtered     bool
+	hasNegIds    bool
 }
 
 // Scan implements sql.Scanner
@@ -107,6 +111,16 @@ func (rc *RecordCollection) Env() Environment {
 	return res
 }
 
+// logger returns the logger of the Environment of this RecordSet, which
+// adds the request ID to the messages, or the package logger if this
+// RecordSet has no Environment.
+func (rc *RecordCollection) logger() logging.Logger {
+	if rc.env == nil {
+		return log
+	}
+	return rc.env.Logger()
+}
+
 // ModelName returns the model name of the RecordSet
 func (rc *RecordCollection) ModelName() string {
 	return rc.model.name
@@ -185,6 +199,8 @@ func (rc *RecordCollection) create(data RecordData) *RecordCollection {
 	rSet.processInverseMethods(data)
 	rSet.processTriggers(fMap.FieldNames(rSet.model))
 	rSet.CheckConstraints(data.Underlying().FieldNames())
+	// check that the user is allowed to create this record
+	rSet.checkRecordRules(security.Create)
 	return rSet
 }
 
@@ -373,6 +389,7 @@ func (rc *RecordCollection) update(data RecordData) bool {
 	if !rc.hasNegIds && rc.ForceLoad(ID).IsEmpty() {
 		return true
 	}
+	rc.checkFieldsRecordRules(data.Underlying().FieldNames())
 	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Write)
 	// process create data for FK relations if any
 	data = rc.createFKRelationRecords(data)
@@ -435,7 +452,7 @@ func (rc *RecordCollection) filterMapOnStoredFields(fMap FieldMap) FieldMap {
 func (rc *RecordCollection) doUpdate(fMap FieldMap) {
 	rc.CheckExecutionPermission(rc.model.methods.MustGet("Write"))
 	if rc.IsEmpty() {
-		log.Panic("Trying to update an empty RecordSet", "model", rc.ModelName(), "values", fMap)
+		rc.logger().Panic("Trying to update an empty RecordSet", "model", rc.ModelName(), "values", fMap)
 	}
 	defer func() {
 		if r := recover(); r != nil {
@@ -455,7 +472,7 @@ func (rc *RecordCollection) doUpdate(fMap FieldMap) {
 		query, args := rc.query.updateQuery(fMap)
 		res := rc.env.cr.Execute(query, args...)
 		if num, _ := res.RowsAffected(); num == 0 {
-			log.Panic("Unexpected noop on update (num = 0)", "model", rc.ModelName(), "values", fMap, "query", query, "args", args)
+			rc.logger().Panic("Unexpected noop on update (num = 0)", "model", rc.ModelName(), "values", fMap, "query", query, "args", args)
 		}
 	}
 	for _, rec := range rc.Records() {
@@ -476,7 +493,7 @@ func (rc *RecordCollection) updateRelationFields(fMap FieldMap) {
 			// We take only the first record since updating all records
 			// will override each other
 			if rc.Len() > 1 {
-				log.Warn("Updating one2many relation on multiple record at once", "model", rc.ModelName(), "field", field)
+				rc.logger().Warn("Updating one2many relation on multiple record at once", "model", rc.ModelName(), "field", field)
 			}
 			curRS := rc.env.Pool(fi.relatedModelName).Search(fi.relatedModel.Field(ID).In(rc.Get(rc.model.FieldName(fi.name)).(RecordSet).Collection()))
 			newRS := rc.env.Pool(fi.relatedModelName).Search(fi.relatedModel.Field(ID).In(value.([]int64)))
@@ -801,17 +818,17 @@ func (rc *RecordCollection) ForceLoad(fieldNames ...FieldName) *RecordCollection
 		return rc
 	}
 	if rc.hasNegIds {
-		log.Panic("Trying to load a memory RecordSet created by New", "model", rc.model, "ids", rc.ids)
+		rc.logger().Panic("Trying to load a memory RecordSet created by New", "model", rc.model, "ids", rc.ids)
 	}
 	if len(rc.query.groups) > 0 {
-		log.Panic("Trying to load a grouped query", "model", rc.model, "groups", rc.query.groups)
+		rc.logger().Panic("Trying to load a grouped query", "model", rc.model, "groups", rc.query.groups)
 	}
 	rSet := rc
 	var prefetch bool
-	if !rc.prefetchRC.IsEmpty() && len(rc.ids) > 0 {
+	if rc.prefetchRC != nil && len(rc.prefetchRC.ids) > 0 && len(rc.ids) > 0 && !rc.hasNegIds {
 		// We have a prefetch recordSet and our ids are already fetched
 		prefetch = true
-		rSet = rc.Union(rc.prefetchRC).WithEnv(rc.Env())
+		rSet = rc.prefetchBatch(fieldNames)
 	}
 	rSet = rSet.addRecordRuleConditions(rc.env.uid, security.Read)
 	rSet.applyDefaultOrder()
@@ -827,14 +844,14 @@ func (rc *RecordCollection) ForceLoad(fieldNames ...FieldName) *RecordCollection
 	rSet = rSet.substituteRelatedInQuery()
 	dbFields := filterOnDBFields(rSet.model, subFields)
 	query, args, substs := rSet.query.selectQuery(dbFields)
-	rows := dbQuery(rSet.env.cr.tx, query, args...)
+	rows := rSet.env.cr.query(query, args...)
 	defer rows.Close()
 	var ids []int64
 	for rows.Next() {
 		line := make(FieldMap)
 		err := rSet.model.scanToFieldMap(rows, &line, substs)
 		if err != nil {
-			log.Panic(err.Error(), "model", rSet.ModelName(), "fields", fields)
+			rSet.logger().Panic(err.Error(), "model", rSet.ModelName(), "fields", fields)
 		}
 		rSet.env.cache.addRecord(rSet.model, line["id"].(int64), line, rc.query.ctxArgsSlug())
 		ids = append(ids, line["id"].(int64))
@@ -843,7 +860,9 @@ func (rc *RecordCollection) ForceLoad(fieldNames ...FieldName) *RecordCollection
 	rSet = rSet.withIds(ids)
 	rSet.loadRelationFields(subFields)
 	if prefetch {
+		prefetchRC := rc.prefetchRC
 		*rc = *rSet.Intersect(rc).WithEnv(rc.Env())
+		rc.prefetchRC = prefetchRC
 		return rc
 	}
 	return rSet
@@ -962,7 +981,11 @@ func (rc *RecordCollection) Get(fieldName FieldName) interface{} {
 	}
 
 	if fi.isRelationField() {
-		res = rc.convertToRecordSet(res, fi.relatedModelName)
+		relRC := rc.convertToRecordSet(res, fi.relatedModelName)
+		if !fi.isComputedField() && !fi.isRelatedField() {
+			relRC.prefetchRC = rc.relatedPrefetch(fieldName, fi.relatedModelName)
+		}
+		res = relRC
 	}
 	return res
 }
@@ -975,7 +998,7 @@ func (rc *RecordCollection) convertToRecordSet(val interface{}, relatedModelName
 	}
 	res := newRecordCollection(rc.Env(), relatedModelName)
 	if err := res.Scan(val); err != nil {
-		log.Panic("Error while converting to RecordSet", "error", err)
+		rc.logger().Panic("Error while converting to RecordSet", "error", err)
 	}
 	return res
 }
@@ -1051,7 +1074,7 @@ func (rc *RecordCollection) All() []*ModelData {
 // Aggregates returns the result of this RecordCollection query, which must by a grouped query.
 func (rc *RecordCollection) Aggregates(fieldNames ...FieldName) []GroupAggregateRow {
 	if len(rc.query.groups) == 0 {
-		log.Panic("Trying to get aggregates of a non-grouped query", "model", rc.model)
+		rc.logger().Panic("Trying to get aggregates of a non-grouped query", "model", rc.model)
 	}
 	groups := make([]FieldName, len(rc.query.groups))
 	copy(groups, rc.query.groups)
@@ -1067,14 +1090,14 @@ func (rc *RecordCollection) Aggregates(fieldNames ...FieldName) []GroupAggregate
 
 	query, args := rSet.query.selectGroupQuery(rSet.fieldsGroupOperators(dbFields))
 	var res []GroupAggregateRow
-	rows := dbQuery(rSet.env.cr.tx, query, args...)
+	rows := rSet.env.cr.query(query, args...)
 	defer rows.Close()
 
 	for rows.Next() {
 		vals := make(FieldMap)
 		err := sqlx.MapScan(rows, vals)
 		if err != nil {
-			log.Panic(err.Error(), "model", rSet.ModelName(), "fields", fields)
+			rSet.logger().Panic(err.Error(), "model", rSet.ModelName(), "fields", fields)
 		}
 		cnt := vals["__count"].(int64)
 		delete(vals, "__count")
@@ -1171,7 +1194,7 @@ func (rc *RecordCollection) Records() []*RecordCollection {
 	for i, id := range rc.Ids() {
 		newRC := newRecordCollection(rc.Env(), rc.ModelName())
 		res[i] = newRC.withIds([]int64{id})
-		res[i].prefetchRC = rc
+		res[i].prefetchRC = rc.prefetchSource()
 	}
 	return res
 }
@@ -1179,7 +1202,7 @@ func (rc *RecordCollection) Records() []*RecordCollection {
 // EnsureOne panics if rc is not a singleton
 func (rc *RecordCollection) EnsureOne() {
 	if rc.Len() != 1 {
-		log.Panic("Expected singleton", "model", rc.ModelName(), "received", rc)
+		rc.logger().Panic("Expected singleton", "model", rc.ModelName(), "received", rc)
 	}
 }
 
@@ -1225,7 +1248,8 @@ func (rc *RecordCollection) Model() *Model {
 func (rc *RecordCollection) GetRecord(externalID string) *RecordCollection {
 	res := rc.Search(rc.model.Field(rc.model.FieldName("erpExternalID")).Equals(externalID))
 	if res.IsEmpty() {
-		log.Panic("Unknown external ID", "model", rc.model.name, "externalID", externalID)
+		panicWithError(rc.env.Logger(), NotFoundError{Message: "Unknown external ID"},
+			"model", rc.model.name, "externalID", externalID)
 	}
 	return res
 }
@@ -17,6 +17,7 @@ package models
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -66,6 +67,20 @@ func (mc *modelCollection) MustGet(nameOrJSON string) *Model {
 	return mi
 }
 
+// All returns all the models of the registry sorted by name
+func (mc *modelCollection) All() []*Model {
+	mc.RLock()
+	defer mc.RUnlock()
+	res := make([]*Model, 0, len(mc.registryByName))
+	for _, mi := range mc.registryByName {
+		res = append(res, mi)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+	return res
+}
+
 // GetSequence the given Sequence by name or by db name
 func (mc *modelCollection) GetSequence(nameOrJSON string) (s *Sequence, ok bool) {
 	s, ok = mc.sequences[nameOrJSON]
@@ -324,6 +339,13 @@ func (m *Model) IsTransient() bool {
 	return m.options == TransientModel
 }
 
+// IsExposed returns true if this Model can be accessed directly by clients,
+// e.g. through the REST API. Mixins and system models such as many2many
+// link models are not exposed.
+func (m *Model) IsExposed() bool {
+	return !m.IsMixin() && !m.isSystem()
+}
+
 // hasParentField returns true if this model is recursive and has a Parent field.
 func (m *Model) hasParentField() bool {
 	_, parentExists := m.fields.Get("Parent")
@@ -0,0 +1,370 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"errors"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/fieldtype"
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+	"github.com/Pedro-lmso-erp/erp/src/models/types/dates"
+	"github.com/Pedro-lmso-erp/erp/src/tools/cron"
+)
+
+const (
+	// ScheduledJobModel is the name of the model that stores
+	// the scheduled jobs and their run times.
+	ScheduledJobModel = "ScheduledJob"
+	// scheduledJobsPeriod is the period of the worker that runs due jobs
+	scheduledJobsPeriod = 15 * time.Second
+	// maxCatchUpRuns is the maximum number of missed runs of a job
+	// executed in a row with the CatchUpAll policy.
+	maxCatchUpRuns = 100
+)
+
+// A CatchUpPolicy defines how the runs of a scheduled job that have been
+// missed, e.g. because no server was running, are handled.
+type CatchUpPolicy string
+
+// Available catch-up policies
+const (
+	// CatchUpSkip skips the missed runs. The job runs again at its next
+	// scheduled time.
+	CatchUpSkip CatchUpPolicy = "skip"
+	// CatchUpOnce executes the missed runs as a single run.
+	CatchUpOnce CatchUpPolicy = "once"
+	// CatchUpAll executes all the missed runs one after the other.
+	CatchUpAll CatchUpPolicy = "all"
+)
+
+// catchUpPolicies is the selection of the CatchUp field of scheduled jobs
+var catchUpPolicies = types.Selection{
+	string(CatchUpSkip): "Skip missed runs",
+	string(CatchUpOnce): "Run once",
+	string(CatchUpAll):  "Run all missed runs",
+}
+
+// A ScheduledJob is a function defined in code that runs on a cron schedule.
+//
+// Scheduled jobs can also be defined in data files as records of the
+// ScheduledJobModel with a Model and a Method to call instead of a Function.
+type ScheduledJob struct {
+	// Name uniquely identifies the job
+	Name string
+	// Schedule is the cron expression of the job (see the cron package)
+	Schedule string
+	// CatchUp is the policy for missed runs. Defaults to CatchUpOnce.
+	CatchUp CatchUpPolicy
+	// Function is executed with superuser rights at each run of the job
+	Function func(Environment)
+}
+
+// A ScheduledJobRegistry holds the scheduled jobs defined in code
+type ScheduledJobRegistry struct {
+	sync.RWMutex
+	jobs map[string]*ScheduledJob
+	// synced is false when the jobs have changed since the
+	// last synchronization with the database.
+	synced bool
+}
+
+// ScheduledJobs is the registry of the scheduled jobs defined in code.
+//
+// Jobs are stored in the database with their next run time and run by a
+// single server of the cluster at each tick. They can be enabled or
+// disabled at runtime with the Active field of their record (see
+// SetScheduledJobActive).
+var ScheduledJobs = &ScheduledJobRegistry{
+	jobs: make(map[string]*ScheduledJob),
+}
+
+// Register adds the given job to this registry.
+// It panics if the job is invalid or if a job with the same name exists.
+func (sr *ScheduledJobRegistry) Register(job *ScheduledJob) {
+	if job.Name == "" || job.Function == nil {
+		log.Panic("Scheduled jobs must have a name and a function", "job", job.Name)
+	}
+	if _, err := cron.Parse(job.Schedule); err != nil {
+		log.Panic("Invalid schedule for scheduled job", "job", job.Name, "error", err)
+	}
+	if job.CatchUp == "" {
+		job.CatchUp = CatchUpOnce
+	}
+	if _, ok := catchUpPolicies[string(job.CatchUp)]; !ok {
+		log.Panic("Unknown catch-up policy for scheduled job", "job", job.Name, "policy", job.CatchUp)
+	}
+	sr.Lock()
+	defer sr.Unlock()
+	if _, exists := sr.jobs[job.Name]; exists {
+		log.Panic("Scheduled job already registered", "job", job.Name)
+	}
+	sr.jobs[job.Name] = job
+	sr.synced = false
+}
+
+// Unregister removes the job with the given name from this registry.
+// Its record is kept in the database but it is not run anymore.
+func (sr *ScheduledJobRegistry) Unregister(name string) {
+	sr.Lock()
+	defer sr.Unlock()
+	delete(sr.jobs, name)
+}
+
+// Get returns the job with the given name
+func (sr *ScheduledJobRegistry) Get(name string) (*ScheduledJob, bool) {
+	sr.RLock()
+	defer sr.RUnlock()
+	job, ok := sr.jobs[name]
+	return job, ok
+}
+
+// SetScheduledJobActive enables or disables the scheduled job with the given
+// name. A disabled job is not run until it is enabled again, at which point
+// its missed runs are handled according to its catch-up policy.
+func SetScheduledJobActive(env Environment, name string, active bool) {
+	job := scheduledJobRecord(env.Sudo(), name)
+	if job.IsEmpty() {
+		log.Panic("Unknown scheduled job", "job", name)
+	}
+	job.Call("Write", NewModelData(job.model, FieldMap{"Active": active}))
+}
+
+// scheduledJobRecord returns the record of the scheduled job with the given name
+func scheduledJobRecord(env Environment, name string) *RecordCollection {
+	jobs := env.Pool(ScheduledJobModel)
+	return jobs.Search(jobs.model.Field(jobs.model.FieldName("Name")).Equals(name)).Limit(1)
+}
+
+// RunScheduledJobs runs the scheduled jobs that are due. It is called
+// periodically by the core worker loop of each server of the cluster.
+//
+// Each job is run in its own transaction that first claims the record of
+// the job with a row lock, so that a job runs on a single server at each
+// tick. A server whose snapshot predates the last run of the job by another
+// server fails to claim the record with a serialization error and retries
+// the transaction, which then sees that the job is not due anymore.
+func RunScheduledJobs() {
+	syncScheduledJobs()
+	var names []string
+	err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		env.Cr().Select(&names, `SELECT name FROM scheduled_job WHERE active = ? AND (next_run IS NULL OR next_run <= ?) ORDER BY next_run`,
+			true, dates.Now())
+	})
+	if err != nil {
+		log.Warn("Unable to get due scheduled jobs", "error", err)
+		return
+	}
+	for _, name := range names {
+		for i := 0; i < maxCatchUpRuns && runScheduledJob(name); i++ {
+		}
+	}
+}
+
+// syncScheduledJobs creates or updates the records of the jobs
+// defined in code if they have changed since the last call.
+func syncScheduledJobs() {
+	ScheduledJobs.RLock()
+	if ScheduledJobs.synced {
+		ScheduledJobs.RUnlock()
+		return
+	}
+	jobs := make([]ScheduledJob, 0, len(ScheduledJobs.jobs))
+	for _, job := range ScheduledJobs.jobs {
+		jobs = append(jobs, *job)
+	}
+	ScheduledJobs.RUnlock()
+	var synced bool
+	err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		if !tryAdvisoryLock(env, "scheduled_jobs_sync") {
+			return
+		}
+		model := Registry.MustGet(ScheduledJobModel)
+		for _, job := range jobs {
+			rec := scheduledJobRecord(env, job.Name)
+			if rec.IsEmpty() {
+				env.Pool(ScheduledJobModel).Call("Create", NewModelData(model, FieldMap{
+					"Name":     job.Name,
+					"Schedule": job.Schedule,
+					"CatchUp":  string(job.CatchUp),
+					"Active":   true,
+				}))
+				continue
+			}
+			if rec.Get(model.FieldName("Schedule")).(string) == job.Schedule &&
+				rec.Get(model.FieldName("CatchUp")).(string) == string(job.CatchUp) {
+				continue
+			}
+			rec.Call("Write", NewModelData(model, FieldMap{
+				"Schedule": job.Schedule,
+				"CatchUp":  string(job.CatchUp),
+				"NextRun":  dates.DateTime{},
+			}))
+		}
+		synced = true
+	})
+	if err != nil {
+		log.Warn("Unable to synchronize scheduled jobs", "error", err)
+		return
+	}
+	if synced {
+		ScheduledJobs.Lock()
+		ScheduledJobs.synced = true
+		ScheduledJobs.Unlock()
+	}
+}
+
+// runScheduledJob runs the scheduled job with the given name if it is due
+// and not being run by another server. It returns true if the job has run
+// and is still due, i.e. if it has other missed runs to catch up.
+func runScheduledJob(name string) bool {
+	var again bool
+	err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		job := claimScheduledJob(env, name)
+		model := job.model
+		if job.IsEmpty() || !job.Get(model.FieldName("Active")).(bool) {
+			return
+		}
+		now := time.Now()
+		schedule, err := cron.Parse(job.Get(model.FieldName("Schedule")).(string))
+		if err != nil {
+			log.Warn("Disabling scheduled job with invalid schedule", "job", name, "error", err)
+			job.Call("Write", NewModelData(model, FieldMap{"Active": false, "LastError": err.Error()}))
+			return
+		}
+		nextRun := job.Get(model.FieldName("NextRun")).(dates.DateTime)
+		if nextRun.IsZero() {
+			// First scheduling of the job
+			job.Call("Write", NewModelData(model, FieldMap{"NextRun": nextRunTime(schedule, now)}))
+			return
+		}
+		if nextRun.Time.After(now) {
+			// Already run by another server
+			return
+		}
+		due := nextRun.Time.In(time.Local)
+		missed := !schedule.Next(due).After(now)
+		policy := CatchUpPolicy(job.Get(model.FieldName("CatchUp")).(string))
+		if missed && policy == CatchUpSkip {
+			log.Info("Skipping missed runs of scheduled job", "job", name, "due", due)
+			job.Call("Write", NewModelData(model, FieldMap{"NextRun": nextRunTime(schedule, now)}))
+			return
+		}
+		values := executeScheduledJob(env, job)
+		switch policy {
+		case CatchUpAll:
+			next := nextRunTime(schedule, due)
+			values["NextRun"] = next
+			again = !next.IsZero() && !next.Time.After(now)
+		default:
+			values["NextRun"] = nextRunTime(schedule, now)
+		}
+		if values["NextRun"].(dates.DateTime).IsZero() {
+			values["Active"] = false
+			values["LastError"] = "the schedule has no next run time"
+		}
+		job.Call("Write", NewModelData(model, values))
+	})
+	if err != nil {
+		log.Warn("Error while running scheduled job", "job", name, "error", err)
+		return false
+	}
+	return again
+}
+
+// claimScheduledJob returns the record of the scheduled job with the given
+// name and locks it until the end of the transaction. It returns an empty
+// RecordSet if the record is locked by another transaction.
+func claimScheduledJob(env Environment, name string) *RecordCollection {
+	var res []int64
+	env.Cr().Select(&res, `SELECT id FROM scheduled_job WHERE name = ? FOR UPDATE SKIP LOCKED`, name)
+	return env.Pool(ScheduledJobModel).Call("Browse", res).(RecordSet).Collection()
+}
+
+// executeScheduledJob executes the function of the given job record within
+// a savepoint and returns the values of the record to update with the result.
+func executeScheduledJob(env Environment, job *RecordCollection) FieldMap {
+	model := job.model
+	name := job.Get(model.FieldName("Name")).(string)
+	var fnct func(Environment)
+	if codeJob, ok := ScheduledJobs.Get(name); ok {
+		fnct = codeJob.Function
+	} else if modelName := job.Get(model.FieldName("Model")).(string); modelName != "" {
+		methodName := job.Get(model.FieldName("Method")).(string)
+		fnct = func(env Environment) {
+			env.Pool(modelName).Call(methodName)
+		}
+	}
+	start := time.Now()
+	var err error
+	if fnct == nil {
+		err = errors.New("the scheduled job has no function nor model method")
+	} else {
+		err = ExecuteInSavepoint(env, fnct)
+	}
+	values := FieldMap{
+		"LastRun":      dates.DateTime{Time: start.UTC()},
+		"LastDuration": time.Now().Sub(start).Seconds(),
+		"LastError":    "",
+	}
+	if err != nil {
+		log.Warn("Scheduled job failed", "job", name, "error", err)
+		values["LastError"] = err.Error()
+	}
+	return values
+}
+
+// nextRunTime returns the first run time of the given schedule after t
+func nextRunTime(schedule *cron.Schedule, t time.Time) dates.DateTime {
+	next := schedule.Next(t.In(time.Local))
+	if next.IsZero() {
+		return dates.DateTime{}
+	}
+	return dates.DateTime{Time: next.UTC()}
+}
+
+// tryAdvisoryLock tries to acquire the advisory lock with the given name
+// until the end of the transaction of env. It returns true on success and
+// false if the lock is held by another transaction.
+func tryAdvisoryLock(env Environment, name string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	var res bool
+	env.Cr().Get(&res, adapters[db.DriverName()].tryAdvisoryLockQuery(), int64(h.Sum64()))
+	return res
+}
+
+// declareScheduledJobModel creates the system model that stores the scheduled jobs
+func declareScheduledJobModel() {
+	model := getOrCreateModel(ScheduledJobModel, SystemModel)
+	model.InheritModel(Registry.MustGet("BaseMixin"))
+	for _, fi := range []*Field{
+		{name: "Name", json: "name", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")},
+			required: true, unique: true, index: true},
+		{name: "Schedule", json: "schedule", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")},
+			required: true},
+		{name: "Model", json: "model", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "Method", json: "method", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "CatchUp", json: "catch_up", fieldType: fieldtype.Selection, structField: reflect.StructField{Type: reflect.TypeOf("")},
+			selection: catchUpPolicies, required: true, defaultFunc: DefaultValue(string(CatchUpOnce))},
+		{name: "Active", json: "active", fieldType: fieldtype.Boolean, structField: reflect.StructField{Type: reflect.TypeOf(true)},
+			defaultFunc: DefaultValue(true)},
+		{name: "NextRun", json: "next_run", fieldType: fieldtype.DateTime,
+			structField: reflect.StructField{Type: reflect.TypeOf(dates.DateTime{})}, index: true},
+		{name: "LastRun", json: "last_run", fieldType: fieldtype.DateTime,
+			structField: reflect.StructField{Type: reflect.TypeOf(dates.DateTime{})}},
+		{name: "LastDuration", json: "last_duration", fieldType: fieldtype.Float,
+			structField: reflect.StructField{Type: reflect.TypeOf(float64(0))}},
+		{name: "LastError", json: "last_error", fieldType: fieldtype.Text, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+	} {
+		fi.model = model
+		fi.description = fi.name
+		fi.noCopy = true
+		model.fields.add(fi)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package security
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/password"
+)
+
+const (
+	// APIKeyPrefix is the prefix of all API keys, making them easy
+	// to recognize (e.g. by secret scanners).
+	APIKeyPrefix    = "erp_"
+	apiKeyIDLen     = 8
+	apiKeySecretLen = 32
+)
+
+// ErrAPIKeyExpired is returned when authenticating with an expired API key
+var ErrAPIKeyExpired = errors.New("API key expired")
+
+// An APIKey grants access to the application on behalf of a user
+// without a password, typically for scripts and third party services.
+//
+// Only the hash of the secret part of the key is stored.
+type APIKey struct {
+	// ID is the public identifier of the key
+	ID string
+	// UID is the id of the user on behalf of whom the key acts
+	UID  int64
+	Name string
+	Hash string
+	// Groups are the IDs of the groups the key is restricted to.
+	// The key has all the groups of its user if Groups is empty.
+	Groups []string
+	// ExpiresAt is the expiry time of the key. The key never expires if it is zero.
+	ExpiresAt time.Time
+	LastUsed  time.Time
+}
+
+// Expired returns true if this APIKey is expired at the given time.
+func (k *APIKey) Expired(t time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !t.Before(k.ExpiresAt)
+}
+
+// Scope returns the groups this APIKey is restricted to, or
+// nil if the key has all the groups of its user.
+//
+// Groups that are not registered anymore are ignored, so that
+// a key scoped only to deleted groups gets no group at all.
+func (k *APIKey) Scope() []*Group {
+	if len(k.Groups) == 0 {
+		return nil
+	}
+	res := []*Group{GroupEveryone}
+	for _, groupID := range k.Groups {
+		if group := Registry.GetGroup(groupID); group != nil {
+			res = append(res, group)
+		}
+	}
+	return res
+}
+
+// An APIKeyStore persists API keys. It is typically implemented
+// by the module defining the User model.
+type APIKeyStore interface {
+	// APIKey returns the API key with the given ID and
+	// false if no such key exists.
+	APIKey(id string) (*APIKey, bool)
+	// UserAPIKeys returns all the API keys of the user with the given uid
+	UserAPIKeys(uid int64) []*APIKey
+	// SaveAPIKey creates or updates the given key
+	SaveAPIKey(key *APIKey) error
+	// DeleteAPIKey deletes the API key with the given ID
+	DeleteAPIKey(id string) error
+}
+
+// An APIKeyManager generates and verifies API keys stored in an APIKeyStore.
+type APIKeyManager struct {
+	store APIKeyStore
+	now   func() time.Time
+}
+
+// NewAPIKeyManager returns a new APIKeyManager storing keys in the given store.
+func NewAPIKeyManager(store APIKeyStore) *APIKeyManager {
+	return &APIKeyManager{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// Generate creates a new API key for the user with the given uid, restricted
+// to the given groups (or all the user's groups if none is given) and valid
+// until expiresAt (or forever if expiresAt is zero).
+//
+// It returns the token to hand over to the user, which is not stored and
+// cannot be retrieved afterwards, and the created APIKey.
+func (m *APIKeyManager) Generate(uid int64, name string, expiresAt time.Time, groups ...*Group) (string, *APIKey, error) {
+	idBytes := make([]byte, apiKeyIDLen)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	secretBytes := make([]byte, apiKeySecretLen)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", nil, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	hash, err := password.Hash(secret)
+	if err != nil {
+		return "", nil, err
+	}
+	key := &APIKey{
+		ID:        hex.EncodeToString(idBytes),
+		UID:       uid,
+		Name:      name,
+		Hash:      hash,
+		ExpiresAt: expiresAt,
+	}
+	for _, group := range groups {
+		key.Groups = append(key.Groups, group.ID())
+	}
+	if err = m.store.SaveAPIKey(key); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("%s%s.%s", APIKeyPrefix, key.ID, secret), key, nil
+}
+
+// Verify checks the given token and returns the matching APIKey.
+// The LastUsed time of the key is updated on success.
+//
+// It returns an InvalidCredentialsError if the token is not valid
+// and ErrAPIKeyExpired if the key is expired.
+func (m *APIKeyManager) Verify(token string) (*APIKey, error) {
+	id, secret, ok := splitAPIKey(token)
+	if !ok {
+		return nil, InvalidCredentialsError("<API key>")
+	}
+	key, ok := m.store.APIKey(id)
+	if !ok || password.Verify(secret, key.Hash) != nil {
+		return nil, InvalidCredentialsError(fmt.Sprintf("<API key %s>", id))
+	}
+	now := m.now()
+	if key.Expired(now) {
+		return nil, ErrAPIKeyExpired
+	}
+	key.LastUsed = now
+	if err := m.store.SaveAPIKey(key); err != nil {
+		log.Warn("Unable to update API key last used time", "id", id, "error", err)
+	}
+	return key, nil
+}
+
+// Revoke deletes the API key with the given ID
+func (m *APIKeyManager) Revoke(id string) error {
+	return m.store.DeleteAPIKey(id)
+}
+
+// splitAPIKey returns the ID and the secret of the given token
+func splitAPIKey(token string) (string, string, bool) {
+	if !strings.HasPrefix(token, APIKeyPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, APIKeyPrefix), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
@@ -16,6 +16,7 @@ package security
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/Pedro-lmso-erp/erp/src/models/types"
 )
@@ -40,6 +41,21 @@ func (ice InvalidCredentialsError) Error() string {
 	return fmt.Sprintf("Wrong credentials for user %s", string(ice))
 }
 
+// A SecondFactorPendingError is returned by AuthBackendRegistry.Authenticate
+// when the user's password is valid, but a second factor must still be
+// verified with VerifySecondFactor before the user is authenticated.
+type SecondFactorPendingError int64
+
+// Error returns the error message
+func (sfpe SecondFactorPendingError) Error() string {
+	return fmt.Sprintf("Second authentication factor required for user %d", int64(sfpe))
+}
+
+// UID returns the id of the user whose second factor is pending
+func (sfpe SecondFactorPendingError) UID() int64 {
+	return int64(sfpe)
+}
+
 // An AuthBackend is an interface that is capable of authenticating a
 // user and tell whether a user is a member of a given group.
 type AuthBackend interface {
@@ -53,12 +69,54 @@ type AuthBackend interface {
 	Authenticate(login, secret string, context *types.Context) (int64, error)
 }
 
+// A SecondFactorBackend verifies a second authentication factor
+// of users after their password has been checked.
+type SecondFactorBackend interface {
+	// IsEnabled returns true if the user with the given uid
+	// must provide a second factor to log in.
+	IsEnabled(uid int64) bool
+	// VerifySecondFactor checks the given code for the user with
+	// the given uid. It returns an InvalidCredentialsError if the
+	// code is not valid.
+	VerifySecondFactor(uid int64, code string, context *types.Context) error
+}
+
 // An AuthBackendRegistry holds an ordered list of AuthBackend instances
 // that enables authentication against several backends.
 // A pointer to AuthBackendRegistry is itself an AuthBackend that can be
 // used in another AuthBackendRegistry.
+//
+// Login attempts can be throttled with a Throttler and
+// recorded with an AuditLogger.
 type AuthBackendRegistry struct {
-	backends []AuthBackend
+	backends     []AuthBackend
+	secondFactor SecondFactorBackend
+	throttler    Throttler
+	audit        AuditLogger
+}
+
+// SetThrottler sets the Throttler that limits the failed login
+// attempts of this registry. Set to nil to disable throttling.
+func (ar *AuthBackendRegistry) SetThrottler(throttler Throttler) {
+	ar.throttler = throttler
+}
+
+// SetAuditLogger sets the AuditLogger that records the login
+// attempts of this registry. Set to nil to disable audit.
+func (ar *AuthBackendRegistry) SetAuditLogger(audit AuditLogger) {
+	ar.audit = audit
+}
+
+// SetSecondFactorBackend sets the backend that verifies the second
+// authentication factor of users. Set to nil to disable second factor.
+func (ar *AuthBackendRegistry) SetSecondFactorBackend(backend SecondFactorBackend) {
+	ar.secondFactor = backend
+}
+
+// SecondFactorBackend returns the second factor backend of
+// this registry or nil if none is set.
+func (ar *AuthBackendRegistry) SecondFactorBackend() SecondFactorBackend {
+	return ar.secondFactor
 }
 
 // RegisterBackend registers the given backend in this registry.
@@ -72,7 +130,53 @@ func (ar *AuthBackendRegistry) RegisterBackend(backend AuthBackend) {
 // Authenticate tries to authenticate the user with the given uid and secret.
 // Backends are polled in order. The user is authenticated as soon as one
 // backend authenticates his uid with the given secret.
+//
+// If a second factor is enabled for this user, Authenticate returns the uid
+// with a SecondFactorPendingError. The user is then only authenticated after
+// a successful call to VerifySecondFactor.
+//
+// If a throttler is set and too many attempts failed for this login or for the
+// IP address set under RemoteIPKey in the context, a ThrottledError is returned
+// without polling the backends.
 func (ar *AuthBackendRegistry) Authenticate(login, secret string, context *types.Context) (int64, error) {
+	ip := remoteIP(context)
+	if err := ar.allow(login, ip); err != nil {
+		return 0, err
+	}
+	uid, backend, err := ar.authenticate(login, secret, context)
+	ar.record(login, ip, backend, uid, err)
+	if err != nil {
+		return 0, err
+	}
+	if ar.secondFactor != nil && ar.secondFactor.IsEnabled(uid) {
+		return uid, SecondFactorPendingError(uid)
+	}
+	return uid, nil
+}
+
+// VerifySecondFactor checks the given second factor code of the user with the
+// given uid, whose password has already been verified by Authenticate.
+//
+// Second factor attempts are throttled and audited like logins, under the
+// "#<uid>" login.
+func (ar *AuthBackendRegistry) VerifySecondFactor(uid int64, code string, context *types.Context) error {
+	if ar.secondFactor == nil || !ar.secondFactor.IsEnabled(uid) {
+		return nil
+	}
+	login := fmt.Sprintf("#%d", uid)
+	ip := remoteIP(context)
+	if err := ar.allow(login, ip); err != nil {
+		return err
+	}
+	err := ar.secondFactor.VerifySecondFactor(uid, code, context)
+	ar.record(login, ip, ar.secondFactor, uid, err)
+	return err
+}
+
+// authenticate polls the backends of this registry in order to authenticate
+// the user with the given login and secret. It also returns the backend that
+// authenticated or rejected the user, if any.
+func (ar *AuthBackendRegistry) authenticate(login, secret string, context *types.Context) (int64, interface{}, error) {
 	for _, backend := range ar.backends {
 		uid, err := backend.Authenticate(login, secret, context)
 		if err != nil {
@@ -80,14 +184,63 @@ func (ar *AuthBackendRegistry) Authenticate(login, secret string, context *types
 			case UserNotFoundError:
 				continue
 			case InvalidCredentialsError:
-				return 0, err
+				return 0, backend, err
 			default:
-				return 0, err
+				return 0, backend, err
 			}
 		}
-		return uid, nil
+		return uid, backend, nil
+	}
+	return 0, nil, UserNotFoundError(login)
+}
+
+// allow returns a ThrottledError if the throttler of this registry refuses
+// an attempt for the given login and ip. Refused attempts are audited.
+func (ar *AuthBackendRegistry) allow(login, ip string) error {
+	if ar.throttler == nil {
+		return nil
+	}
+	err := ar.throttler.Allow(login, ip)
+	if err != nil && ar.audit != nil {
+		ar.audit.LogAttempt(LoginAttempt{
+			Time:  time.Now(),
+			Login: login,
+			IP:    ip,
+			Error: err.Error(),
+		})
+	}
+	return err
+}
+
+// record notifies the throttler and the audit logger of this registry of
+// the result of an attempt. Only wrong credentials or unknown logins count
+// as failures for the throttler, not errors of the backends.
+func (ar *AuthBackendRegistry) record(login, ip string, backend interface{}, uid int64, err error) {
+	if ar.throttler != nil {
+		switch err.(type) {
+		case nil:
+			ar.throttler.RecordSuccess(login, ip)
+		case InvalidCredentialsError, UserNotFoundError:
+			ar.throttler.RecordFailure(login, ip)
+		}
+	}
+	if ar.audit == nil {
+		return
+	}
+	attempt := LoginAttempt{
+		Time:    time.Now(),
+		Login:   login,
+		IP:      ip,
+		Success: err == nil,
+		UID:     uid,
+	}
+	if backend != nil {
+		attempt.Backend = fmt.Sprintf("%T", backend)
+	}
+	if err != nil {
+		attempt.Error = err.Error()
 	}
-	return 0, UserNotFoundError(login)
+	ar.audit.LogAttempt(attempt)
 }
 
 var _ AuthBackend = new(AuthBackendRegistry)
@@ -0,0 +1,202 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package ldapauth provides an authentication backend
+// that authenticates users against an LDAP directory.
+package ldapauth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// UserInfo holds the data of an LDAP user used to provision a new user.
+type UserInfo struct {
+	Login string
+	DN    string
+	Name  string
+	Email string
+	// Groups are the DNs of the LDAP groups of the user
+	Groups []string
+}
+
+// A UserProvider gives access to the users of the application.
+//
+// It is typically implemented by the module defining the User model.
+type UserProvider interface {
+	// UserID returns the ID of the user with the given login.
+	// The second returned value is false if there is no such user.
+	UserID(login string) (int64, bool)
+	// CreateUser creates a new user with the given info and returns its ID.
+	CreateUser(info UserInfo) (int64, error)
+}
+
+// A Backend is a security.AuthBackend that authenticates users against
+// an LDAP directory. It first binds as the service account to find the
+// user's entry, then binds as the user with the given password.
+type Backend struct {
+	config Config
+	users  UserProvider
+	groups *security.GroupCollection
+}
+
+var _ security.AuthBackend = new(Backend)
+
+// NewBackend returns a new LDAP Backend with the given config.
+// users is used to find and provision the users of the application
+// and group memberships are synchronized in security.Registry.
+func NewBackend(config Config, users UserProvider) *Backend {
+	return &Backend{
+		config: config,
+		users:  users,
+		groups: security.Registry,
+	}
+}
+
+// RegisterFromViper registers in security.AuthenticationRegistry an LDAP
+// backend configured from the "LDAP" key of viper, if "LDAP.URL" is set.
+//
+// It returns the registered backend or nil if LDAP is not configured.
+func RegisterFromViper(users UserProvider) *Backend {
+	config := ConfigFromViper("LDAP")
+	if config.URL == "" {
+		return nil
+	}
+	backend := NewBackend(config, users)
+	security.AuthenticationRegistry.RegisterBackend(backend)
+	log.Info("LDAP authentication enabled", "url", config.URL, "baseDN", config.BaseDN)
+	return backend
+}
+
+// Authenticate the user defined by login and secret against the LDAP directory.
+//
+// It returns a UserNotFoundError if the login does not exist in the directory
+// (or in the application when auto provisioning is disabled) and an
+// InvalidCredentialsError if the password is wrong. Other errors, such as
+// the directory being unreachable, are returned as is.
+func (b *Backend) Authenticate(login, secret string, context *types.Context) (int64, error) {
+	if secret == "" {
+		// An empty password would be an unauthenticated bind that always succeeds
+		return 0, security.InvalidCredentialsError(login)
+	}
+	conn, err := b.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	info, err := b.searchUser(conn, login)
+	if err != nil {
+		return 0, err
+	}
+	if err = conn.Bind(info.DN, secret); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return 0, security.InvalidCredentialsError(login)
+		}
+		return 0, fmt.Errorf("unable to bind as user %s: %s", info.DN, err)
+	}
+	uid, exists := b.users.UserID(login)
+	if !exists {
+		if !b.config.AutoProvision {
+			return 0, security.UserNotFoundError(login)
+		}
+		uid, err = b.users.CreateUser(info)
+		if err != nil {
+			return 0, fmt.Errorf("unable to provision user %s: %s", login, err)
+		}
+		log.Info("Provisioned new user from LDAP", "login", login, "uid", uid, "dn", info.DN)
+	}
+	b.syncGroups(uid, info.Groups)
+	return uid, nil
+}
+
+// dial opens a connection to the LDAP server and binds as the service account
+func (b *Backend) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: b.config.InsecureSkipVerify}
+	if u, err := url.Parse(b.config.URL); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	conn, err := ldap.DialURL(b.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: b.config.Timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to LDAP server: %s", err)
+	}
+	if b.config.Timeout > 0 {
+		conn.SetTimeout(b.config.Timeout)
+	}
+	if b.config.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to start TLS with LDAP server: %s", err)
+		}
+	}
+	if b.config.BindDN != "" {
+		if err = conn.Bind(b.config.BindDN, b.config.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to bind as service account %s: %s", b.config.BindDN, err)
+		}
+	}
+	return conn, nil
+}
+
+// searchUser returns the UserInfo of the directory entry of the given login.
+func (b *Backend) searchUser(conn *ldap.Conn, login string) (UserInfo, error) {
+	request := ldap.NewSearchRequest(
+		b.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(b.config.UserFilter, ldap.EscapeFilter(login)),
+		[]string{b.config.NameAttribute, b.config.EmailAttribute, b.config.GroupAttribute},
+		nil)
+	result, err := conn.Search(request)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return UserInfo{}, fmt.Errorf("unable to search user %s: %s", login, err)
+	}
+	switch {
+	case result == nil || len(result.Entries) == 0:
+		return UserInfo{}, security.UserNotFoundError(login)
+	case len(result.Entries) > 1:
+		return UserInfo{}, errors.New("several LDAP entries match login " + login)
+	}
+	entry := result.Entries[0]
+	return UserInfo{
+		Login:  login,
+		DN:     entry.DN,
+		Name:   entry.GetAttributeValue(b.config.NameAttribute),
+		Email:  entry.GetAttributeValue(b.config.EmailAttribute),
+		Groups: entry.GetAttributeValues(b.config.GroupAttribute),
+	}, nil
+}
+
+// syncGroups updates the memberships of the user with the given uid
+// to the mapped groups according to the given LDAP groups.
+//
+// Memberships to groups that are not mapped are left untouched.
+func (b *Backend) syncGroups(uid int64, ldapGroups []string) {
+	userGroups := make(map[string]bool)
+	for _, dn := range ldapGroups {
+		userGroups[normalizeDN(dn)] = true
+	}
+	// Several LDAP groups may be mapped to the same group
+	memberships := make(map[string]bool)
+	for ldapGroup, groupID := range b.config.GroupMapping {
+		memberships[groupID] = memberships[groupID] || userGroups[normalizeDN(ldapGroup)]
+	}
+	for groupID, isMember := range memberships {
+		group := b.groups.GetGroup(groupID)
+		if group == nil {
+			log.Warn("Unknown group in LDAP group mapping", "group", groupID)
+			continue
+		}
+		if isMember {
+			b.groups.AddMembership(uid, group)
+			continue
+		}
+		b.groups.RemoveMembership(uid, group)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package ldapauth
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
+	"github.com/spf13/viper"
+)
+
+var log logging.Logger
+
+func init() {
+	log = logging.GetLogger("ldapauth")
+}
+
+// A Config holds the parameters of an LDAP authentication backend
+type Config struct {
+	// URL of the LDAP server, e.g. ldap://ldap.example.com:389 or ldaps://ldap.example.com
+	URL string
+	// StartTLS upgrades a plain ldap:// connection with StartTLS
+	StartTLS bool
+	// InsecureSkipVerify disables the verification of the server's certificate
+	InsecureSkipVerify bool
+	// Timeout of the connection and of each request
+	Timeout time.Duration
+	// BindDN and BindPassword are the credentials of the service account
+	// used to search users. If BindDN is empty, the search is anonymous.
+	BindDN       string
+	BindPassword string
+	// BaseDN is the DN under which users are searched
+	BaseDN string
+	// UserFilter is the LDAP filter to find a user. It must contain
+	// a single %s verb which is replaced by the escaped login.
+	UserFilter string
+	// NameAttribute and EmailAttribute are the LDAP attributes
+	// used to fill in the data of provisioned users.
+	NameAttribute  string
+	EmailAttribute string
+	// GroupAttribute is the LDAP attribute of the user entry that
+	// lists the DNs of the LDAP groups the user belongs to.
+	GroupAttribute string
+	// GroupMapping maps LDAP group DNs to security.Group IDs. Memberships of
+	// mapped groups are synchronized with the LDAP groups at each login.
+	GroupMapping map[string]string
+	// AutoProvision creates the user on first login if it does not exist yet
+	AutoProvision bool
+}
+
+// DefaultConfig returns a Config with the default attributes of an
+// OpenLDAP directory.
+func DefaultConfig() Config {
+	return Config{
+		Timeout:        10 * time.Second,
+		UserFilter:     "(uid=%s)",
+		NameAttribute:  "cn",
+		EmailAttribute: "mail",
+		GroupAttribute: "memberOf",
+		GroupMapping:   make(map[string]string),
+	}
+}
+
+// ConfigFromViper returns the Config defined in viper under the given key,
+// e.g. with key "LDAP", the URL is read from "LDAP.URL".
+//
+// Unset values are taken from DefaultConfig.
+func ConfigFromViper(key string) Config {
+	res := DefaultConfig()
+	getString := func(name string, value *string) {
+		if viper.IsSet(key + "." + name) {
+			*value = viper.GetString(key + "." + name)
+		}
+	}
+	getString("URL", &res.URL)
+	getString("BindDN", &res.BindDN)
+	getString("BindPassword", &res.BindPassword)
+	getString("BaseDN", &res.BaseDN)
+	getString("UserFilter", &res.UserFilter)
+	getString("NameAttribute", &res.NameAttribute)
+	getString("EmailAttribute", &res.EmailAttribute)
+	getString("GroupAttribute", &res.GroupAttribute)
+	res.StartTLS = viper.GetBool(key + ".StartTLS")
+	res.InsecureSkipVerify = viper.GetBool(key + ".InsecureSkipVerify")
+	res.AutoProvision = viper.GetBool(key + ".AutoProvision")
+	if viper.IsSet(key + ".Timeout") {
+		res.Timeout = viper.GetDuration(key + ".Timeout")
+	}
+	for ldapGroup, groupID := range viper.GetStringMapString(key + ".GroupMapping") {
+		res.GroupMapping[normalizeDN(ldapGroup)] = groupID
+	}
+	return res
+}
+
+// normalizeDN returns the given DN in a form suitable for comparison.
+//
+// DNs are case insensitive and viper lowercases map keys anyway.
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return strings.ToLower(strings.Join(parts, ","))
+}
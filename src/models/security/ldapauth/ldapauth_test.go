@@ -0,0 +1,342 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package ldapauth
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// A stubEntry is a user entry of the stub LDAP directory
+type stubEntry struct {
+	dn         string
+	login      string
+	password   string
+	attributes map[string][]string
+}
+
+// A stubServer is a minimal in-process LDAP server that
+// only supports simple binds and searches by uid.
+type stubServer struct {
+	listener        net.Listener
+	serviceDN       string
+	servicePassword string
+	entries         []stubEntry
+}
+
+// newStubServer starts a new stub LDAP server on a random local port
+func newStubServer(entries ...stubEntry) *stubServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	srv := &stubServer{
+		listener:        listener,
+		serviceDN:       "cn=service,dc=example,dc=com",
+		servicePassword: "service-secret",
+		entries:         entries,
+	}
+	go srv.serve()
+	return srv
+}
+
+// URL returns the ldap:// URL of this server
+func (s *stubServer) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// Close stops this server
+func (s *stubServer) Close() {
+	s.listener.Close()
+}
+
+func (s *stubServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+var uidFilterRE = regexp.MustCompile(`\(uid=([^)]*)\)`)
+
+// handle answers the requests of a single connection
+func (s *stubServer) handle(conn net.Conn) {
+	defer conn.Close()
+	var boundDN string
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+		msgID := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := request.Children[1].Value.(string)
+			password := request.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if s.checkPassword(dn, password) {
+				code = ldap.LDAPResultSuccess
+				boundDN = dn
+			}
+			conn.Write(stubResponse(msgID, ldap.ApplicationBindResponse, stubResult(code)...))
+		case ldap.ApplicationSearchRequest:
+			if boundDN != s.serviceDN {
+				conn.Write(stubResponse(msgID, ldap.ApplicationSearchResultDone, stubResult(ldap.LDAPResultInsufficientAccessRights)...))
+				continue
+			}
+			filter, _ := ldap.DecompileFilter(request.Children[6])
+			var login string
+			if match := uidFilterRE.FindStringSubmatch(filter); match != nil {
+				login = match[1]
+			}
+			for _, entry := range s.entries {
+				if entry.login != login {
+					continue
+				}
+				conn.Write(stubResponse(msgID, ldap.ApplicationSearchResultEntry, stubEntryPackets(entry)...))
+			}
+			conn.Write(stubResponse(msgID, ldap.ApplicationSearchResultDone, stubResult(ldap.LDAPResultSuccess)...))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// checkPassword returns true if the given credentials are valid
+func (s *stubServer) checkPassword(dn, password string) bool {
+	if dn == s.serviceDN {
+		return password == s.servicePassword
+	}
+	for _, entry := range s.entries {
+		if entry.dn == dn {
+			return password == entry.password
+		}
+	}
+	return false
+}
+
+// stubResponse returns the encoded LDAP message with the given id and response
+func stubResponse(msgID int64, tag ber.Tag, children ...*ber.Packet) []byte {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	for _, child := range children {
+		response.AppendChild(child)
+	}
+	envelope.AppendChild(response)
+	return envelope.Bytes()
+}
+
+// stubResult returns the packets of an LDAPResult with the given code
+func stubResult(code uint16) []*ber.Packet {
+	return []*ber.Packet{
+		ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"),
+	}
+}
+
+// stubEntryPackets returns the packets of a SearchResultEntry for the given entry
+func stubEntryPackets(entry stubEntry) []*ber.Packet {
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range entry.attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, value := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		}
+		attribute.AppendChild(vals)
+		attributes.AppendChild(attribute)
+	}
+	return []*ber.Packet{
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "objectName"),
+		attributes,
+	}
+}
+
+// testUsers is a UserProvider that keeps users in memory
+type testUsers struct {
+	users  map[string]int64
+	infos  map[int64]UserInfo
+	nextID int64
+}
+
+func (tu *testUsers) UserID(login string) (int64, bool) {
+	uid, ok := tu.users[login]
+	return uid, ok
+}
+
+func (tu *testUsers) CreateUser(info UserInfo) (int64, error) {
+	tu.nextID++
+	tu.users[info.Login] = tu.nextID
+	tu.infos[tu.nextID] = info
+	return tu.nextID, nil
+}
+
+func TestLDAPBackend(t *testing.T) {
+	accounting := security.Registry.NewGroup("ldap_accounting", "Accounting")
+	managers := security.Registry.NewGroup("ldap_managers", "Managers")
+	defer security.Registry.UnregisterGroup(accounting)
+	defer security.Registry.UnregisterGroup(managers)
+	srv := newStubServer(
+		stubEntry{
+			dn:       "uid=jdoe,ou=people,dc=example,dc=com",
+			login:    "jdoe",
+			password: "jdoe-secret",
+			attributes: map[string][]string{
+				"cn":       {"John Doe"},
+				"mail":     {"jdoe@example.com"},
+				"memberOf": {"cn=Accounting,ou=groups,dc=example,dc=com"},
+			},
+		},
+		stubEntry{
+			dn:       "uid=asmith,ou=people,dc=example,dc=com",
+			login:    "asmith",
+			password: "asmith-secret",
+			attributes: map[string][]string{
+				"cn":       {"Alice Smith"},
+				"mail":     {"asmith@example.com"},
+				"memberOf": {"cn=managers,ou=groups,dc=example,dc=com", "cn=accounting,ou=groups,dc=example,dc=com"},
+			},
+		},
+	)
+	defer srv.Close()
+	newConfig := func() Config {
+		config := DefaultConfig()
+		config.URL = srv.URL()
+		config.Timeout = 2 * time.Second
+		config.BindDN = srv.serviceDN
+		config.BindPassword = srv.servicePassword
+		config.BaseDN = "ou=people,dc=example,dc=com"
+		config.GroupMapping = map[string]string{
+			"cn=accounting,ou=groups,dc=example,dc=com": "ldap_accounting",
+			"cn=managers,ou=groups,dc=example,dc=com":   "ldap_managers",
+		}
+		return config
+	}
+	Convey("Testing LDAP authentication backend", t, func() {
+		users := &testUsers{
+			users:  map[string]int64{"jdoe": 10},
+			infos:  make(map[int64]UserInfo),
+			nextID: 100,
+		}
+		backend := NewBackend(newConfig(), users)
+		Convey("Valid credentials should authenticate the user", func() {
+			uid, err := backend.Authenticate("jdoe", "jdoe-secret", types.NewContext())
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 10)
+		})
+		Convey("Mapped LDAP groups should be synchronized", func() {
+			security.Registry.AddMembership(10, managers)
+			_, err := backend.Authenticate("jdoe", "jdoe-secret", types.NewContext())
+			So(err, ShouldBeNil)
+			So(security.Registry.HasMembership(10, accounting), ShouldBeTrue)
+			So(security.Registry.HasMembership(10, managers), ShouldBeFalse)
+			security.Registry.RemoveAllMembershipsForUser(10)
+		})
+		Convey("Wrong password should return an InvalidCredentialsError", func() {
+			_, err := backend.Authenticate("jdoe", "wrong", types.NewContext())
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+		})
+		Convey("Empty password should return an InvalidCredentialsError", func() {
+			_, err := backend.Authenticate("jdoe", "", types.NewContext())
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+		})
+		Convey("Unknown login should return a UserNotFoundError", func() {
+			_, err := backend.Authenticate("nobody", "secret", types.NewContext())
+			So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
+		})
+		Convey("Logins should be escaped in the search filter", func() {
+			_, err := backend.Authenticate("*", "jdoe-secret", types.NewContext())
+			So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
+		})
+		Convey("Users not known to the application should not log in without auto provisioning", func() {
+			_, err := backend.Authenticate("asmith", "asmith-secret", types.NewContext())
+			So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
+			So(users.users, ShouldNotContainKey, "asmith")
+		})
+		Convey("Users should be provisioned on first login with auto provisioning", func() {
+			config := newConfig()
+			config.AutoProvision = true
+			backend = NewBackend(config, users)
+			uid, err := backend.Authenticate("asmith", "asmith-secret", types.NewContext())
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 101)
+			So(users.infos[uid].Name, ShouldEqual, "Alice Smith")
+			So(users.infos[uid].Email, ShouldEqual, "asmith@example.com")
+			So(users.infos[uid].DN, ShouldEqual, "uid=asmith,ou=people,dc=example,dc=com")
+			So(security.Registry.HasMembership(uid, accounting), ShouldBeTrue)
+			So(security.Registry.HasMembership(uid, managers), ShouldBeTrue)
+			uid2, err := backend.Authenticate("asmith", "asmith-secret", types.NewContext())
+			So(err, ShouldBeNil)
+			So(uid2, ShouldEqual, uid)
+			security.Registry.RemoveAllMembershipsForUser(uid)
+		})
+		Convey("Wrong service account credentials should return an error", func() {
+			config := newConfig()
+			config.BindPassword = "wrong"
+			backend = NewBackend(config, users)
+			_, err := backend.Authenticate("jdoe", "jdoe-secret", types.NewContext())
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotHaveSameTypeAs, security.InvalidCredentialsError(""))
+			So(err, ShouldNotHaveSameTypeAs, security.UserNotFoundError(""))
+		})
+		Convey("Unreachable server should return an error", func() {
+			config := newConfig()
+			listener, _ := net.Listen("tcp", "127.0.0.1:0")
+			config.URL = fmt.Sprintf("ldap://%s", listener.Addr())
+			listener.Close()
+			backend = NewBackend(config, users)
+			_, err := backend.Authenticate("jdoe", "jdoe-secret", types.NewContext())
+			So(err, ShouldNotBeNil)
+		})
+		Convey("LDAP backend should work in an AuthBackendRegistry", func() {
+			registry := new(security.AuthBackendRegistry)
+			registry.RegisterBackend(backend)
+			uid, err := registry.Authenticate("jdoe", "jdoe-secret", types.NewContext())
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 10)
+			_, err = registry.Authenticate("jdoe", "wrong", types.NewContext())
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+		})
+	})
+	Convey("Testing LDAP configuration from viper", t, func() {
+		viper.Set("LDAPTest.URL", "ldaps://ldap.example.com")
+		viper.Set("LDAPTest.BaseDN", "dc=example,dc=com")
+		viper.Set("LDAPTest.AutoProvision", true)
+		viper.Set("LDAPTest.Timeout", "3s")
+		viper.Set("LDAPTest.GroupMapping", map[string]string{
+			"CN=Accounting, OU=Groups, DC=example, DC=com": "ldap_accounting",
+		})
+		config := ConfigFromViper("LDAPTest")
+		So(config.URL, ShouldEqual, "ldaps://ldap.example.com")
+		So(config.BaseDN, ShouldEqual, "dc=example,dc=com")
+		So(config.AutoProvision, ShouldBeTrue)
+		So(config.Timeout, ShouldEqual, 3*time.Second)
+		So(config.UserFilter, ShouldEqual, "(uid=%s)")
+		So(config.GroupAttribute, ShouldEqual, "memberOf")
+		So(config.GroupMapping, ShouldResemble, map[string]string{
+			"cn=accounting,ou=groups,dc=example,dc=com": "ldap_accounting",
+		})
+		So(ConfigFromViper("NoLDAP").URL, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,273 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package oidcauth provides an authentication backend that authenticates
+// users with an OpenID Connect identity provider, using the authorization
+// code flow with PKCE.
+//
+// A login is started by redirecting the user to the URL of a LoginRequest.
+// When the provider redirects back to the application with an authorization
+// code, the code is passed as secret to the Authenticate method, with the
+// code verifier and the nonce of the LoginRequest in the context.
+package oidcauth
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+)
+
+const (
+	// CodeVerifierKey is the key of the PKCE code verifier of
+	// the LoginRequest in the context passed to Authenticate.
+	CodeVerifierKey = "oidc_code_verifier"
+	// NonceKey is the key of the nonce of the LoginRequest
+	// in the context passed to Authenticate.
+	NonceKey = "oidc_nonce"
+)
+
+// errInvalidGrant is returned by the token endpoint when
+// the authorization code or the code verifier is not valid.
+var errInvalidGrant = errors.New("invalid authorization code")
+
+// An invalidTokenError is returned when the ID token returned
+// by the provider cannot be verified.
+type invalidTokenError struct {
+	error
+}
+
+// UserInfo holds the data of an OIDC user used to provision a new user.
+type UserInfo struct {
+	Login string
+	// Issuer and Subject are the provider's unique identifier of the user
+	Issuer  string
+	Subject string
+	Name    string
+	Email   string
+	// EmailVerified is true if the provider has verified that
+	// the user owns the Email address.
+	EmailVerified bool
+	// Groups are the names of the provider's groups of the user
+	Groups []string
+}
+
+// A UserProvider gives access to the users of the application.
+//
+// Users are identified by the issuer and subject of their ID token, which
+// are stored for each user with LinkSubject. Other claims such as the login
+// or the email may be changed by the user at the provider and are only used
+// to provision new users.
+//
+// It is typically implemented by the module defining the User model.
+type UserProvider interface {
+	// SubjectUserID returns the ID of the user linked to the given subject
+	// of the given issuer. The second returned value is false if there is
+	// no such user.
+	SubjectUserID(issuer, subject string) (int64, bool)
+	// EmailUserID returns the ID of the user with the given email.
+	// The second returned value is false if there is no such user.
+	EmailUserID(email string) (int64, bool)
+	// LinkSubject links the user with the given uid to the given
+	// subject of the given issuer.
+	LinkSubject(uid int64, issuer, subject string) error
+	// CreateUser creates a new user with the given info and returns its ID.
+	CreateUser(info UserInfo) (int64, error)
+}
+
+// A Backend is a security.AuthBackend that authenticates users with
+// an OpenID Connect identity provider.
+type Backend struct {
+	sync.Mutex
+	config      Config
+	users       UserProvider
+	groups      *security.GroupCollection
+	client      *http.Client
+	provider    *providerMetadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	now         func() time.Time
+}
+
+var _ security.AuthBackend = new(Backend)
+
+// NewBackend returns a new OIDC Backend with the given config.
+// users is used to find and provision the users of the application
+// and group memberships are synchronized in security.Registry.
+func NewBackend(config Config, users UserProvider) *Backend {
+	return &Backend{
+		config: config,
+		users:  users,
+		groups: security.Registry,
+		client: &http.Client{Timeout: config.Timeout},
+		keys:   make(map[string]crypto.PublicKey),
+		now:    time.Now,
+	}
+}
+
+// RegisterFromViper registers in security.AuthenticationRegistry an OIDC
+// backend configured from the "OIDC" key of viper, if "OIDC.Issuer" is set.
+//
+// It returns the registered backend or nil if OIDC is not configured.
+func RegisterFromViper(users UserProvider) *Backend {
+	config := ConfigFromViper("OIDC")
+	if config.Issuer == "" {
+		return nil
+	}
+	backend := NewBackend(config, users)
+	security.AuthenticationRegistry.RegisterBackend(backend)
+	log.Info("OIDC authentication enabled", "issuer", config.Issuer, "clientID", config.ClientID)
+	return backend
+}
+
+// NewLoginRequest starts a new login with the identity provider and returns
+// the LoginRequest holding the URL to redirect the user to.
+func (b *Backend) NewLoginRequest() (*LoginRequest, error) {
+	meta, err := b.metadata()
+	if err != nil {
+		return nil, err
+	}
+	var req LoginRequest
+	for _, value := range []*string{&req.State, &req.Nonce, &req.CodeVerifier} {
+		if *value, err = randomString(); err != nil {
+			return nil, err
+		}
+	}
+	scopes := []string{"openid"}
+	for _, scope := range b.config.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", b.config.ClientID)
+	params.Set("redirect_uri", b.config.RedirectURL)
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", req.State)
+	params.Set("nonce", req.Nonce)
+	params.Set("code_challenge", codeChallenge(req.CodeVerifier))
+	params.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	req.URL = meta.AuthorizationEndpoint + separator + params.Encode()
+	return &req, nil
+}
+
+// Authenticate the user with the authorization code given as secret.
+// The context must hold the code verifier and the nonce of the LoginRequest
+// under the CodeVerifierKey and NonceKey keys. login is ignored since the
+// user is identified by the issuer and subject of the ID token (see
+// UserProvider).
+//
+// It returns a UserNotFoundError if the context has no code verifier (i.e.
+// this is not an OIDC login) or if the user does not exist in the application
+// and auto provisioning is disabled. It returns an InvalidCredentialsError if
+// the code is rejected by the provider or if the ID token is not valid.
+func (b *Backend) Authenticate(login, secret string, context *types.Context) (int64, error) {
+	if context == nil || context.GetString(CodeVerifierKey) == "" {
+		return 0, security.UserNotFoundError(login)
+	}
+	token, err := b.exchangeCode(secret, context.GetString(CodeVerifierKey), context.GetString(NonceKey))
+	switch err.(type) {
+	case nil:
+	case invalidTokenError:
+		log.Warn("Invalid OIDC ID token", "error", err)
+		return 0, security.InvalidCredentialsError("<OIDC token>")
+	default:
+		if err == errInvalidGrant {
+			return 0, security.InvalidCredentialsError("<OIDC code>")
+		}
+		return 0, err
+	}
+	info := UserInfo{
+		Login:         token.stringClaim(b.config.LoginClaim),
+		Issuer:        token.stringClaim("iss"),
+		Subject:       token.stringClaim("sub"),
+		Name:          token.stringClaim(b.config.NameClaim),
+		Email:         token.stringClaim(b.config.EmailClaim),
+		EmailVerified: token.boolClaim("email_verified"),
+		Groups:        token.stringsClaim(b.config.GroupsClaim),
+	}
+	if info.Subject == "" {
+		return 0, errors.New("no sub claim in OIDC ID token")
+	}
+	uid, err := b.userID(info)
+	if err != nil {
+		return 0, err
+	}
+	b.syncGroups(uid, info.Groups)
+	return uid, nil
+}
+
+// userID returns the ID of the user with the given info.
+//
+// The user is found by the issuer and subject of its ID token. Users that
+// have never logged in with the provider are found by their email, only if
+// it has been verified by the provider, or created if AutoProvision is set.
+// In both cases, the user is then linked to the issuer and subject.
+func (b *Backend) userID(info UserInfo) (int64, error) {
+	if uid, ok := b.users.SubjectUserID(info.Issuer, info.Subject); ok {
+		return uid, nil
+	}
+	uid, exists := int64(0), false
+	if info.Email != "" && info.EmailVerified {
+		uid, exists = b.users.EmailUserID(info.Email)
+	}
+	if !exists {
+		if !b.config.AutoProvision {
+			return 0, security.UserNotFoundError(info.Subject)
+		}
+		if info.Login == "" {
+			return 0, fmt.Errorf("no %s claim in OIDC ID token of %s", b.config.LoginClaim, info.Subject)
+		}
+		var err error
+		uid, err = b.users.CreateUser(info)
+		if err != nil {
+			return 0, fmt.Errorf("unable to provision user %s: %s", info.Login, err)
+		}
+		log.Info("Provisioned new user from OIDC", "login", info.Login, "uid", uid, "subject", info.Subject)
+	}
+	if err := b.users.LinkSubject(uid, info.Issuer, info.Subject); err != nil {
+		return 0, fmt.Errorf("unable to link user %d to OIDC subject %s: %s", uid, info.Subject, err)
+	}
+	log.Info("Linked user to OIDC subject", "uid", uid, "issuer", info.Issuer, "subject", info.Subject)
+	return uid, nil
+}
+
+// syncGroups updates the memberships of the user with the given uid
+// to the mapped groups according to the given provider's groups.
+//
+// Memberships to groups that are not mapped are left untouched.
+func (b *Backend) syncGroups(uid int64, providerGroups []string) {
+	userGroups := make(map[string]bool)
+	for _, name := range providerGroups {
+		userGroups[strings.ToLower(name)] = true
+	}
+	// Several provider groups may be mapped to the same group
+	memberships := make(map[string]bool)
+	for providerGroup, groupID := range b.config.GroupMapping {
+		memberships[groupID] = memberships[groupID] || userGroups[strings.ToLower(providerGroup)]
+	}
+	for groupID, isMember := range memberships {
+		group := b.groups.GetGroup(groupID)
+		if group == nil {
+			log.Warn("Unknown group in OIDC group mapping", "group", groupID)
+			continue
+		}
+		if isMember {
+			b.groups.AddMembership(uid, group)
+			continue
+		}
+		b.groups.RemoveMembership(uid, group)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package oidcauth
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
+	"github.com/spf13/viper"
+)
+
+var log logging.Logger
+
+func init() {
+	log = logging.GetLogger("oidcauth")
+}
+
+// A Config holds the parameters of an OpenID Connect authentication backend
+type Config struct {
+	// Issuer is the URL of the identity provider. The provider's endpoints are
+	// read from its discovery document at <Issuer>/.well-known/openid-configuration
+	Issuer string
+	// ClientID and ClientSecret are the credentials of the application at the
+	// identity provider. ClientSecret may be empty for public clients.
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the absolute URL of the callback route of the application,
+	// e.g. https://erp.example.com/auth/oidc/callback
+	RedirectURL string
+	// Scopes requested to the identity provider. "openid" is always requested.
+	Scopes []string
+	// LoginClaim, NameClaim and EmailClaim are the claims used to fill in the
+	// data of provisioned users. Users are identified by the "iss" and "sub"
+	// claims and, on their first login, by EmailClaim if "email_verified" is true.
+	LoginClaim string
+	NameClaim  string
+	EmailClaim string
+	// GroupsClaim is the claim of the ID token that lists
+	// the names of the groups the user belongs to.
+	GroupsClaim string
+	// GroupMapping maps the provider's group names (case insensitive) to
+	// security.Group IDs. Memberships of mapped groups are synchronized
+	// with the groups claim at each login.
+	GroupMapping map[string]string
+	// AutoProvision creates the user on first login if it does not exist yet
+	AutoProvision bool
+	// Timeout of the requests to the identity provider
+	Timeout time.Duration
+	// ClockSkew is the tolerated clock difference with the
+	// identity provider when checking ID tokens validity.
+	ClockSkew time.Duration
+}
+
+// DefaultConfig returns a Config with the standard claims of OpenID Connect.
+func DefaultConfig() Config {
+	return Config{
+		Scopes:       []string{"openid", "profile", "email"},
+		LoginClaim:   "preferred_username",
+		NameClaim:    "name",
+		EmailClaim:   "email",
+		GroupsClaim:  "groups",
+		GroupMapping: make(map[string]string),
+		Timeout:      10 * time.Second,
+		ClockSkew:    time.Minute,
+	}
+}
+
+// ConfigFromViper returns the Config defined in viper under the given key,
+// e.g. with key "OIDC", the issuer is read from "OIDC.Issuer".
+//
+// Unset values are taken from DefaultConfig.
+func ConfigFromViper(key string) Config {
+	res := DefaultConfig()
+	getString := func(name string, value *string) {
+		if viper.IsSet(key + "." + name) {
+			*value = viper.GetString(key + "." + name)
+		}
+	}
+	getString("Issuer", &res.Issuer)
+	getString("ClientID", &res.ClientID)
+	getString("ClientSecret", &res.ClientSecret)
+	getString("RedirectURL", &res.RedirectURL)
+	getString("LoginClaim", &res.LoginClaim)
+	getString("NameClaim", &res.NameClaim)
+	getString("EmailClaim", &res.EmailClaim)
+	getString("GroupsClaim", &res.GroupsClaim)
+	if viper.IsSet(key + ".Scopes") {
+		res.Scopes = viper.GetStringSlice(key + ".Scopes")
+	}
+	res.AutoProvision = viper.GetBool(key + ".AutoProvision")
+	if viper.IsSet(key + ".Timeout") {
+		res.Timeout = viper.GetDuration(key + ".Timeout")
+	}
+	if viper.IsSet(key + ".ClockSkew") {
+		res.ClockSkew = viper.GetDuration(key + ".ClockSkew")
+	}
+	for providerGroup, groupID := range viper.GetStringMapString(key + ".GroupMapping") {
+		res.GroupMapping[strings.ToLower(providerGroup)] = groupID
+	}
+	return res
+}
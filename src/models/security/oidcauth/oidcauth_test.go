@@ -0,0 +1,505 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package oidcauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// A fakeGrant is an authorization code issued by the fakeProvider
+type fakeGrant struct {
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+// A fakeProvider is a minimal in-process OpenID Connect provider
+// that issues RS256 signed ID tokens.
+type fakeProvider struct {
+	sync.Mutex
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	grants map[string]fakeGrant
+	issued int
+	// signKey, if set, signs the tokens instead of key
+	signKey *rsa.PrivateKey
+	// noTokenKid, if set, omits the key ID in the tokens header
+	noTokenKid bool
+}
+
+// newFakeProvider starts a new fakeProvider on a random local port
+func newFakeProvider() *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	fp := &fakeProvider{
+		key:    key,
+		kid:    "key-1",
+		grants: make(map[string]fakeGrant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                           fp.server.URL,
+			"authorization_endpoint":           fp.server.URL + "/authorize",
+			"token_endpoint":                   fp.server.URL + "/token",
+			"jwks_uri":                         fp.server.URL + "/jwks",
+			"code_challenge_methods_supported": []string{"S256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		fp.Lock()
+		defer fp.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": fp.kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(fp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(fp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", fp.token)
+	fp.server = httptest.NewServer(mux)
+	return fp
+}
+
+// authorize simulates the login of a user with the given claims at the
+// provider for the given authorization URL and returns the issued code.
+func (fp *fakeProvider) authorize(authURL string, claims map[string]interface{}) string {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		panic(err)
+	}
+	fp.Lock()
+	defer fp.Unlock()
+	fp.issued++
+	code := fmt.Sprintf("code-%d", fp.issued)
+	fp.grants[code] = fakeGrant{
+		challenge: parsed.Query().Get("code_challenge"),
+		nonce:     parsed.Query().Get("nonce"),
+		claims:    claims,
+	}
+	return code
+}
+
+// token is the token endpoint of the fakeProvider
+func (fp *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	fp.Lock()
+	defer fp.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	grant, ok := fp.grants[r.PostFormValue("code")]
+	delete(fp.grants, r.PostFormValue("code"))
+	clientID, _, _ := r.BasicAuth()
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || clientID != "erp" ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	claims := map[string]interface{}{
+		"iss":   fp.server.URL,
+		"aud":   "erp",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": grant.nonce,
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     fp.sign(claims),
+	})
+}
+
+// sign returns the RS256 signed JWT of the given claims
+func (fp *fakeProvider) sign(claims map[string]interface{}) string {
+	headerFields := map[string]string{"alg": "RS256", "kid": fp.kid, "typ": "JWT"}
+	if fp.noTokenKid {
+		delete(headerFields, "kid")
+	}
+	header, _ := json.Marshal(headerFields)
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	key := fp.key
+	if fp.signKey != nil {
+		key = fp.signKey
+	}
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testUsers is a UserProvider that keeps users in memory
+type testUsers struct {
+	subjects map[string]int64
+	emails   map[string]int64
+	infos    map[int64]UserInfo
+	nextID   int64
+}
+
+func (tu *testUsers) SubjectUserID(issuer, subject string) (int64, bool) {
+	uid, ok := tu.subjects[issuer+"|"+subject]
+	return uid, ok
+}
+
+func (tu *testUsers) EmailUserID(email string) (int64, bool) {
+	uid, ok := tu.emails[email]
+	return uid, ok
+}
+
+func (tu *testUsers) LinkSubject(uid int64, issuer, subject string) error {
+	tu.subjects[issuer+"|"+subject] = uid
+	return nil
+}
+
+func (tu *testUsers) CreateUser(info UserInfo) (int64, error) {
+	tu.nextID++
+	if info.Email != "" {
+		tu.emails[info.Email] = tu.nextID
+	}
+	tu.infos[tu.nextID] = info
+	return tu.nextID, nil
+}
+
+func TestOIDCBackend(t *testing.T) {
+	accounting := security.Registry.NewGroup("oidc_accounting", "Accounting")
+	managers := security.Registry.NewGroup("oidc_managers", "Managers")
+	defer security.Registry.UnregisterGroup(accounting)
+	defer security.Registry.UnregisterGroup(managers)
+	provider := newFakeProvider()
+	defer provider.server.Close()
+	newConfig := func() Config {
+		config := DefaultConfig()
+		config.Issuer = provider.server.URL
+		config.ClientID = "erp"
+		config.ClientSecret = "erp-secret"
+		config.RedirectURL = "https://erp.example.com/auth/oidc/callback"
+		config.GroupMapping = map[string]string{
+			"accounting": "oidc_accounting",
+			"managers":   "oidc_managers",
+		}
+		return config
+	}
+	jdoe := map[string]interface{}{
+		"sub":                "1234",
+		"preferred_username": "jdoe",
+		"name":               "John Doe",
+		"email":              "jdoe@example.com",
+		"email_verified":     true,
+		"groups":             []string{"Accounting"},
+	}
+	// withClaims returns the claims of jdoe updated with the given claims
+	withClaims := func(claims map[string]interface{}) map[string]interface{} {
+		res := make(map[string]interface{})
+		for k, v := range jdoe {
+			res[k] = v
+		}
+		for k, v := range claims {
+			res[k] = v
+		}
+		return res
+	}
+	Convey("Testing OIDC authentication backend", t, func() {
+		users := &testUsers{
+			subjects: make(map[string]int64),
+			emails:   map[string]int64{"jdoe@example.com": 10},
+			infos:    make(map[int64]UserInfo),
+			nextID:   100,
+		}
+		backend := NewBackend(newConfig(), users)
+		login := func(claims map[string]interface{}) (*LoginRequest, string) {
+			req, err := backend.NewLoginRequest()
+			So(err, ShouldBeNil)
+			return req, provider.authorize(req.URL, claims)
+		}
+		contextOf := func(req *LoginRequest) *types.Context {
+			return types.NewContext().WithKey(CodeVerifierKey, req.CodeVerifier).WithKey(NonceKey, req.Nonce)
+		}
+		Convey("Login requests should use PKCE", func() {
+			req, err := backend.NewLoginRequest()
+			So(err, ShouldBeNil)
+			parsed, err := url.Parse(req.URL)
+			So(err, ShouldBeNil)
+			So(parsed.Path, ShouldEqual, "/authorize")
+			query := parsed.Query()
+			So(query.Get("response_type"), ShouldEqual, "code")
+			So(query.Get("client_id"), ShouldEqual, "erp")
+			So(query.Get("redirect_uri"), ShouldEqual, "https://erp.example.com/auth/oidc/callback")
+			So(query.Get("scope"), ShouldEqual, "openid profile email")
+			So(query.Get("state"), ShouldEqual, req.State)
+			So(query.Get("nonce"), ShouldEqual, req.Nonce)
+			So(query.Get("code_challenge_method"), ShouldEqual, "S256")
+			So(query.Get("code_challenge"), ShouldEqual, codeChallenge(req.CodeVerifier))
+			So(query.Get("code_challenge"), ShouldNotEqual, req.CodeVerifier)
+			req2, _ := backend.NewLoginRequest()
+			So(req2.State, ShouldNotEqual, req.State)
+			So(req2.CodeVerifier, ShouldNotEqual, req.CodeVerifier)
+		})
+		Convey("Valid codes should authenticate the user and sync mapped groups", func() {
+			security.Registry.AddMembership(10, managers)
+			req, code := login(jdoe)
+			uid, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 10)
+			So(security.Registry.HasMembership(10, accounting), ShouldBeTrue)
+			So(security.Registry.HasMembership(10, managers), ShouldBeFalse)
+			security.Registry.RemoveAllMembershipsForUser(10)
+		})
+		Convey("Users should be identified by their issuer and subject", func() {
+			req, code := login(jdoe)
+			uid, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 10)
+			So(users.subjects[provider.server.URL+"|1234"], ShouldEqual, 10)
+			req, code = login(withClaims(map[string]interface{}{
+				"preferred_username": "johnny",
+				"email":              "johnny@example.com",
+			}))
+			uid, err = backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 10)
+			security.Registry.RemoveAllMembershipsForUser(10)
+		})
+		Convey("Users with the login of another user should not log in as this user", func() {
+			req, code := login(map[string]interface{}{"sub": "9999", "preferred_username": "jdoe"})
+			_, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
+			So(users.subjects, ShouldBeEmpty)
+		})
+		Convey("Unverified emails should not match existing users", func() {
+			req, code := login(withClaims(map[string]interface{}{"email_verified": false}))
+			_, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
+			req, code = login(withClaims(map[string]interface{}{"email_verified": "true"}))
+			uid, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 10)
+			security.Registry.RemoveAllMembershipsForUser(10)
+		})
+		Convey("ID tokens without subject should be refused", func() {
+			req, code := login(withClaims(map[string]interface{}{"sub": ""}))
+			_, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Codes should only be used once", func() {
+			req, code := login(jdoe)
+			_, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			_, err = backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+			security.Registry.RemoveAllMembershipsForUser(10)
+		})
+		Convey("Wrong code verifier should return an InvalidCredentialsError", func() {
+			req, code := login(jdoe)
+			ctx := contextOf(req).WithKey(CodeVerifierKey, "wrong-verifier")
+			_, err := backend.Authenticate("", code, ctx)
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+		})
+		Convey("Wrong nonce should return an InvalidCredentialsError", func() {
+			req, code := login(jdoe)
+			ctx := contextOf(req).WithKey(NonceKey, "wrong-nonce")
+			_, err := backend.Authenticate("", code, ctx)
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+		})
+		Convey("Expired ID tokens should return an InvalidCredentialsError", func() {
+			claims := map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}
+			for k, v := range jdoe {
+				claims[k] = v
+			}
+			req, code := login(claims)
+			_, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+		})
+		Convey("ID tokens for another client should return an InvalidCredentialsError", func() {
+			claims := map[string]interface{}{"aud": []string{"other"}}
+			for k, v := range jdoe {
+				claims[k] = v
+			}
+			req, code := login(claims)
+			_, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+		})
+		Convey("ID tokens with a wrong signature should return an InvalidCredentialsError", func() {
+			otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+			provider.signKey = otherKey
+			defer func() { provider.signKey = nil }()
+			req, code := login(jdoe)
+			_, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+		})
+		Convey("Rotated provider keys should be downloaded again", func() {
+			req, code := login(jdoe)
+			_, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+			oldKey, oldKid := provider.key, provider.kid
+			provider.key, provider.kid = newKey, "key-2"
+			defer func() { provider.key, provider.kid = oldKey, oldKid }()
+			req, code = login(jdoe)
+			_, err = backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+			backend.now = func() time.Time { return time.Now().Add(jwksMinRefreshInterval) }
+			req, code = login(jdoe)
+			_, err = backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			security.Registry.RemoveAllMembershipsForUser(10)
+		})
+		Convey("Provider keys should be used for consecutive logins with tokens without key ID", func() {
+			provider.noTokenKid = true
+			defer func() { provider.noTokenKid = false }()
+			for i := 0; i < 2; i++ {
+				req, code := login(jdoe)
+				uid, err := backend.Authenticate("", code, contextOf(req))
+				So(err, ShouldBeNil)
+				So(uid, ShouldEqual, 10)
+			}
+			security.Registry.RemoveAllMembershipsForUser(10)
+		})
+		Convey("Requests without code verifier should return a UserNotFoundError", func() {
+			_, err := backend.Authenticate("jdoe", "password", types.NewContext())
+			So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
+			_, err = backend.Authenticate("jdoe", "password", nil)
+			So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
+		})
+		Convey("Users not known to the application should not log in without auto provisioning", func() {
+			req, code := login(map[string]interface{}{"sub": "5678", "preferred_username": "asmith"})
+			_, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
+			So(users.infos, ShouldBeEmpty)
+			So(users.subjects, ShouldBeEmpty)
+		})
+		Convey("Users should be provisioned on first login with auto provisioning", func() {
+			config := newConfig()
+			config.AutoProvision = true
+			backend = NewBackend(config, users)
+			asmith := map[string]interface{}{
+				"sub":                "5678",
+				"preferred_username": "asmith",
+				"name":               "Alice Smith",
+				"email":              "asmith@example.com",
+				"groups":             []string{"managers", "accounting"},
+			}
+			req, code := login(asmith)
+			uid, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 101)
+			So(users.infos[uid].Subject, ShouldEqual, "5678")
+			So(users.infos[uid].Issuer, ShouldEqual, provider.server.URL)
+			So(users.subjects[provider.server.URL+"|5678"], ShouldEqual, uid)
+			So(users.infos[uid].Name, ShouldEqual, "Alice Smith")
+			So(users.infos[uid].Email, ShouldEqual, "asmith@example.com")
+			So(security.Registry.HasMembership(uid, accounting), ShouldBeTrue)
+			So(security.Registry.HasMembership(uid, managers), ShouldBeTrue)
+			req, code = login(asmith)
+			uid2, err := backend.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			So(uid2, ShouldEqual, uid)
+			security.Registry.RemoveAllMembershipsForUser(uid)
+		})
+		Convey("Unreachable provider should return an error", func() {
+			config := newConfig()
+			unreachable := httptest.NewServer(http.NotFoundHandler())
+			config.Issuer = unreachable.URL
+			unreachable.Close()
+			backend = NewBackend(config, users)
+			_, err := backend.NewLoginRequest()
+			So(err, ShouldNotBeNil)
+			_, err = backend.Authenticate("", "code", types.NewContext().WithKey(CodeVerifierKey, "verifier"))
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotHaveSameTypeAs, security.InvalidCredentialsError(""))
+		})
+		Convey("OIDC backend should work in an AuthBackendRegistry", func() {
+			registry := new(security.AuthBackendRegistry)
+			registry.RegisterBackend(backend)
+			req, code := login(jdoe)
+			uid, err := registry.Authenticate("", code, contextOf(req))
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 10)
+			security.Registry.RemoveAllMembershipsForUser(10)
+		})
+	})
+	Convey("Testing ID token signatures", t, func() {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		jwk := jsonWebKey{
+			Kty: "EC",
+			Kid: "ec-key",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}
+		publicKey, err := jwk.publicKey()
+		So(err, ShouldBeNil)
+		signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"ec-key"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1234"}`))
+		digest := sha256.Sum256([]byte(signed))
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+		signature := make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+		token, err := parseIDToken(signed + "." + base64.RawURLEncoding.EncodeToString(signature))
+		So(err, ShouldBeNil)
+		So(token.verifySignature(publicKey), ShouldBeNil)
+		signature[10]++
+		token, _ = parseIDToken(signed + "." + base64.RawURLEncoding.EncodeToString(signature))
+		So(token.verifySignature(publicKey), ShouldNotBeNil)
+		token.alg = "none"
+		So(token.verifySignature(publicKey), ShouldNotBeNil)
+		token.alg = "HS256"
+		So(token.verifySignature(publicKey), ShouldNotBeNil)
+		_, err = parseIDToken("not.a-token")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Testing OIDC configuration from viper", t, func() {
+		viper.Set("OIDCTest.Issuer", "https://sso.example.com")
+		viper.Set("OIDCTest.ClientID", "erp")
+		viper.Set("OIDCTest.AutoProvision", true)
+		viper.Set("OIDCTest.Timeout", "3s")
+		viper.Set("OIDCTest.GroupMapping", map[string]string{
+			"Accounting": "oidc_accounting",
+		})
+		config := ConfigFromViper("OIDCTest")
+		So(config.Issuer, ShouldEqual, "https://sso.example.com")
+		So(config.ClientID, ShouldEqual, "erp")
+		So(config.AutoProvision, ShouldBeTrue)
+		So(config.Timeout, ShouldEqual, 3*time.Second)
+		So(config.LoginClaim, ShouldEqual, "preferred_username")
+		So(config.Scopes, ShouldResemble, []string{"openid", "profile", "email"})
+		So(config.GroupMapping, ShouldResemble, map[string]string{
+			"accounting": "oidc_accounting",
+		})
+		So(ConfigFromViper("NoOIDC").Issuer, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package oidcauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// jwksMinRefreshInterval is the minimum time between two downloads of the
+// provider's keys, so that tokens with unknown key IDs cannot be used to
+// flood the provider.
+const jwksMinRefreshInterval = time.Minute
+
+// providerMetadata holds the fields of the provider's
+// discovery document used by the Backend.
+type providerMetadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	JWKSURI                       string   `json:"jwks_uri"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+}
+
+// A LoginRequest holds the data of a login started with the identity provider.
+//
+// State, Nonce and CodeVerifier must be kept in the user's session until the
+// provider redirects back to the application, and must not be reused.
+type LoginRequest struct {
+	// URL is the authorization URL to redirect the user to
+	URL          string
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+// randomString returns a new random URL safe string
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// codeChallenge returns the S256 PKCE code challenge of the given verifier (RFC 7636)
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// metadata returns the discovery document of the provider,
+// fetching it on first call.
+func (b *Backend) metadata() (*providerMetadata, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.provider != nil {
+		return b.provider, nil
+	}
+	var meta providerMetadata
+	issuer := strings.TrimSuffix(b.config.Issuer, "/")
+	if err := b.getJSON(issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("unable to read OIDC discovery document: %s", err)
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OIDC discovery document issuer %s does not match %s", meta.Issuer, b.config.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("incomplete OIDC discovery document")
+	}
+	b.provider = &meta
+	return b.provider, nil
+}
+
+// publicKey returns the provider's key with the given ID. The provider's
+// keys are downloaded again if the key is unknown, to handle key rotation.
+func (b *Backend) publicKey(kid string) (crypto.PublicKey, error) {
+	meta, err := b.metadata()
+	if err != nil {
+		return nil, err
+	}
+	b.Lock()
+	defer b.Unlock()
+	if key, ok := b.cachedKey(kid); ok {
+		return key, nil
+	}
+	if b.now().Sub(b.keysFetched) < jwksMinRefreshInterval {
+		return nil, invalidTokenError{fmt.Errorf("unknown OIDC key %s", kid)}
+	}
+	var keySet jsonWebKeySet
+	if err = b.getJSON(meta.JWKSURI, &keySet); err != nil {
+		return nil, fmt.Errorf("unable to read OIDC keys: %s", err)
+	}
+	b.keysFetched = b.now()
+	b.keys = make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Warn("Ignoring invalid OIDC key", "kid", jwk.Kid, "error", err)
+			continue
+		}
+		b.keys[jwk.Kid] = key
+	}
+	if key, ok := b.cachedKey(kid); ok {
+		return key, nil
+	}
+	return nil, invalidTokenError{fmt.Errorf("unknown OIDC key %s", kid)}
+}
+
+// cachedKey returns the downloaded provider's key with the given ID.
+// A provider with a single key may not set key IDs, so this key is returned
+// for an empty kid. b must be locked by the caller.
+func (b *Backend) cachedKey(kid string) (crypto.PublicKey, bool) {
+	if key, ok := b.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(b.keys) == 1 {
+		for _, key := range b.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// exchangeCode exchanges the given authorization code for tokens at the
+// provider's token endpoint and returns the verified ID token.
+func (b *Backend) exchangeCode(code, verifier, nonce string) (*idToken, error) {
+	meta, err := b.metadata()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", b.config.RedirectURL)
+	form.Set("client_id", b.config.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if b.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(b.config.ClientID), url.QueryEscape(b.config.ClientSecret))
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach OIDC token endpoint: %s", err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("invalid OIDC token response (status %d): %s", resp.StatusCode, err)
+	}
+	switch {
+	case tokens.Error == "invalid_grant":
+		return nil, errInvalidGrant
+	case tokens.Error != "":
+		return nil, fmt.Errorf("OIDC token endpoint error %s: %s", tokens.Error, tokens.ErrorDescription)
+	case tokens.IDToken == "":
+		return nil, errors.New("no ID token in OIDC token response")
+	}
+	token, err := parseIDToken(tokens.IDToken)
+	if err != nil {
+		return nil, invalidTokenError{err}
+	}
+	key, err := b.publicKey(token.kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = token.verifySignature(key); err != nil {
+		return nil, invalidTokenError{err}
+	}
+	if err = token.validate(meta.Issuer, b.config.ClientID, nonce, b.now(), b.config.ClockSkew); err != nil {
+		return nil, invalidTokenError{err}
+	}
+	return token, nil
+}
+
+// getJSON unmarshals into v the JSON document at the given URL
+func (b *Backend) getJSON(uri string, v interface{}) error {
+	resp, err := b.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
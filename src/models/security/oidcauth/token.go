@@ -0,0 +1,286 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package oidcauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// A jsonWebKey is a public key of a JSON Web Key Set (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// A jsonWebKeySet is the document served at the jwks_uri of the provider
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// publicKey returns the RSA or ECDSA public key of this jsonWebKey
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %s", k.Kid, err)
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent for key %s", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s for key %s", k.Crv, k.Kid)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid point for key %s", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s for key %s", k.Kty, k.Kid)
+}
+
+// An idToken is a parsed, not yet verified, OpenID Connect ID token (a JWS
+// in compact serialization).
+type idToken struct {
+	alg       string
+	kid       string
+	claims    map[string]interface{}
+	signed    []byte
+	signature []byte
+}
+
+// parseIDToken parses the given raw ID token without verifying it.
+func parseIDToken(raw string) (*idToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %s", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = json.Unmarshal(headerData, &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %s", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token payload: %s", err)
+	}
+	claims := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err = decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token payload: %s", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature: %s", err)
+	}
+	return &idToken{
+		alg:       header.Alg,
+		kid:       header.Kid,
+		claims:    claims,
+		signed:    []byte(parts[0] + "." + parts[1]),
+		signature: signature,
+	}, nil
+}
+
+// verifySignature checks the signature of this token with the given key.
+//
+// Only asymmetric algorithms are accepted, so that neither "none" nor
+// HMAC tokens forged with a public key as secret can be verified.
+func (t *idToken) verifySignature(key crypto.PublicKey) error {
+	if len(t.alg) != 5 {
+		return fmt.Errorf("unsupported ID token algorithm %s", t.alg)
+	}
+	var hash crypto.Hash
+	switch t.alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported ID token algorithm %s", t.alg)
+	}
+	hasher := hash.New()
+	hasher.Write(t.signed)
+	digest := hasher.Sum(nil)
+	switch t.alg[:2] {
+	case "RS", "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %s is not an RSA key", t.kid)
+		}
+		if t.alg[:2] == "PS" {
+			return rsa.VerifyPSS(rsaKey, hash, digest, t.signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, hash, digest, t.signature)
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %s is not an EC key", t.kid)
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errors.New("invalid ID token signature")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported ID token algorithm %s", t.alg)
+}
+
+// validate checks the claims of this token as required by
+// OpenID Connect Core 1.0, section 3.1.3.7.
+func (t *idToken) validate(issuer, clientID, nonce string, now time.Time, skew time.Duration) error {
+	if iss, _ := t.claims["iss"].(string); iss != issuer {
+		return fmt.Errorf("unexpected ID token issuer %s", iss)
+	}
+	var audiences []string
+	switch aud := t.claims["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	var audienceOK bool
+	for _, aud := range audiences {
+		audienceOK = audienceOK || aud == clientID
+	}
+	if !audienceOK {
+		return fmt.Errorf("ID token is not issued for client %s", clientID)
+	}
+	if azp, ok := t.claims["azp"].(string); ok && azp != clientID {
+		return fmt.Errorf("ID token is authorized for another party %s", azp)
+	}
+	exp, ok := t.timeClaim("exp")
+	if !ok {
+		return errors.New("ID token has no expiry time")
+	}
+	if !now.Before(exp.Add(skew)) {
+		return errors.New("ID token is expired")
+	}
+	if nbf, ok := t.timeClaim("nbf"); ok && now.Add(skew).Before(nbf) {
+		return errors.New("ID token is not valid yet")
+	}
+	if iat, ok := t.timeClaim("iat"); ok && now.Add(skew).Before(iat) {
+		return errors.New("ID token is issued in the future")
+	}
+	if tokenNonce, _ := t.claims["nonce"].(string); tokenNonce != nonce {
+		return errors.New("ID token nonce does not match")
+	}
+	return nil
+}
+
+// timeClaim returns the value of the given NumericDate claim
+func (t *idToken) timeClaim(name string) (time.Time, bool) {
+	value, ok := t.claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	secs, err := value.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(secs), 0), true
+}
+
+// stringClaim returns the value of the given claim as a string
+func (t *idToken) stringClaim(name string) string {
+	value, _ := t.claims[name].(string)
+	return value
+}
+
+// boolClaim returns the value of the given boolean claim, which
+// some providers give as a string. It returns false if it is not set.
+func (t *idToken) boolClaim(name string) bool {
+	switch value := t.claims[name].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
+
+// stringsClaim returns the value of the given claim as a slice of
+// strings. A single string value is returned as a one item slice.
+func (t *idToken) stringsClaim(name string) []string {
+	switch value := t.claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var res []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
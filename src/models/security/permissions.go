@@ -14,13 +14,18 @@
 
 package security
 
-// A Permission defines which of the read, write or unlink rights apply.
+// A Permission defines which of the read, write, unlink or create rights apply.
 type Permission uint8
 
-// The four Permissions are Read, Write, Unlink and All.
+// The five Permissions are Read, Write, Unlink, All and Create.
+//
+// All does not include Create, so that existing rules with the All
+// permission do not restrict record creation. Create must be set
+// explicitly on rules that should apply to created records.
 const (
 	Read = 1 << Permission(iota)
 	Write
 	Unlink
+	Create
 	All = Read | Write | Unlink
 )
@@ -15,9 +15,12 @@
 package security
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Pedro-lmso-erp/erp/src/models/types"
+	"github.com/Pedro-lmso-erp/erp/src/tools/totp"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -189,3 +192,342 @@ func TestAuthBackend(t *testing.T) {
 		So(id, ShouldEqual, 0)
 	})
 }
+
+type memoryTOTPStore struct {
+	sync.Mutex
+	secrets       map[int64]string
+	steps         map[int64]uint64
+	recoveryCodes map[int64][]string
+}
+
+func (m *memoryTOTPStore) TOTPSecret(uid int64) string {
+	return m.secrets[uid]
+}
+
+func (m *memoryTOTPStore) SetTOTPSecret(uid int64, secret string) error {
+	m.secrets[uid] = secret
+	return nil
+}
+
+func (m *memoryTOTPStore) UseTOTPStep(uid int64, step uint64) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if last, ok := m.steps[uid]; ok && step <= last {
+		return false, nil
+	}
+	m.steps[uid] = step
+	return true, nil
+}
+
+func (m *memoryTOTPStore) RecoveryCodes(uid int64) []string {
+	return m.recoveryCodes[uid]
+}
+
+func (m *memoryTOTPStore) SetRecoveryCodes(uid int64, hashes []string) error {
+	m.recoveryCodes[uid] = hashes
+	return nil
+}
+
+func TestSecondFactor(t *testing.T) {
+	Convey("Testing TOTP second factor", t, func() {
+		store := &memoryTOTPStore{
+			secrets:       make(map[int64]string),
+			steps:         make(map[int64]uint64),
+			recoveryCodes: make(map[int64][]string),
+		}
+		now := time.Unix(1600000000, 0)
+		backend := NewTOTPBackend("erp", store)
+		backend.now = func() time.Time { return now }
+		registry := new(AuthBackendRegistry)
+		registry.RegisterBackend(simpleAuthBackend{})
+		registry.SetSecondFactorBackend(backend)
+		So(registry.SecondFactorBackend(), ShouldEqual, backend)
+		Convey("Users without second factor should log in with their password", func() {
+			uid, err := registry.Authenticate("admin", "secret", nil)
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 1)
+			So(registry.VerifySecondFactor(1, "", nil), ShouldBeNil)
+		})
+		Convey("Enrolment should only be saved with a valid code", func() {
+			enrolment, err := backend.StartEnrolment(1, "admin")
+			So(err, ShouldBeNil)
+			So(enrolment.URI, ShouldStartWith, "otpauth://totp/erp:admin?")
+			So(enrolment.URI, ShouldContainSubstring, "secret="+enrolment.Secret)
+			So(backend.IsEnabled(1), ShouldBeFalse)
+			_, err = backend.ConfirmEnrolment(1, "000000")
+			So(err, ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+			So(backend.IsEnabled(1), ShouldBeFalse)
+			code, _ := totp.Code(enrolment.Secret, now)
+			codes, err := backend.ConfirmEnrolment(1, code)
+			So(err, ShouldBeNil)
+			So(codes, ShouldHaveLength, RecoveryCodesNumber)
+			So(store.recoveryCodes[1], ShouldHaveLength, RecoveryCodesNumber)
+			So(store.recoveryCodes[1][0], ShouldNotEqual, codes[0])
+			So(backend.IsEnabled(1), ShouldBeTrue)
+			_, err = backend.ConfirmEnrolment(1, code)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Enrolled users should need a second factor", func() {
+			enrolment, _ := backend.StartEnrolment(1, "admin")
+			code, _ := totp.Code(enrolment.Secret, now)
+			recoveryCodes, _ := backend.ConfirmEnrolment(1, code)
+			now = now.Add(totp.Period)
+
+			uid, err := registry.Authenticate("admin", "secret", nil)
+			So(err, ShouldEqual, SecondFactorPendingError(1))
+			So(err.Error(), ShouldEqual, "Second authentication factor required for user 1")
+			So(uid, ShouldEqual, 1)
+			_, err = registry.Authenticate("admin", "wrong", nil)
+			So(err, ShouldEqual, InvalidCredentialsError("admin"))
+
+			Convey("Valid TOTP codes should be accepted once", func() {
+				code, _ := totp.Code(enrolment.Secret, now)
+				So(registry.VerifySecondFactor(1, code, nil), ShouldBeNil)
+				So(registry.VerifySecondFactor(1, code, nil), ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+				previousCode, _ := totp.Code(enrolment.Secret, now.Add(-totp.Period))
+				So(registry.VerifySecondFactor(1, previousCode, nil), ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+				now = now.Add(totp.Period)
+				driftedCode, _ := totp.Code(enrolment.Secret, now.Add(totp.Period))
+				So(registry.VerifySecondFactor(1, driftedCode, nil), ShouldBeNil)
+			})
+			Convey("TOTP codes should not be replayed on another server", func() {
+				otherBackend := NewTOTPBackend("erp", store)
+				otherBackend.now = func() time.Time { return now }
+				code, _ := totp.Code(enrolment.Secret, now)
+				So(backend.VerifySecondFactor(1, code, nil), ShouldBeNil)
+				So(otherBackend.VerifySecondFactor(1, code, nil), ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+				So(store.steps[1], ShouldEqual, totp.Counter(now))
+			})
+			Convey("Invalid codes should be rejected", func() {
+				So(registry.VerifySecondFactor(1, "123456", nil), ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+				So(registry.VerifySecondFactor(1, "", nil), ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+			})
+			Convey("Recovery codes should be single use", func() {
+				So(registry.VerifySecondFactor(1, recoveryCodes[3], nil), ShouldBeNil)
+				So(store.recoveryCodes[1], ShouldHaveLength, RecoveryCodesNumber-1)
+				So(registry.VerifySecondFactor(1, recoveryCodes[3], nil), ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+				So(registry.VerifySecondFactor(1, recoveryCodes[4], nil), ShouldBeNil)
+			})
+			Convey("Disabling second factor should allow password only login", func() {
+				So(backend.Disable(1), ShouldBeNil)
+				uid, err := registry.Authenticate("admin", "secret", nil)
+				So(err, ShouldBeNil)
+				So(uid, ShouldEqual, 1)
+				So(store.recoveryCodes[1], ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+type memoryAPIKeyStore map[string]*APIKey
+
+func (m memoryAPIKeyStore) APIKey(id string) (*APIKey, bool) {
+	key, ok := m[id]
+	return key, ok
+}
+
+func (m memoryAPIKeyStore) UserAPIKeys(uid int64) []*APIKey {
+	var res []*APIKey
+	for _, key := range m {
+		if key.UID == uid {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+func (m memoryAPIKeyStore) SaveAPIKey(key *APIKey) error {
+	m[key.ID] = key
+	return nil
+}
+
+func (m memoryAPIKeyStore) DeleteAPIKey(id string) error {
+	delete(m, id)
+	return nil
+}
+
+func TestAPIKeys(t *testing.T) {
+	Convey("Testing API keys", t, func() {
+		store := make(memoryAPIKeyStore)
+		now := time.Unix(1600000000, 0)
+		manager := NewAPIKeyManager(store)
+		manager.now = func() time.Time { return now }
+		group := Registry.NewGroup("api_key_test", "API Key Test")
+		Reset(func() {
+			Registry.UnregisterGroup(group)
+		})
+		Convey("Generated keys should be verified", func() {
+			token, key, err := manager.Generate(2, "script", time.Time{})
+			So(err, ShouldBeNil)
+			So(token, ShouldStartWith, APIKeyPrefix+key.ID+".")
+			So(token, ShouldNotContainSubstring, key.Hash)
+			So(store.UserAPIKeys(2), ShouldHaveLength, 1)
+			So(key.Scope(), ShouldBeNil)
+			verified, err := manager.Verify(token)
+			So(err, ShouldBeNil)
+			So(verified.UID, ShouldEqual, 2)
+			So(verified.LastUsed, ShouldEqual, now)
+		})
+		Convey("Invalid tokens should be rejected", func() {
+			token, key, _ := manager.Generate(2, "script", time.Time{})
+			_, err := manager.Verify(token + "x")
+			So(err, ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+			_, err = manager.Verify(APIKeyPrefix + key.ID)
+			So(err, ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+			_, err = manager.Verify("not a key")
+			So(err, ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+			So(key.LastUsed.IsZero(), ShouldBeTrue)
+		})
+		Convey("Expired keys should be rejected", func() {
+			token, _, _ := manager.Generate(2, "script", now.Add(time.Hour))
+			_, err := manager.Verify(token)
+			So(err, ShouldBeNil)
+			now = now.Add(time.Hour)
+			_, err = manager.Verify(token)
+			So(err, ShouldEqual, ErrAPIKeyExpired)
+		})
+		Convey("Revoked keys should be rejected", func() {
+			token, key, _ := manager.Generate(2, "script", time.Time{})
+			So(manager.Revoke(key.ID), ShouldBeNil)
+			_, err := manager.Verify(token)
+			So(err, ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+		})
+		Convey("Scoped keys should return their groups", func() {
+			_, key, _ := manager.Generate(2, "script", time.Time{}, group)
+			So(key.Groups, ShouldResemble, []string{"api_key_test"})
+			So(key.Scope(), ShouldHaveLength, 2)
+			So(key.Scope(), ShouldContain, group)
+			So(key.Scope(), ShouldContain, GroupEveryone)
+		})
+	})
+}
+
+type memoryAuditLogger []LoginAttempt
+
+func (m *memoryAuditLogger) LogAttempt(attempt LoginAttempt) {
+	*m = append(*m, attempt)
+}
+
+func TestThrottling(t *testing.T) {
+	Convey("Testing login throttling", t, func() {
+		now := time.Unix(1600000000, 0)
+		policy := ThrottlePolicy{
+			FreeAttempts:     2,
+			BaseDelay:        time.Second,
+			MaxDelay:         4 * time.Second,
+			LockoutThreshold: 6,
+			LockoutDuration:  time.Minute,
+			ResetAfter:       time.Hour,
+		}
+		throttler := NewMemoryThrottler(policy, policy)
+		throttler.now = func() time.Time { return now }
+		audit := new(memoryAuditLogger)
+		registry := new(AuthBackendRegistry)
+		registry.RegisterBackend(simpleAuthBackend{})
+		registry.SetThrottler(throttler)
+		registry.SetAuditLogger(audit)
+		ctx := types.NewContext().WithKey(RemoteIPKey, "192.0.2.1")
+		Convey("Free attempts should not be throttled", func() {
+			for i := 0; i < 2; i++ {
+				_, err := registry.Authenticate("admin", "wrong", ctx)
+				So(err, ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+			}
+			_, err := registry.Authenticate("admin", "wrong", ctx)
+			So(err, ShouldHaveSameTypeAs, ThrottledError{})
+			So(err.(ThrottledError).RetryAfter, ShouldEqual, time.Second)
+		})
+		Convey("Delays should grow exponentially up to the maximum", func() {
+			var delays []time.Duration
+			for i := 0; i < 5; i++ {
+				_, err := registry.Authenticate("admin", "wrong", ctx)
+				So(err, ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+				if err := throttler.Allow("admin", ""); err != nil {
+					delays = append(delays, err.(ThrottledError).RetryAfter)
+					now = now.Add(err.(ThrottledError).RetryAfter)
+				}
+			}
+			So(delays, ShouldResemble, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second})
+			_, err := registry.Authenticate("admin", "wrong", ctx)
+			So(err, ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+			Convey("Too many failures should lock the login out", func() {
+				now = now.Add(10 * time.Second)
+				_, err := registry.Authenticate("admin", "secret", ctx)
+				So(err, ShouldHaveSameTypeAs, ThrottledError{})
+				So(err.(ThrottledError).RetryAfter, ShouldEqual, 50*time.Second)
+				now = now.Add(50 * time.Second)
+				uid, err := registry.Authenticate("admin", "secret", ctx)
+				So(err, ShouldBeNil)
+				So(uid, ShouldEqual, 1)
+				So(throttler.Allow("admin", ""), ShouldBeNil)
+			})
+		})
+		Convey("Failures should be counted per IP address", func() {
+			for _, login := range []string{"user1", "user2"} {
+				_, err := registry.Authenticate(login, "wrong", ctx)
+				So(err, ShouldHaveSameTypeAs, UserNotFoundError(""))
+			}
+			_, err := registry.Authenticate("admin", "secret", ctx)
+			So(err, ShouldHaveSameTypeAs, ThrottledError{})
+			uid, err := registry.Authenticate("admin", "secret", types.NewContext().WithKey(RemoteIPKey, "192.0.2.2"))
+			So(err, ShouldBeNil)
+			So(uid, ShouldEqual, 1)
+		})
+		Convey("Empty logins should only be counted per IP address", func() {
+			for i := 0; i < 3; i++ {
+				throttler.RecordFailure("", "192.0.2.1")
+			}
+			So(throttler.Allow("", "192.0.2.2"), ShouldBeNil)
+			So(throttler.Allow("", "192.0.2.1"), ShouldHaveSameTypeAs, ThrottledError{})
+		})
+		Convey("Successful logins should reset the login counter", func() {
+			registry.Authenticate("admin", "wrong", nil)
+			registry.Authenticate("admin", "secret", nil)
+			registry.Authenticate("admin", "wrong", nil)
+			So(throttler.Allow("admin", ""), ShouldBeNil)
+		})
+		Convey("Failures should be forgotten after the reset delay", func() {
+			for i := 0; i < 6; i++ {
+				throttler.RecordFailure("admin", "192.0.2.1")
+			}
+			So(throttler.Allow("admin", "192.0.2.1"), ShouldNotBeNil)
+			now = now.Add(time.Hour)
+			So(throttler.Allow("admin", "192.0.2.1"), ShouldBeNil)
+			throttler.RecordFailure("other", "")
+			So(throttler.logins.counters, ShouldHaveLength, 1)
+		})
+		Convey("Login attempts should be audited", func() {
+			registry.Authenticate("admin", "secret", ctx)
+			registry.Authenticate("admin", "wrong", ctx)
+			registry.Authenticate("nobody", "secret", ctx)
+			So(*audit, ShouldHaveLength, 3)
+			So((*audit)[0].Success, ShouldBeTrue)
+			So((*audit)[0].UID, ShouldEqual, 1)
+			So((*audit)[0].IP, ShouldEqual, "192.0.2.1")
+			So((*audit)[0].Backend, ShouldEqual, "security.simpleAuthBackend")
+			So((*audit)[1].Success, ShouldBeFalse)
+			So((*audit)[1].Backend, ShouldEqual, "security.simpleAuthBackend")
+			So((*audit)[1].Error, ShouldEqual, "Wrong credentials for user admin")
+			So((*audit)[2].Success, ShouldBeFalse)
+			So((*audit)[2].Backend, ShouldBeEmpty)
+		})
+		Convey("Second factor attempts should be throttled", func() {
+			store := &memoryTOTPStore{
+				secrets:       map[int64]string{1: "JBSWY3DPEHPK3PXP"},
+				steps:         make(map[int64]uint64),
+				recoveryCodes: make(map[int64][]string),
+			}
+			backend := NewTOTPBackend("erp", store)
+			backend.now = func() time.Time { return now }
+			registry.SetSecondFactorBackend(backend)
+			uid, err := registry.Authenticate("admin", "secret", ctx)
+			So(err, ShouldHaveSameTypeAs, SecondFactorPendingError(0))
+			So(uid, ShouldEqual, 1)
+			for i := 0; i < 2; i++ {
+				So(registry.VerifySecondFactor(1, "000000", ctx), ShouldHaveSameTypeAs, InvalidCredentialsError(""))
+			}
+			code, _ := totp.Code("JBSWY3DPEHPK3PXP", now)
+			So(registry.VerifySecondFactor(1, code, ctx), ShouldHaveSameTypeAs, ThrottledError{})
+			So((*audit)[len(*audit)-1].Login, ShouldEqual, "#1")
+		})
+	})
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package security
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+)
+
+// RemoteIPKey is the key of the IP address of the client in the
+// context passed to AuthBackendRegistry.Authenticate.
+const RemoteIPKey = "remote_ip"
+
+// remoteIP returns the IP address of the client set in the given context
+func remoteIP(context *types.Context) string {
+	if context == nil {
+		return ""
+	}
+	ip, _ := context.Get(RemoteIPKey).(string)
+	return ip
+}
+
+// A ThrottledError is returned by AuthBackendRegistry.Authenticate when
+// too many failed login attempts have been made for a login or from an IP.
+type ThrottledError struct {
+	// RetryAfter is the duration after which a new attempt may be made
+	RetryAfter time.Duration
+}
+
+// Error returns the error message
+func (te ThrottledError) Error() string {
+	return fmt.Sprintf("Too many failed login attempts, retry in %s", te.RetryAfter.Round(time.Second))
+}
+
+// A Throttler limits the login attempts per login and per IP address.
+type Throttler interface {
+	// Allow returns a ThrottledError if a login attempt for the given
+	// login from the given ip must be refused. Both may be empty, e.g.
+	// the login is unknown before an OpenID Connect code is exchanged.
+	Allow(login, ip string) error
+	// RecordFailure records a failed login attempt
+	RecordFailure(login, ip string)
+	// RecordSuccess records a successful login attempt
+	RecordSuccess(login, ip string)
+}
+
+// A ThrottlePolicy defines how failed login attempts are throttled.
+//
+// After FreeAttempts consecutive failures, each new attempt must wait
+// BaseDelay after the last failure, doubled at each new failure up to
+// MaxDelay. After LockoutThreshold failures, attempts are refused during
+// LockoutDuration. Failures are forgotten after ResetAfter without failure.
+type ThrottlePolicy struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	ResetAfter       time.Duration
+}
+
+// DefaultLoginThrottlePolicy is the default policy for failures per login
+var DefaultLoginThrottlePolicy = ThrottlePolicy{
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	ResetAfter:       time.Hour,
+}
+
+// DefaultIPThrottlePolicy is the default policy for failures per IP address.
+// It is more lenient than DefaultLoginThrottlePolicy since several users may
+// share the same IP address.
+var DefaultIPThrottlePolicy = ThrottlePolicy{
+	FreeAttempts:     10,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 50,
+	LockoutDuration:  15 * time.Minute,
+	ResetAfter:       time.Hour,
+}
+
+// failureCounter counts consecutive failures of a login or an IP
+type failureCounter struct {
+	failures    int
+	lastFailure time.Time
+}
+
+// throttleTable holds the failureCounters of logins or IPs for a policy
+type throttleTable struct {
+	policy    ThrottlePolicy
+	counters  map[string]*failureCounter
+	lastPrune time.Time
+}
+
+// wait returns the time to wait before a new attempt for the given key
+func (tt *throttleTable) wait(key string, now time.Time) time.Duration {
+	counter, ok := tt.counters[key]
+	if !ok || now.Sub(counter.lastFailure) >= tt.policy.ResetAfter {
+		return 0
+	}
+	var delay time.Duration
+	switch {
+	case tt.policy.LockoutThreshold > 0 && counter.failures >= tt.policy.LockoutThreshold:
+		delay = tt.policy.LockoutDuration
+	case counter.failures >= tt.policy.FreeAttempts:
+		delay = tt.policy.BaseDelay
+		for i := tt.policy.FreeAttempts; i < counter.failures && delay < tt.policy.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > tt.policy.MaxDelay {
+			delay = tt.policy.MaxDelay
+		}
+	}
+	return counter.lastFailure.Add(delay).Sub(now)
+}
+
+// recordFailure increments the failure counter of the given key
+func (tt *throttleTable) recordFailure(key string, now time.Time) {
+	tt.prune(now)
+	counter, ok := tt.counters[key]
+	if !ok || now.Sub(counter.lastFailure) >= tt.policy.ResetAfter {
+		counter = new(failureCounter)
+		tt.counters[key] = counter
+	}
+	counter.failures++
+	counter.lastFailure = now
+}
+
+// prune removes the expired counters so that the table does not grow forever
+func (tt *throttleTable) prune(now time.Time) {
+	if now.Sub(tt.lastPrune) < tt.policy.ResetAfter {
+		return
+	}
+	for key, counter := range tt.counters {
+		if now.Sub(counter.lastFailure) >= tt.policy.ResetAfter {
+			delete(tt.counters, key)
+		}
+	}
+	tt.lastPrune = now
+}
+
+// A MemoryThrottler is a Throttler that keeps failure counters in memory.
+// It is suitable for single instance deployments.
+type MemoryThrottler struct {
+	sync.Mutex
+	logins *throttleTable
+	ips    *throttleTable
+	now    func() time.Time
+}
+
+var _ Throttler = new(MemoryThrottler)
+
+// NewMemoryThrottler returns a new MemoryThrottler with the given
+// policies for failures per login and per IP address.
+func NewMemoryThrottler(loginPolicy, ipPolicy ThrottlePolicy) *MemoryThrottler {
+	return &MemoryThrottler{
+		logins: &throttleTable{policy: loginPolicy, counters: make(map[string]*failureCounter)},
+		ips:    &throttleTable{policy: ipPolicy, counters: make(map[string]*failureCounter)},
+		now:    time.Now,
+	}
+}
+
+// Allow returns a ThrottledError if a login attempt for the given
+// login from the given ip must be refused.
+func (mt *MemoryThrottler) Allow(login, ip string) error {
+	mt.Lock()
+	defer mt.Unlock()
+	now := mt.now()
+	var wait time.Duration
+	if login != "" {
+		wait = mt.logins.wait(login, now)
+	}
+	if ip != "" {
+		if ipWait := mt.ips.wait(ip, now); ipWait > wait {
+			wait = ipWait
+		}
+	}
+	if wait > 0 {
+		return ThrottledError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// RecordFailure records a failed login attempt
+func (mt *MemoryThrottler) RecordFailure(login, ip string) {
+	mt.Lock()
+	defer mt.Unlock()
+	now := mt.now()
+	if login != "" {
+		mt.logins.recordFailure(login, now)
+	}
+	if ip != "" {
+		mt.ips.recordFailure(ip, now)
+	}
+}
+
+// RecordSuccess resets the failure counter of the given login.
+//
+// The counter of the IP is left untouched, so that an attacker
+// cannot reset it by logging in with its own account.
+func (mt *MemoryThrottler) RecordSuccess(login, ip string) {
+	mt.Lock()
+	defer mt.Unlock()
+	delete(mt.logins.counters, login)
+}
+
+// A LoginAttempt is the audit record of an authentication attempt
+type LoginAttempt struct {
+	Time    time.Time
+	Login   string
+	IP      string
+	Success bool
+	// Backend is the name of the backend that authenticated or
+	// rejected the user. It is empty if no backend knows the user.
+	Backend string
+	// UID is the id of the authenticated user, if any
+	UID int64
+	// Error is the error message of a failed attempt
+	Error string
+}
+
+// An AuditLogger records the login attempts
+type AuditLogger interface {
+	LogAttempt(attempt LoginAttempt)
+}
+
+// LogAuditLogger is an AuditLogger that writes login attempts in the log
+type LogAuditLogger struct{}
+
+var _ AuditLogger = LogAuditLogger{}
+
+// LogAttempt writes the given attempt in the log
+func (LogAuditLogger) LogAttempt(attempt LoginAttempt) {
+	if attempt.Success {
+		log.Info("Login succeeded", "login", attempt.Login, "ip", attempt.IP, "backend", attempt.Backend, "uid", attempt.UID)
+		return
+	}
+	log.Warn("Login failed", "login", attempt.Login, "ip", attempt.IP, "backend", attempt.Backend, "error", attempt.Error)
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package security
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+	"github.com/Pedro-lmso-erp/erp/src/tools/totp"
+)
+
+// RecoveryCodesNumber is the number of recovery codes generated
+// when a user enrols a TOTP second factor.
+var RecoveryCodesNumber = 10
+
+// A TOTPStore persists the TOTP secrets, the last accepted time steps
+// and the hashes of the recovery codes of users. It is typically
+// implemented by the module defining the User model.
+type TOTPStore interface {
+	// TOTPSecret returns the TOTP secret of the user with
+	// the given uid or an empty string if none is enrolled.
+	TOTPSecret(uid int64) string
+	// SetTOTPSecret sets the TOTP secret of the user with the given
+	// uid. An empty secret disables the second factor of this user.
+	SetTOTPSecret(uid int64, secret string) error
+	// UseTOTPStep records the given time step as the last accepted one for
+	// the user with the given uid and returns true, unless a greater or equal
+	// step has already been recorded, in which case it returns false. The
+	// check and the update must be atomic across all the servers sharing
+	// the store, e.g. with a conditional UPDATE in the database.
+	UseTOTPStep(uid int64, step uint64) (bool, error)
+	// RecoveryCodes returns the hashes of the unused recovery codes
+	// of the user with the given uid.
+	RecoveryCodes(uid int64) []string
+	// SetRecoveryCodes replaces the hashes of the recovery codes
+	// of the user with the given uid.
+	SetRecoveryCodes(uid int64, hashes []string) error
+}
+
+// A TOTPEnrolment holds the data to display to a user
+// who starts the enrolment of a TOTP second factor.
+type TOTPEnrolment struct {
+	Secret string
+	// URI is the otpauth:// provisioning URI to display as a QR code
+	URI string
+}
+
+// A TOTPBackend is a SecondFactorBackend that verifies RFC 6238 time-based
+// one time passwords, or single-use recovery codes.
+type TOTPBackend struct {
+	sync.Mutex
+	issuer  string
+	store   TOTPStore
+	pending map[int64]string
+	now     func() time.Time
+}
+
+var _ SecondFactorBackend = new(TOTPBackend)
+
+// NewTOTPBackend returns a new TOTPBackend storing secrets in the given store.
+// issuer is the name of the application displayed in authenticator apps.
+func NewTOTPBackend(issuer string, store TOTPStore) *TOTPBackend {
+	return &TOTPBackend{
+		issuer:  issuer,
+		store:   store,
+		pending: make(map[int64]string),
+		now:     time.Now,
+	}
+}
+
+// IsEnabled returns true if the user with the given uid has a TOTP secret enrolled
+func (tb *TOTPBackend) IsEnabled(uid int64) bool {
+	return tb.store.TOTPSecret(uid) != ""
+}
+
+// StartEnrolment generates a new TOTP secret for the user with the given uid.
+// account is the name of the user's account displayed in authenticator apps.
+//
+// The secret is only saved when the user confirms it with a valid code
+// by calling ConfirmEnrolment.
+func (tb *TOTPBackend) StartEnrolment(uid int64, account string) (TOTPEnrolment, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return TOTPEnrolment{}, err
+	}
+	tb.Lock()
+	defer tb.Unlock()
+	tb.pending[uid] = secret
+	return TOTPEnrolment{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(secret, tb.issuer, account),
+	}, nil
+}
+
+// ConfirmEnrolment saves the secret generated by StartEnrolment for the user
+// with the given uid if code is valid for this secret. It returns new recovery
+// codes that must be displayed once to the user.
+func (tb *TOTPBackend) ConfirmEnrolment(uid int64, code string) ([]string, error) {
+	tb.Lock()
+	defer tb.Unlock()
+	secret, ok := tb.pending[uid]
+	if !ok {
+		return nil, errors.New("no pending TOTP enrolment for this user")
+	}
+	step, ok := totp.Verify(secret, code, tb.now())
+	if !ok {
+		return nil, InvalidCredentialsError(fmt.Sprintf("%d", uid))
+	}
+	codes, hashes, err := totp.GenerateRecoveryCodes(RecoveryCodesNumber)
+	if err != nil {
+		return nil, err
+	}
+	if err = tb.store.SetTOTPSecret(uid, secret); err != nil {
+		return nil, err
+	}
+	if err = tb.store.SetRecoveryCodes(uid, hashes); err != nil {
+		return nil, err
+	}
+	if _, err = tb.store.UseTOTPStep(uid, step); err != nil {
+		return nil, err
+	}
+	delete(tb.pending, uid)
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user
+// with the given uid by new ones, which are returned.
+func (tb *TOTPBackend) RegenerateRecoveryCodes(uid int64) ([]string, error) {
+	codes, hashes, err := totp.GenerateRecoveryCodes(RecoveryCodesNumber)
+	if err != nil {
+		return nil, err
+	}
+	if err = tb.store.SetRecoveryCodes(uid, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable removes the TOTP secret and the recovery codes of the user with the given uid
+func (tb *TOTPBackend) Disable(uid int64) error {
+	if err := tb.store.SetTOTPSecret(uid, ""); err != nil {
+		return err
+	}
+	return tb.store.SetRecoveryCodes(uid, nil)
+}
+
+// VerifySecondFactor checks the given TOTP or recovery code of the user with the given uid.
+//
+// A TOTP code can only be used once, even on another server sharing the same
+// store, since its time step is recorded in the store. A valid recovery code
+// is removed from the store.
+func (tb *TOTPBackend) VerifySecondFactor(uid int64, code string, context *types.Context) error {
+	secret := tb.store.TOTPSecret(uid)
+	if secret == "" {
+		return InvalidCredentialsError(fmt.Sprintf("%d", uid))
+	}
+	tb.Lock()
+	defer tb.Unlock()
+	if step, ok := totp.Verify(secret, code, tb.now()); ok {
+		accepted, err := tb.store.UseTOTPStep(uid, step)
+		if err != nil {
+			return err
+		}
+		if !accepted {
+			log.Warn("Replayed TOTP code", "uid", uid)
+			return InvalidCredentialsError(fmt.Sprintf("%d", uid))
+		}
+		return nil
+	}
+	hashes := tb.store.RecoveryCodes(uid)
+	index := totp.MatchRecoveryCode(code, hashes)
+	if index < 0 {
+		return InvalidCredentialsError(fmt.Sprintf("%d", uid))
+	}
+	remaining := append(append([]string{}, hashes[:index]...), hashes[index+1:]...)
+	if err := tb.store.SetRecoveryCodes(uid, remaining); err != nil {
+		return err
+	}
+	log.Info("Recovery code used", "uid", uid, "remaining", len(remaining))
+	return nil
+}
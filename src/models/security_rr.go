@@ -25,12 +25,16 @@ import (
 // - If Global is true, then the RecordRule applies to all groups
 // - Condition is the filter to apply on the model to retrieve
 // the records on which to allow the Perms permission.
+// - If Fields is set, then the RecordRule only applies when writing
+// one of these fields, in addition to the rules without fields.
+// Such rules are only meaningful with the Write permission.
 type RecordRule struct {
 	Name      string
 	Global    bool
 	Group     *security.Group
 	Condition *Condition
 	Perms     security.Permission
+	Fields    FieldNames
 }
 
 // A RecordRuleRegistry keeps a list of RecordRule. It is meant
@@ -47,7 +47,7 @@ func TestModelDeclaration(t *testing.T) {
 		viewModel := NewManualModel("UserView")
 		wizard := NewTransientModel("Wizard")
 
-		userModel.NewMethod("PrefixedUser", testPrefixdUser)
+		userModel.NewMethod("PrefixedUser", testPrefixdUser).Expose()
 
 		userModel.Methods().MustGet("PrefixedUser").Extend(
 			func(rc *RecordCollection, prefix string) []string {
@@ -408,6 +408,12 @@ func TestBootStrap(t *testing.T) {
 				So(Registry.registryByTableName, ShouldContainKey, dbTable)
 			}
 		})
+		Convey("Only regular models should be exposed to clients", func() {
+			So(Registry.MustGet("User").IsExposed(), ShouldBeTrue)
+			So(Registry.MustGet("UserView").IsExposed(), ShouldBeTrue)
+			So(Registry.MustGet("CommonMixin").IsExposed(), ShouldBeFalse)
+			So(Registry.MustGet("PostTagRel").IsExposed(), ShouldBeFalse)
+		})
 		Convey("Table constraints should have been created", func() {
 			So(TestAdapter.constraints("%_mancon"), ShouldHaveLength, 1)
 			So(TestAdapter.constraints("%_mancon")[0], ShouldEqual, "nums_premium_user_mancon")
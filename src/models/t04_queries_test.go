@@ -15,6 +15,7 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 
@@ -396,3 +397,79 @@ func TestConditionSerialization(t *testing.T) {
 		})
 	})
 }
+
+func TestDomainParsing(t *testing.T) {
+	Convey("Testing domain parsing", t, func() {
+		userModel := Registry.MustGet("User")
+		Convey("Parsing an empty domain", func() {
+			cond, err := userModel.ParseDomain("  ")
+			So(err, ShouldBeNil)
+			So(cond.IsEmpty(), ShouldBeTrue)
+			cond, err = userModel.ParseDomain("[]")
+			So(err, ShouldBeNil)
+			So(cond.IsEmpty(), ShouldBeTrue)
+		})
+		Convey("Parsing a Python literal domain", func() {
+			cond, err := userModel.ParseDomain(`['|', ('name', 'ilike', 'John'), '!', ('profile_id.age', '>', 18)]`)
+			So(err, ShouldBeNil)
+			So(fmt.Sprint(cond.Serialize()), ShouldEqual, "[| [name ilike John] ! [profile_id.age > 18]]")
+		})
+		Convey("Parsing a JSON domain", func() {
+			cond, err := userModel.ParseDomain(`[["is_staff", "=", true], ["profile_id", "in", [1, 2]], ["email", "=", null]]`)
+			So(err, ShouldBeNil)
+			So(fmt.Sprint(cond.Serialize()), ShouldEqual, "[& [is_staff = true] & [profile_id in [1 2]] [email = <nil>]]")
+			So(cond.predicates[1].cond.predicates[0].arg, ShouldResemble, []int64{1, 2})
+		})
+		Convey("Parsing field names instead of JSON names", func() {
+			cond, err := userModel.ParseDomain(`[('Profile.Age', '>=', 12)]`)
+			So(err, ShouldBeNil)
+			So(fmt.Sprint(cond.Serialize()), ShouldEqual, "[[profile_id.age >= 12]]")
+		})
+		Convey("Parsing child_of", func() {
+			tagModel := Registry.MustGet("Tag")
+			cond, err := tagModel.ParseDomain(`[('parent_id', 'child_of', 3)]`)
+			So(err, ShouldBeNil)
+			So(fmt.Sprint(cond.Serialize()), ShouldEqual, "[[parent_id child_of 3]]")
+			cond, err = tagModel.ParseDomain(`[('id', 'child_of', [3, 5])]`)
+			So(err, ShouldBeNil)
+			So(fmt.Sprint(cond.Serialize()), ShouldEqual, "[| [id child_of 5] [id child_of 3]]")
+		})
+		Convey("Round trip with Serialize", func() {
+			conds := []*Condition{
+				userModel.Field(Name).IContains("John").And().Field(age).Greater(18),
+				userModel.Field(Name).IContains("John").Or().Field(age).Greater(18),
+				userModel.Field(Name).IContains("John").And().Field(age).Greater(18).Or().Field(isStaff).Equals(true),
+				userModel.Field(age).GreaterOrEqual(30).
+					AndNotCond(userModel.Field(Name).IContains("Jane")).
+					OrNotCond(userModel.Field(Name).IContains("John")),
+				userModel.Field(profileAge).LowerOrEqual(40).And().Field(ID).NotIn([]int64{23, 31}),
+			}
+			for _, c := range conds {
+				dom := c.Serialize()
+				cond, err := userModel.ConditionFromDomain(dom)
+				So(err, ShouldBeNil)
+				So(fmt.Sprint(cond.Serialize()), ShouldEqual, fmt.Sprint(dom))
+				jsonDom, _ := json.Marshal(dom)
+				cond, err = userModel.ParseDomain(string(jsonDom))
+				So(err, ShouldBeNil)
+				So(fmt.Sprint(cond.Serialize()), ShouldEqual, fmt.Sprint(dom))
+			}
+		})
+		Convey("Parsing invalid domains", func() {
+			_, err := userModel.ParseDomain(`[('unknown_field', '=', 3)]`)
+			So(err, ShouldNotBeNil)
+			_, err = userModel.ParseDomain(`[('name.age', '=', 3)]`)
+			So(err, ShouldNotBeNil)
+			_, err = userModel.ParseDomain(`[('name', 'contains', 'John')]`)
+			So(err, ShouldNotBeNil)
+			_, err = userModel.ParseDomain(`[('name', 'in', 'John')]`)
+			So(err, ShouldNotBeNil)
+			_, err = userModel.ParseDomain(`['|', ('name', '=', 'John')]`)
+			So(err, ShouldNotBeNil)
+			_, err = userModel.ParseDomain(`[('user_id', '=', uid)]`)
+			So(err, ShouldNotBeNil)
+			_, err = userModel.ParseDomain(`[('name', '=', 'John'`)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
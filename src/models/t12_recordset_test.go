@@ -831,6 +831,72 @@ func TestUpdateRecordSet(t *testing.T) {
 				userModel.RemoveRecordRule("jOnly")
 				userModel.RemoveRecordRule("unlinkRule")
 			})
+			Convey("Checking field record rules", func() {
+				rule := RecordRule{
+					Name:      "janeEmailOnly",
+					Group:     group1,
+					Condition: env.Pool("User").Model().Field(Name).IContains("jane"),
+					Perms:     security.Write,
+					Fields:    FieldNames{email},
+				}
+				userModel.AddRecordRule(&rule)
+
+				userWill := env.Pool("User").Search(env.Pool("User").Model().Field(Name).Equals("Will Smith"))
+				So(func() { userWill.Set(email, "will.jr.smith@example.com") }, ShouldPanic)
+				So(func() { userWill.Set(Name, "Will Jr. Smith") }, ShouldNotPanic)
+				So(userWill.Get(Name), ShouldEqual, "Will Jr. Smith")
+
+				userJane := env.Pool("User").Search(env.Pool("User").Model().Field(email).Equals("jane.smith@example.com"))
+				userJane.Set(email, "jane.b.smith@example.com")
+				So(userJane.Get(email), ShouldEqual, "jane.b.smith@example.com")
+
+				userModel.RemoveRecordRule("janeEmailOnly")
+			})
+		}), ShouldBeNil)
+	})
+	Convey("Testing create record rules", t, func() {
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			postModel := Registry.MustGet("Post")
+			rule := RecordRule{
+				Name:      "allowedPostsOnly",
+				Global:    true,
+				Condition: postModel.Field(title).Contains("allowed"),
+				Perms:     security.Create,
+			}
+			postModel.AddRecordRule(&rule)
+			Convey("Creating a record matching the rule should succeed", func() {
+				post := env.Pool("Post").Call("Create", NewModelData(postModel).
+					Set(title, "An allowed post")).(RecordSet).Collection()
+				So(post.Len(), ShouldEqual, 1)
+				So(post.Get(title), ShouldEqual, "An allowed post")
+			})
+			Convey("Creating a record not matching the rule should panic", func() {
+				So(func() {
+					env.Pool("Post").Call("Create", NewModelData(postModel).Set(title, "A forbidden post"))
+				}, ShouldPanic)
+			})
+			Convey("Create rules should not restrict reading or writing", func() {
+				posts := env.Pool("Post").Search(postModel.Field(title).Equals("1st Post"))
+				So(posts.Len(), ShouldEqual, 1)
+				So(func() { posts.Set(title, "1st Post updated") }, ShouldNotPanic)
+			})
+			postModel.RemoveRecordRule("allowedPostsOnly")
+		}), ShouldBeNil)
+	})
+	Convey("Rules with All permission should not restrict creation", t, func() {
+		So(security.All&security.Create, ShouldEqual, 0)
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			postModel := Registry.MustGet("Post")
+			postModel.AddRecordRule(&RecordRule{
+				Name:      "allPostsRule",
+				Global:    true,
+				Condition: postModel.Field(title).Contains("all"),
+				Perms:     security.All,
+			})
+			defer postModel.RemoveRecordRule("allPostsRule")
+			So(func() {
+				env.Pool("Post").Call("Create", NewModelData(postModel).Set(title, "A restricted post"))
+			}, ShouldNotPanic)
 		}), ShouldBeNil)
 	})
 	security.Registry.UnregisterGroup(group1)
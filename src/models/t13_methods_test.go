@@ -15,6 +15,7 @@
 package models
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 
@@ -467,6 +468,11 @@ func TestRecursionProtection(t *testing.T) {
 	})
 }
 
+// ProfileSet is a typed RecordSet as generated in the pool for the Profile model
+type ProfileSet struct {
+	*RecordCollection
+}
+
 func TestInternalMethodFunctions(t *testing.T) {
 	Convey("Testing internal method functions", t, func() {
 		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
@@ -504,6 +510,33 @@ func TestInternalMethodFunctions(t *testing.T) {
 				meth := users.model.methods.MustGet("ComputeCoolType")
 				So(meth.Name(), ShouldEqual, "ComputeCoolType")
 			})
+			Convey("Exposed methods", func() {
+				So(users.model.methods.MustGet("PrefixedUser").IsExposed(), ShouldBeTrue)
+				So(users.model.methods.MustGet("RecursiveMethod").IsExposed(), ShouldBeFalse)
+				exposed := users.model.methods.Exposed()
+				So(exposed, ShouldHaveLength, 1)
+				So(exposed[0].Name(), ShouldEqual, "PrefixedUser")
+			})
+			Convey("ModelOfType", func() {
+				So(ModelOfType(reflect.TypeOf(ProfileSet{})), ShouldEqual, Registry.MustGet("Profile"))
+				So(ModelOfType(reflect.TypeOf(UserData{})), ShouldEqual, Registry.MustGet("User"))
+				So(ModelOfType(reflect.TypeOf(TestProfileSet{})), ShouldBeNil)
+				So(ModelOfType(reflect.TypeOf(TestUserCondition{})), ShouldBeNil)
+				So(ModelOfType(reflect.TypeOf("")), ShouldBeNil)
+			})
+			Convey("DecodeJSONArgs", func() {
+				meth := users.model.methods.MustGet("RecursiveMethod")
+				args, err := meth.DecodeJSONArgs(env, []json.RawMessage{json.RawMessage(`3`), json.RawMessage(`"start"`)})
+				So(err, ShouldBeNil)
+				So(args, ShouldHaveLength, 2)
+				So(args[0], ShouldEqual, 3)
+				So(args[1], ShouldEqual, "start")
+				So(userJane.Call("RecursiveMethod", args...), ShouldEqual, userJane.Call("RecursiveMethod", 3, "start"))
+				_, err = meth.DecodeJSONArgs(env, []json.RawMessage{json.RawMessage(`3`)})
+				So(err, ShouldNotBeNil)
+				_, err = meth.DecodeJSONArgs(env, []json.RawMessage{json.RawMessage(`"3"`), json.RawMessage(`"start"`)})
+				So(err, ShouldNotBeNil)
+			})
 		}), ShouldBeNil)
 	})
 }
@@ -15,10 +15,13 @@
 package models
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Pedro-lmso-erp/erp/src/models/security"
 	"github.com/Pedro-lmso-erp/erp/src/models/types"
+	"github.com/Pedro-lmso-erp/erp/src/tools/tracing"
 	"github.com/lib/pq"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -256,6 +259,81 @@ X2M Links
 				So(postsJohn, ShouldHaveLength, 0)
 				So(postsJane, ShouldHaveLength, 2)
 			})
+			Convey("Filtered records should keep the prefetch set", func() {
+				filtered := userSet.SortedByField(ID, false).Filtered(func(rs RecordSet) bool { return true })
+				So(filtered.prefetchRC, ShouldNotBeNil)
+				records := filtered.Records()
+				So(records, ShouldHaveLength, 2)
+				_, fetched := records[0].get(Name, false)
+				So(fetched, ShouldBeTrue)
+				_, fetched2 := records[1].get(Name, false)
+				So(fetched2, ShouldBeFalse)
+			})
+			Convey("Prefetch should be bounded by PrefetchSize", func() {
+				defer func(size int) { PrefetchSize = size }(PrefetchSize)
+				PrefetchSize = 1
+				records := userSet.SortedByField(ID, false).Records()
+				_, fetched := records[0].get(Name, false)
+				So(fetched, ShouldBeTrue)
+				_, fetched2 := records[1].get(Name, false)
+				So(fetched2, ShouldBeTrue)
+			})
+			Convey("Prefetch data should be computed once per prefetch set", func() {
+				source := userSet.SortedByField(ID, false)
+				records := source.Records()
+				records[0].Get(Name)
+				pd := source.prefetchData
+				So(pd, ShouldNotBeNil)
+				So(pd.index, ShouldHaveLength, 2)
+				So(records[1].prefetchStart(), ShouldEqual, 1)
+				records[1].Get(Name)
+				So(source.prefetchData, ShouldEqual, pd)
+			})
+			Convey("Many2One targets should be prefetched together", func() {
+				postsSet := env.Pool("Post").SearchAll()
+				records := postsSet.SortedByField(ID, false).Records()
+				So(len(records), ShouldBeGreaterThanOrEqualTo, 2)
+				user0 := records[0].Get(user).(*RecordCollection)
+				So(user0.prefetchRC, ShouldNotBeNil)
+				postsUsers := env.Pool("User")
+				for _, rec := range records {
+					postsUsers = postsUsers.Union(rec.Get(user).(*RecordCollection))
+				}
+				So(user0.prefetchRC.Equals(postsUsers), ShouldBeTrue)
+				userRecs := user0.prefetchRC.Records()
+				_, fetched := userRecs[0].get(email, false)
+				So(fetched, ShouldBeTrue)
+				for _, rec := range userRecs[1:] {
+					_, fetched := rec.get(email, false)
+					So(fetched, ShouldBeFalse)
+				}
+			})
+			Convey("Related prefetch sets should be built once per window", func() {
+				records := env.Pool("Post").SearchAll().SortedByField(ID, false).Records()
+				So(len(records), ShouldBeGreaterThanOrEqualTo, 2)
+				prefetch0 := records[0].Get(user).(*RecordCollection).prefetchRC
+				prefetch1 := records[1].Get(user).(*RecordCollection).prefetchRC
+				So(prefetch0, ShouldNotBeNil)
+				So(prefetch1, ShouldNotBeNil)
+				So(prefetch1, ShouldNotEqual, prefetch0)
+				So(prefetch1.Equals(prefetch0), ShouldBeTrue)
+				So(&prefetch1.ids[0], ShouldEqual, &prefetch0.ids[0])
+				So(prefetch1.prefetchData, ShouldNotBeNil)
+				So(prefetch1.prefetchData, ShouldEqual, prefetch0.prefetchData)
+				So(prefetch1.env, ShouldNotEqual, prefetch0.env)
+			})
+			Convey("Iterating over records should issue one query per field", func() {
+				profiler := NewQueryProfiler(0, false)
+				So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+					records := env.Pool("User").SearchAll().Records()
+					So(len(records), ShouldBeGreaterThanOrEqualTo, 2)
+					before := profiler.Count()
+					for _, rec := range records {
+						rec.Get(email)
+					}
+					So(profiler.Count()-before, ShouldEqual, 1)
+				}, WithQueryProfiler(profiler)), ShouldBeNil)
+			})
 		}), ShouldBeNil)
 	})
 	Convey("Checking error types", t, func() {
@@ -302,4 +380,238 @@ X2M Links
 			So(retries, ShouldEqual, 3)
 		})
 	})
+	Convey("Testing savepoints", t, func() {
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field(email).Equals("jane.smith@example.com"))
+			Convey("Successful functions should keep their changes", func() {
+				So(ExecuteInSavepoint(env, func(env Environment) {
+					userJane.WithEnv(env).Set(email, "jane.doe@example.com")
+				}), ShouldBeNil)
+				So(users.Search(users.Model().Field(email).Equals("jane.doe@example.com")).Len(), ShouldEqual, 1)
+			})
+			Convey("Failed functions should be rolled back without aborting the transaction", func() {
+				So(ExecuteInSavepoint(env, func(env Environment) {
+					userJane.WithEnv(env).Set(email, "jane.doe@example.com")
+					env.Cr().Execute("SELECT * FROM nonexistent_table")
+				}), ShouldNotBeNil)
+				So(env.cache.data, ShouldBeEmpty)
+				So(users.Search(users.Model().Field(email).Equals("jane.doe@example.com")).Len(), ShouldEqual, 0)
+				So(userJane.Get(email), ShouldEqual, "jane.smith@example.com")
+			})
+			Convey("Serialization errors should be panicked again", func() {
+				So(func() {
+					ExecuteInSavepoint(env, func(env Environment) {
+						panic(&pq.Error{Code: "40001"})
+					})
+				}, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+	Convey("Testing query profiler", t, func() {
+		Convey("Environments without profiler should not record queries", func() {
+			So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				So(env.QueryProfiler(), ShouldBeNil)
+				env.Pool("User").SearchAll().Load()
+			}), ShouldBeNil)
+		})
+		Convey("Profiled environments should record queries and repeated queries", func() {
+			profiler := NewQueryProfiler(0, false)
+			var usersCount int
+			So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				So(env.QueryProfiler(), ShouldEqual, profiler)
+				users := env.Pool("User").SearchAll().Fetch()
+				usersCount = users.Len()
+				So(usersCount, ShouldBeGreaterThan, 1)
+				for _, user := range users.Records() {
+					env.Pool("User").Search(env.Pool("User").Model().Field(ID).Equals(user.Ids()[0])).ForceLoad(Name)
+				}
+				env.cr.Execute("SELECT 1")
+				env.cr.Execute("SELECT 1")
+			}, WithQueryProfiler(profiler)), ShouldBeNil)
+			So(profiler.Count(), ShouldBeGreaterThanOrEqualTo, usersCount+3)
+			profile := profiler.Profile()
+			So(profile.QueriesCount, ShouldEqual, profiler.Count())
+			So(profile.SlowQueries, ShouldBeEmpty)
+			So(len(profile.RepeatedQueries), ShouldBeGreaterThanOrEqualTo, 2)
+			var selectOne RepeatedQuery
+			for _, rq := range profile.RepeatedQueries {
+				if rq.Query == "SELECT 1" {
+					selectOne = rq
+				}
+			}
+			So(selectOne.Count, ShouldEqual, 2)
+			So(selectOne.Duplicates, ShouldEqual, 1)
+			So(selectOne.CallSites, ShouldHaveLength, 1)
+			for site := range selectOne.CallSites {
+				So(site, ShouldContainSubstring, "t14_environment_test.go")
+			}
+		})
+		Convey("Slow queries should be reported with their execution plan", func() {
+			profiler := NewQueryProfiler(time.Nanosecond, true)
+			So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				var ids []int64
+				env.cr.Select(&ids, `SELECT id FROM "user"`)
+				env.cr.Execute(`UPDATE "user" SET nums = nums`)
+			}, WithQueryProfiler(profiler)), ShouldBeNil)
+			profile := profiler.Profile()
+			So(profile.SlowQueries, ShouldHaveLength, 2)
+			So(profile.SlowQueries[0].Plan, ShouldContainSubstring, "actual time")
+			So(profile.SlowQueries[1].Plan, ShouldBeEmpty)
+		})
+		Convey("Explaining data-modifying WITH queries should not write twice", func() {
+			profiler := NewQueryProfiler(time.Nanosecond, true)
+			So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.cr.Execute(`CREATE TEMPORARY TABLE profiler_rows (id integer) ON COMMIT DROP`)
+				var ids []int64
+				env.cr.Select(&ids, `WITH inserted AS (INSERT INTO profiler_rows VALUES (1) RETURNING id) SELECT id FROM inserted`)
+				So(ids, ShouldResemble, []int64{1})
+				var count int64
+				env.cr.Get(&count, `SELECT count(*) FROM profiler_rows`)
+				So(count, ShouldEqual, 1)
+			}, WithQueryProfiler(profiler)), ShouldBeNil)
+			var plan string
+			for _, sq := range profiler.Profile().SlowQueries {
+				if strings.HasPrefix(sq.Query, "WITH inserted") {
+					plan = sq.Plan
+				}
+			}
+			So(plan, ShouldContainSubstring, "actual time")
+		})
+	})
+}
+
+func TestGroupsScope(t *testing.T) {
+	Convey("Testing Environment groups scope", t, func() {
+		scopeGroup := security.Registry.NewGroup("scope_group", "Scope Group")
+		otherGroup := security.Registry.NewGroup("scope_other_group", "Scope Other Group", scopeGroup)
+		security.Registry.AddMembership(2, otherGroup)
+		Reset(func() {
+			security.Registry.UnregisterGroup(otherGroup)
+			security.Registry.UnregisterGroup(scopeGroup)
+		})
+		Convey("Unscoped environments should have all user groups", func() {
+			So(SimulateInNewEnvironment(2, func(env Environment) {
+				groups := env.userGroups()
+				So(groups, ShouldContainKey, otherGroup)
+				So(groups, ShouldContainKey, scopeGroup)
+			}), ShouldBeNil)
+		})
+		Convey("Scoped environments should only have scoped and implied groups", func() {
+			So(SimulateInNewEnvironment(2, func(env Environment) {
+				groups := env.userGroups()
+				So(groups, ShouldContainKey, security.GroupEveryone)
+				So(groups, ShouldContainKey, scopeGroup)
+				So(groups, ShouldNotContainKey, otherGroup)
+			}, WithGroupsScope(scopeGroup)), ShouldBeNil)
+			So(SimulateInNewEnvironment(2, func(env Environment) {
+				groups := env.userGroups()
+				So(groups, ShouldContainKey, otherGroup)
+				So(groups, ShouldContainKey, scopeGroup)
+			}, WithGroupsScope(otherGroup)), ShouldBeNil)
+		})
+		Convey("Scoped environments should not grant groups the user does not have", func() {
+			So(SimulateInNewEnvironment(3, func(env Environment) {
+				So(env.userGroups(), ShouldNotContainKey, scopeGroup)
+			}, WithGroupsScope(scopeGroup)), ShouldBeNil)
+		})
+		Convey("Method permissions should be checked against scoped groups", func() {
+			So(SimulateInNewEnvironment(2, func(env Environment) {
+				method := env.Pool("User").Model().methods.MustGet("PrefixedUser")
+				method.AllowGroup(otherGroup)
+				defer method.RevokeGroup(otherGroup)
+				So(env.Pool("User").CheckExecutionPermission(method, true), ShouldBeTrue)
+				scopedEnv := env
+				WithGroupsScope(scopeGroup)(&scopedEnv)
+				users := env.Pool("User").WithEnv(scopedEnv)
+				So(users.CheckExecutionPermission(method, true), ShouldBeFalse)
+				So(users.Sudo(2).CheckExecutionPermission(method, true), ShouldBeTrue)
+			}), ShouldBeNil)
+		})
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	Convey("Testing request IDs", t, func() {
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			So(env.RequestID(), ShouldBeEmpty)
+			So(env.Logger(), ShouldEqual, log)
+		}), ShouldBeNil)
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			So(env.RequestID(), ShouldEqual, "req-1234")
+			So(env.Context().GetString("erp_request_id"), ShouldEqual, "req-1234")
+			So(env.Logger(), ShouldNotEqual, log)
+			So(env.Sudo().Logger(), ShouldEqual, env.Logger())
+			users := env.Pool("User").SearchAll()
+			So(users.Env().RequestID(), ShouldEqual, "req-1234")
+		}, WithRequestID("req-1234")), ShouldBeNil)
+	})
+}
+
+// A recordingExporter keeps the exported spans in memory
+type recordingExporter struct {
+	spans []tracing.SpanData
+}
+
+func (re *recordingExporter) ExportSpan(data tracing.SpanData) {
+	re.spans = append(re.spans, data)
+}
+
+// span returns the first recorded span with the given name
+func (re *recordingExporter) span(name string) (tracing.SpanData, bool) {
+	for _, data := range re.spans {
+		if data.Name == name {
+			return data, true
+		}
+	}
+	return tracing.SpanData{}, false
+}
+
+func TestTracing(t *testing.T) {
+	Convey("Testing tracing", t, func() {
+		exp := new(recordingExporter)
+		tracing.SetExporter(exp)
+		Reset(func() {
+			tracing.SetExporter(nil)
+		})
+		root := tracing.StartSpan(nil, tracing.KindServer, "request")
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			So(env.Span(), ShouldNotBeNil)
+			env.Pool("User").Call("SearchCount")
+			So(env.Span().SpanID(), ShouldNotEqual, root.SpanID())
+		}, WithSpan(root)), ShouldBeNil)
+		root.End()
+		transaction, ok := exp.span("Transaction")
+		So(ok, ShouldBeTrue)
+		So(transaction.TraceID, ShouldEqual, root.TraceID())
+		So(transaction.ParentSpanID, ShouldEqual, root.SpanID())
+		method, ok := exp.span("User.SearchCount")
+		So(ok, ShouldBeTrue)
+		So(method.ParentSpanID, ShouldEqual, transaction.SpanID)
+		So(method.Attributes["erp.model"], ShouldEqual, "User")
+		So(method.Attributes["erp.method"], ShouldEqual, "SearchCount")
+		var sqlFound bool
+		for _, data := range exp.spans {
+			if data.Name != "SQL" || data.ParentSpanID != method.SpanID {
+				continue
+			}
+			sqlFound = true
+			So(data.Kind, ShouldEqual, tracing.KindClient)
+			So(data.Attributes["db.statement"], ShouldContainSubstring, "SELECT")
+		}
+		So(sqlFound, ShouldBeTrue)
+		Convey("Failed queries should have an error status", func() {
+			So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Cr().Execute("SELECT * FROM unknown_table")
+			}), ShouldNotBeNil)
+			var failed bool
+			for _, data := range exp.spans {
+				if data.Name == "SQL" && data.Status.Code == tracing.StatusError {
+					failed = true
+					So(data.Attributes["db.statement"], ShouldEqual, "SELECT * FROM unknown_table")
+				}
+			}
+			So(failed, ShouldBeTrue)
+		})
+	})
 }
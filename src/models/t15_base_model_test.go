@@ -469,6 +469,76 @@ func TestBaseModelMethods(t *testing.T) {
 					return true
 				}).IsValid(), ShouldBeFalse)
 			})
+			Convey("FilteredOn and Matches", func() {
+				for i := 0; i < 10; i++ {
+					env.Pool("Post").Call("Create", NewModelData(postModel).
+						Set(title, fmt.Sprintf("Filtered post %02d", i)).
+						Set(content, fmt.Sprintf("Content %d", i%3)).
+						Set(user, userJane))
+				}
+				rPosts := env.Pool("Post").Search(env.Pool("Post").Model().Field(title).Contains("Filtered post")).Load()
+				So(rPosts.Len(), ShouldEqual, 10)
+
+				res := rPosts.FilteredOn(postModel.Field(content).Equals("Content 0"))
+				So(res.Len(), ShouldEqual, 4)
+				res = rPosts.FilteredOn(postModel.Field(content).Equals("Content 0").Or().Field(title).IContains("POST 01"))
+				So(res.Len(), ShouldEqual, 5)
+				res = rPosts.FilteredOn(postModel.Field(title).Like("Filtered post 0_").AndNot().Field(content).Equals("Content 1"))
+				So(res.Len(), ShouldEqual, 7)
+				res = rPosts.Call("FilteredOn", postModel.Field(user).Equals(userJane).
+					AndCond(postModel.Field(content).In([]string{"Content 1", "Content 2"}))).(RecordSet).Collection()
+				So(res.Len(), ShouldEqual, 6)
+				res = rPosts.FilteredOn(postModel.Field(user).AddOperator(operator.Equals, "Jane"))
+				So(res.Len(), ShouldEqual, 0)
+				res = rPosts.FilteredOn(postModel.Field(user).AddOperator(operator.IContains, "Jane"))
+				So(res.Len(), ShouldEqual, 10)
+				res = rPosts.FilteredOn(postModel.Field(fieldName{name: "User.Name", json: "user_id.name"}).NotEquals(userJane.Get(Name)))
+				So(res.Len(), ShouldEqual, 0)
+				res = rPosts.FilteredOn(postModel.Field(content).NotEquals(nil))
+				So(res.Len(), ShouldEqual, 10)
+
+				So(rPosts.Matches(postModel.Field(title).Contains("Filtered")), ShouldBeTrue)
+				So(rPosts.Call("Matches", postModel.Field(content).Equals("Content 1")), ShouldBeFalse)
+				So(env.Pool("Post").Matches(postModel.Field(title).Contains("Filtered")), ShouldBeFalse)
+
+				Convey("Values not in cache are checked in database", func() {
+					for _, rec := range rPosts.Records() {
+						env.cache.invalidateRecord(postModel, rec.Ids()[0])
+					}
+					res := rPosts.FilteredOn(postModel.Field(content).Equals("Content 0"))
+					So(res.Len(), ShouldEqual, 4)
+				})
+				Convey("Filtered records should keep the context and the prefetch set", func() {
+					res := rPosts.FilteredOn(postModel.Field(content).Equals("Content 0"))
+					So(res.prefetchRC, ShouldEqual, rPosts)
+					for _, rec := range rPosts.Records() {
+						env.cache.invalidateRecord(postModel, rec.Ids()[0])
+					}
+					res = rPosts.FilteredOn(postModel.Field(content).Equals("Content 0"))
+					So(res.Len(), ShouldEqual, 4)
+					So(res.prefetchRC, ShouldEqual, rPosts)
+
+					tagModel.Create(env, NewModelData(tagModel).Set(Name, "Filtered Tag"))
+					tags := env.Pool("Tag").WithContext("lang", "fr_FR").
+						Search(tagModel.Field(Name).Equals("Filtered Tag")).Load()
+					So(tags.query.ctxArgsSlug(), ShouldNotEqual, newRecordCollection(env, "Tag").query.ctxArgsSlug())
+					res = tags.FilteredOn(tagModel.Field(Name).Contains("Filtered"))
+					So(res.Len(), ShouldEqual, 1)
+					So(res.query.ctxArgsSlug(), ShouldEqual, tags.query.ctxArgsSlug())
+				})
+				Convey("Child of", func() {
+					tagParent := tagModel.Create(env, NewModelData(tagModel).Set(Name, "Filtered Parent"))
+					tagChild := tagModel.Create(env, NewModelData(tagModel).Set(Name, "Filtered Child").Set(parent, tagParent))
+					tagGrandChild := tagModel.Create(env, NewModelData(tagModel).Set(Name, "Filtered Grand Child").Set(parent, tagChild))
+					tagOther := tagModel.Create(env, NewModelData(tagModel).Set(Name, "Filtered Other"))
+					tags := tagParent.Union(tagChild).Union(tagGrandChild).Union(tagOther).Load()
+					res := tags.FilteredOn(tagModel.Field(ID).ChildOf(tagChild))
+					So(res.Len(), ShouldEqual, 2)
+					So(res.Intersect(tagGrandChild).IsNotEmpty(), ShouldBeTrue)
+					So(tagGrandChild.Matches(tagModel.Field(ID).ChildOf(tagParent)), ShouldBeTrue)
+					So(tagOther.Matches(tagModel.Field(ID).ChildOf(tagParent)), ShouldBeFalse)
+				})
+			})
 			Convey("CheckExecutionPermissions", func() {
 				res := env.Pool("User").Call("CheckExecutionPermission", Registry.MustGet("User").Methods().MustGet("Load"), []bool{true})
 				So(res, ShouldBeTrue)
@@ -570,3 +640,27 @@ func TestFreeTransientModels(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestStopWorkerLoop(t *testing.T) {
+	Convey("Stopping the worker loop should wait for running worker functions", t, func() {
+		started := make(chan struct{})
+		var done bool
+		savedWorkers := workerFunctions
+		Reset(func() {
+			workerFunctions = savedWorkers
+		})
+		workerFunctions = []WorkerFunction{NewWorkerFunction(func() {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			time.Sleep(300 * time.Millisecond)
+			done = true
+		}, 50*time.Millisecond)}
+		RunWorkerLoop()
+		<-started
+		StopWorkerLoop()
+		So(done, ShouldBeTrue)
+		So(workerStop, ShouldBeNil)
+	})
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types/dates"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebhooks(t *testing.T) {
+	Convey("Testing webhooks registration", t, func() {
+		So(func() { Webhooks.Register(&Webhook{Name: "test_invalid", Model: "User", Event: WebhookCreate}) }, ShouldPanic)
+		So(func() {
+			Webhooks.Register(&Webhook{Name: "test_invalid", Model: "User", Event: WebhookMethodCall, URL: "http://localhost"})
+		}, ShouldPanic)
+		So(func() {
+			Webhooks.Register(&Webhook{Name: "test_invalid", Model: "User", Event: "unknown", URL: "http://localhost"})
+		}, ShouldPanic)
+		So(func() {
+			Webhooks.Register(&Webhook{Name: "test_invalid", Model: WebhookDeliveryModel, Event: WebhookCreate, URL: "http://localhost"})
+		}, ShouldPanic)
+		So(Webhooks.isEmpty(), ShouldBeTrue)
+		Webhooks.Register(&Webhook{Name: "test_valid", Model: "User", Event: WebhookWrite, URL: "http://localhost"})
+		So(func() {
+			Webhooks.Register(&Webhook{Name: "test_valid", Model: "User", Event: WebhookWrite, URL: "http://localhost"})
+		}, ShouldPanic)
+		_, ok := Webhooks.Get("test_valid")
+		So(ok, ShouldBeTrue)
+		Webhooks.Unregister("test_valid")
+		_, ok = Webhooks.Get("test_valid")
+		So(ok, ShouldBeFalse)
+		So(Webhooks.triggers["User"]["Write"], ShouldBeEmpty)
+	})
+	Convey("Testing webhook retry delays", t, func() {
+		policy := WebhookRetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+		So(policy.delay(1), ShouldEqual, time.Second)
+		So(policy.delay(2), ShouldEqual, 2*time.Second)
+		So(policy.delay(3), ShouldEqual, 4*time.Second)
+		So(policy.delay(5), ShouldEqual, 10*time.Second)
+	})
+	Convey("Testing webhook deliveries", t, func() {
+		var (
+			status      = http.StatusOK
+			lastRequest *http.Request
+			lastBody    []byte
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lastRequest = r
+			lastBody, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(status)
+		}))
+		userModel := Registry.MustGet("User")
+		password := userModel.FieldName("Password")
+		Webhooks.Register(&Webhook{
+			Name:      "test_user_create",
+			Model:     "User",
+			Event:     WebhookCreate,
+			Condition: userModel.Field(email).Contains("@webhook.example.com"),
+			URL:       server.URL,
+			Secret:    "s3cr3t",
+		})
+		Webhooks.Register(&Webhook{
+			Name:   "test_user_unlink",
+			Model:  "User",
+			Event:  WebhookUnlink,
+			Fields: FieldNames{email, password},
+			URL:    server.URL,
+		})
+		Reset(func() {
+			server.Close()
+			Webhooks.Unregister("test_user_create")
+			Webhooks.Unregister("test_user_unlink")
+			Webhooks.SetRetryPolicy(DefaultWebhookRetryPolicy)
+		})
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			deliveries := env.Pool(WebhookDeliveryModel)
+			dm := deliveries.Model()
+			webhookDeliveries := func(name string) *RecordCollection {
+				return deliveries.Search(dm.Field(dm.FieldName("Webhook")).Equals(name))
+			}
+			Convey("Creating a non matching record should not enqueue a delivery", func() {
+				env.Pool("User").Call("Create", NewModelData(userModel).
+					Set(Name, "Webhook Other").
+					Set(email, "other@example.com"))
+				So(webhookDeliveries("test_user_create").IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Creating a matching record should enqueue a delivery", func() {
+				user := env.Pool("User").Call("Create", NewModelData(userModel).
+					Set(Name, "Webhook User").
+					Set(email, "user@webhook.example.com").
+					Set(password, "p4ssw0rd")).(RecordSet).Collection()
+				delivery := webhookDeliveries("test_user_create")
+				So(delivery.Len(), ShouldEqual, 1)
+				So(delivery.Get(dm.FieldName("State")), ShouldEqual, WebhookPending)
+				So(delivery.Get(dm.FieldName("URL")), ShouldEqual, server.URL)
+				var payload webhookPayload
+				So(json.Unmarshal([]byte(delivery.Get(dm.FieldName("Payload")).(string)), &payload), ShouldBeNil)
+				So(payload.Event, ShouldEqual, WebhookCreate)
+				So(payload.Model, ShouldEqual, "User")
+				So(payload.IDs, ShouldResemble, user.Ids())
+				So(payload.Records, ShouldHaveLength, 1)
+				So(payload.Records[0]["id"], ShouldEqual, user.Ids()[0])
+				So(payload.Records[0]["name"], ShouldEqual, "Webhook User")
+				So(payload.Records[0]["email"], ShouldEqual, "user@webhook.example.com")
+				So(payload.Records[0], ShouldNotContainKey, "password")
+				So(payload.Records[0], ShouldNotContainKey, "is_staff")
+				So(lockNextWebhookDelivery(env, delivery.Ids()).Ids(), ShouldResemble, delivery.Ids())
+				Convey("Successful deliveries should send a signed payload", func() {
+					deliverWebhook(delivery)
+					So(delivery.Get(dm.FieldName("State")), ShouldEqual, WebhookDelivered)
+					So(delivery.Get(dm.FieldName("Attempts")), ShouldEqual, 1)
+					So(delivery.Get(dm.FieldName("ResponseStatus")), ShouldEqual, http.StatusOK)
+					So(lastBody, ShouldResemble, []byte(delivery.Get(dm.FieldName("Payload")).(string)))
+					So(lastRequest.Header.Get(WebhookEventHeader), ShouldEqual, "create")
+					timestamp := lastRequest.Header.Get(WebhookTimestampHeader)
+					So(lastRequest.Header.Get(WebhookSignatureHeader), ShouldEqual, "sha256="+WebhookSignature("s3cr3t", timestamp, lastBody))
+					So(lockNextWebhookDelivery(env, delivery.Ids()).IsEmpty(), ShouldBeTrue)
+				})
+				Convey("Failed deliveries should be retried until they are dead", func() {
+					status = http.StatusInternalServerError
+					Webhooks.SetRetryPolicy(WebhookRetryPolicy{MaxAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Timeout: time.Second})
+					deliverWebhook(delivery)
+					So(delivery.Get(dm.FieldName("State")), ShouldEqual, WebhookPending)
+					So(delivery.Get(dm.FieldName("Attempts")), ShouldEqual, 1)
+					So(delivery.Get(dm.FieldName("ResponseStatus")), ShouldEqual, http.StatusInternalServerError)
+					So(delivery.Get(dm.FieldName("Error")), ShouldNotBeEmpty)
+					nextAttempt := delivery.Get(dm.FieldName("NextAttempt")).(dates.DateTime)
+					So(nextAttempt.Greater(dates.Now().Add(50*time.Second)), ShouldBeTrue)
+					So(lockNextWebhookDelivery(env, delivery.Ids()).IsEmpty(), ShouldBeTrue)
+					deliverWebhook(delivery)
+					So(delivery.Get(dm.FieldName("State")), ShouldEqual, WebhookDead)
+					So(delivery.Get(dm.FieldName("Attempts")), ShouldEqual, 2)
+				})
+				Convey("Deliveries of unknown webhooks should be dead", func() {
+					Webhooks.Unregister("test_user_create")
+					deliverWebhook(delivery)
+					So(delivery.Get(dm.FieldName("State")), ShouldEqual, WebhookDead)
+					So(lastRequest, ShouldBeNil)
+				})
+			})
+			Convey("Writing records should only send the written fields", func() {
+				Webhooks.Register(&Webhook{
+					Name:  "test_user_write",
+					Model: "User",
+					Event: WebhookWrite,
+					URL:   server.URL,
+				})
+				defer Webhooks.Unregister("test_user_write")
+				user := env.Pool("User").Call("Create", NewModelData(userModel).
+					Set(Name, "Webhook Written").
+					Set(email, "written@example.com")).(RecordSet).Collection()
+				user.Call("Write", NewModelData(userModel).
+					Set(email, "rewritten@example.com").
+					Set(password, "p4ssw0rd"))
+				// Stored computed fields may also be written by the ORM
+				var records []map[string]interface{}
+				for _, delivery := range webhookDeliveries("test_user_write").Records() {
+					var payload webhookPayload
+					So(json.Unmarshal([]byte(delivery.Get(dm.FieldName("Payload")).(string)), &payload), ShouldBeNil)
+					So(payload.Records, ShouldHaveLength, 1)
+					So(payload.Records[0], ShouldNotContainKey, "password")
+					if _, ok := payload.Records[0]["email"]; ok {
+						records = append(records, payload.Records[0])
+					}
+				}
+				So(records, ShouldResemble, []map[string]interface{}{{
+					"id":    float64(user.Ids()[0]),
+					"email": "rewritten@example.com",
+				}})
+			})
+			Convey("Unlinking records should enqueue a delivery with their data", func() {
+				users := env.Pool("User").Call("Create", NewModelData(userModel).
+					Set(Name, "Webhook Unlinked").
+					Set(email, "unlinked@example.com")).(RecordSet).Collection()
+				ids := users.Ids()
+				users.Call("Unlink")
+				delivery := webhookDeliveries("test_user_unlink")
+				So(delivery.Len(), ShouldEqual, 1)
+				var payload webhookPayload
+				So(json.Unmarshal([]byte(delivery.Get(dm.FieldName("Payload")).(string)), &payload), ShouldBeNil)
+				So(payload.Event, ShouldEqual, WebhookUnlink)
+				So(payload.IDs, ShouldResemble, ids)
+				So(payload.Records[0]["email"], ShouldEqual, "unlinked@example.com")
+				So(payload.Records[0], ShouldNotContainKey, "name")
+				So(payload.Records[0], ShouldNotContainKey, "password")
+			})
+		}), ShouldBeNil)
+	})
+}
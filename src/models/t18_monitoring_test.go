@@ -0,0 +1,137 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMonitoring(t *testing.T) {
+	Convey("Testing readiness checks", t, func() {
+		So(DBPing(context.Background()), ShouldBeNil)
+		So(CheckDatabaseSchema(), ShouldBeNil)
+		So(schemaUpToDate, ShouldEqual, 1)
+	})
+	Convey("Testing query statistics", t, func() {
+		before := GetStats()
+		So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			env.Pool("User").SearchAll().Load()
+		}), ShouldBeNil)
+		after := GetStats()
+		So(after.Queries, ShouldBeGreaterThan, before.Queries)
+		So(after.QueriesDuration, ShouldBeGreaterThan, before.QueriesDuration)
+		So(after.QueryErrors, ShouldEqual, before.QueryErrors)
+	})
+	Convey("Testing worker statistics", t, func() {
+		savedWorkers := workerFunctions
+		workerFunctions = nil
+		Reset(func() {
+			workerFunctions = savedWorkers
+		})
+		RegisterWorker(NewWorkerFunction(FreeTransientModels, time.Second))
+		RegisterWorker(NewNamedWorkerFunction("failing", func() {
+			panic(errors.New("worker failure"))
+		}, time.Second))
+		So(TriggerWorker("models.FreeTransientModels"), ShouldBeNil)
+		So(TriggerWorker("failing"), ShouldBeNil)
+		workerGroup.Wait()
+		workers := RegisteredWorkers()
+		So(workers, ShouldContainKey, "models.FreeTransientModels")
+		So(workers["models.FreeTransientModels"].Runs, ShouldBeGreaterThanOrEqualTo, 1)
+		So(workers["models.FreeTransientModels"].Failures, ShouldEqual, 0)
+		So(workers["models.FreeTransientModels"].LastError, ShouldBeEmpty)
+		So(workers["models.FreeTransientModels"].LastRun.IsZero(), ShouldBeFalse)
+		So(workers["models.FreeTransientModels"].Running, ShouldBeFalse)
+		So(workers, ShouldContainKey, "failing")
+		So(workers["failing"].Runs, ShouldEqual, 1)
+		So(workers["failing"].Failures, ShouldEqual, 1)
+		So(workers["failing"].LastError, ShouldContainSubstring, "worker failure")
+		So(workers["failing"].Running, ShouldBeFalse)
+		So(GetStats().Workers["failing"], ShouldResemble, workers["failing"])
+	})
+	Convey("Testing worker registration", t, func() {
+		savedWorkers := workerFunctions
+		workerFunctions = nil
+		Reset(func() {
+			workerFunctions = savedWorkers
+		})
+		RegisterWorker(NewWorkerFunction(FreeTransientModels, time.Second))
+		So(func() { RegisterWorker(NewWorkerFunction(FreeTransientModels, time.Minute)) }, ShouldPanic)
+		So(func() { RegisterWorker(NewNamedWorkerFunction("models.FreeTransientModels", func() {}, time.Minute)) }, ShouldPanic)
+		RegisterWorker(NewNamedWorkerFunction("free_transient_models", FreeTransientModels, time.Minute))
+		So(RegisteredWorkers(), ShouldHaveLength, 2)
+		Convey("Instances of custom worker types should be registered separately", func() {
+			first, second := &customWorker{}, &customWorker{}
+			So(func() { RegisterWorker(first) }, ShouldNotPanic)
+			So(func() { RegisterWorker(second) }, ShouldNotPanic)
+			So(workerName(first), ShouldNotEqual, workerName(second))
+			So(workerName(first), ShouldStartWith, "*models.customWorker@")
+			So(RegisteredWorkers(), ShouldHaveLength, 4)
+		})
+		Convey("Custom workers with a name should be identified by it", func() {
+			RegisterWorker(namedCustomWorker("custom"))
+			So(RegisteredWorkers(), ShouldContainKey, "custom")
+			So(func() { RegisterWorker(namedCustomWorker("custom")) }, ShouldPanic)
+		})
+	})
+	Convey("Testing worker supervision", t, func() {
+		release := make(chan struct{})
+		started := make(chan struct{}, 1)
+		savedWorkers := workerFunctions
+		workerFunctions = []WorkerFunction{NewNamedWorkerFunction("blocking", func() {
+			started <- struct{}{}
+			<-release
+		}, time.Hour)}
+		Reset(func() {
+			workerFunctions = savedWorkers
+		})
+		So(RegisteredWorkers(), ShouldContainKey, "blocking")
+		So(RegisteredWorkers()["blocking"].Runs, ShouldEqual, 0)
+		So(TriggerWorker("unknown"), ShouldNotBeNil)
+		So(TriggerWorker("blocking"), ShouldBeNil)
+		<-started
+		So(RegisteredWorkers()["blocking"].Running, ShouldBeTrue)
+		So(TriggerWorker("blocking"), ShouldNotBeNil)
+		So(startWorker(workerFunctions[0]), ShouldBeFalse)
+		So(RegisteredWorkers()["blocking"].Skipped, ShouldEqual, 2)
+		close(release)
+		workerGroup.Wait()
+		status := RegisteredWorkers()["blocking"]
+		So(status.Running, ShouldBeFalse)
+		So(status.Runs, ShouldEqual, 1)
+		So(status.LastError, ShouldBeEmpty)
+	})
+}
+
+// A customWorker is a WorkerFunction without a name
+type customWorker struct {
+	runs int
+}
+
+func (w *customWorker) Run() {
+	w.runs++
+}
+
+func (w *customWorker) LoopPeriod() time.Duration {
+	return time.Hour
+}
+
+// A namedCustomWorker is a WorkerFunction named by its Name method
+type namedCustomWorker string
+
+func (w namedCustomWorker) Run() {}
+
+func (w namedCustomWorker) LoopPeriod() time.Duration {
+	return time.Hour
+}
+
+func (w namedCustomWorker) Name() string {
+	return string(w)
+}
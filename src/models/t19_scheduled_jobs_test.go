@@ -0,0 +1,165 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types/dates"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScheduledJobs(t *testing.T) {
+	Convey("Testing scheduled jobs registration", t, func() {
+		noop := func(Environment) {}
+		So(func() { ScheduledJobs.Register(&ScheduledJob{Name: "test_invalid", Schedule: "* * * * *"}) }, ShouldPanic)
+		So(func() { ScheduledJobs.Register(&ScheduledJob{Name: "test_invalid", Schedule: "* * *", Function: noop}) }, ShouldPanic)
+		So(func() {
+			ScheduledJobs.Register(&ScheduledJob{Name: "test_invalid", Schedule: "* * * * *", CatchUp: "unknown", Function: noop})
+		}, ShouldPanic)
+		_, ok := ScheduledJobs.Get("test_invalid")
+		So(ok, ShouldBeFalse)
+		job := &ScheduledJob{Name: "test_valid", Schedule: "@hourly", Function: noop}
+		ScheduledJobs.Register(job)
+		So(job.CatchUp, ShouldEqual, CatchUpOnce)
+		So(func() { ScheduledJobs.Register(&ScheduledJob{Name: "test_valid", Schedule: "@daily", Function: noop}) }, ShouldPanic)
+		_, ok = ScheduledJobs.Get("test_valid")
+		So(ok, ShouldBeTrue)
+		ScheduledJobs.Unregister("test_valid")
+		_, ok = ScheduledJobs.Get("test_valid")
+		So(ok, ShouldBeFalse)
+	})
+	Convey("Testing scheduled jobs execution", t, func() {
+		var runs int
+		var fail bool
+		ScheduledJobs.Register(&ScheduledJob{
+			Name:     "test_job",
+			Schedule: "*/5 * * * *",
+			Function: func(env Environment) {
+				runs++
+				if fail {
+					log.Panic("Scheduled job failure")
+				}
+			},
+		})
+		model := Registry.MustGet(ScheduledJobModel)
+		// getJob returns the value of the given field of the test job
+		getJob := func(field string) interface{} {
+			var value interface{}
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				value = scheduledJobRecord(env, "test_job").Get(model.FieldName(field))
+			}), ShouldBeNil)
+			return value
+		}
+		// setJob updates the record of the test job with the given values
+		setJob := func(values FieldMap) {
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				scheduledJobRecord(env, "test_job").Call("Write", NewModelData(model, values))
+			}), ShouldBeNil)
+		}
+		Reset(func() {
+			ScheduledJobs.Unregister("test_job")
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				scheduledJobRecord(env, "test_job").Call("Unlink")
+			})
+		})
+		Convey("Registered jobs should be synchronized and scheduled", func() {
+			RunScheduledJobs()
+			So(getJob("Schedule"), ShouldEqual, "*/5 * * * *")
+			So(getJob("CatchUp"), ShouldEqual, string(CatchUpOnce))
+			So(getJob("Active"), ShouldBeTrue)
+			nextRun := getJob("NextRun").(dates.DateTime)
+			So(nextRun.Time.After(time.Now()), ShouldBeTrue)
+			So(nextRun.Time.Minute()%5, ShouldEqual, 0)
+			So(runs, ShouldEqual, 0)
+		})
+		Convey("Due jobs should run and be rescheduled", func() {
+			RunScheduledJobs()
+			setJob(FieldMap{"NextRun": dates.DateTime{Time: time.Now().Add(-time.Minute).UTC()}})
+			RunScheduledJobs()
+			So(runs, ShouldEqual, 1)
+			So(getJob("LastRun").(dates.DateTime).IsZero(), ShouldBeFalse)
+			So(getJob("LastError"), ShouldEqual, "")
+			So(getJob("NextRun").(dates.DateTime).Time.After(time.Now()), ShouldBeTrue)
+		})
+		Convey("Missed runs should be handled according to the catch-up policy", func() {
+			RunScheduledJobs()
+			missed := dates.DateTime{Time: time.Now().Add(-time.Hour).UTC()}
+			Convey("Once policy should run the job once", func() {
+				setJob(FieldMap{"NextRun": missed})
+				RunScheduledJobs()
+				So(runs, ShouldEqual, 1)
+			})
+			Convey("Skip policy should not run the job", func() {
+				setJob(FieldMap{"NextRun": missed, "CatchUp": string(CatchUpSkip)})
+				So(runScheduledJob("test_job"), ShouldBeFalse)
+				So(runs, ShouldEqual, 0)
+				So(getJob("NextRun").(dates.DateTime).Time.After(time.Now()), ShouldBeTrue)
+			})
+			Convey("All policy should run the job for each missed run", func() {
+				setJob(FieldMap{"NextRun": missed, "CatchUp": string(CatchUpAll)})
+				So(runScheduledJob("test_job"), ShouldBeTrue)
+				So(runs, ShouldEqual, 1)
+				RunScheduledJobs()
+				So(runs, ShouldBeGreaterThanOrEqualTo, 12)
+				So(getJob("NextRun").(dates.DateTime).Time.After(time.Now()), ShouldBeTrue)
+			})
+		})
+		Convey("Disabled jobs should not run", func() {
+			RunScheduledJobs()
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				SetScheduledJobActive(env, "test_job", false)
+				So(func() { SetScheduledJobActive(env, "unknown_job", false) }, ShouldPanic)
+			}), ShouldBeNil)
+			setJob(FieldMap{"NextRun": dates.DateTime{Time: time.Now().Add(-time.Minute).UTC()}})
+			RunScheduledJobs()
+			So(runs, ShouldEqual, 0)
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				SetScheduledJobActive(env, "test_job", true)
+			}), ShouldBeNil)
+			RunScheduledJobs()
+			So(runs, ShouldEqual, 1)
+		})
+		Convey("Failing jobs should record their error and be rescheduled", func() {
+			fail = true
+			RunScheduledJobs()
+			setJob(FieldMap{"NextRun": dates.DateTime{Time: time.Now().Add(-time.Minute).UTC()}})
+			RunScheduledJobs()
+			So(runs, ShouldEqual, 1)
+			So(getJob("LastError"), ShouldContainSubstring, "Scheduled job failure")
+			So(getJob("NextRun").(dates.DateTime).Time.After(time.Now()), ShouldBeTrue)
+		})
+		Convey("Jobs locked by another transaction should not run", func() {
+			RunScheduledJobs()
+			setJob(FieldMap{"NextRun": dates.DateTime{Time: time.Now().Add(-time.Minute).UTC()}})
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				So(claimScheduledJob(env, "test_job").IsEmpty(), ShouldBeFalse)
+				So(runScheduledJob("test_job"), ShouldBeFalse)
+			}), ShouldBeNil)
+			So(runs, ShouldEqual, 0)
+			RunScheduledJobs()
+			So(runs, ShouldEqual, 1)
+		})
+		Convey("Jobs run by another transaction after the snapshot should not run again", func() {
+			RunScheduledJobs()
+			setJob(FieldMap{"NextRun": dates.DateTime{Time: time.Now().Add(-time.Minute).UTC()}})
+			var attempts int
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				attempts++
+				// Take the snapshot of the transaction before the job runs in another one
+				var count int64
+				env.Cr().Get(&count, "SELECT count(*) FROM scheduled_job")
+				if attempts == 1 {
+					So(runScheduledJob("test_job"), ShouldBeFalse)
+				}
+				job := claimScheduledJob(env, "test_job")
+				So(job.Get(job.model.FieldName("NextRun")).(dates.DateTime).Time.After(time.Now()), ShouldBeTrue)
+			}), ShouldBeNil)
+			So(attempts, ShouldEqual, 2)
+			So(runs, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types/dates"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestJobQueue(t *testing.T) {
+	Convey("Testing job retry delays", t, func() {
+		So(jobRetryDelay(1), ShouldEqual, 30*time.Second)
+		So(jobRetryDelay(2), ShouldEqual, time.Minute)
+		So(jobRetryDelay(4), ShouldEqual, 4*time.Minute)
+		So(jobRetryDelay(20), ShouldEqual, time.Hour)
+	})
+	Convey("Testing job options defaults", t, func() {
+		options := JobOptions{Priority: 5}.withDefaults()
+		So(options.Priority, ShouldEqual, 5)
+		So(options.MaxAttempts, ShouldEqual, DefaultJobOptions.MaxAttempts)
+		So(options.Timeout, ShouldEqual, DefaultJobOptions.Timeout)
+	})
+	Convey("Testing the job queue", t, func() {
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			users = users.Search(users.Model().Field(email).Equals("jane.smith@example.com"))
+			jm := Registry.MustGet(QueueJobModel)
+			Convey("Delaying methods with wrong arguments should panic", func() {
+				So(func() { users.Delay("UnknownMethod") }, ShouldPanic)
+				So(func() { users.Delay("PrefixedUser") }, ShouldPanic)
+				So(func() { users.Delay("PrefixedUser", make(chan int)) }, ShouldPanic)
+			})
+			Convey("Delayed methods should be run with their context", func() {
+				job := users.WithContext("use_double_square", true).Delay("PrefixedUser", "Prefix")
+				So(job.Get(jm.FieldName("State")), ShouldEqual, JobPending)
+				So(job.Get(jm.FieldName("Model")), ShouldEqual, "User")
+				So(job.Get(jm.FieldName("Method")), ShouldEqual, "PrefixedUser")
+				So(job.Get(jm.FieldName("RecordIDs")), ShouldEqual, fmt.Sprintf("[%d]", users.Ids()[0]))
+				So(job.Get(jm.FieldName("Args")), ShouldEqual, `["Prefix"]`)
+				So(job.Get(jm.FieldName("UserID")), ShouldEqual, security.SuperUserID)
+				So(job.Get(jm.FieldName("Priority")), ShouldEqual, DefaultJobOptions.Priority)
+				claimed := claimNextJob(env)
+				So(claimed.Ids(), ShouldResemble, job.Ids())
+				So(job.Get(jm.FieldName("State")), ShouldEqual, JobStarted)
+				So(job.Get(jm.FieldName("Attempts")), ShouldEqual, 1)
+				So(claimNextJob(env).IsEmpty(), ShouldBeTrue)
+				executeJob(claimed)
+				So(job.Get(jm.FieldName("State")), ShouldEqual, JobDone)
+				So(job.Get(jm.FieldName("Error")), ShouldBeEmpty)
+				So(job.Get(jm.FieldName("FinishedAt")).(dates.DateTime).IsZero(), ShouldBeFalse)
+				var result []string
+				So(json.Unmarshal([]byte(job.Get(jm.FieldName("Result")).(string)), &result), ShouldBeNil)
+				So(result, ShouldResemble, []string{"Prefix: Jane A. Smith [[jane.smith@example.com]]"})
+			})
+			Convey("Jobs should be claimed by priority and ETA", func() {
+				low := users.DelayWithOptions(JobOptions{Priority: 20}, "PrefixedUser", "Low")
+				later := users.DelayWithOptions(JobOptions{Priority: 1, ETA: time.Now().Add(time.Hour)}, "PrefixedUser", "Later")
+				high := users.DelayWithOptions(JobOptions{Priority: 1}, "PrefixedUser", "High")
+				So(claimNextJob(env).Ids(), ShouldResemble, high.Ids())
+				So(claimNextJob(env).Ids(), ShouldResemble, low.Ids())
+				So(claimNextJob(env).IsEmpty(), ShouldBeTrue)
+				So(later.Get(jm.FieldName("State")), ShouldEqual, JobPending)
+			})
+			Convey("Failed jobs should be retried until they fail", func() {
+				job := users.DelayWithOptions(JobOptions{MaxAttempts: 2}, "PrefixedUser", "Prefix")
+				job.Set(jm.FieldName("Args"), `[1]`)
+				executeJob(claimNextJob(env))
+				So(job.Get(jm.FieldName("State")), ShouldEqual, JobPending)
+				So(job.Get(jm.FieldName("Error")), ShouldNotBeEmpty)
+				eta := job.Get(jm.FieldName("ETA")).(dates.DateTime)
+				So(eta.Greater(dates.Now().Add(20*time.Second)), ShouldBeTrue)
+				So(claimNextJob(env).IsEmpty(), ShouldBeTrue)
+				job.Set(jm.FieldName("ETA"), dates.Now())
+				executeJob(claimNextJob(env))
+				So(job.Get(jm.FieldName("State")), ShouldEqual, JobFailed)
+				So(job.Get(jm.FieldName("Attempts")), ShouldEqual, 2)
+			})
+			Convey("Jobs running longer than their timeout should fail", func() {
+				job := users.DelayWithOptions(JobOptions{MaxAttempts: 1}, "PrefixedUser", "Prefix")
+				job.Set(jm.FieldName("Timeout"), int64(0))
+				executeJob(claimNextJob(env))
+				So(job.Get(jm.FieldName("State")), ShouldEqual, JobFailed)
+				So(job.Get(jm.FieldName("Error")), ShouldContainSubstring, "Job timed out")
+				So(job.Get(jm.FieldName("Result")), ShouldBeEmpty)
+			})
+			Convey("Queries of jobs running longer than their timeout should be cancelled", func() {
+				start := time.Now()
+				var timedOut bool
+				err := ExecuteInSavepoint(env, func(env Environment) {
+					watchdog := startJobWatchdog(env, 100*time.Millisecond)
+					defer func() {
+						timedOut = watchdog.stop()
+					}()
+					env.Cr().Execute("SELECT pg_sleep(10)")
+				})
+				So(err, ShouldNotBeNil)
+				So(timedOut, ShouldBeTrue)
+				So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+				So(ExecuteInSavepoint(env, func(env Environment) {
+					watchdog := startJobWatchdog(env, time.Hour)
+					env.Cr().Execute("SELECT pg_sleep(0.2)")
+					So(watchdog.stop(), ShouldBeFalse)
+				}), ShouldBeNil)
+			})
+			Convey("Delayed methods should be run with the groups scope of their environment", func() {
+				scopeGroup := security.Registry.NewGroup("job_scope_group", "Job Scope Group")
+				defer security.Registry.UnregisterGroup(scopeGroup)
+				job := users.Delay("PrefixedUser", "Prefix")
+				So(job.Get(jm.FieldName("GroupsScope")), ShouldBeEmpty)
+				So(jobEnvironment(env, job).groupsScope, ShouldBeNil)
+				scopedEnv := env
+				WithGroupsScope(scopeGroup)(&scopedEnv)
+				job = users.WithEnv(scopedEnv).Delay("PrefixedUser", "Prefix")
+				So(job.Get(jm.FieldName("GroupsScope")), ShouldEqual,
+					fmt.Sprintf(`["%s","%s"]`, security.GroupEveryone.ID(), scopeGroup.ID()))
+				So(jobEnvironment(env, job).groupsScope, ShouldResemble, scopedEnv.groupsScope)
+				So(jobEnvironment(env, job).uid, ShouldEqual, security.SuperUserID)
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/tracing"
+)
+
+// WithSpan returns an EnvOption that makes the spans of the new
+// Environment children of the given span, e.g. the span of an HTTP request.
+func WithSpan(span *tracing.Span) EnvOption {
+	return func(env *Environment) {
+		env.cr.span = span
+	}
+}
+
+// Span returns the current span of this Environment, i.e. the span of the
+// method being executed or of the transaction. It returns nil if tracing
+// is disabled.
+//
+// It can be used as the parent of custom spans:
+//
+//	span := tracing.StartSpan(env.Span(), tracing.KindInternal, "MyOperation")
+//	defer span.End()
+func (env Environment) Span() *tracing.Span {
+	return env.cr.span
+}
+
+// startTransactionSpan starts the span of the transaction of this
+// Environment as a child of the span set by WithSpan, if any.
+func (env Environment) startTransactionSpan() {
+	span := tracing.StartSpan(env.cr.span, tracing.KindInternal, "Transaction")
+	span.SetAttribute("erp.uid", env.uid)
+	env.cr.span = span
+}
+
+// traceMethod starts the span of the call of the given method on rc and
+// makes it the current span of the transaction. It returns a function
+// to defer that ends the span and restores the previous current span.
+func (rc *RecordCollection) traceMethod(methName string) func() {
+	parent := rc.env.cr.span
+	if parent == nil {
+		return noopTrace
+	}
+	span := tracing.StartSpan(parent, tracing.KindInternal, fmt.Sprintf("%s.%s", rc.model.name, methName))
+	span.SetAttribute("erp.model", rc.model.name)
+	span.SetAttribute("erp.method", methName)
+	span.SetAttribute("erp.records", len(rc.ids))
+	rc.env.cr.span = span
+	return func() {
+		rc.env.cr.span = parent
+		endSpan(span, recover())
+	}
+}
+
+// noopTrace is the function returned by traceMethod when tracing is disabled
+func noopTrace() {}
+
+// startQuerySpan starts the span of the given SQL query as a child
+// of the current span of this Cursor.
+func (c *Cursor) startQuerySpan(query string) *tracing.Span {
+	if c.span == nil {
+		return nil
+	}
+	span := tracing.StartSpan(c.span, tracing.KindClient, "SQL")
+	span.SetAttribute("db.system", db.DriverName())
+	span.SetAttribute("db.statement", query)
+	return span
+}
+
+// endSpan ends the given span of an operation. panicData is the result of
+// recover() in the deferred function of the operation: if not nil, the
+// span is marked as failed and panicData is panicked again.
+func endSpan(span *tracing.Span, panicData interface{}) {
+	if panicData != nil {
+		span.SetError(fmt.Errorf("%v", panicData))
+	}
+	span.End()
+	if panicData != nil {
+		panic(panicData)
+	}
+}
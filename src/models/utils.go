@@ -220,6 +220,9 @@ func consumeAndPredicates(i int, predicates []predicate, res []interface{}) ([]i
 // appendPredicateToSerial appends the given predicate to the given serialized
 // predicate list and returns the result.
 func appendPredicateToSerial(res []interface{}, predicate predicate) []interface{} {
+	if predicate.isNot {
+		res = append(res, "!")
+	}
 	if predicate.isCond {
 		res = append(res, serializePredicates(predicate.cond.predicates)...)
 	} else {
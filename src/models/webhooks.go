@@ -0,0 +1,586 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/fieldtype"
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+	"github.com/Pedro-lmso-erp/erp/src/models/types/dates"
+)
+
+const (
+	// WebhookDeliveryModel is the name of the model that
+	// logs the deliveries of webhooks.
+	WebhookDeliveryModel = "WebhookDelivery"
+	// webhookDeliveryPeriod is the period of the worker
+	// that delivers pending webhooks.
+	webhookDeliveryPeriod = 10 * time.Second
+)
+
+// webhookSecretFieldPatterns are the substrings of the JSON names of the
+// fields that are never sent in webhook payloads, such as password hashes,
+// TOTP secrets or API key hashes.
+var webhookSecretFieldPatterns = []string{"password", "passwd", "secret", "totp", "api_key", "hash", "token"}
+
+// Headers of the webhook requests
+const (
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	// WebhookSignatureHeader holds the hex encoded HMAC-SHA256 of the
+	// timestamp and the body of the request joined by a dot, computed
+	// with the secret of the webhook and prefixed by 'sha256='.
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// States of the WebhookDelivery records
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	// WebhookDead is the state of deliveries that failed more
+	// than the maximum number of attempts of the retry policy.
+	WebhookDead = "dead"
+)
+
+// A WebhookEvent is a record event that triggers a webhook
+type WebhookEvent string
+
+// Webhook events
+const (
+	WebhookCreate WebhookEvent = "create"
+	WebhookWrite  WebhookEvent = "write"
+	WebhookUnlink WebhookEvent = "unlink"
+	// WebhookMethodCall is the event of a call to the Method of the Webhook
+	WebhookMethodCall WebhookEvent = "method"
+)
+
+// A Webhook is a subscription to the events of a model. Each time the event
+// occurs, a signed JSON payload is sent to the URL of the webhook once the
+// transaction has been committed.
+type Webhook struct {
+	// Name identifies the webhook
+	Name  string
+	Model string
+	Event WebhookEvent
+	// Method is the name of the method which triggers the
+	// webhook when Event is WebhookMethodCall.
+	Method string
+	// Condition restricts the webhook to the records that match it.
+	// It is evaluated after the event, or before for WebhookUnlink.
+	Condition Conditioner
+	// Fields are the fields of the records sent in the payload with their
+	// ids. If empty, the fields given to the Create or Write call that
+	// triggered the webhook are sent, and only the ids for other events.
+	// Password and secret fields are never sent, even if they are listed.
+	Fields FieldNames
+	URL    string
+	// Secret is the key used to sign the payload. The payload
+	// is not signed if Secret is empty.
+	Secret string
+}
+
+// payloadFields returns the fields of the given model to send in the payload
+// of this webhook, given the fields written by the triggering call.
+func (wh *Webhook) payloadFields(model *Model, written FieldNames) FieldNames {
+	fields := wh.Fields
+	if len(fields) == 0 {
+		fields = written
+	}
+	var res FieldNames
+	for _, field := range fields {
+		fi := model.fields.MustGet(field.JSON())
+		if fi.json == ID.JSON() || isSecretField(fi) {
+			continue
+		}
+		res = append(res, fi)
+	}
+	return res
+}
+
+// isSecretField returns true if the given field must never be sent
+// in webhook payloads (see webhookSecretFieldPatterns).
+func isSecretField(fi *Field) bool {
+	name := strings.ToLower(fi.json)
+	for _, pattern := range webhookSecretFieldPatterns {
+		if strings.Contains(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// methodName returns the name of the method that triggers this webhook
+func (wh *Webhook) methodName() string {
+	switch wh.Event {
+	case WebhookCreate:
+		return "Create"
+	case WebhookWrite:
+		return "Write"
+	case WebhookUnlink:
+		return "Unlink"
+	}
+	return wh.Method
+}
+
+// A WebhookRetryPolicy defines how failed webhook deliveries are retried.
+//
+// After each failure, the delivery is retried after BaseDelay, doubled at
+// each new failure up to MaxDelay. After MaxAttempts failed attempts, the
+// delivery is not retried anymore and is set in the WebhookDead state.
+type WebhookRetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Timeout is the timeout of each HTTP request
+	Timeout time.Duration
+}
+
+// DefaultWebhookRetryPolicy is the default policy for webhook deliveries
+var DefaultWebhookRetryPolicy = WebhookRetryPolicy{
+	MaxAttempts: 10,
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    6 * time.Hour,
+	Timeout:     10 * time.Second,
+}
+
+// delay returns the time to wait before the next attempt
+// after the given number of failed attempts.
+func (p WebhookRetryPolicy) delay(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// A WebhookRegistry holds the webhooks of the application
+type WebhookRegistry struct {
+	sync.RWMutex
+	registry map[string]*Webhook
+	// triggers holds the webhooks by model and method names
+	triggers map[string]map[string][]*Webhook
+	policy   WebhookRetryPolicy
+	client   *http.Client
+}
+
+// Webhooks is the registry of all the webhooks of the application
+var Webhooks = newWebhookRegistry()
+
+// newWebhookRegistry returns a new empty WebhookRegistry
+func newWebhookRegistry() *WebhookRegistry {
+	wr := &WebhookRegistry{
+		registry: make(map[string]*Webhook),
+		triggers: make(map[string]map[string][]*Webhook),
+	}
+	wr.SetRetryPolicy(DefaultWebhookRetryPolicy)
+	return wr
+}
+
+// Register adds the given webhook to the registry.
+// It panics if the webhook is not valid or if a webhook with the same name
+// is already registered.
+func (wr *WebhookRegistry) Register(wh *Webhook) {
+	switch {
+	case wh.Name == "" || wh.Model == "" || wh.URL == "":
+		log.Panic("Webhooks must have a name, a model and a URL", "webhook", wh.Name, "model", wh.Model, "url", wh.URL)
+	case wh.Event == WebhookMethodCall && wh.Method == "":
+		log.Panic("Method call webhooks must have a method", "webhook", wh.Name)
+	case wh.methodName() == "":
+		log.Panic("Unknown webhook event", "webhook", wh.Name, "event", wh.Event)
+	case wh.Model == WebhookDeliveryModel:
+		log.Panic("Webhooks cannot be triggered by webhook deliveries", "webhook", wh.Name)
+	}
+	wr.Lock()
+	defer wr.Unlock()
+	if _, exists := wr.registry[wh.Name]; exists {
+		log.Panic("Trying to register an already existing webhook", "webhook", wh.Name)
+	}
+	wr.registry[wh.Name] = wh
+	if wr.triggers[wh.Model] == nil {
+		wr.triggers[wh.Model] = make(map[string][]*Webhook)
+	}
+	wr.triggers[wh.Model][wh.methodName()] = append(wr.triggers[wh.Model][wh.methodName()], wh)
+}
+
+// Unregister removes the webhook with the given name from the registry.
+// Pending deliveries of this webhook are set in the WebhookDead state
+// when they are processed.
+func (wr *WebhookRegistry) Unregister(name string) {
+	wr.Lock()
+	defer wr.Unlock()
+	wh, ok := wr.registry[name]
+	if !ok {
+		return
+	}
+	delete(wr.registry, name)
+	webhooks := wr.triggers[wh.Model][wh.methodName()]
+	for i, w := range webhooks {
+		if w == wh {
+			wr.triggers[wh.Model][wh.methodName()] = append(webhooks[:i:i], webhooks[i+1:]...)
+			break
+		}
+	}
+}
+
+// Get returns the webhook with the given name and true if it exists
+func (wr *WebhookRegistry) Get(name string) (*Webhook, bool) {
+	wr.RLock()
+	defer wr.RUnlock()
+	wh, ok := wr.registry[name]
+	return wh, ok
+}
+
+// SetRetryPolicy sets the policy of the deliveries of all webhooks
+func (wr *WebhookRegistry) SetRetryPolicy(policy WebhookRetryPolicy) {
+	wr.Lock()
+	defer wr.Unlock()
+	wr.policy = policy
+	wr.client = &http.Client{Timeout: policy.Timeout}
+}
+
+// isEmpty returns true if no webhook is registered
+func (wr *WebhookRegistry) isEmpty() bool {
+	wr.RLock()
+	defer wr.RUnlock()
+	return len(wr.registry) == 0
+}
+
+// triggered returns the webhooks triggered by the given method of the given model
+func (wr *WebhookRegistry) triggered(model *Model, method *Method) []*Webhook {
+	wr.RLock()
+	defer wr.RUnlock()
+	return wr.triggers[model.name][method.name]
+}
+
+// A webhookPayload is the JSON body sent to the URL of a webhook
+type webhookPayload struct {
+	Webhook string                   `json:"webhook"`
+	Event   WebhookEvent             `json:"event"`
+	Model   string                   `json:"model"`
+	Method  string                   `json:"method"`
+	IDs     []int64                  `json:"ids"`
+	Records []map[string]interface{} `json:"records"`
+	Time    time.Time                `json:"time"`
+	webhook *Webhook
+}
+
+// newWebhookPayload returns the payload of the given webhook for the given records,
+// the written fields being the fields given to the triggering call.
+// The records must be in a superuser Environment.
+func newWebhookPayload(wh *Webhook, records *RecordCollection, written FieldNames) *webhookPayload {
+	payload := webhookPayload{
+		Webhook: wh.Name,
+		Event:   wh.Event,
+		Model:   wh.Model,
+		Method:  wh.methodName(),
+		IDs:     records.Ids(),
+		Time:    time.Now().UTC(),
+		webhook: wh,
+	}
+	fields := wh.payloadFields(records.model, written)
+	if len(fields) > 0 {
+		records.Load(fields...)
+	}
+	for _, rec := range records.Records() {
+		values := map[string]interface{}{ID.JSON(): rec.ids[0]}
+		for _, field := range fields {
+			value := rec.Get(field)
+			if rs, ok := value.(RecordSet); ok {
+				value = rs.Ids()
+			}
+			values[field.JSON()] = value
+		}
+		payload.Records = append(payload.Records, values)
+	}
+	return &payload
+}
+
+// webhookWrittenFields returns the fields of the data given to the given
+// method with the given args, if it is Create or Write.
+func (rc *RecordCollection) webhookWrittenFields(method *Method, args []interface{}) FieldNames {
+	if (method.name != "Create" && method.name != "Write") || len(args) == 0 {
+		return nil
+	}
+	data, ok := args[0].(RecordData)
+	if !ok {
+		return nil
+	}
+	md := data.Underlying()
+	keys := md.Keys()
+	for key := range md.ToCreate {
+		keys = append(keys, key)
+	}
+	var res FieldNames
+	for _, key := range keys {
+		if fi, ok := rc.model.fields.Get(key); ok {
+			res = append(res, fi)
+		}
+	}
+	return res
+}
+
+// webhooksBefore is called before the given method is called on rc with the
+// given args. It returns the function to call with the results of the method
+// to enqueue the deliveries of the webhooks triggered by this call, or nil if
+// no webhook is triggered.
+func (rc *RecordCollection) webhooksBefore(method *Method, args []interface{}) func([]interface{}) {
+	webhooks := Webhooks.triggered(rc.model, method)
+	if len(webhooks) == 0 {
+		return nil
+	}
+	written := rc.webhookWrittenFields(method, args)
+	if method.name == "Unlink" {
+		// Records must be read before they are deleted
+		var payloads []*webhookPayload
+		for _, wh := range webhooks {
+			if records := rc.webhookRecords(wh); !records.IsEmpty() {
+				payloads = append(payloads, newWebhookPayload(wh, records, written))
+			}
+		}
+		return func([]interface{}) {
+			rc.enqueueWebhooks(payloads)
+		}
+	}
+	return func(res []interface{}) {
+		records := rc
+		if method.name == "Create" {
+			records = res[0].(RecordSet).Collection()
+		}
+		var payloads []*webhookPayload
+		for _, wh := range webhooks {
+			if matching := records.webhookRecords(wh); !matching.IsEmpty() {
+				payloads = append(payloads, newWebhookPayload(wh, matching, written))
+			}
+		}
+		rc.enqueueWebhooks(payloads)
+	}
+}
+
+// webhookRecords returns the records of this RecordCollection that match
+// the condition of the given webhook, in a superuser Environment.
+func (rc *RecordCollection) webhookRecords(wh *Webhook) *RecordCollection {
+	records := rc.Sudo()
+	if wh.Condition == nil {
+		return records.Fetch()
+	}
+	return records.FilteredOn(wh.Condition.Underlying())
+}
+
+// enqueueWebhooks creates the WebhookDelivery records of the given payloads
+// and registers their delivery after the transaction is committed.
+func (rc *RecordCollection) enqueueWebhooks(payloads []*webhookPayload) {
+	if len(payloads) == 0 {
+		return
+	}
+	deliveries := rc.env.Pool(WebhookDeliveryModel).Sudo()
+	var ids []int64
+	for _, payload := range payloads {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Panic("Unable to marshal webhook payload", "webhook", payload.Webhook, "error", err)
+		}
+		delivery := deliveries.Call("Create", NewModelData(deliveries.model, FieldMap{
+			"Webhook":     payload.Webhook,
+			"Event":       string(payload.Event),
+			"URL":         payload.webhook.URL,
+			"Payload":     string(body),
+			"State":       WebhookPending,
+			"NextAttempt": dates.Now(),
+		})).(RecordSet).Collection()
+		ids = append(ids, delivery.Ids()...)
+	}
+	rc.env.AfterCommit(func() {
+		// Deliveries are part of the worker group so that StopWorkerLoop waits for them
+		workerGroup.Add(1)
+		go func() {
+			defer workerGroup.Done()
+			ProcessWebhookDeliveries(ids...)
+		}()
+	})
+}
+
+// processDueWebhookDeliveries delivers all the pending webhooks whose next
+// attempt is due. It is the worker function of the webhooks.
+func processDueWebhookDeliveries() {
+	ProcessWebhookDeliveries()
+}
+
+// ProcessWebhookDeliveries delivers the pending webhooks whose next attempt
+// is due. If ids are given, only the deliveries with these ids are processed.
+//
+// Each delivery is processed in its own transaction and locked during its
+// processing so that this function can be called concurrently. This function
+// is called by the core worker loop and after the commit of the transactions
+// that enqueued deliveries.
+func ProcessWebhookDeliveries(ids ...int64) {
+	if Webhooks.isEmpty() {
+		return
+	}
+	for {
+		var found bool
+		err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			delivery := lockNextWebhookDelivery(env, ids)
+			if delivery.IsEmpty() {
+				return
+			}
+			found = true
+			deliverWebhook(delivery)
+		})
+		if err != nil {
+			log.Warn("Error while processing webhook deliveries", "error", err)
+			return
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+// lockNextWebhookDelivery returns the next pending WebhookDelivery whose next
+// attempt is due, restricted to the given ids if any, and locks it until the
+// end of the transaction. Deliveries locked by other transactions are skipped.
+func lockNextWebhookDelivery(env Environment, ids []int64) *RecordCollection {
+	query := `SELECT id FROM webhook_delivery WHERE state = ? AND next_attempt <= ?`
+	args := []interface{}{WebhookPending, dates.Now()}
+	if len(ids) > 0 {
+		query += ` AND id IN (?)`
+		args = append(args, ids)
+	}
+	query += ` ORDER BY next_attempt, id LIMIT 1 FOR UPDATE SKIP LOCKED`
+	var res []int64
+	env.Cr().Select(&res, query, args...)
+	return env.Pool(WebhookDeliveryModel).Call("Browse", res).(RecordSet).Collection()
+}
+
+// deliverWebhook sends the payload of the given WebhookDelivery record to the
+// URL of its webhook and updates the record with the result of the attempt.
+func deliverWebhook(delivery *RecordCollection) {
+	model := delivery.model
+	Webhooks.RLock()
+	policy, client := Webhooks.policy, Webhooks.client
+	Webhooks.RUnlock()
+	attempts := delivery.Get(model.FieldName("Attempts")).(int64) + 1
+	values := FieldMap{
+		"Attempts":    attempts,
+		"LastAttempt": dates.Now(),
+	}
+	wh, ok := Webhooks.Get(delivery.Get(model.FieldName("Webhook")).(string))
+	var (
+		status int
+		err    error
+	)
+	if ok {
+		status, err = sendWebhook(client, wh, delivery)
+	} else {
+		err = fmt.Errorf("unknown webhook '%s'", delivery.Get(model.FieldName("Webhook")))
+	}
+	values["ResponseStatus"] = int64(status)
+	switch {
+	case err == nil:
+		values["State"] = WebhookDelivered
+		values["Error"] = ""
+	case !ok || attempts >= int64(policy.MaxAttempts):
+		values["State"] = WebhookDead
+		values["Error"] = err.Error()
+	default:
+		values["NextAttempt"] = dates.Now().Add(policy.delay(int(attempts)))
+		values["Error"] = err.Error()
+	}
+	if err != nil {
+		log.Info("Webhook delivery failed", "webhook", delivery.Get(model.FieldName("Webhook")), "delivery", delivery.ids[0],
+			"attempts", attempts, "error", err)
+	}
+	delivery.Call("Write", NewModelData(model, values))
+}
+
+// sendWebhook sends the request of the given WebhookDelivery record of the
+// given webhook with the given client and returns the HTTP status code of the
+// response. It returns an error if the request failed or the status is not 2xx.
+func sendWebhook(client *http.Client, wh *Webhook, delivery *RecordCollection) (int, error) {
+	model := delivery.model
+	body := []byte(delivery.Get(model.FieldName("Payload")).(string))
+	req, err := http.NewRequest(http.MethodPost, delivery.Get(model.FieldName("URL")).(string), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(delivery.ids[0], 10))
+	req.Header.Set(WebhookEventHeader, delivery.Get(model.FieldName("Event")).(string))
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if wh.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(wh.Secret, timestamp, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// WebhookSignature returns the hex encoded HMAC-SHA256 of the given
+// timestamp and body joined by a dot, computed with the given secret.
+//
+// Receivers should compare it with the WebhookSignatureHeader of the
+// request with hmac.Equal and check that the timestamp is recent.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// declareWebhookDeliveryModel creates the system model that logs webhook deliveries
+func declareWebhookDeliveryModel() {
+	model := getOrCreateModel(WebhookDeliveryModel, SystemModel)
+	model.InheritModel(Registry.MustGet("BaseMixin"))
+	for _, fi := range []*Field{
+		{name: "Webhook", json: "webhook", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")},
+			required: true, index: true},
+		{name: "Event", json: "event", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "URL", json: "url", fieldType: fieldtype.Char, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "Payload", json: "payload", fieldType: fieldtype.Text, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+		{name: "State", json: "state", fieldType: fieldtype.Selection, structField: reflect.StructField{Type: reflect.TypeOf("")},
+			selection: types.Selection{WebhookPending: "Pending", WebhookDelivered: "Delivered", WebhookDead: "Dead"},
+			required:  true, index: true},
+		{name: "Attempts", json: "attempts", fieldType: fieldtype.Integer, structField: reflect.StructField{Type: reflect.TypeOf(int64(0))}},
+		{name: "NextAttempt", json: "next_attempt", fieldType: fieldtype.DateTime,
+			structField: reflect.StructField{Type: reflect.TypeOf(dates.DateTime{})}, index: true},
+		{name: "LastAttempt", json: "last_attempt", fieldType: fieldtype.DateTime,
+			structField: reflect.StructField{Type: reflect.TypeOf(dates.DateTime{})}},
+		{name: "ResponseStatus", json: "response_status", fieldType: fieldtype.Integer,
+			structField: reflect.StructField{Type: reflect.TypeOf(int64(0))}},
+		{name: "Error", json: "error", fieldType: fieldtype.Text, structField: reflect.StructField{Type: reflect.TypeOf("")}},
+	} {
+		fi.model = model
+		fi.description = fi.name
+		fi.noCopy = true
+		model.fields.add(fi)
+	}
+}
@@ -4,6 +4,7 @@
 package models
 
 import (
+	"fmt"
 	"sync"
 	"time"
 )
@@ -18,6 +19,7 @@ type WorkerFunction interface {
 
 // A workerFunction implements WorkerFunction
 type workerFunction struct {
+	name   string
 	fnct   func()
 	period time.Duration
 }
@@ -32,7 +34,8 @@ func (w *workerFunction) LoopPeriod() time.Duration {
 	return w.period
 }
 
-// NewWorkerFunction returns a WorkerFunction from the given fnct and period
+// NewWorkerFunction returns a WorkerFunction from the given fnct and period.
+// The worker is named after fnct in statistics.
 func NewWorkerFunction(fnct func(), period time.Duration) WorkerFunction {
 	return &workerFunction{
 		fnct:   fnct,
@@ -40,6 +43,16 @@ func NewWorkerFunction(fnct func(), period time.Duration) WorkerFunction {
 	}
 }
 
+// NewNamedWorkerFunction returns a WorkerFunction with the given name
+// from the given fnct and period.
+func NewNamedWorkerFunction(name string, fnct func(), period time.Duration) WorkerFunction {
+	return &workerFunction{
+		name:   name,
+		fnct:   fnct,
+		period: period,
+	}
+}
+
 var (
 	workerFunctions []WorkerFunction
 	workerStop      chan struct{}
@@ -47,12 +60,29 @@ var (
 )
 
 // RegisterWorker registers a WorkerFunction so that it will be called by the core loop.
+//
+// Worker functions are identified by their name in statistics and in
+// TriggerWorker, so this function panics if a worker function with the
+// same name is already registered. Use NewNamedWorkerFunction to register
+// the same function several times. Other implementations of WorkerFunction
+// are named by their Name method if they have one, or else by their type
+// and address, so that distinct instances of the same type do not collide.
 func RegisterWorker(wf WorkerFunction) {
+	name := workerName(wf)
+	for _, registered := range workerFunctions {
+		if workerName(registered) == name {
+			log.Panic("Trying to register an already existing worker function", "worker", name)
+		}
+	}
 	workerFunctions = append(workerFunctions, wf)
 }
 
 // RunWorkerLoop launches the erp core worker loop.
 //
+// Each worker function is run in its own goroutine every LoopPeriod. A tick
+// is skipped if the previous run of the worker function is still active. A
+// panic in a worker function is logged and recorded in its statistics.
+//
 // This function must be called only once or it will panic
 func RunWorkerLoop() {
 	if workerStop != nil {
@@ -67,7 +97,7 @@ func RunWorkerLoop() {
 			for {
 				select {
 				case <-ticker.C:
-					wf.Run()
+					startWorker(wf)
 				case <-workerStop:
 					workerGroup.Done()
 					return
@@ -77,7 +107,55 @@ func RunWorkerLoop() {
 	}
 }
 
-// StopWorkerLoop stops the erp core worker loop.
+// startWorker runs the given WorkerFunction in a new goroutine of the worker
+// group, unless it is already running. It returns false in this case.
+func startWorker(wf WorkerFunction) bool {
+	name := workerName(wf)
+	if !startWorkerRun(name) {
+		log.Debug("Skipping worker function run, previous run still active", "worker", name)
+		return false
+	}
+	workerGroup.Add(1)
+	go func() {
+		defer workerGroup.Done()
+		executeWorker(name, wf)
+	}()
+	return true
+}
+
+// TriggerWorker runs the registered worker function with the given name
+// immediately in the background, independently of its LoopPeriod.
+//
+// It returns an error if there is no such worker function or if it is
+// already running.
+func TriggerWorker(name string) error {
+	for _, wf := range workerFunctions {
+		if workerName(wf) != name {
+			continue
+		}
+		if !startWorker(wf) {
+			return fmt.Errorf("worker %s is already running", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown worker %s", name)
+}
+
+// RegisteredWorkers returns the statistics and the status of the
+// registered worker functions by name.
+func RegisteredWorkers() map[string]WorkerStats {
+	res := make(map[string]WorkerStats)
+	stats.Lock()
+	defer stats.Unlock()
+	for _, wf := range workerFunctions {
+		name := workerName(wf)
+		res[name] = stats.workers[name]
+	}
+	return res
+}
+
+// StopWorkerLoop stops the erp core worker loop. It waits for the
+// running worker functions to complete.
 //
 // Calling this method if the core worker loop is not running will cause panic.
 func StopWorkerLoop() {
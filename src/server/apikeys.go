@@ -0,0 +1,93 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+)
+
+// apiKeyKey is the key of the request's APIKey in the gin context
+const apiKeyKey = "erp_api_key"
+
+// BearerAuthentication returns a middleware that authenticates requests with
+// an 'Authorization: Bearer <API key>' header against the given APIKeyManager.
+// It is meant to be added to controllers groups with AddMiddleWare.
+//
+// Requests with a valid key are processed on behalf of the key's user (see
+// Context.UID). Requests with an invalid or expired key get a 401 Unauthorized
+// response. Requests without bearer token are left untouched.
+//
+// Keys restricted to some groups get a 403 Forbidden response, since the
+// handlers of the group may create Environments without the key's scope. Use
+// ScopedBearerAuthentication for groups whose handlers enforce it.
+func BearerAuthentication(keys *security.APIKeyManager) HandlerFunc {
+	return bearerAuthentication(keys, false)
+}
+
+// ScopedBearerAuthentication is the same as BearerAuthentication, but also
+// accepts keys restricted to some groups.
+//
+// It must only be used for groups whose handlers create all their Environments
+// with Context.ExecuteInNewEnvironment, which restricts the groups of the user
+// to the key's scope (see Context.EnvOptions). This is the case of the REST,
+// GraphQL and JSON-RPC batch handlers of this package.
+func ScopedBearerAuthentication(keys *security.APIKeyManager) HandlerFunc {
+	return bearerAuthentication(keys, true)
+}
+
+// bearerAuthentication returns the middleware of BearerAuthentication and
+// ScopedBearerAuthentication. Keys restricted to some groups are refused
+// unless allowScoped is true.
+func bearerAuthentication(keys *security.APIKeyManager, allowScoped bool) HandlerFunc {
+	return func(c *Context) {
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			c.Next()
+			return
+		}
+		key, err := keys.Verify(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		if err != nil {
+			c.Logger().Info("API key authentication failed", "error", err, "remote", c.ClientIP())
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, map[string]string{
+				"error": "invalid API key",
+			})
+			return
+		}
+		if len(key.Groups) > 0 && !allowScoped {
+			c.Logger().Info("Scoped API key refused", "path", c.Request.URL.Path, "uid", key.UID, "remote", c.ClientIP())
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			c.AbortWithStatusJSON(http.StatusForbidden, map[string]string{
+				"error": "scoped API keys are not allowed on this route",
+			})
+			return
+		}
+		c.Set(apiKeyKey, key)
+		c.Next()
+	}
+}
+
+// APIKey returns the APIKey this request has been authenticated with,
+// or nil if it has not been authenticated with an API key.
+func (c *Context) APIKey() *security.APIKey {
+	key, ok := c.Get(apiKeyKey)
+	if !ok {
+		return nil
+	}
+	return key.(*security.APIKey)
+}
+
+// UID returns the id of the user on behalf of whom this request is processed,
+// either from its API key or from its session. It returns 0 if the request
+// is not authenticated.
+func (c *Context) UID() int64 {
+	if key := c.APIKey(); key != nil {
+		return key.UID
+	}
+	uid, _ := c.Session().Get(SessionUIDKey).(int64)
+	return uid
+}
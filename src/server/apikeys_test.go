@@ -0,0 +1,59 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBearerAuthentication(t *testing.T) {
+	Convey("Testing API key authentication", t, func() {
+		keys := security.NewAPIKeyManager(make(memoryAPIKeyStore))
+		group := security.Registry.NewGroup("server_api_key_test", "Server API Key Test")
+		Reset(func() {
+			security.Registry.UnregisterGroup(group)
+		})
+		uidHandler := func(c *Context) {
+			c.String(http.StatusOK, strconv.FormatInt(c.UID(), 10))
+		}
+		srv := newTestServer()
+		srv.Group("/plain", BearerAuthentication(keys)).GET("/uid", uidHandler)
+		srv.Group("/scoped", ScopedBearerAuthentication(keys)).GET("/uid", uidHandler)
+		token, _, err := keys.Generate(2, "script", time.Time{})
+		So(err, ShouldBeNil)
+		scopedToken, _, err := keys.Generate(2, "scoped script", time.Time{}, group)
+		So(err, ShouldBeNil)
+		Convey("Requests without token should be left untouched", func() {
+			w := performRequest(srv, http.MethodGet, "/plain/uid", nil, nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "0")
+		})
+		Convey("Requests with a valid key should be authenticated", func() {
+			for _, path := range []string{"/plain/uid", "/scoped/uid"} {
+				w := performRequest(srv, http.MethodGet, path, nil, map[string]string{"Authorization": "Bearer " + token})
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldEqual, "2")
+			}
+		})
+		Convey("Requests with an invalid key should be refused", func() {
+			w := performRequest(srv, http.MethodGet, "/scoped/uid", nil, map[string]string{"Authorization": "Bearer " + token + "x"})
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Header().Get("WWW-Authenticate"), ShouldContainSubstring, "invalid_token")
+		})
+		Convey("Scoped keys should only be accepted on routes that enforce the scope", func() {
+			w := performRequest(srv, http.MethodGet, "/plain/uid", nil, map[string]string{"Authorization": "Bearer " + scopedToken})
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Header().Get("WWW-Authenticate"), ShouldContainSubstring, "insufficient_scope")
+			w = performRequest(srv, http.MethodGet, "/scoped/uid", nil, map[string]string{"Authorization": "Bearer " + scopedToken})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "2")
+		})
+	})
+}
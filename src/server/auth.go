@@ -0,0 +1,122 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/types"
+)
+
+const (
+	// SessionUIDKey is the session key of the uid of the logged in user
+	SessionUIDKey = "uid"
+	// SessionSecondFactorKey is the session key of the uid of a user whose
+	// password has been verified, but who has not provided a second factor yet.
+	SessionSecondFactorKey = "second_factor_uid"
+)
+
+// Authenticate checks the given credentials against the security.AuthenticationRegistry
+// and logs the user in the session on success.
+//
+// If the user must provide a second factor, the session is marked as pending
+// and a security.SecondFactorPendingError is returned. The user is then logged
+// in by a successful call to VerifySecondFactor.
+func (c *Context) Authenticate(login, secret string) (int64, error) {
+	return c.authenticate(login, secret, c.authContext())
+}
+
+// authenticate checks the given credentials with the given authentication
+// context and logs the user in. See Authenticate for details.
+func (c *Context) authenticate(login, secret string, context *types.Context) (int64, error) {
+	uid, err := security.AuthenticationRegistry.Authenticate(login, secret, context)
+	switch err.(type) {
+	case nil:
+		c.logIn(uid)
+	case security.SecondFactorPendingError:
+		sess := c.Session()
+		sess.Delete(SessionUIDKey)
+		sess.Set(SessionSecondFactorKey, uid)
+		sess.Save()
+	}
+	return uid, err
+}
+
+// VerifySecondFactor checks the given second factor code of the user whose
+// second factor is pending in this session and logs the user in on success.
+func (c *Context) VerifySecondFactor(code string) (int64, error) {
+	uid, ok := c.Session().Get(SessionSecondFactorKey).(int64)
+	if !ok {
+		return 0, errors.New("no second factor pending in this session")
+	}
+	if err := security.AuthenticationRegistry.VerifySecondFactor(uid, code, c.authContext()); err != nil {
+		return 0, err
+	}
+	c.logIn(uid)
+	return uid, nil
+}
+
+// SecondFactorPending returns true if the user of this session has
+// been authenticated by password but has not provided a second factor yet.
+func (c *Context) SecondFactorPending() bool {
+	_, ok := c.Session().Get(SessionSecondFactorKey).(int64)
+	return ok
+}
+
+// logIn sets the given uid as logged in user of the session.
+// The CSRF token is renewed so that a token obtained before login
+// cannot be reused.
+func (c *Context) logIn(uid int64) {
+	sess := c.Session()
+	sess.Delete(SessionSecondFactorKey)
+	sess.Delete(CSRFTokenKey)
+	sess.Set(SessionUIDKey, uid)
+	sess.Save()
+}
+
+// authContext returns the context passed to the authentication backends.
+// It holds the IP address of the client for login throttling and audit.
+func (c *Context) authContext() *types.Context {
+	return types.NewContext().WithKey(security.RemoteIPKey, c.ClientIP())
+}
+
+// EnforceSecondFactor adds a middleware to the server that restricts sessions
+// with a pending second factor to the given secondFactorPath and allowedPaths
+// (e.g. static assets). Other HTML requests are redirected to secondFactorPath
+// and other JSON requests get a 401 Unauthorized response.
+//
+// Paths ending with '/' allow all paths with this prefix.
+func EnforceSecondFactor(secondFactorPath string, allowedPaths ...string) {
+	erpServer.Use(wrapContextFuncs(secondFactorMiddleware(secondFactorPath, allowedPaths...))...)
+}
+
+// secondFactorMiddleware returns a middleware that prevents sessions with a pending
+// second factor to access other paths than secondFactorPath and allowedPaths.
+func secondFactorMiddleware(secondFactorPath string, allowedPaths ...string) HandlerFunc {
+	allowed := append([]string{secondFactorPath}, allowedPaths...)
+	return func(c *Context) {
+		if !c.SecondFactorPending() {
+			c.Next()
+			return
+		}
+		path := c.Request.URL.Path
+		for _, p := range allowed {
+			if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+				c.Next()
+				return
+			}
+		}
+		if strings.Contains(c.GetHeader("Content-Type"), "application/json") {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, map[string]string{
+				"error": "second authentication factor required",
+			})
+			return
+		}
+		c.Redirect(http.StatusFound, secondFactorPath)
+		c.Abort()
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/Pedro-lmso-erp/erp/src/models"
 	"github.com/Pedro-lmso-erp/erp/src/tools/exceptions"
 	"github.com/Pedro-lmso-erp/erp/src/tools/hweb"
 	"github.com/gin-contrib/sessions"
@@ -39,20 +40,7 @@ func (c *Context) RPC(code int, obj interface{}, err ...error) {
 			c.AbortWithError(http.StatusInternalServerError, errors.New("error is of unknown type"))
 			return
 		}
-		respErr := ResponseError{
-			JsonRPC: "2.0",
-			ID:      id.(int64),
-			Error: JSONRPCError{
-				Code:    code,
-				Message: "erp Server Error",
-				Data: JSONRPCErrorData{
-					Arguments:     []string{userError.Message},
-					ExceptionType: "user_error",
-					Debug:         userError.Debug,
-				},
-			},
-		}
-		c.JSON(code, respErr)
+		c.JSON(code, c.newResponseError(id.(int64), code, userError))
 		return
 	}
 	resp := ResponseRPC{
@@ -63,6 +51,32 @@ func (c *Context) RPC(code int, obj interface{}, err ...error) {
 	c.JSON(code, resp)
 }
 
+// newResponseError returns the ResponseError of this request with the given id
+// and code for the given error.
+func (c *Context) newResponseError(id int64, code int, err error) ResponseError {
+	data := JSONRPCErrorData{
+		Arguments:     []string{err.Error()},
+		ExceptionType: "internal_error",
+	}
+	if userError, ok := err.(exceptions.UserError); ok {
+		data = JSONRPCErrorData{
+			Arguments:     []string{userError.Message},
+			ExceptionType: "user_error",
+			Debug:         userError.Debug,
+		}
+	}
+	data.RequestID = c.RequestID()
+	return ResponseError{
+		JsonRPC: "2.0",
+		ID:      id,
+		Error: JSONRPCError{
+			Code:    code,
+			Message: "erp Server Error",
+			Data:    data,
+		},
+	}
+}
+
 // BindRPCParams binds the RPC parameters to the given data object.
 func (c *Context) BindRPCParams(data interface{}) {
 	var req RequestRPC
@@ -110,6 +124,61 @@ func (c *Context) HTTPGet(uri string) (*http.Response, error) {
 // HTML renders the HTTP template specified by its file name.
 // It also updates the HTTP code and sets the Content-Type as "text/html".
 // See http://golang.org/doc/articles/wiki/
+//
+// If the session has a CSRF token, it is available in the template as the
+// 'csrf_token' variable (see CSRFProtection).
 func (c *Context) HTML(code int, name string, context hweb.Context) {
+	if token, ok := c.Session().Get(CSRFTokenKey).(string); ok {
+		if context == nil {
+			context = make(hweb.Context)
+		}
+		if _, exists := context[CSRFTokenKey]; !exists {
+			context[CSRFTokenKey] = token
+		}
+	}
 	c.Context.HTML(code, name, context)
 }
+
+// QueryProfiler returns the QueryProfiler of this request or
+// nil if the queries of this request are not profiled.
+func (c *Context) QueryProfiler() *models.QueryProfiler {
+	profiler, ok := c.Get(queryProfilerKey)
+	if !ok {
+		return nil
+	}
+	return profiler.(*models.QueryProfiler)
+}
+
+// EnvOptions returns the options to apply to the Environments
+// created for this request.
+func (c *Context) EnvOptions() []models.EnvOption {
+	var res []models.EnvOption
+	if profiler := c.QueryProfiler(); profiler != nil {
+		res = append(res, models.WithQueryProfiler(profiler))
+	}
+	if key := c.APIKey(); key != nil && len(key.Groups) > 0 {
+		res = append(res, models.WithGroupsScope(key.Scope()...))
+	}
+	if span := c.Span(); span != nil {
+		res = append(res, models.WithSpan(span))
+	}
+	if requestID := c.RequestID(); requestID != "" {
+		res = append(res, models.WithRequestID(requestID))
+	}
+	return res
+}
+
+// ExecuteInNewEnvironment executes the given fnct in a new Environment
+// for the given uid, customized for this request (e.g. query profiling,
+// API key groups scope, tracing or request ID).
+//
+// In a JSON-RPC batch request with a shared transaction, fnct is executed
+// in a savepoint of the transaction of the batch instead (see RPCBatch).
+//
+// See models.ExecuteInNewEnvironment for details.
+func (c *Context) ExecuteInNewEnvironment(uid int64, fnct func(models.Environment)) error {
+	if batch, ok := c.Request.Context().Value(rpcBatchKey{}).(*rpcBatch); ok && batch.shared {
+		return batch.executeInSavepoint(uid, fnct)
+	}
+	return models.ExecuteInNewEnvironment(uid, fnct, c.EnvOptions()...)
+}
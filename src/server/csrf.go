@@ -0,0 +1,110 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	// CSRFTokenKey is the name of the session key, of the form field
+	// and of the template variable holding the CSRF token.
+	CSRFTokenKey = "csrf_token"
+	// CSRFHeader is the header in which scripts can send the CSRF token
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFRPCHeader is the custom header that JSON-RPC calls to exempted
+	// routes must carry instead of the CSRF token. Browsers do not allow
+	// other origins to set custom headers without a CORS preflight.
+	CSRFRPCHeader = "X-Requested-With"
+	// csrfTokenLen is the number of random bytes of a CSRF token
+	csrfTokenLen = 32
+)
+
+// CSRFProtection returns a middleware that protects against cross-site request
+// forgery with a synchronizer token. It is meant to be added to controllers
+// groups with AddMiddleWare.
+//
+// A token is stored in the session of each client and is available in the
+// templates rendered with Context.HTML as the 'csrf_token' variable. Requests
+// with an unsafe method (i.e. other than GET, HEAD, OPTIONS and TRACE) must send
+// this token either in the 'csrf_token' form field or in the X-CSRF-Token header.
+// Otherwise they get a 403 Forbidden response.
+//
+// Requests to rpcPaths are exempted from the token if they carry the
+// X-Requested-With header, so that JSON-RPC clients do not need to fetch the
+// token. Paths ending with '/' exempt all paths with this prefix. Requests
+// authenticated with an API key are exempted too since they do not rely on
+// the session cookie.
+func CSRFProtection(rpcPaths ...string) HandlerFunc {
+	return func(c *Context) {
+		if c.CSRFToken() == "" {
+			c.Abort()
+			return
+		}
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			c.Next()
+			return
+		}
+		if c.APIKey() != nil {
+			c.Next()
+			return
+		}
+		if c.GetHeader(CSRFRPCHeader) != "" {
+			path := c.Request.URL.Path
+			for _, p := range rpcPaths {
+				if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+					c.Next()
+					return
+				}
+			}
+		}
+		if !c.checkCSRFToken() {
+			c.Logger().Info("CSRF token check failed", "method", c.Request.Method, "path", c.Request.URL.Path, "remote", c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusForbidden, map[string]string{
+				"error": "invalid CSRF token",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CSRFToken returns the CSRF token of the session, generating a new one if
+// the session does not have one yet. It returns an empty string and sets a
+// 500 Internal Server Error status if the token cannot be generated.
+func (c *Context) CSRFToken() string {
+	sess := c.Session()
+	if token, ok := sess.Get(CSRFTokenKey).(string); ok && token != "" {
+		return token
+	}
+	b := make([]byte, csrfTokenLen)
+	if _, err := rand.Read(b); err != nil {
+		c.Logger().Warn("Unable to generate CSRF token", "error", err)
+		c.Status(http.StatusInternalServerError)
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	sess.Set(CSRFTokenKey, token)
+	sess.Save()
+	return token
+}
+
+// checkCSRFToken returns true if the request carries the CSRF token of
+// the session in the X-CSRF-Token header or in the csrf_token form field.
+func (c *Context) checkCSRFToken() bool {
+	expected, _ := c.Session().Get(CSRFTokenKey).(string)
+	if expected == "" {
+		return false
+	}
+	token := c.GetHeader(CSRFHeader)
+	if token == "" {
+		token = c.PostForm(CSRFTokenKey)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	Convey("Testing CSRF protection", t, func() {
+		keys := security.NewAPIKeyManager(make(memoryAPIKeyStore))
+		apiToken, _, err := keys.Generate(2, "script", time.Time{})
+		So(err, ShouldBeNil)
+		ok := func(c *Context) {
+			c.String(http.StatusOK, "ok")
+		}
+		srv := newTestServer()
+		group := srv.Group("/", BearerAuthentication(keys), CSRFProtection("/rpc/call", "/rpc/dataset/"))
+		group.GET("/token", func(c *Context) {
+			c.String(http.StatusOK, c.CSRFToken())
+		})
+		group.POST("/form", ok)
+		group.POST("/rpc/call", ok)
+		group.POST("/rpc/dataset/search_read", ok)
+		group.POST("/rpc/other", ok)
+		// Get a session with its CSRF token
+		w := performRequest(srv, http.MethodGet, "/token", nil, nil)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		token := w.Body.String()
+		So(token, ShouldNotBeEmpty)
+		cookie := strings.Split(w.Header().Get("Set-Cookie"), ";")[0]
+		So(cookie, ShouldStartWith, "erp-session=")
+		Convey("Tokens should be kept in the session", func() {
+			w := performRequest(srv, http.MethodGet, "/token", nil, map[string]string{"Cookie": cookie})
+			So(w.Body.String(), ShouldEqual, token)
+			w = performRequest(srv, http.MethodGet, "/token", nil, nil)
+			So(w.Body.String(), ShouldNotEqual, token)
+		})
+		Convey("Unsafe requests without token should be refused", func() {
+			w := performRequest(srv, http.MethodPost, "/form", nil, map[string]string{"Cookie": cookie})
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			w = performRequest(srv, http.MethodPost, "/form", nil, nil)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Unsafe requests with a wrong token should be refused", func() {
+			w := performRequest(srv, http.MethodPost, "/form", nil, map[string]string{
+				"Cookie":   cookie,
+				CSRFHeader: token + "x",
+			})
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Unsafe requests with the token should be accepted", func() {
+			w := performRequest(srv, http.MethodPost, "/form", nil, map[string]string{
+				"Cookie":   cookie,
+				CSRFHeader: token,
+			})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			form := url.Values{CSRFTokenKey: []string{token}}
+			w = performRequest(srv, http.MethodPost, "/form", strings.NewReader(form.Encode()), map[string]string{
+				"Cookie":       cookie,
+				"Content-Type": "application/x-www-form-urlencoded",
+			})
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("RPC paths should be exempted with the X-Requested-With header", func() {
+			headers := map[string]string{
+				"Cookie":      cookie,
+				CSRFRPCHeader: "XMLHttpRequest",
+			}
+			So(performRequest(srv, http.MethodPost, "/rpc/call", nil, headers).Code, ShouldEqual, http.StatusOK)
+			So(performRequest(srv, http.MethodPost, "/rpc/dataset/search_read", nil, headers).Code, ShouldEqual, http.StatusOK)
+			So(performRequest(srv, http.MethodPost, "/rpc/other", nil, headers).Code, ShouldEqual, http.StatusForbidden)
+			So(performRequest(srv, http.MethodPost, "/form", nil, headers).Code, ShouldEqual, http.StatusForbidden)
+			delete(headers, CSRFRPCHeader)
+			So(performRequest(srv, http.MethodPost, "/rpc/call", nil, headers).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Requests authenticated with an API key should be exempted", func() {
+			w := performRequest(srv, http.MethodPost, "/form", nil, map[string]string{"Authorization": "Bearer " + apiToken})
+			So(w.Code, ShouldEqual, http.StatusOK)
+			w = performRequest(srv, http.MethodPost, "/form", nil, map[string]string{"Authorization": "Bearer " + apiToken + "x"})
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
@@ -0,0 +1,280 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/kinds"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"github.com/graphql-go/graphql/language/visitor"
+)
+
+const (
+	// GraphQLMaxDepth is the maximum nesting depth of the fields of a GraphQL
+	// request. It lets the introspection query of GraphQL clients through.
+	GraphQLMaxDepth = 15
+	// GraphQLMaxFields is the maximum number of fields of a GraphQL request,
+	// the fields of fragments being counted each time they are spread.
+	GraphQLMaxFields = 1000
+)
+
+var (
+	// graphQLSchema is the schema of the GraphQL API generated by PostInit
+	graphQLSchema *graphql.Schema
+	// graphQLEnabled is set when the GraphQL handler is created,
+	// so that PostInit generates the schema.
+	graphQLEnabled bool
+	// errGraphQLRollback is panicked to roll back the transaction of a
+	// GraphQL request that has errors.
+	errGraphQLRollback = errors.New("the request failed, all changes have been rolled back")
+	// graphQLValidationRules are the rules against which GraphQL requests are validated
+	graphQLValidationRules = append(append([]graphql.ValidationRuleFn(nil), graphql.SpecifiedRules...), graphQLComplexityRule)
+)
+
+// A graphQLRequest is a GraphQL request, sent in the JSON body of
+// POST requests or in the query parameters of GET requests.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLContextKey is the key of the graphQLExecution in the context of resolvers
+type graphQLContextKey struct{}
+
+// A graphQLExecution holds the state of the execution of a GraphQL request
+type graphQLExecution struct {
+	env models.Environment
+	// readOnly is true if mutations are forbidden, i.e. for GET requests
+	readOnly bool
+	// mutated is true if a mutation has been executed
+	mutated bool
+}
+
+// graphQLExecutionOf returns the graphQLExecution of the given resolver params
+func graphQLExecutionOf(p graphql.ResolveParams) *graphQLExecution {
+	return p.Context.Value(graphQLContextKey{}).(*graphQLExecution)
+}
+
+// mutate marks this execution as mutated.
+// It panics if mutations are forbidden.
+func (ge *graphQLExecution) mutate() {
+	if ge.readOnly {
+		panic(errors.New("mutations are not allowed in GET requests"))
+	}
+	ge.mutated = true
+}
+
+// GraphQL returns the handler of the GraphQL API. It accepts GET requests with
+// the 'query', 'operationName' and 'variables' parameters, and POST requests
+// with these keys in a JSON body. Mutations are only accepted in POST requests.
+//
+// The schema is generated by PostInit from the exposed models of the registry
+// (see models.Model.IsExposed), with for each model:
+//
+//   - an object type with its fields, relation fields resolving to the
+//     related objects if their model is exposed or to ids otherwise,
+//   - the '<Model>(id)', '<Model>Search(filter, order, limit, offset)' and
+//     '<Model>Count(filter)' queries, where filter is a '<Model>Filter' input
+//     with an operators input per field (eq, ne, gt, in, like, isNull, etc.)
+//     and 'and', 'or' and 'not' to combine filters,
+//   - the '<Model>Create(values)', '<Model>Update(id, values)' and
+//     '<Model>Delete(id)' mutations,
+//   - a '<Model>Call<Method>(ids, arg1, ...)' mutation per exposed method,
+//     returning the JSON encoding of the result as for RESTCall.
+//
+// Ids and integer fields are of the 'Int64' scalar type, since GraphQL's Int
+// is limited to 32 bits.
+//
+// Requests with fields nested deeper than GraphQLMaxDepth or with more than
+// GraphQLMaxFields fields are rejected.
+//
+// The request is executed in a single transaction as the user of the request,
+// so that access rights and record rules apply. The transaction is rolled
+// back if the request has errors. Relation fields are loaded in batches for
+// all the records of a list thanks to the prefetch of the ORM.
+func GraphQL() HandlerFunc {
+	graphQLEnabled = true
+	return func(c *Context) {
+		uid := c.UID()
+		if uid == 0 {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.graphQLError(http.StatusUnauthorized, errors.New("authentication required"))
+			return
+		}
+		if graphQLSchema == nil {
+			c.graphQLError(http.StatusServiceUnavailable, errors.New("the GraphQL schema has not been generated"))
+			return
+		}
+		var req graphQLRequest
+		if c.Request.Method == http.MethodGet {
+			req.Query = c.Query("query")
+			req.OperationName = c.Query("operationName")
+			if vars := c.Query("variables"); vars != "" {
+				if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+					c.graphQLError(http.StatusBadRequest, fmt.Errorf("invalid variables: %s", err))
+					return
+				}
+			}
+		} else if err := c.ShouldBindJSON(&req); err != nil {
+			c.graphQLError(http.StatusBadRequest, fmt.Errorf("invalid JSON body: %s", err))
+			return
+		}
+		exec := &graphQLExecution{readOnly: c.Request.Method == http.MethodGet}
+		var result *graphql.Result
+		err := c.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+			exec.env = env
+			exec.mutated = false
+			result = executeGraphQL(graphql.Params{
+				Schema:         *graphQLSchema,
+				RequestString:  req.Query,
+				VariableValues: req.Variables,
+				OperationName:  req.OperationName,
+				Context:        context.WithValue(c.Request.Context(), graphQLContextKey{}, exec),
+			})
+			if result.HasErrors() {
+				panic(errGraphQLRollback)
+			}
+		})
+		if result == nil || (err != nil && !result.HasErrors()) {
+			code, msg := ormErrorStatus(err)
+			c.graphQLError(code, errors.New(msg))
+			return
+		}
+		if result.HasErrors() && exec.mutated {
+			result.Data = nil
+			result.Errors = append(result.Errors, gqlerrors.FormattedError{Message: errGraphQLRollback.Error()})
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// graphQLError aborts the request with the given status code and error
+// formatted as a GraphQL response.
+func (c *Context) graphQLError(code int, err error) {
+	c.AbortWithStatusJSON(code, gin.H{
+		"errors": []gqlerrors.FormattedError{{Message: err.Error()}},
+	})
+}
+
+// executeGraphQL executes the given GraphQL request as graphql.Do, except
+// that the request is validated against graphQLValidationRules.
+func executeGraphQL(p graphql.Params) *graphql.Result {
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+		Body: []byte(p.RequestString),
+		Name: "GraphQL request",
+	})})
+	if err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+	validation := graphql.ValidateDocument(&p.Schema, doc, graphQLValidationRules)
+	if !validation.IsValid {
+		return &graphql.Result{Errors: validation.Errors}
+	}
+	return graphql.Execute(graphql.ExecuteParams{
+		Schema:        p.Schema,
+		Root:          p.RootObject,
+		AST:           doc,
+		OperationName: p.OperationName,
+		Args:          p.VariableValues,
+		Context:       p.Context,
+	})
+}
+
+// graphQLComplexityRule is a GraphQL validation rule rejecting operations
+// with fields nested deeper than GraphQLMaxDepth or with more than
+// GraphQLMaxFields fields.
+func graphQLComplexityRule(context *graphql.ValidationContext) *graphql.ValidationRuleInstance {
+	return &graphql.ValidationRuleInstance{
+		VisitorOpts: &visitor.VisitorOptions{
+			KindFuncMap: map[string]visitor.NamedVisitFuncs{
+				kinds.OperationDefinition: {
+					Kind: func(p visitor.VisitFuncParams) (string, interface{}) {
+						op, ok := p.Node.(*ast.OperationDefinition)
+						if !ok || op == nil {
+							return visitor.ActionSkip, nil
+						}
+						var fields int
+						depth := graphQLComplexity(context, op.SelectionSet, &fields, make(map[string]bool))
+						var msg string
+						switch {
+						case fields > GraphQLMaxFields:
+							msg = fmt.Sprintf("The operation has more than %d fields", GraphQLMaxFields)
+						case depth > GraphQLMaxDepth:
+							msg = fmt.Sprintf("The operation is nested deeper than %d levels", GraphQLMaxDepth)
+						default:
+							return visitor.ActionSkip, nil
+						}
+						context.ReportError(gqlerrors.NewError(msg, []ast.Node{op}, "", nil, []int{}, nil))
+						return visitor.ActionSkip, nil
+					},
+				},
+			},
+		},
+	}
+}
+
+// graphQLComplexity returns the depth of the given selection set and adds
+// its number of fields to fields, counting the fields of fragments each time
+// they are spread. It stops counting as soon as fields exceeds GraphQLMaxFields.
+//
+// spread holds the fragments being spread, so that fragment cycles, which are
+// reported by another rule, are not followed.
+func graphQLComplexity(context *graphql.ValidationContext, set *ast.SelectionSet, fields *int, spread map[string]bool) int {
+	if set == nil {
+		return 0
+	}
+	var depth int
+	for _, selection := range set.Selections {
+		if *fields > GraphQLMaxFields {
+			break
+		}
+		var selDepth int
+		switch sel := selection.(type) {
+		case *ast.Field:
+			*fields++
+			selDepth = graphQLComplexity(context, sel.SelectionSet, fields, spread) + 1
+		case *ast.InlineFragment:
+			selDepth = graphQLComplexity(context, sel.SelectionSet, fields, spread)
+		case *ast.FragmentSpread:
+			name := sel.Name.Value
+			fragment := context.Fragment(name)
+			if fragment == nil || spread[name] {
+				continue
+			}
+			spread[name] = true
+			selDepth = graphQLComplexity(context, fragment.SelectionSet, fields, spread)
+			delete(spread, name)
+		}
+		if selDepth > depth {
+			depth = selDepth
+		}
+	}
+	return depth
+}
+
+// buildGraphQLSchema generates the GraphQL schema from the models registry
+// if the GraphQL handler has been created. It must be called after the
+// bootstrap of the models.
+func buildGraphQLSchema() {
+	if !graphQLEnabled {
+		return
+	}
+	schema, err := newGraphQLBuilder().schema()
+	if err != nil {
+		log.Panic("Unable to generate GraphQL schema", "error", err)
+	}
+	graphQLSchema = &schema
+}
@@ -0,0 +1,656 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/Pedro-lmso-erp/erp/src/models/fieldtype"
+	"github.com/Pedro-lmso-erp/erp/src/models/operator"
+	"github.com/Pedro-lmso-erp/erp/src/models/types/dates"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// graphQLFilterOperators maps the operators of filter inputs to ORM operators
+var graphQLFilterOperators = map[string]operator.Operator{
+	"eq":    operator.Equals,
+	"ne":    operator.NotEquals,
+	"gt":    operator.Greater,
+	"gte":   operator.GreaterOrEqual,
+	"lt":    operator.Lower,
+	"lte":   operator.LowerOrEqual,
+	"like":  operator.Contains,
+	"ilike": operator.IContains,
+	"in":    operator.In,
+	"nin":   operator.NotIn,
+}
+
+// graphQLJSON is a scalar type for any JSON value
+var graphQLJSON = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Any JSON value",
+	Serialize: func(value interface{}) interface{} {
+		return value
+	},
+	ParseValue: func(value interface{}) interface{} {
+		return value
+	},
+	ParseLiteral: graphQLLiteralValue,
+})
+
+// graphQLInt64 is a scalar type for ids and integer fields, which are 64-bit
+// integers whereas the Int type of GraphQL is limited to 32 bits.
+var graphQLInt64 = graphql.NewScalar(graphql.ScalarConfig{
+	Name: "Int64",
+	Description: "A 64-bit signed integer. It can also be given as a string, " +
+		"e.g. by clients that cannot represent integers above 2^53",
+	Serialize:  graphQLInt64Value,
+	ParseValue: graphQLInt64Value,
+	ParseLiteral: func(value ast.Value) interface{} {
+		switch v := value.(type) {
+		case *ast.IntValue:
+			return graphQLInt64Value(v.Value)
+		case *ast.StringValue:
+			return graphQLInt64Value(v.Value)
+		}
+		return nil
+	},
+})
+
+// graphQLInt64Value returns the given integer, integral float or decimal
+// string as an int64, or nil if it cannot be represented as an int64.
+func graphQLInt64Value(value interface{}) interface{} {
+	val := reflect.ValueOf(value)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if val.Uint() <= math.MaxInt64 {
+			return int64(val.Uint())
+		}
+	case reflect.Float32, reflect.Float64:
+		if f := val.Float(); f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return int64(f)
+		}
+	case reflect.String:
+		if i, err := strconv.ParseInt(val.String(), 10, 64); err == nil {
+			return i
+		}
+	}
+	return nil
+}
+
+// graphQLLiteralValue returns the Go value of the given literal
+func graphQLLiteralValue(value ast.Value) interface{} {
+	switch v := value.(type) {
+	case *ast.StringValue:
+		return v.Value
+	case *ast.EnumValue:
+		return v.Value
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.IntValue:
+		i, err := strconv.ParseInt(v.Value, 10, 64)
+		if err != nil {
+			return nil
+		}
+		return i
+	case *ast.FloatValue:
+		f, err := strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			return nil
+		}
+		return f
+	case *ast.ListValue:
+		res := make([]interface{}, len(v.Values))
+		for i, val := range v.Values {
+			res[i] = graphQLLiteralValue(val)
+		}
+		return res
+	case *ast.ObjectValue:
+		res := make(map[string]interface{}, len(v.Fields))
+		for _, field := range v.Fields {
+			res[field.Name.Value] = graphQLLiteralValue(field.Value)
+		}
+		return res
+	}
+	return nil
+}
+
+// A graphQLBuilder generates the GraphQL schema of the exposed models
+type graphQLBuilder struct {
+	objects map[string]*graphql.Object
+	inputs  map[string]*graphql.InputObject
+	filters map[string]*graphql.InputObject
+	// scalarFilters are the operators inputs of the fields, by GraphQL type name
+	scalarFilters map[string]*graphql.InputObject
+}
+
+// newGraphQLBuilder returns a new graphQLBuilder
+func newGraphQLBuilder() *graphQLBuilder {
+	gb := graphQLBuilder{
+		objects:       make(map[string]*graphql.Object),
+		inputs:        make(map[string]*graphql.InputObject),
+		filters:       make(map[string]*graphql.InputObject),
+		scalarFilters: make(map[string]*graphql.InputObject),
+	}
+	for _, typ := range []*graphql.Scalar{graphql.String, graphQLInt64, graphql.Float, graphql.Boolean} {
+		fields := graphql.InputObjectConfigFieldMap{
+			"eq":     {Type: typ},
+			"ne":     {Type: typ},
+			"isNull": {Type: graphql.Boolean},
+		}
+		if typ != graphql.Boolean {
+			for _, op := range []string{"gt", "gte", "lt", "lte"} {
+				fields[op] = &graphql.InputObjectFieldConfig{Type: typ}
+			}
+			fields["in"] = &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(typ))}
+			fields["nin"] = &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(typ))}
+		}
+		if typ == graphql.String {
+			fields["like"] = &graphql.InputObjectFieldConfig{Type: typ, Description: "Contains the given string"}
+			fields["ilike"] = &graphql.InputObjectFieldConfig{Type: typ, Description: "Contains the given string, case insensitive"}
+		}
+		gb.scalarFilters[typ.Name()] = graphql.NewInputObject(graphql.InputObjectConfig{
+			Name:   typ.Name() + "Filter",
+			Fields: fields,
+		})
+	}
+	return &gb
+}
+
+// schema returns the GraphQL schema of the exposed models of the registry
+func (gb *graphQLBuilder) schema() (graphql.Schema, error) {
+	query := make(graphql.Fields)
+	mutation := make(graphql.Fields)
+	for _, model := range models.Registry.All() {
+		if !model.IsExposed() {
+			continue
+		}
+		gb.addQueries(query, model)
+		gb.addMutations(mutation, model)
+	}
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: query}),
+		Mutation: graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutation}),
+	})
+}
+
+// addQueries adds the queries of the given model to the given fields
+func (gb *graphQLBuilder) addQueries(query graphql.Fields, model *models.Model) {
+	name := model.Name()
+	query[name] = &graphql.Field{
+		Type:        gb.object(model),
+		Description: fmt.Sprintf("The %s record with the given id", name),
+		Args: graphql.FieldConfigArgument{
+			"id": {Type: graphql.NewNonNull(graphQLInt64)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			rec := restRecord(graphQLExecutionOf(p).env, model, p.Args["id"].(int64))
+			if rec == nil {
+				return nil, nil
+			}
+			return rec, nil
+		},
+	}
+	query[name+"Search"] = &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(gb.object(model)))),
+		Description: fmt.Sprintf("The %s records matching the given filter", name),
+		Args: graphql.FieldConfigArgument{
+			"filter": {Type: gb.filter(model)},
+			"order": {
+				Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+				Description: "Fields with optional direction, e.g. [\"name desc\", \"id\"]",
+			},
+			"limit":  {Type: graphql.Int, DefaultValue: RESTDefaultLimit},
+			"offset": {Type: graphql.Int, DefaultValue: 0},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			rs, err := graphQLSearch(p, model)
+			if err != nil {
+				return nil, err
+			}
+			var orders []string
+			if list, ok := p.Args["order"].([]interface{}); ok {
+				for _, o := range list {
+					orders = append(orders, o.(string))
+				}
+			}
+			orders, err = restOrders(model, strings.Join(orders, ","))
+			if err != nil {
+				return nil, err
+			}
+			if len(orders) > 0 {
+				rs = rs.OrderBy(orders...)
+			}
+			limit, offset := p.Args["limit"].(int), p.Args["offset"].(int)
+			if limit < 1 || limit > RESTMaxLimit {
+				return nil, fmt.Errorf("limit must be between 1 and %d", RESTMaxLimit)
+			}
+			if offset < 0 {
+				return nil, fmt.Errorf("offset must be positive")
+			}
+			return rs.Limit(limit).Offset(offset).Fetch().Records(), nil
+		},
+	}
+	query[name+"Count"] = &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.Int),
+		Description: fmt.Sprintf("The number of %s records matching the given filter", name),
+		Args: graphql.FieldConfigArgument{
+			"filter": {Type: gb.filter(model)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			rs, err := graphQLSearch(p, model)
+			if err != nil {
+				return nil, err
+			}
+			return rs.SearchCount(), nil
+		},
+	}
+}
+
+// addMutations adds the mutations of the given model to the given fields
+func (gb *graphQLBuilder) addMutations(mutation graphql.Fields, model *models.Model) {
+	name := model.Name()
+	if input := gb.input(model); input != nil {
+		mutation[name+"Create"] = &graphql.Field{
+			Type:        graphql.NewNonNull(gb.object(model)),
+			Description: fmt.Sprintf("Create a %s record", name),
+			Args: graphql.FieldConfigArgument{
+				"values": {Type: graphql.NewNonNull(input)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				exec := graphQLExecutionOf(p)
+				exec.mutate()
+				rs := exec.env.Pool(name)
+				values := p.Args["values"].(map[string]interface{})
+				return rs.Call("Create", models.NewModelDataFromRS(rs, values)).(models.RecordSet).Collection(), nil
+			},
+		}
+		mutation[name+"Update"] = &graphql.Field{
+			Type:        gb.object(model),
+			Description: fmt.Sprintf("Update the %s record with the given id. Returns null if it does not exist.", name),
+			Args: graphql.FieldConfigArgument{
+				"id":     {Type: graphql.NewNonNull(graphQLInt64)},
+				"values": {Type: graphql.NewNonNull(input)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				exec := graphQLExecutionOf(p)
+				exec.mutate()
+				rec := restRecord(exec.env, model, p.Args["id"].(int64))
+				if rec == nil {
+					return nil, nil
+				}
+				rec.Call("Write", models.NewModelDataFromRS(rec, p.Args["values"].(map[string]interface{})))
+				return rec, nil
+			},
+		}
+	}
+	mutation[name+"Delete"] = &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.Boolean),
+		Description: fmt.Sprintf("Delete the %s record with the given id. Returns false if it does not exist.", name),
+		Args: graphql.FieldConfigArgument{
+			"id": {Type: graphql.NewNonNull(graphQLInt64)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			exec := graphQLExecutionOf(p)
+			exec.mutate()
+			rec := restRecord(exec.env, model, p.Args["id"].(int64))
+			if rec == nil {
+				return false, nil
+			}
+			rec.Call("Unlink")
+			return true, nil
+		},
+	}
+	for _, method := range model.Methods().Exposed() {
+		mutation[name+"Call"+method.Name()] = gb.methodMutation(model, method)
+	}
+}
+
+// methodMutation returns the mutation calling the given exposed method of the given model
+func (gb *graphQLBuilder) methodMutation(model *models.Model, method *models.Method) *graphql.Field {
+	methType := method.MethodType()
+	args := graphql.FieldConfigArgument{
+		"ids": {
+			Type:        graphql.NewList(graphql.NewNonNull(graphQLInt64)),
+			Description: "The ids of the records on which to call the method",
+		},
+	}
+	// The first argument is the RecordSet on which the method is called
+	nArgs := methType.NumIn() - 1
+	converters := make([]func(interface{}) interface{}, nArgs)
+	for i := 0; i < nArgs; i++ {
+		typ, conv := gb.argType(methType.In(i + 1))
+		if !methType.IsVariadic() || i < nArgs-1 {
+			typ = graphql.NewNonNull(typ)
+		}
+		args[fmt.Sprintf("arg%d", i+1)] = &graphql.ArgumentConfig{Type: typ}
+		converters[i] = conv
+	}
+	return &graphql.Field{
+		Type:        graphQLJSON,
+		Description: fmt.Sprintf("Call the %s method of %s", method.Name(), model.Name()),
+		Args:        args,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			exec := graphQLExecutionOf(p)
+			exec.mutate()
+			var jsonArgs []json.RawMessage
+			for i := 0; i < nArgs; i++ {
+				val, ok := p.Args[fmt.Sprintf("arg%d", i+1)]
+				if !ok {
+					break
+				}
+				if converters[i] != nil {
+					val = converters[i](val)
+				}
+				data, err := json.Marshal(val)
+				if err != nil {
+					return nil, err
+				}
+				jsonArgs = append(jsonArgs, data)
+			}
+			var ids []int64
+			if list, ok := p.Args["ids"].([]interface{}); ok {
+				for _, id := range list {
+					ids = append(ids, id.(int64))
+				}
+			}
+			rs := restRecords(exec.env, model, ids)
+			if rs == nil {
+				return nil, fmt.Errorf("record not found")
+			}
+			callArgs, err := method.DecodeJSONArgs(exec.env, jsonArgs)
+			if err != nil {
+				return nil, err
+			}
+			return restResult(rs.Call(method.Name(), callArgs...)), nil
+		},
+	}
+}
+
+// argType returns the GraphQL input type of a method argument of the given
+// type, and a function converting the input value to the JSON expected by
+// models.Method.DecodeJSONArgs if it is not the same.
+func (gb *graphQLBuilder) argType(typ reflect.Type) (graphql.Input, func(interface{}) interface{}) {
+	model := models.ModelOfType(typ)
+	switch {
+	case typ.Implements(reflect.TypeOf((*models.RecordSet)(nil)).Elem()):
+		return graphql.NewList(graphql.NewNonNull(graphQLInt64)), nil
+	case model == nil || !model.IsExposed():
+	case typ.Implements(reflect.TypeOf((*models.RecordData)(nil)).Elem()):
+		if input := gb.input(model); input != nil {
+			return input, nil
+		}
+	default:
+		return gb.filter(model), func(val interface{}) interface{} {
+			return graphQLFilterDomain(val.(map[string]interface{}))
+		}
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return graphql.Boolean, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return graphQLInt64, nil
+	case reflect.Float32, reflect.Float64:
+		return graphql.Float, nil
+	case reflect.String:
+		return graphql.String, nil
+	}
+	return graphQLJSON, nil
+}
+
+// object returns the object type of the given model
+func (gb *graphQLBuilder) object(model *models.Model) *graphql.Object {
+	if obj, ok := gb.objects[model.Name()]; ok {
+		return obj
+	}
+	obj := graphql.NewObject(graphql.ObjectConfig{
+		Name: model.Name(),
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := make(graphql.Fields)
+			for field, fInfo := range model.FieldsGet() {
+				fields[field] = gb.objectField(fInfo)
+			}
+			return fields
+		}),
+	})
+	gb.objects[model.Name()] = obj
+	return obj
+}
+
+// objectField returns the field of an object type for the field with the given infos
+func (gb *graphQLBuilder) objectField(fInfo *models.FieldInfo) *graphql.Field {
+	res := &graphql.Field{Description: fInfo.Help}
+	if res.Description == "" {
+		res.Description = fInfo.String
+	}
+	if !fInfo.Type.IsRelationType() {
+		res.Type = graphQLScalarType(fInfo.Type)
+		res.Resolve = func(p graphql.ResolveParams) (interface{}, error) {
+			rec := p.Source.(*models.RecordCollection)
+			return graphQLScalarValue(rec.Get(rec.Model().FieldName(fInfo.JSON))), nil
+		}
+		return res
+	}
+	related := models.Registry.MustGet(fInfo.Relation)
+	var relType graphql.Output = graphQLInt64
+	if related.IsExposed() {
+		relType = gb.object(related)
+	}
+	if fInfo.Type.Is2OneRelationType() {
+		res.Type = relType
+	} else {
+		res.Type = graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(relType)))
+	}
+	res.Resolve = func(p graphql.ResolveParams) (interface{}, error) {
+		rec := p.Source.(*models.RecordCollection)
+		// Records taken from a relation field have the records of this field
+		// for all the records of the list of rec as prefetch set, so that
+		// their fields are loaded for all of them at once.
+		records := rec.Get(rec.Model().FieldName(fInfo.JSON)).(models.RecordSet).Collection().Records()
+		items := make([]interface{}, len(records))
+		for i, r := range records {
+			items[i] = r
+			if !related.IsExposed() {
+				items[i] = r.Ids()[0]
+			}
+		}
+		if !fInfo.Type.Is2OneRelationType() {
+			return items, nil
+		}
+		if len(items) == 0 {
+			return nil, nil
+		}
+		return items[0], nil
+	}
+	return res
+}
+
+// input returns the input type of the values of the given model for create
+// and update mutations, or nil if the model has no writable field.
+func (gb *graphQLBuilder) input(model *models.Model) *graphql.InputObject {
+	if input, ok := gb.inputs[model.Name()]; ok {
+		return input
+	}
+	fields := make(graphql.InputObjectConfigFieldMap)
+	for field, fInfo := range model.FieldsGet() {
+		if fInfo.ReadOnly || field == models.ID.JSON() {
+			continue
+		}
+		var typ graphql.Input
+		switch {
+		case fInfo.Type.Is2OneRelationType():
+			typ = graphQLInt64
+		case fInfo.Type.Is2ManyRelationType():
+			typ = graphql.NewList(graphql.NewNonNull(graphQLInt64))
+		default:
+			typ = graphQLScalarType(fInfo.Type)
+		}
+		fields[field] = &graphql.InputObjectFieldConfig{Type: typ, Description: fInfo.String}
+	}
+	var res *graphql.InputObject
+	if len(fields) > 0 {
+		res = graphql.NewInputObject(graphql.InputObjectConfig{
+			Name:   model.Name() + "Input",
+			Fields: fields,
+		})
+	}
+	gb.inputs[model.Name()] = res
+	return res
+}
+
+// filter returns the filter input type of the given model
+func (gb *graphQLBuilder) filter(model *models.Model) *graphql.InputObject {
+	if filter, ok := gb.filters[model.Name()]; ok {
+		return filter
+	}
+	var filter *graphql.InputObject
+	filter = graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: model.Name() + "Filter",
+		Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+			fields := graphql.InputObjectConfigFieldMap{
+				"and": {Type: graphql.NewList(graphql.NewNonNull(filter)), Description: "All the given filters must match"},
+				"or":  {Type: graphql.NewList(graphql.NewNonNull(filter)), Description: "At least one of the given filters must match"},
+				"not": {Type: filter, Description: "The given filter must not match"},
+			}
+			for field, fInfo := range model.FieldsGet() {
+				if !fInfo.Store || fInfo.Type == fieldtype.Binary {
+					// Computed fields without inverse are not stored
+					continue
+				}
+				typ := graphQLInt64
+				if !fInfo.Type.IsRelationType() {
+					typ = graphQLScalarType(fInfo.Type)
+				}
+				fields[field] = &graphql.InputObjectFieldConfig{Type: gb.scalarFilters[typ.Name()]}
+			}
+			return fields
+		}),
+	})
+	gb.filters[model.Name()] = filter
+	return filter
+}
+
+// graphQLSearch returns the records of the given model matching
+// the 'filter' argument of the given resolver params.
+func graphQLSearch(p graphql.ResolveParams, model *models.Model) (*models.RecordCollection, error) {
+	rs := graphQLExecutionOf(p).env.Pool(model.Name())
+	filter, _ := p.Args["filter"].(map[string]interface{})
+	cond, err := model.ConditionFromDomain(graphQLFilterDomain(filter))
+	if err != nil {
+		return nil, err
+	}
+	if cond.IsEmpty() {
+		return rs.SearchAll(), nil
+	}
+	return rs.Search(cond), nil
+}
+
+// graphQLFilterDomain returns the domain in polish notation of the given
+// filter input value. It returns an empty domain if the filter is empty.
+func graphQLFilterDomain(filter map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var terms [][]interface{}
+	for _, key := range keys {
+		switch key {
+		case "and", "or":
+			subFilters, _ := filter[key].([]interface{})
+			var subTerms [][]interface{}
+			for _, sub := range subFilters {
+				if term := graphQLFilterDomain(sub.(map[string]interface{})); len(term) > 0 {
+					subTerms = append(subTerms, term)
+				}
+			}
+			op := "&"
+			if key == "or" {
+				op = "|"
+			}
+			if term := graphQLCombineTerms(op, subTerms); len(term) > 0 {
+				terms = append(terms, term)
+			}
+		case "not":
+			sub, _ := filter[key].(map[string]interface{})
+			if term := graphQLFilterDomain(sub); len(term) > 0 {
+				terms = append(terms, append([]interface{}{"!"}, term...))
+			}
+		default:
+			ops, _ := filter[key].(map[string]interface{})
+			opNames := make([]string, 0, len(ops))
+			for op := range ops {
+				opNames = append(opNames, op)
+			}
+			sort.Strings(opNames)
+			for _, op := range opNames {
+				if op == "isNull" {
+					leafOp := operator.Equals
+					if isNull, _ := ops[op].(bool); !isNull {
+						leafOp = operator.NotEquals
+					}
+					terms = append(terms, []interface{}{[]interface{}{key, string(leafOp), nil}})
+					continue
+				}
+				terms = append(terms, []interface{}{[]interface{}{key, string(graphQLFilterOperators[op]), ops[op]}})
+			}
+		}
+	}
+	return graphQLCombineTerms("&", terms)
+}
+
+// graphQLCombineTerms returns the domain combining the given domain
+// terms in polish notation with the given logical operator.
+func graphQLCombineTerms(op string, terms [][]interface{}) []interface{} {
+	var res []interface{}
+	for i := 1; i < len(terms); i++ {
+		res = append(res, op)
+	}
+	for _, term := range terms {
+		res = append(res, term...)
+	}
+	return res
+}
+
+// graphQLScalarType returns the GraphQL type of the given non relation field type
+func graphQLScalarType(typ fieldtype.Type) *graphql.Scalar {
+	switch typ {
+	case fieldtype.Boolean:
+		return graphql.Boolean
+	case fieldtype.Integer:
+		return graphQLInt64
+	case fieldtype.Float:
+		return graphql.Float
+	}
+	return graphql.String
+}
+
+// graphQLScalarValue returns the given field value suitable for GraphQL
+// serialization. Empty dates are returned as nil.
+func graphQLScalarValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case dates.Date:
+		if v.IsZero() {
+			return nil
+		}
+		return v.String()
+	case dates.DateTime:
+		if v.IsZero() {
+			return nil
+		}
+		return v.String()
+	}
+	return value
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/operator"
+	"github.com/graphql-go/graphql"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGraphQLFilterDomain(t *testing.T) {
+	Convey("Testing GraphQL filters conversion to domains", t, func() {
+		nameEq := func(name string) map[string]interface{} {
+			return map[string]interface{}{"name": map[string]interface{}{"eq": name}}
+		}
+		nameTerm := func(name string) []interface{} {
+			return []interface{}{"name", string(operator.Equals), name}
+		}
+		Convey("Empty filters should give empty domains", func() {
+			So(graphQLFilterDomain(nil), ShouldBeEmpty)
+			So(graphQLFilterDomain(map[string]interface{}{}), ShouldBeEmpty)
+			So(graphQLFilterDomain(map[string]interface{}{
+				"and": []interface{}{map[string]interface{}{}},
+				"not": map[string]interface{}{},
+			}), ShouldBeEmpty)
+		})
+		Convey("Field operators should give domain leaves", func() {
+			So(graphQLFilterDomain(nameEq("John")), ShouldResemble, []interface{}{nameTerm("John")})
+			So(graphQLFilterDomain(map[string]interface{}{
+				"name": map[string]interface{}{"like": "Jo"},
+			}), ShouldResemble, []interface{}{[]interface{}{"name", string(operator.Contains), "Jo"}})
+			So(graphQLFilterDomain(map[string]interface{}{
+				"id": map[string]interface{}{"in": []interface{}{int64(1), int64(2)}},
+			}), ShouldResemble, []interface{}{[]interface{}{"id", string(operator.In), []interface{}{int64(1), int64(2)}}})
+		})
+		Convey("isNull should be converted to a comparison with null", func() {
+			So(graphQLFilterDomain(map[string]interface{}{
+				"email": map[string]interface{}{"isNull": true},
+			}), ShouldResemble, []interface{}{[]interface{}{"email", string(operator.Equals), nil}})
+			So(graphQLFilterDomain(map[string]interface{}{
+				"email": map[string]interface{}{"isNull": false},
+			}), ShouldResemble, []interface{}{[]interface{}{"email", string(operator.NotEquals), nil}})
+		})
+		Convey("Several fields and operators should be and-ed in a stable order", func() {
+			So(graphQLFilterDomain(map[string]interface{}{
+				"nums": map[string]interface{}{"lt": int64(10), "gte": int64(2)},
+				"name": map[string]interface{}{"eq": "John"},
+			}), ShouldResemble, []interface{}{
+				"&", "&",
+				nameTerm("John"),
+				[]interface{}{"nums", string(operator.GreaterOrEqual), int64(2)},
+				[]interface{}{"nums", string(operator.Lower), int64(10)},
+			})
+		})
+		Convey("and, or and not should be combined in polish notation", func() {
+			So(graphQLFilterDomain(map[string]interface{}{
+				"or": []interface{}{nameEq("John"), nameEq("Jane"), map[string]interface{}{}},
+			}), ShouldResemble, []interface{}{"|", nameTerm("John"), nameTerm("Jane")})
+			So(graphQLFilterDomain(map[string]interface{}{
+				"and": []interface{}{nameEq("John")},
+				"not": nameEq("Jane"),
+			}), ShouldResemble, []interface{}{"&", nameTerm("John"), "!", nameTerm("Jane")})
+			So(graphQLFilterDomain(map[string]interface{}{
+				"not": map[string]interface{}{
+					"or": []interface{}{nameEq("John"), nameEq("Jane")},
+				},
+			}), ShouldResemble, []interface{}{"!", "|", nameTerm("John"), nameTerm("Jane")})
+		})
+	})
+}
+
+func TestGraphQLInt64(t *testing.T) {
+	Convey("Testing GraphQL Int64 scalar values", t, func() {
+		Convey("Integers, integral floats and decimal strings should be accepted", func() {
+			So(graphQLInt64Value(int16(-3)), ShouldEqual, int64(-3))
+			So(graphQLInt64Value(uint32(7)), ShouldEqual, int64(7))
+			So(graphQLInt64Value(float64(1<<40)), ShouldEqual, int64(1<<40))
+			So(graphQLInt64Value("9007199254740993"), ShouldEqual, int64(9007199254740993))
+		})
+		Convey("Other values should be refused", func() {
+			So(graphQLInt64Value(nil), ShouldBeNil)
+			So(graphQLInt64Value(1.5), ShouldBeNil)
+			So(graphQLInt64Value(1e19), ShouldBeNil)
+			So(graphQLInt64Value(uint64(1<<63)), ShouldBeNil)
+			So(graphQLInt64Value("12a"), ShouldBeNil)
+			So(graphQLInt64Value(true), ShouldBeNil)
+		})
+	})
+}
+
+func TestGraphQLComplexityRule(t *testing.T) {
+	Convey("Testing GraphQL requests depth and fields limits", t, func() {
+		var node *graphql.Object
+		node = graphql.NewObject(graphql.ObjectConfig{
+			Name: "Node",
+			Fields: graphql.FieldsThunk(func() graphql.Fields {
+				return graphql.Fields{
+					"id":    {Type: graphQLInt64},
+					"child": {Type: node},
+				}
+			}),
+		})
+		schema, err := graphql.NewSchema(graphql.SchemaConfig{
+			Query: graphql.NewObject(graphql.ObjectConfig{
+				Name: "Query",
+				Fields: graphql.Fields{
+					"node": {
+						Type: node,
+						Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+							return map[string]interface{}{"id": int64(1) << 40}, nil
+						},
+					},
+				},
+			}),
+		})
+		So(err, ShouldBeNil)
+		execute := func(query string) *graphql.Result {
+			return executeGraphQL(graphql.Params{Schema: schema, RequestString: query})
+		}
+		// nested returns a query of the given depth
+		nested := func(depth int) string {
+			return "{ node { " + strings.Repeat("child { ", depth-2) + "id" + strings.Repeat(" }", depth-1) + " }"
+		}
+		Convey("Requests within the limits should be executed", func() {
+			res := execute(nested(GraphQLMaxDepth))
+			So(res.Errors, ShouldBeEmpty)
+			res = execute("{ node { id } }")
+			So(res.Errors, ShouldBeEmpty)
+			So(res.Data, ShouldResemble, map[string]interface{}{"node": map[string]interface{}{"id": int64(1) << 40}})
+		})
+		Convey("Requests nested too deeply should be refused", func() {
+			res := execute(nested(GraphQLMaxDepth + 1))
+			So(res.Errors, ShouldHaveLength, 1)
+			So(res.Errors[0].Message, ShouldContainSubstring, "nested deeper")
+			So(res.Data, ShouldBeNil)
+			res = execute("{ node { ...Deep } } fragment Deep on Node { " + strings.Repeat("child { ", GraphQLMaxDepth) +
+				"id" + strings.Repeat(" }", GraphQLMaxDepth) + " }")
+			So(res.Errors, ShouldHaveLength, 1)
+			So(res.Errors[0].Message, ShouldContainSubstring, "nested deeper")
+		})
+		Convey("Requests with too many fields should be refused", func() {
+			var fields []string
+			for i := 0; i < GraphQLMaxFields; i++ {
+				fields = append(fields, fmt.Sprintf("f%d: id", i))
+			}
+			res := execute("{ node { " + strings.Join(fields, " ") + " } }")
+			So(res.Errors, ShouldHaveLength, 1)
+			So(res.Errors[0].Message, ShouldContainSubstring, "more than")
+		})
+		Convey("Fragments should be counted each time they are spread", func() {
+			fragments := []string{"fragment F0 on Node { id }"}
+			for i := 1; i <= 10; i++ {
+				fragments = append(fragments, fmt.Sprintf("fragment F%d on Node { a: child { ...F%d } b: child { ...F%d } }", i, i-1, i-1))
+			}
+			res := execute("{ node { ...F10 } } " + strings.Join(fragments, " "))
+			So(res.Errors, ShouldHaveLength, 1)
+			So(res.Errors[0].Message, ShouldContainSubstring, "more than")
+		})
+		Convey("Fragment cycles should be reported without looping", func() {
+			res := execute("{ node { ...A } } fragment A on Node { child { ...B } } fragment B on Node { child { ...A } }")
+			So(res.Errors, ShouldNotBeEmpty)
+		})
+	})
+}
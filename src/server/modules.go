@@ -40,6 +40,7 @@ type Module struct {
 	Name     string
 	PreInit  func() // Function to be run before bootstrap but after all calls to init
 	PostInit func() // Function to be run after initialisation is complete and before server starts
+	Shutdown func() // Function to be run when the server stops, after in-flight requests have been drained
 }
 
 // A ModulesList is a list of Module objects
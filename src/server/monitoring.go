@@ -0,0 +1,186 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// metricsNamespace is the prefix of all the erp metrics
+	metricsNamespace = "erp"
+	// readinessTimeout is the maximum time to wait for the database
+	// to answer in the readiness probe.
+	readinessTimeout = 2 * time.Second
+	// unmatchedRoute is the route label of the requests that did
+	// not match any route.
+	unmatchedRoute = "unmatched"
+)
+
+var (
+	// metricsRegistry is the registry of the metrics exposed on /metrics
+	metricsRegistry = prometheus.NewRegistry()
+	// httpRequestDuration is the latency of the HTTP requests by route
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the HTTP requests by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// A modelsCollector is a prometheus.Collector for the statistics of the models
+type modelsCollector struct {
+	queries            *prometheus.Desc
+	queryErrors        *prometheus.Desc
+	queriesDuration    *prometheus.Desc
+	transactionRetries *prometheus.Desc
+	workerRuns         *prometheus.Desc
+	workerFailures     *prometheus.Desc
+	workerDuration     *prometheus.Desc
+	workerSkipped      *prometheus.Desc
+}
+
+var _ prometheus.Collector = new(modelsCollector)
+
+// newModelsCollector returns a new modelsCollector
+func newModelsCollector() *modelsCollector {
+	return &modelsCollector{
+		queries: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "db", "queries_total"),
+			"Number of queries sent to the database.", nil, nil),
+		queryErrors: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "db", "query_errors_total"),
+			"Number of queries that failed.", nil, nil),
+		queriesDuration: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "db", "query_duration_seconds_total"),
+			"Total time spent executing queries.", nil, nil),
+		transactionRetries: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "db", "transaction_retries_total"),
+			"Number of transactions retried because of a serialization error.", nil, nil),
+		workerRuns: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "worker", "runs_total"),
+			"Number of runs of the worker functions.", []string{"worker"}, nil),
+		workerFailures: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "worker", "failures_total"),
+			"Number of runs of the worker functions that failed.", []string{"worker"}, nil),
+		workerDuration: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "worker", "run_duration_seconds_total"),
+			"Total time spent running the worker functions.", []string{"worker"}, nil),
+		workerSkipped: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "worker", "skipped_total"),
+			"Number of runs of the worker functions skipped because the previous run was still active.", []string{"worker"}, nil),
+	}
+}
+
+// Describe sends the descriptors of the models metrics to the given channel
+func (mc *modelsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mc.queries
+	ch <- mc.queryErrors
+	ch <- mc.queriesDuration
+	ch <- mc.transactionRetries
+	ch <- mc.workerRuns
+	ch <- mc.workerFailures
+	ch <- mc.workerDuration
+	ch <- mc.workerSkipped
+}
+
+// Collect sends the current values of the models metrics to the given channel
+func (mc *modelsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := models.GetStats()
+	ch <- prometheus.MustNewConstMetric(mc.queries, prometheus.CounterValue, float64(stats.Queries))
+	ch <- prometheus.MustNewConstMetric(mc.queryErrors, prometheus.CounterValue, float64(stats.QueryErrors))
+	ch <- prometheus.MustNewConstMetric(mc.queriesDuration, prometheus.CounterValue, stats.QueriesDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(mc.transactionRetries, prometheus.CounterValue, float64(stats.TransactionRetries))
+	for name, ws := range stats.Workers {
+		ch <- prometheus.MustNewConstMetric(mc.workerRuns, prometheus.CounterValue, float64(ws.Runs), name)
+		ch <- prometheus.MustNewConstMetric(mc.workerFailures, prometheus.CounterValue, float64(ws.Failures), name)
+		ch <- prometheus.MustNewConstMetric(mc.workerDuration, prometheus.CounterValue, ws.Duration.Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(mc.workerSkipped, prometheus.CounterValue, float64(ws.Skipped), name)
+	}
+}
+
+// EnableMonitoring registers the routes used to probe the server:
+//
+// - /healthz always returns 200 when the process is up,
+// - /readyz returns 200 when the database is reachable, the models are
+// bootstrapped and the database schema matches the models, and 503 with
+// the names of the failed checks otherwise. The errors of the checks are
+// only logged since these routes are not authenticated.
+//
+// If metrics is true, it also adds a middleware recording the latency of
+// the requests and registers the /metrics route that exposes the metrics
+// of the server in Prometheus text format: HTTP latency by route, database
+// queries, transaction retries, worker runs and Go runtime statistics.
+// The /metrics route is not authenticated either, so metrics should only be
+// enabled when this route is not reachable from untrusted networks.
+//
+// This function must be called before the routes of the controllers are
+// created for their requests to be measured.
+func EnableMonitoring(metrics bool) {
+	erpServer.GET("/healthz", wrapContextFuncs(healthz)...)
+	erpServer.GET("/readyz", wrapContextFuncs(readyz)...)
+	if !metrics {
+		return
+	}
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestDuration,
+		newModelsCollector(),
+	)
+	erpServer.Use(wrapContextFuncs(metricsMiddleware)...)
+	erpServer.GET("/metrics", gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})))
+}
+
+// healthz is the liveness probe. It always succeeds.
+func healthz(c *Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz is the readiness probe. It checks that the server can serve requests.
+func readyz(c *Context) {
+	checks := make(map[string]string)
+	ready := true
+	check := func(name string, err error) {
+		if err != nil {
+			c.Logger().Warn("Readiness check failed", "check", name, "error", err)
+			checks[name] = "failed"
+			ready = false
+			return
+		}
+		checks[name] = "ok"
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+	dbErr := models.DBPing(ctx)
+	check("database", dbErr)
+	var bootErr error
+	if !models.BootStrapped() {
+		bootErr = errors.New("models are not bootstrapped")
+	}
+	check("bootstrap", bootErr)
+	if dbErr == nil && bootErr == nil {
+		check("schema", models.CheckDatabaseSchema())
+	}
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": checks})
+}
+
+// metricsMiddleware records the latency of the requests by route
+func metricsMiddleware(c *Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
+	httpRequestDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Now().Sub(start).Seconds())
+}
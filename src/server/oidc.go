@@ -0,0 +1,85 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/models/security/oidcauth"
+)
+
+const (
+	sessionOIDCStateKey    = "oidc_state"
+	sessionOIDCNonceKey    = "oidc_nonce"
+	sessionOIDCVerifierKey = "oidc_code_verifier"
+)
+
+// OIDCLogin returns a handler that starts a login with the OpenID Connect
+// provider of the given backend by redirecting the user to the provider.
+func OIDCLogin(backend *oidcauth.Backend) HandlerFunc {
+	return func(c *Context) {
+		req, err := backend.NewLoginRequest()
+		if err != nil {
+			c.Logger().Warn("Unable to start OIDC login", "error", err)
+			c.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+		sess := c.Session()
+		sess.Set(sessionOIDCStateKey, req.State)
+		sess.Set(sessionOIDCNonceKey, req.Nonce)
+		sess.Set(sessionOIDCVerifierKey, req.CodeVerifier)
+		sess.Save()
+		c.Redirect(http.StatusFound, req.URL)
+	}
+}
+
+// OIDCCallback returns the handler of the route to which the OpenID Connect
+// provider of the given backend redirects the user after login. This route
+// must match the RedirectURL of the backend's configuration.
+//
+// On success, the user is logged in and redirected to successPath. If the
+// user must provide a second factor, the session is left pending as with
+// Context.Authenticate.
+func OIDCCallback(backend *oidcauth.Backend, successPath string) HandlerFunc {
+	return func(c *Context) {
+		sess := c.Session()
+		state, _ := sess.Get(sessionOIDCStateKey).(string)
+		nonce, _ := sess.Get(sessionOIDCNonceKey).(string)
+		verifier, _ := sess.Get(sessionOIDCVerifierKey).(string)
+		// A login request can only be used once
+		sess.Delete(sessionOIDCStateKey)
+		sess.Delete(sessionOIDCNonceKey)
+		sess.Delete(sessionOIDCVerifierKey)
+		sess.Save()
+		if errCode := c.Query("error"); errCode != "" {
+			c.Logger().Info("OIDC login refused by provider", "error", errCode, "description", c.Query("error_description"))
+			c.String(http.StatusUnauthorized, "Login refused by identity provider")
+			return
+		}
+		if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+			c.String(http.StatusBadRequest, "Invalid or expired login request")
+			return
+		}
+		context := c.authContext().
+			WithKey(oidcauth.CodeVerifierKey, verifier).
+			WithKey(oidcauth.NonceKey, nonce)
+		_, err := c.authenticate("", c.Query("code"), context)
+		switch e := err.(type) {
+		case nil, security.SecondFactorPendingError:
+			c.Redirect(http.StatusFound, successPath)
+		case security.InvalidCredentialsError, security.UserNotFoundError:
+			c.Logger().Info("OIDC login failed", "error", err)
+			c.String(http.StatusUnauthorized, "Login failed")
+		case security.ThrottledError:
+			c.Header("Retry-After", strconv.Itoa(int(e.RetryAfter.Seconds())+1))
+			c.String(http.StatusTooManyRequests, err.Error())
+		default:
+			c.Logger().Warn("OIDC login error", "error", err)
+			c.String(http.StatusBadGateway, "Identity provider error")
+		}
+	}
+}
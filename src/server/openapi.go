@@ -0,0 +1,426 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/Pedro-lmso-erp/erp/src/models/fieldtype"
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification
+// of the documents returned by OpenAPISpec.
+const OpenAPIVersion = "3.0.3"
+
+// OpenAPIInfo is the 'info' object of the documents returned by OpenAPISpec.
+// It may be modified before the server starts.
+var OpenAPIInfo = gin.H{
+	"title":   "ERP REST API",
+	"version": "v1",
+}
+
+// OpenAPISpec returns an OpenAPI 3 document describing the REST API served
+// under the given prefix (see controllers.EnableREST). It is generated from
+// the exposed models of the registry with their fields and exposed methods,
+// and must therefore be called after models.BootStrap.
+func OpenAPISpec(prefix string) gin.H {
+	paths := make(gin.H)
+	schemas := gin.H{
+		"Error": gin.H{
+			"type":       "object",
+			"properties": gin.H{"error": gin.H{"type": "string"}},
+		},
+		"Domain": gin.H{
+			"type":        "array",
+			"description": "A domain in polish notation, e.g. [\"|\", [\"name\", \"=\", \"John\"], [\"id\", \">\", 3]]",
+			"items":       gin.H{},
+		},
+	}
+	for _, model := range models.Registry.All() {
+		if !model.IsExposed() {
+			continue
+		}
+		name := model.Name()
+		schemas[name] = openAPIModelSchema(model, true)
+		schemas[name+"Update"] = openAPIModelSchema(model, false)
+		paths[fmt.Sprintf("%s/%s", prefix, name)] = gin.H{
+			"get":  openAPISearchOperation(model),
+			"post": openAPICreateOperation(model),
+		}
+		paths[fmt.Sprintf("%s/%s/{id}", prefix, name)] = gin.H{
+			"parameters": []gin.H{openAPIParameter("path", "id", "The id of the record", gin.H{"type": "integer", "format": "int64"})},
+			"get":        openAPIReadOperation(model),
+			"patch":      openAPIUpdateOperation(model),
+			"delete":     openAPIDeleteOperation(model),
+		}
+		for _, method := range model.Methods().Exposed() {
+			paths[fmt.Sprintf("%s/%s/call/%s", prefix, name, method.Name())] = gin.H{
+				"post": openAPICallOperation(model, method),
+			}
+		}
+	}
+	return gin.H{
+		"openapi": OpenAPIVersion,
+		"info":    OpenAPIInfo,
+		"servers": []gin.H{{"url": "/"}},
+		"paths":   paths,
+		"components": gin.H{
+			"schemas": schemas,
+			"responses": gin.H{
+				"Error": gin.H{
+					"description": "Error",
+					"content":     openAPIJSONContent(openAPIRef("Error")),
+				},
+			},
+			"securitySchemes": gin.H{
+				"bearerAuth": gin.H{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []gin.H{{"bearerAuth": []string{}}},
+	}
+}
+
+// OpenAPI is the handler that returns the OpenAPI specification of the REST
+// API served under the given prefix. The specification is generated at the
+// first request. Only authenticated users can get it.
+func OpenAPI(prefix string) HandlerFunc {
+	var (
+		spec gin.H
+		once sync.Once
+	)
+	return func(c *Context) {
+		if c.UID() == 0 {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.restError(http.StatusUnauthorized, errors.New("authentication required"))
+			return
+		}
+		once.Do(func() {
+			spec = OpenAPISpec(prefix)
+		})
+		c.JSON(http.StatusOK, spec)
+	}
+}
+
+// openAPIModelSchema returns the schema of the records of the given model.
+// If withRequired is false, no field is marked as required, so that the
+// schema can be used for partial updates.
+func openAPIModelSchema(model *models.Model, withRequired bool) gin.H {
+	fInfos := model.FieldsGet()
+	fields := make([]string, 0, len(fInfos))
+	for field := range fInfos {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	properties := make(gin.H)
+	var required []string
+	for _, field := range fields {
+		fInfo := fInfos[field]
+		readOnly := fInfo.ReadOnly || field == models.ID.JSON()
+		properties[field] = openAPIFieldSchema(fInfo, readOnly)
+		if withRequired && fInfo.Required && !readOnly {
+			required = append(required, field)
+		}
+	}
+	res := gin.H{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		res["required"] = required
+	}
+	return res
+}
+
+// openAPIFieldSchema returns the schema of the field with the given infos
+func openAPIFieldSchema(fInfo *models.FieldInfo, readOnly bool) gin.H {
+	var res gin.H
+	switch fInfo.Type {
+	case fieldtype.Boolean:
+		res = gin.H{"type": "boolean"}
+	case fieldtype.Integer:
+		res = gin.H{"type": "integer", "format": "int64"}
+	case fieldtype.Float:
+		res = gin.H{"type": "number"}
+	case fieldtype.Date:
+		res = gin.H{"type": "string", "format": "date"}
+	case fieldtype.DateTime:
+		res = gin.H{"type": "string", "format": "date-time"}
+	case fieldtype.Binary:
+		res = gin.H{"type": "string", "format": "byte"}
+	case fieldtype.Selection:
+		values := make([]string, 0, len(fInfo.Selection))
+		for value := range fInfo.Selection {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		res = gin.H{"type": "string", "enum": values, "nullable": true}
+	case fieldtype.Many2One, fieldtype.One2One, fieldtype.Rev2One:
+		res = gin.H{
+			"type":        "integer",
+			"format":      "int64",
+			"nullable":    true,
+			"description": fmt.Sprintf("The id of the related %s record, or the record itself if expanded", fInfo.Relation),
+		}
+	case fieldtype.One2Many, fieldtype.Many2Many:
+		res = gin.H{
+			"type":        "array",
+			"items":       gin.H{"type": "integer", "format": "int64"},
+			"description": fmt.Sprintf("The ids of the related %s records, or the records themselves if expanded", fInfo.Relation),
+		}
+	default:
+		res = gin.H{"type": "string"}
+	}
+	if fInfo.String != "" {
+		res["title"] = fInfo.String
+	}
+	if fInfo.Help != "" && res["description"] == nil {
+		res["description"] = fInfo.Help
+	}
+	if readOnly {
+		res["readOnly"] = true
+	}
+	return res
+}
+
+// openAPITypeSchema returns the schema of the JSON encoding of
+// the given method argument or return type.
+func openAPITypeSchema(typ reflect.Type) gin.H {
+	model := models.ModelOfType(typ)
+	switch {
+	case typ.Implements(reflect.TypeOf((*models.RecordSet)(nil)).Elem()):
+		res := gin.H{
+			"type":        "array",
+			"items":       gin.H{"type": "integer", "format": "int64"},
+			"description": "The ids of the records",
+		}
+		if model != nil {
+			res["description"] = fmt.Sprintf("The ids of %s records", model.Name())
+		}
+		return res
+	case typ.Implements(reflect.TypeOf((*models.RecordData)(nil)).Elem()):
+		if model != nil && model.IsExposed() {
+			return openAPIRef(model.Name() + "Update")
+		}
+		return gin.H{"type": "object", "description": "The values of a record indexed by field names"}
+	case model != nil, typ.Implements(reflect.TypeOf((*models.Conditioner)(nil)).Elem()):
+		return openAPIRef("Domain")
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return gin.H{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return gin.H{"type": "array", "items": openAPITypeSchema(typ.Elem())}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": openAPITypeSchema(typ.Elem())}
+	case reflect.Struct:
+		return gin.H{"type": "object"}
+	case reflect.Ptr:
+		return openAPITypeSchema(typ.Elem())
+	}
+	return gin.H{}
+}
+
+// openAPISearchOperation returns the operation of the search request of the given model
+func openAPISearchOperation(model *models.Model) gin.H {
+	params := []gin.H{
+		openAPIParameter("query", "domain", "A domain in polish notation, in JSON or as a Python literal", gin.H{"type": "string"}),
+		openAPIParameter("query", "order", "A comma separated list of fields with optional direction, e.g. 'name desc,id'", gin.H{"type": "string"}),
+		openAPIParameter("query", "limit", "The maximum number of records to return", gin.H{
+			"type": "integer", "minimum": 1, "maximum": RESTMaxLimit, "default": RESTDefaultLimit,
+		}),
+		openAPIParameter("query", "offset", "The number of records to skip", gin.H{"type": "integer", "minimum": 0, "default": 0}),
+	}
+	return gin.H{
+		"summary":     fmt.Sprintf("Search %s records", model.Name()),
+		"operationId": "search" + model.Name(),
+		"tags":        []string{model.Name()},
+		"parameters":  append(params, openAPISelectionParameters()...),
+		"responses": openAPIResponses(http.StatusOK, gin.H{
+			"type": "object",
+			"properties": gin.H{
+				"count":   gin.H{"type": "integer"},
+				"limit":   gin.H{"type": "integer"},
+				"offset":  gin.H{"type": "integer"},
+				"records": gin.H{"type": "array", "items": openAPIRef(model.Name())},
+			},
+		}),
+	}
+}
+
+// openAPIReadOperation returns the operation of the read request of the given model
+func openAPIReadOperation(model *models.Model) gin.H {
+	return gin.H{
+		"summary":     fmt.Sprintf("Read a %s record", model.Name()),
+		"operationId": "read" + model.Name(),
+		"tags":        []string{model.Name()},
+		"parameters":  openAPISelectionParameters(),
+		"responses":   openAPIResponses(http.StatusOK, openAPIRef(model.Name())),
+	}
+}
+
+// openAPICreateOperation returns the operation of the create request of the given model
+func openAPICreateOperation(model *models.Model) gin.H {
+	return gin.H{
+		"summary":     fmt.Sprintf("Create a %s record", model.Name()),
+		"operationId": "create" + model.Name(),
+		"tags":        []string{model.Name()},
+		"parameters":  openAPISelectionParameters(),
+		"requestBody": openAPIRequestBody(openAPIRef(model.Name())),
+		"responses":   openAPIResponses(http.StatusCreated, openAPIRef(model.Name())),
+	}
+}
+
+// openAPIUpdateOperation returns the operation of the update request of the given model
+func openAPIUpdateOperation(model *models.Model) gin.H {
+	return gin.H{
+		"summary":     fmt.Sprintf("Update a %s record", model.Name()),
+		"operationId": "update" + model.Name(),
+		"tags":        []string{model.Name()},
+		"parameters":  openAPISelectionParameters(),
+		"requestBody": openAPIRequestBody(openAPIRef(model.Name() + "Update")),
+		"responses":   openAPIResponses(http.StatusOK, openAPIRef(model.Name())),
+	}
+}
+
+// openAPIDeleteOperation returns the operation of the delete request of the given model
+func openAPIDeleteOperation(model *models.Model) gin.H {
+	return gin.H{
+		"summary":     fmt.Sprintf("Delete a %s record", model.Name()),
+		"operationId": "delete" + model.Name(),
+		"tags":        []string{model.Name()},
+		"responses":   openAPIResponses(http.StatusNoContent, nil),
+	}
+}
+
+// openAPICallOperation returns the operation of the call
+// request of the given exposed method of the given model.
+func openAPICallOperation(model *models.Model, method *models.Method) gin.H {
+	methType := method.MethodType()
+	// The first argument is the RecordSet on which the method is called
+	args := make([]interface{}, methType.NumIn()-1)
+	for i := range args {
+		args[i] = openAPITypeSchema(methType.In(i + 1))
+	}
+	argsSchema := gin.H{
+		"type":     "array",
+		"minItems": len(args),
+		"maxItems": len(args),
+		"items":    gin.H{},
+	}
+	if methType.IsVariadic() {
+		argsSchema["minItems"] = len(args) - 1
+	}
+	if len(args) > 0 {
+		argsSchema["items"] = gin.H{"anyOf": args}
+		argsSchema["description"] = fmt.Sprintf("The arguments of the method, in order: %s", openAPIArgsDescription(methType))
+	}
+	var result interface{} = gin.H{}
+	if methType.NumOut() > 0 {
+		result = openAPITypeSchema(methType.Out(0))
+	}
+	return gin.H{
+		"summary":     fmt.Sprintf("Call the %s method of %s", method.Name(), model.Name()),
+		"operationId": fmt.Sprintf("call%s%s", model.Name(), method.Name()),
+		"tags":        []string{model.Name()},
+		"requestBody": openAPIRequestBody(gin.H{
+			"type": "object",
+			"properties": gin.H{
+				"ids": gin.H{
+					"type":        "array",
+					"items":       gin.H{"type": "integer", "format": "int64"},
+					"description": "The ids of the records on which to call the method",
+				},
+				"args": argsSchema,
+			},
+		}),
+		"responses": openAPIResponses(http.StatusOK, gin.H{
+			"type":       "object",
+			"properties": gin.H{"result": result},
+		}),
+	}
+}
+
+// openAPIArgsDescription returns the comma separated list of the Go
+// types of the arguments of the given method type, without the receiver.
+func openAPIArgsDescription(methType reflect.Type) string {
+	var res string
+	for i := 1; i < methType.NumIn(); i++ {
+		if i > 1 {
+			res += ", "
+		}
+		res += methType.In(i).String()
+	}
+	return res
+}
+
+// openAPISelectionParameters returns the parameters selecting
+// the fields returned by a REST request.
+func openAPISelectionParameters() []gin.H {
+	return []gin.H{
+		openAPIParameter("query", "fields", "A comma separated list of fields to return (default all)", gin.H{"type": "string"}),
+		openAPIParameter("query", "expand", "A comma separated list of relation field paths to return as nested records instead of ids", gin.H{"type": "string"}),
+	}
+}
+
+// openAPIParameter returns a parameter object
+func openAPIParameter(in, name, description string, schema gin.H) gin.H {
+	return gin.H{
+		"in":          in,
+		"name":        name,
+		"description": description,
+		"required":    in == "path",
+		"schema":      schema,
+	}
+}
+
+// openAPIRequestBody returns a required JSON request body object with the given schema
+func openAPIRequestBody(schema gin.H) gin.H {
+	return gin.H{
+		"required": true,
+		"content":  openAPIJSONContent(schema),
+	}
+}
+
+// openAPIResponses returns the responses object of an operation whose successful
+// response has the given status code and JSON schema (no content if nil).
+func openAPIResponses(code int, schema gin.H) gin.H {
+	success := gin.H{"description": http.StatusText(code)}
+	if schema != nil {
+		success["content"] = openAPIJSONContent(schema)
+	}
+	res := gin.H{fmt.Sprint(code): success}
+	for _, errCode := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		res[fmt.Sprint(errCode)] = openAPIRef("Error", "responses")
+	}
+	return res
+}
+
+// openAPIJSONContent returns a content object of type application/json with the given schema
+func openAPIJSONContent(schema gin.H) gin.H {
+	return gin.H{"application/json": gin.H{"schema": schema}}
+}
+
+// openAPIRef returns a reference object to the given component,
+// which is a schema unless another kind of component is given.
+func openAPIRef(name string, kind ...string) gin.H {
+	k := "schemas"
+	if len(kind) > 0 {
+		k = kind[0]
+	}
+	return gin.H{"$ref": fmt.Sprintf("#/components/%s/%s", k, name)}
+}
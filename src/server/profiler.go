@@ -0,0 +1,144 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// QueryProfilerHeader is the request header that enables the
+	// profiling of the queries of this request when set.
+	QueryProfilerHeader = "X-Profile-Queries"
+	// queryProfilerKey is the key of the request's QueryProfiler in the Context
+	queryProfilerKey = "erp.queryProfiler"
+	// maxRequestProfiles is the number of request profiles kept in memory
+	maxRequestProfiles = 50
+)
+
+// A RequestProfile is the query profile of a single HTTP request
+type RequestProfile struct {
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Time   time.Time `json:"time"`
+	models.QueryProfile
+}
+
+// requestProfiles holds the last profiles of requests
+var requestProfiles struct {
+	sync.Mutex
+	list []RequestProfile
+}
+
+// EnableQueryProfiling adds a middleware to the server that profiles the
+// queries of the requests that have the QueryProfilerHeader set. It also
+// registers the /debug/queries route that returns the last request profiles
+// as JSON.
+//
+// Queries of a profiled request taking longer than slowThreshold are reported
+// as slow queries and if explain is set, their execution plan is captured.
+//
+// Only the queries of the Environments created with Context.ExecuteInNewEnvironment
+// are profiled, so that controllers must use it instead of
+// models.ExecuteInNewEnvironment to be profiled. A warning is logged for
+// profiled requests that did not record any query.
+//
+// This function is meant to be called only in debug mode.
+func EnableQueryProfiling(slowThreshold time.Duration, explain bool) {
+	erpServer.Use(wrapContextFuncs(queryProfilerMiddleware(slowThreshold, explain))...)
+	erpServer.GET("/debug/queries", wrapContextFuncs(showRequestProfiles)...)
+}
+
+// queryProfilerMiddleware returns a middleware that profiles the queries
+// of the requests that have the QueryProfilerHeader set.
+func queryProfilerMiddleware(slowThreshold time.Duration, explain bool) HandlerFunc {
+	return func(c *Context) {
+		if c.GetHeader(QueryProfilerHeader) == "" {
+			c.Next()
+			return
+		}
+		profiler := models.NewQueryProfiler(slowThreshold, explain)
+		c.Set(queryProfilerKey, profiler)
+		c.Writer = &profiledResponseWriter{
+			ResponseWriter: c.Writer,
+			profiler:       profiler,
+		}
+		c.Next()
+		profile := profiler.Profile()
+		if profile.QueriesCount == 0 {
+			c.Logger().Warn("No queries recorded for profiled request, the handler may not use Context.ExecuteInNewEnvironment",
+				"method", c.Request.Method, "path", c.Request.URL.Path)
+		}
+		c.Logger().Debug("Request queries profile", "method", c.Request.Method, "path", c.Request.URL.Path,
+			"queries", profile.QueriesCount, "duration_ms", profile.DurationMS, "repeated", len(profile.RepeatedQueries))
+		requestProfiles.Lock()
+		defer requestProfiles.Unlock()
+		requestProfiles.list = append(requestProfiles.list, RequestProfile{
+			Method:       c.Request.Method,
+			Path:         c.Request.URL.Path,
+			Time:         time.Now(),
+			QueryProfile: profile,
+		})
+		if len(requestProfiles.list) > maxRequestProfiles {
+			requestProfiles.list = requestProfiles.list[len(requestProfiles.list)-maxRequestProfiles:]
+		}
+	}
+}
+
+// showRequestProfiles returns the last request profiles as JSON, the latest first.
+func showRequestProfiles(c *Context) {
+	requestProfiles.Lock()
+	defer requestProfiles.Unlock()
+	res := make([]RequestProfile, len(requestProfiles.list))
+	for i, profile := range requestProfiles.list {
+		res[len(res)-1-i] = profile
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// A profiledResponseWriter adds the query profile headers to
+// the response just before the headers are sent.
+type profiledResponseWriter struct {
+	gin.ResponseWriter
+	profiler   *models.QueryProfiler
+	headersSet bool
+}
+
+// setProfileHeaders adds the query profile headers to the response
+// if they have not been sent yet.
+func (w *profiledResponseWriter) setProfileHeaders() {
+	if w.headersSet || w.ResponseWriter.Written() {
+		return
+	}
+	w.headersSet = true
+	profile := w.profiler.Profile()
+	w.Header().Set("X-Query-Count", strconv.Itoa(profile.QueriesCount))
+	w.Header().Set("X-Query-Duration", fmt.Sprintf("%.3fms", profile.DurationMS))
+	w.Header().Set("X-Query-Repeated", strconv.Itoa(len(profile.RepeatedQueries)))
+}
+
+// WriteHeaderNow forces to write the http header (status code + headers).
+func (w *profiledResponseWriter) WriteHeaderNow() {
+	w.setProfileHeaders()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Write writes the given data to the response body
+func (w *profiledResponseWriter) Write(data []byte) (int, error) {
+	w.setProfileHeaders()
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString writes the given string into the response body.
+func (w *profiledResponseWriter) WriteString(s string) (int, error) {
+	w.setProfileHeaders()
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/ratelimit"
+)
+
+// A RateLimitKeyFunc returns the key of the token bucket of a request
+type RateLimitKeyFunc func(c *Context) string
+
+// RateLimitByIP is a RateLimitKeyFunc that limits requests per client IP address
+func RateLimitByIP(c *Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// RateLimitByUID is a RateLimitKeyFunc that limits requests per user, whether
+// authenticated by session or by API key. Anonymous requests are limited per
+// client IP address.
+func RateLimitByUID(c *Context) string {
+	if uid := c.UID(); uid != 0 {
+		return fmt.Sprintf("uid:%d", uid)
+	}
+	return RateLimitByIP(c)
+}
+
+// RateLimitByAPIKey is a RateLimitKeyFunc that limits requests per API key.
+// Requests without API key are limited per client IP address.
+func RateLimitByAPIKey(c *Context) string {
+	if key := c.APIKey(); key != nil {
+		return "key:" + key.ID
+	}
+	return RateLimitByIP(c)
+}
+
+// A RateLimitConfig is the configuration of a RateLimit middleware
+type RateLimitConfig struct {
+	// Name identifies the buckets of this middleware in the Store, so that
+	// several middlewares with different limits can share the same Store.
+	Name string
+	// Limit is the rate of the token buckets
+	Limit ratelimit.Limit
+	// Key returns the bucket key of a request. Defaults to RateLimitByIP.
+	Key RateLimitKeyFunc
+	// Store holds the token buckets. Defaults to a new ratelimit.MemoryStore.
+	Store ratelimit.Store
+}
+
+// RateLimit returns a middleware that limits the rate of requests with a token
+// bucket per key as defined by the given config. It is meant to be added to
+// controllers groups with AddMiddleWare.
+//
+// Requests exceeding the limit get a 429 Too Many Requests response with a
+// Retry-After header. If the store fails, requests are let through so that
+// an unavailable shared store does not take the server down.
+func RateLimit(config RateLimitConfig) HandlerFunc {
+	if config.Limit.Events <= 0 || config.Limit.Period <= 0 {
+		log.Panic("Rate limit must have positive events and period", "name", config.Name, "limit", config.Limit)
+	}
+	if config.Key == nil {
+		config.Key = RateLimitByIP
+	}
+	if config.Store == nil {
+		config.Store = ratelimit.NewMemoryStore()
+	}
+	return func(c *Context) {
+		key := config.Key(c)
+		wait, err := config.Store.Take(config.Name+":"+key, config.Limit)
+		if err != nil {
+			c.Logger().Warn("Rate limit store error", "name", config.Name, "key", key, "error", err)
+			c.Next()
+			return
+		}
+		if wait > 0 {
+			c.Logger().Info("Rate limit exceeded", "name", config.Name, "key", key, "path", c.Request.URL.Path)
+			c.Header("Retry-After", strconv.Itoa(ratelimit.RetryAfter(wait)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, map[string]string{
+				"error": "too many requests",
+			})
+			return
+		}
+		c.Next()
+	}
+}
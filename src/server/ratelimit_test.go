@@ -0,0 +1,93 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/tools/ratelimit"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// failingStore is a ratelimit.Store that always fails
+type failingStore struct{}
+
+func (failingStore) Take(key string, limit ratelimit.Limit) (time.Duration, error) {
+	return 0, errors.New("store unavailable")
+}
+
+func TestRateLimit(t *testing.T) {
+	Convey("Testing rate limit middleware", t, func() {
+		keys := security.NewAPIKeyManager(make(memoryAPIKeyStore))
+		token1, _, err := keys.Generate(2, "script 1", time.Time{})
+		So(err, ShouldBeNil)
+		token2, _, err := keys.Generate(2, "script 2", time.Time{})
+		So(err, ShouldBeNil)
+		token3, _, err := keys.Generate(3, "script 3", time.Time{})
+		So(err, ShouldBeNil)
+		limit := ratelimit.Limit{Events: 2, Period: time.Hour}
+		ok := func(c *Context) {
+			c.String(http.StatusOK, "ok")
+		}
+		srv := newTestServer()
+		store := ratelimit.NewMemoryStore()
+		srv.Group("/ip", RateLimit(RateLimitConfig{Name: "ip", Limit: limit, Store: store})).GET("", ok)
+		srv.Group("/key", BearerAuthentication(keys),
+			RateLimit(RateLimitConfig{Name: "key", Limit: limit, Key: RateLimitByAPIKey, Store: store})).GET("", ok)
+		srv.Group("/uid", BearerAuthentication(keys),
+			RateLimit(RateLimitConfig{Name: "uid", Limit: limit, Key: RateLimitByUID, Store: store})).GET("", ok)
+		srv.Group("/failing", RateLimit(RateLimitConfig{Name: "failing", Limit: limit, Store: failingStore{}})).GET("", ok)
+		// get performs a GET request on path with the given API key token if not empty
+		get := func(path, token string) int {
+			headers := make(map[string]string)
+			if token != "" {
+				headers["Authorization"] = "Bearer " + token
+			}
+			return performRequest(srv, http.MethodGet, path, nil, headers).Code
+		}
+		Convey("Requests exceeding the limit should get a 429 response with Retry-After", func() {
+			So(get("/ip", ""), ShouldEqual, http.StatusOK)
+			So(get("/ip", ""), ShouldEqual, http.StatusOK)
+			w := performRequest(srv, http.MethodGet, "/ip", nil, nil)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+			So(err, ShouldBeNil)
+			So(retryAfter, ShouldBeGreaterThan, 0)
+			So(retryAfter, ShouldBeLessThanOrEqualTo, 1800)
+		})
+		Convey("Middlewares should not share their buckets", func() {
+			So(get("/ip", ""), ShouldEqual, http.StatusOK)
+			So(get("/ip", ""), ShouldEqual, http.StatusOK)
+			So(get("/ip", ""), ShouldEqual, http.StatusTooManyRequests)
+			So(get("/key", ""), ShouldEqual, http.StatusOK)
+		})
+		Convey("Requests should be limited per API key", func() {
+			So(get("/key", token1), ShouldEqual, http.StatusOK)
+			So(get("/key", token1), ShouldEqual, http.StatusOK)
+			So(get("/key", token1), ShouldEqual, http.StatusTooManyRequests)
+			So(get("/key", token2), ShouldEqual, http.StatusOK)
+			So(get("/key", ""), ShouldEqual, http.StatusOK)
+		})
+		Convey("Requests should be limited per user", func() {
+			So(get("/uid", token1), ShouldEqual, http.StatusOK)
+			So(get("/uid", token2), ShouldEqual, http.StatusOK)
+			So(get("/uid", token1), ShouldEqual, http.StatusTooManyRequests)
+			So(get("/uid", token3), ShouldEqual, http.StatusOK)
+			So(get("/uid", ""), ShouldEqual, http.StatusOK)
+		})
+		Convey("Requests should be let through if the store fails", func() {
+			for i := 0; i < 3; i++ {
+				So(get("/failing", ""), ShouldEqual, http.StatusOK)
+			}
+		})
+		Convey("Invalid limits should panic", func() {
+			So(func() { RateLimit(RateLimitConfig{Name: "invalid"}) }, ShouldPanic)
+		})
+	})
+}
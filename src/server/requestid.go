@@ -0,0 +1,42 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"regexp"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader is the header holding the ID of a request. It is read
+// from the request if set by the client or a proxy and always echoed in
+// the response.
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID matches the request IDs accepted from the clients
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// requestIDMiddleware sets the ID of each request, taken from the
+// RequestIDHeader or generated if missing or invalid, in the context of
+// the request and in the response headers.
+func requestIDMiddleware(c *Context) {
+	requestID := c.GetHeader(RequestIDHeader)
+	if !validRequestID.MatchString(requestID) {
+		requestID = uuid.New().String()
+	}
+	c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), requestID))
+	c.Header(RequestIDHeader, requestID)
+	c.Next()
+}
+
+// RequestID returns the ID of this request
+func (c *Context) RequestID() string {
+	return logging.RequestID(c.Request.Context())
+}
+
+// Logger returns a logger that adds the ID of this request to its messages
+func (c *Context) Logger() logging.Logger {
+	return logging.ForRequest(log, c.RequestID())
+}
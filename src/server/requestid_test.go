@@ -0,0 +1,58 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequestID(t *testing.T) {
+	Convey("Testing request IDs", t, func() {
+		srv := newTestServer()
+		srv.Group("/id").GET("", func(c *Context) {
+			c.String(http.StatusOK, c.RequestID())
+		})
+		// get performs a GET request with the given request ID header if
+		// not empty and returns the ID seen by the handler and the ID of
+		// the response header.
+		get := func(requestID string) (string, string) {
+			headers := make(map[string]string)
+			if requestID != "" {
+				headers[RequestIDHeader] = requestID
+			}
+			w := performRequest(srv, http.MethodGet, "/id", nil, headers)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			return w.Body.String(), w.Header().Get(RequestIDHeader)
+		}
+		Convey("Request IDs given by the client should be used and echoed", func() {
+			for _, requestID := range []string{"abc-123", "req.42:part/1+x=", strings.Repeat("a", 128)} {
+				handlerID, responseID := get(requestID)
+				So(handlerID, ShouldEqual, requestID)
+				So(responseID, ShouldEqual, requestID)
+			}
+		})
+		Convey("Request IDs should be generated if missing", func() {
+			handlerID, responseID := get("")
+			So(responseID, ShouldEqual, handlerID)
+			_, err := uuid.Parse(handlerID)
+			So(err, ShouldBeNil)
+			otherID, _ := get("")
+			So(otherID, ShouldNotEqual, handlerID)
+		})
+		Convey("Invalid request IDs should be replaced by generated ones", func() {
+			for _, requestID := range []string{strings.Repeat("a", 129), "id with spaces", "id\"quote", "<script>", "é"} {
+				handlerID, responseID := get(requestID)
+				So(handlerID, ShouldNotEqual, requestID)
+				So(responseID, ShouldEqual, handlerID)
+				_, err := uuid.Parse(handlerID)
+				So(err, ShouldBeNil)
+			}
+		})
+	})
+}
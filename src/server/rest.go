@@ -0,0 +1,621 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// RESTDefaultLimit is the number of records returned by a REST search
+	// request without 'limit' parameter.
+	RESTDefaultLimit = 80
+	// RESTMaxLimit is the maximum number of records returned by a REST search request
+	RESTMaxLimit = 1000
+)
+
+// RESTSearch is the handler of 'GET <prefix>/<model>' REST requests. It
+// returns the records of the model matching the following query parameters:
+//
+//   - domain: a domain in polish notation, in JSON or as a Python literal,
+//   - fields: a comma separated list of fields to return (default all),
+//   - expand: a comma separated list of relation field paths to return as
+//     nested records instead of ids (e.g. 'user_id.profile_id,tag_ids'),
+//   - order: a comma separated list of fields with optional direction
+//     (e.g. 'name desc,id'),
+//   - limit and offset: the pagination (default limit is RESTDefaultLimit).
+//
+// The response holds the total number of matching records in 'count' and
+// the requested page in 'records'.
+//
+// Like all REST handlers, RESTSearch executes as the user of the request
+// (see Context.UID), so that access rights and record rules apply.
+func RESTSearch(c *Context) {
+	model, uid, ok := c.restModel()
+	if !ok {
+		return
+	}
+	sel, err := restSelectionFromQuery(model, c.Query("fields"), c.Query("expand"))
+	if err != nil {
+		c.restError(http.StatusBadRequest, err)
+		return
+	}
+	cond, err := model.ParseDomain(c.Query("domain"))
+	if err != nil {
+		c.restError(http.StatusBadRequest, fmt.Errorf("invalid domain: %s", err))
+		return
+	}
+	orders, err := restOrders(model, c.Query("order"))
+	if err != nil {
+		c.restError(http.StatusBadRequest, err)
+		return
+	}
+	limit, err := restIntParam(c, "limit", RESTDefaultLimit, 1, RESTMaxLimit)
+	if err != nil {
+		c.restError(http.StatusBadRequest, err)
+		return
+	}
+	offset, err := restIntParam(c, "offset", 0, 0, -1)
+	if err != nil {
+		c.restError(http.StatusBadRequest, err)
+		return
+	}
+	var res gin.H
+	err = c.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		rs := env.Pool(model.Name())
+		if cond.IsEmpty() {
+			rs = rs.SearchAll()
+		} else {
+			rs = rs.Search(cond)
+		}
+		if len(orders) > 0 {
+			rs = rs.OrderBy(orders...)
+		}
+		records := make([]map[string]interface{}, 0, limit)
+		for _, rec := range rs.Limit(limit).Offset(offset).Fetch().Records() {
+			records = append(records, sel.serialize(rec))
+		}
+		res = gin.H{
+			"count":   rs.SearchCount(),
+			"limit":   limit,
+			"offset":  offset,
+			"records": records,
+		}
+	})
+	if err != nil {
+		c.restORMError(err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// RESTRead is the handler of 'GET <prefix>/<model>/<id>' REST requests. It
+// returns the record with the given id. The 'fields' and 'expand' query
+// parameters are accepted as for RESTSearch.
+func RESTRead(c *Context) {
+	model, uid, ok := c.restModel()
+	if !ok {
+		return
+	}
+	id, ok := c.restID()
+	if !ok {
+		return
+	}
+	sel, err := restSelectionFromQuery(model, c.Query("fields"), c.Query("expand"))
+	if err != nil {
+		c.restError(http.StatusBadRequest, err)
+		return
+	}
+	var res map[string]interface{}
+	err = c.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		if rec := restRecord(env, model, id); rec != nil {
+			res = sel.serialize(rec)
+		}
+	})
+	c.restRespond(http.StatusOK, res, err)
+}
+
+// RESTCreate is the handler of 'POST <prefix>/<model>' REST requests. It
+// creates a record from the JSON object of the request body, indexed by
+// field names. Relation fields take ids or lists of ids.
+//
+// The response is the created record, with the 'fields' and 'expand' query
+// parameters accepted as for RESTSearch.
+func RESTCreate(c *Context) {
+	model, uid, ok := c.restModel()
+	if !ok {
+		return
+	}
+	values, ok := c.restValues(model)
+	if !ok {
+		return
+	}
+	sel, err := restSelectionFromQuery(model, c.Query("fields"), c.Query("expand"))
+	if err != nil {
+		c.restError(http.StatusBadRequest, err)
+		return
+	}
+	var res map[string]interface{}
+	err = c.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		rs := env.Pool(model.Name())
+		rec := rs.Call("Create", models.NewModelDataFromRS(rs, values)).(models.RecordSet).Collection()
+		res = sel.serialize(rec)
+	})
+	if err == nil {
+		c.Header("Location", fmt.Sprintf("%s/%d", strings.TrimSuffix(c.Request.URL.Path, "/"), res["id"]))
+	}
+	c.restRespond(http.StatusCreated, res, err)
+}
+
+// RESTUpdate is the handler of 'PATCH <prefix>/<model>/<id>' REST requests.
+// It updates the record with the given id with the JSON object of the request
+// body as for RESTCreate and returns the updated record.
+func RESTUpdate(c *Context) {
+	model, uid, ok := c.restModel()
+	if !ok {
+		return
+	}
+	id, ok := c.restID()
+	if !ok {
+		return
+	}
+	values, ok := c.restValues(model)
+	if !ok {
+		return
+	}
+	sel, err := restSelectionFromQuery(model, c.Query("fields"), c.Query("expand"))
+	if err != nil {
+		c.restError(http.StatusBadRequest, err)
+		return
+	}
+	var res map[string]interface{}
+	err = c.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		rec := restRecord(env, model, id)
+		if rec == nil {
+			return
+		}
+		rec.Call("Write", models.NewModelDataFromRS(rec, values))
+		res = sel.serialize(rec)
+	})
+	c.restRespond(http.StatusOK, res, err)
+}
+
+// RESTDelete is the handler of 'DELETE <prefix>/<model>/<id>' REST requests.
+// It deletes the record with the given id.
+func RESTDelete(c *Context) {
+	model, uid, ok := c.restModel()
+	if !ok {
+		return
+	}
+	id, ok := c.restID()
+	if !ok {
+		return
+	}
+	var found bool
+	err := c.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		rec := restRecord(env, model, id)
+		if rec == nil {
+			return
+		}
+		rec.Call("Unlink")
+		found = true
+	})
+	switch {
+	case err != nil:
+		c.restORMError(err)
+	case !found:
+		c.restError(http.StatusNotFound, errors.New("record not found"))
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// A restCallRequest is the JSON body of a REST method call request
+type restCallRequest struct {
+	// IDs are the ids of the records on which to call the method.
+	// The method is called on an empty RecordSet if there are none.
+	IDs []int64 `json:"ids"`
+	// Args are the arguments of the method, decoded with
+	// models.Method.DecodeJSONArgs.
+	Args []json.RawMessage `json:"args"`
+}
+
+// RESTCall is the handler of 'POST <prefix>/<model>/call/<method>' REST
+// requests. It calls the given exposed method on the records whose ids are
+// given in the 'ids' list of the JSON request body, with the arguments of
+// the 'args' list.
+//
+// RecordSet arguments are given as ids, RecordData arguments as objects
+// indexed by field names and Condition arguments as domains. The response
+// holds the value returned by the method in 'result', with RecordSets
+// converted to lists of ids in the same way.
+func RESTCall(c *Context) {
+	model, uid, ok := c.restModel()
+	if !ok {
+		return
+	}
+	method, ok := model.Methods().Get(c.Param("method"))
+	if !ok || !method.IsExposed() {
+		c.restError(http.StatusNotFound, fmt.Errorf("unknown method '%s' in model %s", c.Param("method"), model.Name()))
+		return
+	}
+	var req restCallRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.restError(http.StatusBadRequest, fmt.Errorf("invalid JSON body: %s", err))
+		return
+	}
+	var (
+		res     interface{}
+		found   bool
+		argsErr error
+	)
+	err := c.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		rs := restRecords(env, model, req.IDs)
+		if rs == nil {
+			return
+		}
+		found = true
+		var args []interface{}
+		args, argsErr = method.DecodeJSONArgs(env, req.Args)
+		if argsErr != nil {
+			return
+		}
+		res = restResult(rs.Call(method.Name(), args...))
+	})
+	switch {
+	case argsErr != nil:
+		c.restError(http.StatusBadRequest, argsErr)
+	case err != nil:
+		c.restORMError(err)
+	case !found:
+		c.restError(http.StatusNotFound, errors.New("record not found"))
+	default:
+		c.JSON(http.StatusOK, gin.H{"result": res})
+	}
+}
+
+// restRecords returns the records of the given model with the given ids, or
+// nil if some of them do not exist or are not visible by the user. It returns
+// an empty RecordSet if no ids are given.
+func restRecords(env models.Environment, model *models.Model, ids []int64) *models.RecordCollection {
+	rs := env.Pool(model.Name())
+	if len(ids) == 0 {
+		return rs
+	}
+	unique := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		unique[id] = true
+	}
+	rs = rs.Search(model.Field(models.ID).In(ids)).Fetch()
+	if rs.Len() != len(unique) {
+		return nil
+	}
+	return rs
+}
+
+// restResult converts the given value returned by a method call for
+// JSON encoding: RecordSets become lists of ids, RecordData objects
+// indexed by field names and Conditions domains.
+func restResult(val interface{}) interface{} {
+	switch v := val.(type) {
+	case models.RecordSet:
+		return v.Ids()
+	case models.RecordData:
+		res := make(map[string]interface{}, len(v.Underlying().FieldMap))
+		for field, value := range v.Underlying().FieldMap {
+			res[field] = restResult(value)
+		}
+		return res
+	case models.Conditioner:
+		return v.Underlying().Serialize()
+	}
+	return val
+}
+
+// restModel returns the exposed model of the request and the uid of the
+// user. It aborts the request and returns false if the request is not
+// authenticated or if the model does not exist.
+func (c *Context) restModel() (*models.Model, int64, bool) {
+	uid := c.UID()
+	if uid == 0 {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.restError(http.StatusUnauthorized, errors.New("authentication required"))
+		return nil, 0, false
+	}
+	model, ok := models.Registry.Get(c.Param("model"))
+	if !ok || !model.IsExposed() {
+		c.restError(http.StatusNotFound, fmt.Errorf("unknown model '%s'", c.Param("model")))
+		return nil, 0, false
+	}
+	return model, uid, true
+}
+
+// restID returns the record id of the request.
+// It aborts the request and returns false if the id is invalid.
+func (c *Context) restID() (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.restError(http.StatusBadRequest, fmt.Errorf("invalid id '%s'", c.Param("id")))
+		return 0, false
+	}
+	return id, true
+}
+
+// restValues returns the field values of the JSON body of the request.
+// It aborts the request and returns false if the body is invalid.
+func (c *Context) restValues(model *models.Model) (models.FieldMap, bool) {
+	var values map[string]interface{}
+	if err := c.ShouldBindJSON(&values); err != nil {
+		c.restError(http.StatusBadRequest, fmt.Errorf("invalid JSON body: %s", err))
+		return nil, false
+	}
+	delete(values, models.ID.JSON())
+	for name := range values {
+		if _, err := restFieldPath(model, name); err != nil || strings.Contains(name, models.ExprSep) {
+			c.restError(http.StatusBadRequest, fmt.Errorf("unknown field '%s' in model %s", name, model.Name()))
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// restRespond writes the given record with the given status code, or the
+// given error, or a 404 Not Found response if the record is nil.
+func (c *Context) restRespond(code int, record map[string]interface{}, err error) {
+	switch {
+	case err != nil:
+		c.restORMError(err)
+	case record == nil:
+		c.restError(http.StatusNotFound, errors.New("record not found"))
+	default:
+		c.JSON(code, record)
+	}
+}
+
+// restError aborts the request with the given status code and error
+func (c *Context) restError(code int, err error) {
+	c.AbortWithStatusJSON(code, gin.H{"error": err.Error()})
+}
+
+// restORMError aborts the request with the status code and message
+// for the given error returned by the execution of a REST request in
+// the ORM (see ormErrorStatus).
+func (c *Context) restORMError(err error) {
+	code, msg := ormErrorStatus(err)
+	if code == http.StatusInternalServerError {
+		c.AbortWithStatusJSON(code, gin.H{"error": msg, "request_id": c.RequestID()})
+		return
+	}
+	c.restError(code, errors.New(msg))
+}
+
+// ormErrorStatus returns the HTTP status code and the message to return to
+// the client for the given error returned by the execution of a request in
+// the ORM.
+//
+// Only the messages of models.AccessError and models.NotFoundError are
+// returned. Other errors may hold internal details and get a generic message,
+// the details being logged with the request ID.
+func ormErrorStatus(err error) (int, string) {
+	var (
+		accessErr   models.AccessError
+		notFoundErr models.NotFoundError
+	)
+	switch {
+	case errors.As(err, &accessErr):
+		return http.StatusForbidden, accessErr.Message
+	case errors.As(err, &notFoundErr):
+		return http.StatusNotFound, notFoundErr.Message
+	}
+	return http.StatusInternalServerError, "internal server error"
+}
+
+// restRecord returns the record of the given model with the given id,
+// or nil if it does not exist or if it is not visible by the user.
+func restRecord(env models.Environment, model *models.Model, id int64) *models.RecordCollection {
+	rec := env.Pool(model.Name()).Search(model.Field(models.ID).Equals(id)).Fetch()
+	if rec.IsEmpty() {
+		return nil
+	}
+	return rec
+}
+
+// restIntParam returns the integer query parameter with the given name, or
+// def if it is not set. An error is returned if it is not between min and
+// max (max < 0 means no maximum).
+func restIntParam(c *Context, name string, def, min, max int) (int, error) {
+	param := c.Query(name)
+	if param == "" {
+		return def, nil
+	}
+	val, err := strconv.Atoi(param)
+	if err != nil || val < min || (max >= 0 && val > max) {
+		if max < 0 {
+			return 0, fmt.Errorf("%s must be an integer greater than or equal to %d", name, min)
+		}
+		return 0, fmt.Errorf("%s must be an integer between %d and %d", name, min, max)
+	}
+	return val, nil
+}
+
+// restOrders parses the given comma separated order parameter
+// into order expressions for RecordCollection.OrderBy.
+func restOrders(model *models.Model, param string) ([]string, error) {
+	var res []string
+	for _, expr := range restSplit(param) {
+		parts := strings.Fields(expr)
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("invalid order '%s'", expr)
+		}
+		if len(parts) == 2 {
+			dir := strings.ToLower(parts[1])
+			if dir != "asc" && dir != "desc" {
+				return nil, fmt.Errorf("invalid order direction '%s'", parts[1])
+			}
+		}
+		if _, err := restFieldPath(model, parts[0]); err != nil {
+			return nil, err
+		}
+		res = append(res, expr)
+	}
+	return res, nil
+}
+
+// restSplit splits the given comma separated list
+// and removes spaces and empty items.
+func restSplit(param string) []string {
+	var res []string
+	for _, item := range strings.Split(param, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// restFieldPath returns the FieldInfo of each field of the given dot
+// separated path from the given model, or an error if it is invalid.
+func restFieldPath(model *models.Model, path string) ([]*models.FieldInfo, error) {
+	var res []*models.FieldInfo
+	for i, name := range strings.Split(path, models.ExprSep) {
+		if i > 0 {
+			relation := res[i-1].Relation
+			if relation == "" {
+				return nil, fmt.Errorf("field '%s' of '%s' is not a relation field", res[i-1].JSON, path)
+			}
+			model = models.Registry.MustGet(relation)
+		}
+		fi, ok := model.Fields().Get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown field '%s' in model %s", name, model.Name())
+		}
+		res = append(res, model.FieldsGet(model.FieldName(fi.JSON()))[fi.JSON()])
+	}
+	return res, nil
+}
+
+// A restSelection is the selection of the fields returned
+// for the records of a model by the REST API.
+type restSelection struct {
+	fields []*models.FieldInfo
+	// expand holds the selection of the related records of the
+	// relation fields to expand, indexed by field JSON name.
+	expand map[string]*restSelection
+}
+
+// newRESTSelection returns a restSelection of the given fields of the given
+// model, or of all its fields if none are given.
+func newRESTSelection(model *models.Model, fields ...string) (*restSelection, error) {
+	res := &restSelection{expand: make(map[string]*restSelection)}
+	if len(fields) == 0 {
+		infos := model.FieldsGet()
+		for _, fi := range infos {
+			res.fields = append(res.fields, fi)
+		}
+		sort.Slice(res.fields, func(i, j int) bool {
+			return res.fields[i].JSON < res.fields[j].JSON
+		})
+		return res, nil
+	}
+	for _, name := range fields {
+		path, err := restFieldPath(model, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > 1 {
+			return nil, fmt.Errorf("invalid field '%s': use expand for related fields", name)
+		}
+		res.add(path[0])
+	}
+	return res, nil
+}
+
+// restSelectionFromQuery returns the restSelection of the given model
+// from the given 'fields' and 'expand' query parameters.
+func restSelectionFromQuery(model *models.Model, fields, expand string) (*restSelection, error) {
+	res, err := newRESTSelection(model, restSplit(fields)...)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range restSplit(expand) {
+		infos, err := restFieldPath(model, path)
+		if err != nil {
+			return nil, err
+		}
+		sel := res
+		for _, fi := range infos {
+			if fi.Relation == "" {
+				return nil, fmt.Errorf("field '%s' of '%s' is not a relation field", fi.JSON, path)
+			}
+			sel.add(fi)
+			sub, ok := sel.expand[fi.JSON]
+			if !ok {
+				// Expanded records have all their fields
+				sub, _ = newRESTSelection(models.Registry.MustGet(fi.Relation))
+				sel.expand[fi.JSON] = sub
+			}
+			sel = sub
+		}
+	}
+	return res, nil
+}
+
+// add adds the given field to this selection if it is not there yet
+func (rs *restSelection) add(fi *models.FieldInfo) {
+	for _, f := range rs.fields {
+		if f.JSON == fi.JSON {
+			return
+		}
+	}
+	rs.fields = append(rs.fields, fi)
+}
+
+// serialize returns the values of the selected fields of the given record
+// indexed by JSON name. Relation fields are given as ids, or as nested
+// records if they are expanded.
+func (rs *restSelection) serialize(rec *models.RecordCollection) map[string]interface{} {
+	res := map[string]interface{}{
+		models.ID.JSON(): rec.Ids()[0],
+	}
+	for _, fi := range rs.fields {
+		val := rec.Get(rec.Model().FieldName(fi.JSON))
+		related, ok := val.(models.RecordSet)
+		if !ok {
+			res[fi.JSON] = val
+			continue
+		}
+		records := related.Collection().Records()
+		sub := rs.expand[fi.JSON]
+		if fi.Type.Is2OneRelationType() {
+			switch {
+			case len(records) == 0:
+				res[fi.JSON] = nil
+			case sub != nil:
+				res[fi.JSON] = sub.serialize(records[0])
+			default:
+				res[fi.JSON] = records[0].Ids()[0]
+			}
+			continue
+		}
+		items := make([]interface{}, len(records))
+		for i, r := range records {
+			if sub != nil {
+				items[i] = sub.serialize(r)
+				continue
+			}
+			items[i] = r.Ids()[0]
+		}
+		res[fi.JSON] = items
+	}
+	return res
+}
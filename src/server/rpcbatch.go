@@ -0,0 +1,254 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
+	"github.com/Pedro-lmso-erp/erp/src/tools/tracing"
+)
+
+const (
+	// RPCBatchTransactionHeader is the request header that makes all the
+	// calls of a JSON-RPC batch request execute in a single transaction
+	// when set to RPCBatchSharedTransaction.
+	RPCBatchTransactionHeader = "X-RPC-Batch-Transaction"
+	// RPCBatchSharedTransaction is the value of the RPCBatchTransactionHeader
+	// that makes all the calls of a batch execute in a single transaction.
+	RPCBatchSharedTransaction = "shared"
+)
+
+// rpcBatchKey is the key of the rpcBatch in the context of the
+// requests of the calls of a batch. It also marks these requests
+// so that RPCBatch does not handle them as batches again.
+type rpcBatchKey struct{}
+
+// An rpcBatch holds the state of the execution of a JSON-RPC batch request
+type rpcBatch struct {
+	// shared is true if all the calls are executed in a single transaction
+	shared bool
+	// env is the Environment of the shared transaction
+	env models.Environment
+	// failure is the panic data of an error that requires the whole
+	// shared transaction to be retried.
+	failure interface{}
+}
+
+// executeInSavepoint executes the given fnct for the given uid within a
+// savepoint of the shared transaction of this batch.
+func (b *rpcBatch) executeInSavepoint(uid int64, fnct func(models.Environment)) (rError error) {
+	defer func() {
+		if r := recover(); r != nil {
+			// Serialization errors are panicked again by ExecuteInSavepoint
+			b.failure = r
+			rError = logging.LogPanicDataWith(b.env.Logger(), r)
+		}
+	}()
+	env := b.env
+	if env.Uid() != uid {
+		env = env.Sudo(uid)
+	}
+	return models.ExecuteInSavepoint(env, fnct)
+}
+
+// RPCBatch returns a middleware that adds support for JSON-RPC batch
+// requests to the JSON-RPC routes of a group. It should be added with
+// the AddMiddleWare method of the group.
+//
+// A batch request is a POST request whose body is an array of JSON-RPC
+// requests. Each request is served as if it had been sent alone to the
+// same URL, with the same headers, and the responses are sent back in
+// an array in the same order. Elements of the array that are not JSON
+// objects get an invalid request error response and are not served, so
+// that batches cannot be nested. Requests without id are notifications:
+// they are executed but their responses are left out. If the batch has
+// only notifications, the response is 204 No Content.
+//
+// An error in a call is reported in its ResponseError and does not fail
+// the other calls of the batch. By default, each call is executed in its
+// own transaction. If the RPCBatchTransactionHeader is set to
+// RPCBatchSharedTransaction, all the Environments created by the handlers
+// with Context.ExecuteInNewEnvironment share a single transaction, which
+// is committed at the end of the batch. Each of them is executed in a
+// savepoint so that the changes of a failed call are rolled back without
+// affecting the others.
+//
+// Batches with more than maxCalls calls are rejected with a 413 status,
+// unless maxCalls is 0. Note that session changes made by a call are not
+// seen by the next calls of the batch.
+func RPCBatch(maxCalls int) HandlerFunc {
+	return func(c *Context) {
+		if c.Request.Method != http.MethodPost || c.Request.Context().Value(rpcBatchKey{}) != nil {
+			c.Next()
+			return
+		}
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		body = bytes.TrimSpace(body)
+		if len(body) == 0 || body[0] != '[' {
+			c.Next()
+			return
+		}
+		var calls []json.RawMessage
+		if err := json.Unmarshal(body, &calls); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, c.newResponseError(0, http.StatusBadRequest, fmt.Errorf("invalid batch request: %s", err)))
+			return
+		}
+		if len(calls) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, c.newResponseError(0, http.StatusBadRequest, errors.New("empty batch request")))
+			return
+		}
+		if maxCalls > 0 && len(calls) > maxCalls {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, c.newResponseError(0, http.StatusRequestEntityTooLarge,
+				fmt.Errorf("too many calls in batch request (max %d)", maxCalls)))
+			return
+		}
+		batch := &rpcBatch{
+			shared: strings.EqualFold(c.GetHeader(RPCBatchTransactionHeader), RPCBatchSharedTransaction),
+		}
+		var responses []json.RawMessage
+		if !batch.shared {
+			responses = c.serveRPCBatch(batch, calls)
+		} else {
+			err = c.ExecuteInNewEnvironment(c.UID(), func(env models.Environment) {
+				batch.env = env
+				batch.failure = nil
+				responses = c.serveRPCBatch(batch, calls)
+			})
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, c.newResponseError(0, http.StatusInternalServerError, err))
+				return
+			}
+		}
+		c.Abort()
+		if len(responses) == 0 {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.JSON(http.StatusOK, responses)
+	}
+}
+
+// serveRPCBatch serves each of the given calls of the given batch and
+// returns the responses of the calls that are not notifications.
+//
+// In a shared transaction, it panics if a call failed with an error that
+// requires the whole transaction to be retried.
+func (c *Context) serveRPCBatch(batch *rpcBatch, calls []json.RawMessage) []json.RawMessage {
+	var responses []json.RawMessage
+	for _, call := range calls {
+		resp, notification := c.serveRPCCall(batch, call)
+		if batch.failure != nil {
+			panic(batch.failure)
+		}
+		if notification {
+			continue
+		}
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+// serveRPCCall serves the given call of a batch as a separate request
+// and returns its response and whether it is a notification.
+func (c *Context) serveRPCCall(batch *rpcBatch, call json.RawMessage) (json.RawMessage, bool) {
+	if !bytes.HasPrefix(bytes.TrimSpace(call), []byte("{")) {
+		return mustMarshalRPC(c.newResponseError(0, http.StatusBadRequest, errors.New("invalid request: batch elements must be JSON objects"))), false
+	}
+	var head struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(call, &head); err != nil {
+		return mustMarshalRPC(c.newResponseError(0, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))), false
+	}
+	var id int64
+	if len(head.ID) > 0 {
+		if err := json.Unmarshal(head.ID, &id); err != nil {
+			return mustMarshalRPC(c.newResponseError(0, http.StatusBadRequest, fmt.Errorf("invalid request id: %s", err))), false
+		}
+	}
+	notification := len(head.ID) == 0 || string(head.ID) == "null"
+
+	req := c.Request.Clone(context.WithValue(c.Request.Context(), rpcBatchKey{}, batch))
+	req.Body = ioutil.NopCloser(bytes.NewReader(call))
+	req.ContentLength = int64(len(call))
+	req.Header.Set(RequestIDHeader, c.RequestID())
+	if span := c.Span(); span != nil {
+		req.Header.Set(tracing.TraceParentHeader, span.TraceParent())
+	}
+	w := newRPCCallResponseWriter()
+	erpServer.ServeHTTP(w, req)
+
+	for _, cookie := range w.header["Set-Cookie"] {
+		c.Writer.Header().Add("Set-Cookie", cookie)
+	}
+	var resp struct {
+		JsonRPC string `json:"jsonrpc"`
+	}
+	if err := json.Unmarshal(w.body.Bytes(), &resp); err == nil && resp.JsonRPC != "" {
+		return w.body.Bytes(), notification
+	}
+	// The handler did not send a JSON-RPC response, e.g. because it aborted
+	msg := strings.TrimSpace(w.body.String())
+	if msg == "" {
+		msg = http.StatusText(w.code)
+	}
+	return mustMarshalRPC(c.newResponseError(id, w.code, errors.New(msg))), notification
+}
+
+// mustMarshalRPC returns the JSON encoding of the given JSON-RPC response.
+// It panics in case of error.
+func mustMarshalRPC(resp interface{}) json.RawMessage {
+	res, err := json.Marshal(resp)
+	if err != nil {
+		log.Panic("Unable to marshal JSON-RPC response", "error", err)
+	}
+	return res
+}
+
+// An rpcCallResponseWriter is an http.ResponseWriter that
+// records the response of a call of a batch.
+type rpcCallResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+var _ http.ResponseWriter = new(rpcCallResponseWriter)
+
+// newRPCCallResponseWriter returns a new rpcCallResponseWriter
+func newRPCCallResponseWriter() *rpcCallResponseWriter {
+	return &rpcCallResponseWriter{
+		header: make(http.Header),
+		code:   http.StatusOK,
+	}
+}
+
+// Header returns the header map of the response
+func (w *rpcCallResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// Write records the given data in the body of the response
+func (w *rpcCallResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+// WriteHeader records the status code of the response
+func (w *rpcCallResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
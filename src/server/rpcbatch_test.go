@@ -0,0 +1,111 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/exceptions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRPCBatch(t *testing.T) {
+	// Calls of batches are served by erpServer
+	path := "/test/rpc/batch"
+	erpServer.Group(path, RPCBatch(5)).POST("", func(c *Context) {
+		var req RequestRPC
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+		c.Set("id", req.ID)
+		if req.Method == "fail" {
+			c.RPC(http.StatusInternalServerError, nil, exceptions.UserError{Message: "call failed"})
+			return
+		}
+		c.RPC(http.StatusOK, req.Method)
+	})
+	Convey("Testing JSON-RPC batch requests", t, func() {
+		// post sends the given body to the batch route and returns the
+		// status code and the decoded responses of the batch.
+		post := func(body string) (int, []map[string]interface{}) {
+			w := performRequest(erpServer, http.MethodPost, path, strings.NewReader(body), map[string]string{"Content-Type": "application/json"})
+			var responses []map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &responses)
+			return w.Code, responses
+		}
+		// errorMessage returns the error message of the given response
+		errorMessage := func(resp map[string]interface{}) string {
+			data := resp["error"].(map[string]interface{})["data"].(map[string]interface{})
+			return data["arguments"].([]interface{})[0].(string)
+		}
+		Convey("Responses should be sent in the order of the calls", func() {
+			code, responses := post(`[{"jsonrpc": "2.0", "id": 3, "method": "a"},
+				{"jsonrpc": "2.0", "id": 1, "method": "b"},
+				{"jsonrpc": "2.0", "id": 2, "method": "c"}]`)
+			So(code, ShouldEqual, http.StatusOK)
+			So(responses, ShouldHaveLength, 3)
+			for i, expected := range []struct {
+				id     float64
+				result string
+			}{{3, "a"}, {1, "b"}, {2, "c"}} {
+				So(responses[i]["id"], ShouldEqual, expected.id)
+				So(responses[i]["result"], ShouldEqual, expected.result)
+			}
+		})
+		Convey("Notifications should be executed without response", func() {
+			code, responses := post(`[{"jsonrpc": "2.0", "method": "a"}, {"jsonrpc": "2.0", "id": 2, "method": "b"}, {"jsonrpc": "2.0", "id": null, "method": "c"}]`)
+			So(code, ShouldEqual, http.StatusOK)
+			So(responses, ShouldHaveLength, 1)
+			So(responses[0]["result"], ShouldEqual, "b")
+			code, _ = post(`[{"jsonrpc": "2.0", "method": "a"}, {"jsonrpc": "2.0", "method": "b"}]`)
+			So(code, ShouldEqual, http.StatusNoContent)
+		})
+		Convey("Errors should be reported per call", func() {
+			code, responses := post(`[{"jsonrpc": "2.0", "id": 1, "method": "fail"}, {"jsonrpc": "2.0", "id": 2, "method": "b"}]`)
+			So(code, ShouldEqual, http.StatusOK)
+			So(responses, ShouldHaveLength, 2)
+			So(responses[0]["id"], ShouldEqual, 1)
+			So(responses[0], ShouldNotContainKey, "result")
+			So(errorMessage(responses[0]), ShouldEqual, "call failed")
+			So(responses[1]["result"], ShouldEqual, "b")
+		})
+		Convey("Elements that are not objects should be invalid requests", func() {
+			code, responses := post(`[[{"jsonrpc": "2.0", "id": 1, "method": "a"}], 1, null, "b", {"jsonrpc": "2.0", "id": 5, "method": "c"}]`)
+			So(code, ShouldEqual, http.StatusOK)
+			So(responses, ShouldHaveLength, 5)
+			for _, resp := range responses[:4] {
+				So(resp["error"].(map[string]interface{})["code"], ShouldEqual, http.StatusBadRequest)
+				So(errorMessage(resp), ShouldStartWith, "invalid request")
+			}
+			So(responses[4]["result"], ShouldEqual, "c")
+		})
+		Convey("Calls of a batch should not be handled as batches", func() {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`[{"jsonrpc": "2.0", "id": 1, "method": "a"}]`))
+			req = req.WithContext(context.WithValue(req.Context(), rpcBatchKey{}, &rpcBatch{}))
+			w := httptest.NewRecorder()
+			erpServer.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Invalid batches should be refused", func() {
+			code, _ := post(`[]`)
+			So(code, ShouldEqual, http.StatusBadRequest)
+			code, _ = post(`[{"jsonrpc": "2.0", "id": 1, "method": "a"}`)
+			So(code, ShouldEqual, http.StatusBadRequest)
+			code, _ = post(`[` + strings.TrimSuffix(strings.Repeat(`{"jsonrpc": "2.0", "id": 1, "method": "a"},`, 6), ",") + `]`)
+			So(code, ShouldEqual, http.StatusRequestEntityTooLarge)
+		})
+		Convey("Single requests should be served as usual", func() {
+			w := performRequest(erpServer, http.MethodPost, path, strings.NewReader(`{"jsonrpc": "2.0", "id": 1, "method": "a"}`), nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var resp map[string]interface{}
+			So(json.Unmarshal(w.Body.Bytes(), &resp), ShouldBeNil)
+			So(resp["result"], ShouldEqual, "a")
+		})
+	})
+}
@@ -15,10 +15,13 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"path/filepath"
+	"sync"
 
 	"github.com/Pedro-lmso-erp/erp/src/templates"
 	"github.com/Pedro-lmso-erp/erp/src/tools/logging"
@@ -33,6 +36,8 @@ import (
 // It is internally a wrapper around a gin.Engine
 type Server struct {
 	*gin.Engine
+	mu          sync.Mutex
+	httpServers []*http.Server
 }
 
 // Group creates a new router group. You should add all the routes that have common middlwares or the same path prefix.
@@ -45,32 +50,39 @@ func (s *Server) Group(relativePath string, handlers ...HandlerFunc) *RouterGrou
 
 // Run attaches the router to a http.Server and starts listening and serving HTTP requests.
 // It is a shortcut for http.ListenAndServe(addr, router)
-// Note: this method will block the calling goroutine indefinitely unless an error happens.
+// Note: this method will block the calling goroutine indefinitely unless an error happens
+// or the server is shut down with Shutdown, in which case it returns nil.
 func (s *Server) Run(addr string) (err error) {
-	defer func() { log.Error("HTTP server stopped", "error", err) }()
+	defer func() { logServerStopped("HTTP", err) }()
 
 	log.Info("erp is up and running HTTP", "address", addr)
-	err = http.ListenAndServe(addr, s)
+	err = s.serve(&http.Server{Addr: addr, Handler: s}, func(srv *http.Server) error {
+		return srv.ListenAndServe()
+	})
 	return
 }
 
 // RunTLS attaches the router to a http.Server and starts listening and serving HTTPS (secure) requests.
 // It is a shortcut for http.ListenAndServeTLS(addr, certFile, keyFile, router)
-// Note: this method will block the calling goroutine indefinitely unless an error happens.
+// Note: this method will block the calling goroutine indefinitely unless an error happens
+// or the server is shut down with Shutdown, in which case it returns nil.
 func (s *Server) RunTLS(addr string, certFile string, keyFile string) (err error) {
-	defer func() { log.Error("HTTPS server stopped", err) }()
+	defer func() { logServerStopped("HTTPS", err) }()
 
 	log.Info("erp is up and running HTTPS", "address", addr, "cert", certFile, "key", keyFile)
-	err = http.ListenAndServeTLS(addr, certFile, keyFile, s)
+	err = s.serve(&http.Server{Addr: addr, Handler: s}, func(srv *http.Server) error {
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	})
 	return
 }
 
 // RunAutoTLS attaches the router to a http.Server and starts listening and serving HTTPS (secure) requests on port 443
 // for all interfaces.
 // It automatically gets certificate for the given domain from Letsencrypt.
-// Note: this method will block the calling goroutine indefinitely unless an error happens.
+// Note: this method will block the calling goroutine indefinitely unless an error happens
+// or the server is shut down with Shutdown, in which case it returns nil.
 func (s *Server) RunAutoTLS(domain string) (err error) {
-	defer func() { log.Error("HTTPS server stopped", err) }()
+	defer func() { logServerStopped("HTTPS", err) }()
 
 	log.Info("erp is up and running HTTPS auto", "domain", domain)
 
@@ -80,16 +92,60 @@ func (s *Server) RunAutoTLS(domain string) (err error) {
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: autocert.HostWhitelist(domain),
 	}
-	go http.ListenAndServe(":http", m.HTTPHandler(nil))
+	go s.serve(&http.Server{Addr: ":http", Handler: m.HTTPHandler(nil)}, func(srv *http.Server) error {
+		return srv.ListenAndServe()
+	})
 	srv := &http.Server{
 		Addr:      ":https",
 		TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
 		Handler:   s,
 	}
-	err = srv.ListenAndServeTLS("", "")
+	err = s.serve(srv, func(srv *http.Server) error {
+		return srv.ListenAndServeTLS("", "")
+	})
 	return
 }
 
+// serve registers the given http.Server so that it is stopped by
+// Shutdown and starts it with the given function. It returns nil
+// if the http.Server has been shut down.
+func (s *Server) serve(srv *http.Server, start func(*http.Server) error) error {
+	s.mu.Lock()
+	s.httpServers = append(s.httpServers, srv)
+	s.mu.Unlock()
+	if err := start(srv); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown gracefully shuts down the HTTP servers started with Run, RunTLS
+// or RunAutoTLS. They first stop accepting new connections, then Shutdown
+// waits for the in-flight requests to complete or for ctx to expire, in which
+// case the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	servers := s.httpServers
+	s.httpServers = nil
+	s.mu.Unlock()
+	var res error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// logServerStopped logs that the server of the given kind stopped with the given error
+func logServerStopped(kind string, err error) {
+	if err != nil {
+		log.Error(fmt.Sprintf("%s server stopped", kind), "error", err)
+		return
+	}
+	log.Info(fmt.Sprintf("%s server stopped", kind))
+}
+
 // A RequestRPC is the message format expected from a client
 type RequestRPC struct {
 	JsonRPC string          `json:"jsonrpc"`
@@ -119,6 +175,7 @@ type JSONRPCErrorData struct {
 	Arguments     []string `json:"arguments"`
 	ExceptionType string   `json:"exception_type"`
 	Debug         string   `json:"debug"`
+	RequestID     string   `json:"request_id,omitempty"`
 }
 
 // JSONRPCError is the format of an Error in a ResponseError
@@ -140,12 +197,14 @@ func init() {
 	log = logging.GetLogger("server")
 	// Set to ReleaseMode now for tests and is overridden later (erp/cmd/server.go)
 	gin.SetMode(gin.ReleaseMode)
-	erpServer = &Server{gin.New()}
+	erpServer = &Server{Engine: gin.New()}
 	store := cookie.NewStore([]byte(">r&5#5T/sG-jnf=EW8$(WQX'-m2R6Gk*^qqr`CxEtG'wQ[/'G@`NYn^on?b!4G`9"),
 		[]byte("!WY9Q|}09!4Ke=@w0HS|]$u,p1f^k(5T"))
 	erpServer.Use(gin.Recovery())
+	erpServer.Use(wrapContextFuncs(requestIDMiddleware)...)
 	erpServer.Use(sessions.Sessions("erp-session", store))
 	erpServer.Use(logging.LogForGin(log))
+	erpServer.Use(wrapContextFuncs(tracingMiddleware)...)
 	erpServer.HTMLRender = templates.Registry
 }
 
@@ -170,8 +229,10 @@ func PreInitModules() {
 // This is typically all actions that need to be done after bootstrapping the models.
 // This function:
 // - runs successively all PostInit() func of all modules,
+// - generates the GraphQL schema if the GraphQL handler has been created.
 func PostInit() {
 	PostInitModules()
+	buildGraphQLSchema()
 }
 
 // PostInitModules calls successively all PostInit functions of all installed modules
@@ -182,3 +243,21 @@ func PostInitModules() {
 		}
 	}
 }
+
+// Shutdown runs all actions that need to be done when the server stops,
+// after the in-flight requests have been drained.
+//
+// This function runs successively all Shutdown() func of modules
+func Shutdown() {
+	ShutdownModules()
+}
+
+// ShutdownModules calls successively all Shutdown functions of all installed
+// modules, in the reverse order of their registration.
+func ShutdownModules() {
+	for i := len(Modules) - 1; i >= 0; i-- {
+		if Modules[i].Shutdown != nil {
+			Modules[i].Shutdown()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+// newTestServer returns a new Server with the request ID and session
+// middlewares, for testing middlewares and handlers without database.
+func newTestServer() *Server {
+	gin.SetMode(gin.ReleaseMode)
+	srv := &Server{Engine: gin.New()}
+	srv.Use(wrapContextFuncs(requestIDMiddleware)...)
+	srv.Use(sessions.Sessions("erp-session", cookie.NewStore([]byte("test-session-secret"))))
+	return srv
+}
+
+// performRequest executes a request with the given method, path, body and
+// headers on the given handler and returns the recorded response.
+func performRequest(h http.Handler, method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// memoryAPIKeyStore is an in-memory security.APIKeyStore for tests
+type memoryAPIKeyStore map[string]*security.APIKey
+
+func (m memoryAPIKeyStore) APIKey(id string) (*security.APIKey, bool) {
+	key, ok := m[id]
+	return key, ok
+}
+
+func (m memoryAPIKeyStore) UserAPIKeys(uid int64) []*security.APIKey {
+	var res []*security.APIKey
+	for _, key := range m {
+		if key.UID == uid {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+func (m memoryAPIKeyStore) SaveAPIKey(key *security.APIKey) error {
+	m[key.ID] = key
+	return nil
+}
+
+func (m memoryAPIKeyStore) DeleteAPIKey(id string) error {
+	delete(m, id)
+	return nil
+}
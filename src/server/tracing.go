@@ -0,0 +1,51 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/tracing"
+)
+
+// spanKey is the key of the span of the request in the Context
+const spanKey = "erp.span"
+
+// tracingMiddleware starts a span for each request, as a child of the span
+// given in the traceparent header if any. The span is the parent of the
+// spans of the Environments created with Context.ExecuteInNewEnvironment.
+//
+// It does nothing if tracing is disabled.
+func tracingMiddleware(c *Context) {
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+	span := tracing.StartRemoteSpan(c.GetHeader(tracing.TraceParentHeader), tracing.KindServer, fmt.Sprintf("%s %s", c.Request.Method, route))
+	if span == nil {
+		c.Next()
+		return
+	}
+	defer span.End()
+	span.SetAttribute("http.method", c.Request.Method)
+	span.SetAttribute("http.route", c.FullPath())
+	span.SetAttribute("http.target", c.Request.URL.RequestURI())
+	span.SetAttribute("erp.request_id", c.RequestID())
+	c.Set(spanKey, span)
+	c.Next()
+	status := c.Writer.Status()
+	span.SetAttribute("http.status_code", status)
+	if status >= 500 {
+		span.SetStatus(tracing.StatusError, fmt.Sprintf("HTTP status %d", status))
+	}
+}
+
+// Span returns the span of this request or nil if tracing is disabled
+func (c *Context) Span() *tracing.Span {
+	span, ok := c.Get(spanKey)
+	if !ok {
+		return nil
+	}
+	return span.(*tracing.Span)
+}
@@ -0,0 +1,304 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/server"
+	"github.com/Pedro-lmso-erp/pool/h"
+	"github.com/Pedro-lmso-erp/pool/q"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// memoryAPIKeyStore is an in-memory security.APIKeyStore for tests
+type memoryAPIKeyStore map[string]*security.APIKey
+
+func (m memoryAPIKeyStore) APIKey(id string) (*security.APIKey, bool) {
+	key, ok := m[id]
+	return key, ok
+}
+
+func (m memoryAPIKeyStore) UserAPIKeys(uid int64) []*security.APIKey {
+	var res []*security.APIKey
+	for _, key := range m {
+		if key.UID == uid {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+func (m memoryAPIKeyStore) SaveAPIKey(key *security.APIKey) error {
+	m[key.ID] = key
+	return nil
+}
+
+func (m memoryAPIKeyStore) DeleteAPIKey(id string) error {
+	delete(m, id)
+	return nil
+}
+
+// graphQLHandler is the GraphQL handler of the apiTestServer. It is created
+// at initialization so that the GraphQL schema is generated by RunTests.
+var graphQLHandler = server.GraphQL()
+
+// An apiTestServer is a server with the REST, GraphQL and JSON-RPC batch
+// routes authenticated with API keys, for testing the API handlers.
+type apiTestServer struct {
+	*server.Server
+	keys *security.APIKeyManager
+}
+
+// newAPITestServer returns a new apiTestServer
+func newAPITestServer() *apiTestServer {
+	gin.SetMode(gin.ReleaseMode)
+	srv := &apiTestServer{
+		Server: &server.Server{Engine: gin.New()},
+		keys:   security.NewAPIKeyManager(make(memoryAPIKeyStore)),
+	}
+	srv.Use(sessions.Sessions("erp-session", cookie.NewStore([]byte("test-session-secret"))))
+	api := srv.Group("/api/v1", server.ScopedBearerAuthentication(srv.keys))
+	api.GET("/:model", server.RESTSearch)
+	api.POST("/:model", server.RESTCreate)
+	api.GET("/:model/:id", server.RESTRead)
+	api.PATCH("/:model/:id", server.RESTUpdate)
+	api.DELETE("/:model/:id", server.RESTDelete)
+	api.POST("/:model/call/:method", server.RESTCall)
+	graphQL := srv.Group("/graphql", server.ScopedBearerAuthentication(srv.keys))
+	graphQL.GET("", graphQLHandler)
+	graphQL.POST("", graphQLHandler)
+	return srv
+}
+
+// token returns a new API key token for the user with the given uid
+func (srv *apiTestServer) token(uid int64) string {
+	token, _, err := srv.keys.Generate(uid, "test", time.Time{})
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+// request executes a request with the given method, path and body encoded
+// in JSON (if not nil) with the given API key token and returns the status
+// code and the decoded JSON response.
+func (srv *apiTestServer) request(token, method, path string, body interface{}) (int, map[string]interface{}) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			panic(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	var res map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+// recordNames returns the 'name' values of the given REST records list
+func recordNames(records interface{}) []string {
+	var res []string
+	for _, rec := range records.([]interface{}) {
+		res = append(res, rec.(map[string]interface{})["name"].(string))
+	}
+	return res
+}
+
+func TestREST(t *testing.T) {
+	srv := newAPITestServer()
+	admin := srv.token(security.SuperUserID)
+	tagsPath := "/api/v1/Tag"
+	Convey("Testing REST API", t, func() {
+		// Create test tags
+		var ids []int64
+		for _, name := range []string{"REST Tag B", "REST Tag A", "REST Tag C"} {
+			code, res := srv.request(admin, http.MethodPost, tagsPath, map[string]interface{}{"name": name, "rate": 5})
+			So(code, ShouldEqual, http.StatusCreated)
+			So(res["name"], ShouldEqual, name)
+			ids = append(ids, int64(res["id"].(float64)))
+		}
+		Reset(func() {
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				h.Tag().Search(env, q.Tag().Name().Contains("REST")).Unlink()
+			})
+		})
+		domain := url.QueryEscape(`[["name", "ilike", "REST Tag"]]`)
+		Convey("Unauthenticated requests should be refused", func() {
+			code, _ := srv.request("", http.MethodGet, tagsPath, nil)
+			So(code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Unknown models should return 404", func() {
+			code, _ := srv.request(admin, http.MethodGet, "/api/v1/UnknownModel", nil)
+			So(code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("Searching should filter, order and paginate records", func() {
+			code, res := srv.request(admin, http.MethodGet, tagsPath+"?domain="+domain+"&order=name", nil)
+			So(code, ShouldEqual, http.StatusOK)
+			So(res["count"], ShouldEqual, 3)
+			So(recordNames(res["records"]), ShouldResemble, []string{"REST Tag A", "REST Tag B", "REST Tag C"})
+			code, res = srv.request(admin, http.MethodGet, tagsPath+"?domain="+domain+"&order=name%20desc&limit=2&offset=1&fields=name", nil)
+			So(code, ShouldEqual, http.StatusOK)
+			So(res["count"], ShouldEqual, 3)
+			So(res["limit"], ShouldEqual, 2)
+			So(res["offset"], ShouldEqual, 1)
+			So(recordNames(res["records"]), ShouldResemble, []string{"REST Tag B", "REST Tag A"})
+			record := res["records"].([]interface{})[0].(map[string]interface{})
+			So(record, ShouldContainKey, "id")
+			So(record, ShouldNotContainKey, "rate")
+		})
+		Convey("Invalid search parameters should return 400", func() {
+			for _, query := range []string{"?domain=not-a-domain", "?order=unknown", "?order=name%20up", "?limit=0", "?offset=-1", "?fields=unknown"} {
+				code, res := srv.request(admin, http.MethodGet, tagsPath+query, nil)
+				So(code, ShouldEqual, http.StatusBadRequest)
+				So(res["error"], ShouldNotBeEmpty)
+			}
+		})
+		Convey("Records should be read, updated and deleted", func() {
+			recordPath := fmt.Sprintf("%s/%d", tagsPath, ids[0])
+			code, res := srv.request(admin, http.MethodGet, recordPath+"?fields=name,rate", nil)
+			So(code, ShouldEqual, http.StatusOK)
+			So(res["name"], ShouldEqual, "REST Tag B")
+			So(res["rate"], ShouldEqual, 5)
+			code, res = srv.request(admin, http.MethodPatch, recordPath, map[string]interface{}{"description": "Updated"})
+			So(code, ShouldEqual, http.StatusOK)
+			So(res["description"], ShouldEqual, "Updated")
+			So(res["name"], ShouldEqual, "REST Tag B")
+			code, _ = srv.request(admin, http.MethodDelete, recordPath, nil)
+			So(code, ShouldEqual, http.StatusNoContent)
+			code, _ = srv.request(admin, http.MethodGet, recordPath, nil)
+			So(code, ShouldEqual, http.StatusNotFound)
+			code, _ = srv.request(admin, http.MethodDelete, recordPath, nil)
+			So(code, ShouldEqual, http.StatusNotFound)
+			code, _ = srv.request(admin, http.MethodGet, tagsPath+"/abc", nil)
+			So(code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Invalid values should return 400", func() {
+			code, res := srv.request(admin, http.MethodPost, tagsPath, map[string]interface{}{"unknown": 1})
+			So(code, ShouldEqual, http.StatusBadRequest)
+			So(res["error"], ShouldContainSubstring, "unknown")
+		})
+		Convey("ORM errors should not be returned to the client", func() {
+			code, res := srv.request(admin, http.MethodPost, tagsPath, map[string]interface{}{"name": "REST Tag D", "rate": 12})
+			So(code, ShouldEqual, http.StatusInternalServerError)
+			So(res["error"], ShouldEqual, "internal server error")
+			So(res, ShouldContainKey, "request_id")
+			code, res = srv.request(admin, http.MethodGet, tagsPath+"?domain="+url.QueryEscape(`[["name", "=", "REST Tag D"]]`), nil)
+			So(code, ShouldEqual, http.StatusOK)
+			So(res["count"], ShouldEqual, 0)
+		})
+		Convey("Access rights and record rules should apply", func() {
+			group := security.Registry.NewGroup("rest_test", "REST Test")
+			security.Registry.AddMembership(2, group)
+			tagModel := models.Registry.MustGet("Tag")
+			tagModel.Methods().MustGet("Load").AllowGroup(group)
+			tagModel.Methods().MustGet("Create").AllowGroup(group)
+			tagModel.Methods().MustGet("Write").AllowGroup(group)
+			rules := []*models.RecordRule{{
+				Name:      "restReadTags",
+				Group:     group,
+				Condition: q.Tag().Name().Contains("REST").Condition,
+				Perms:     security.Read,
+			}, {
+				Name:      "restCreateTags",
+				Group:     group,
+				Condition: q.Tag().Name().Contains("REST").Condition,
+				Perms:     security.Create,
+			}, {
+				Name:      "restEditableDescription",
+				Group:     group,
+				Condition: q.Tag().Name().Contains("Editable").Condition,
+				Perms:     security.Write,
+				Fields:    models.FieldNames{tagModel.FieldName("Description")},
+			}}
+			for _, rule := range rules {
+				tagModel.AddRecordRule(rule)
+			}
+			Reset(func() {
+				for _, rule := range rules {
+					tagModel.RemoveRecordRule(rule.Name)
+				}
+				security.Registry.UnregisterGroup(group)
+			})
+			user := srv.token(2)
+			Convey("Users without access rights should get 403", func() {
+				code, res := srv.request(srv.token(99), http.MethodGet, tagsPath, nil)
+				So(code, ShouldEqual, http.StatusForbidden)
+				So(res["error"], ShouldEqual, "You are not allowed to execute this method")
+			})
+			Convey("Users should only see the records allowed by the rules", func() {
+				code, res := srv.request(user, http.MethodGet, tagsPath+"?fields=name", nil)
+				So(code, ShouldEqual, http.StatusOK)
+				So(res["count"], ShouldEqual, 3)
+				for _, name := range recordNames(res["records"]) {
+					So(name, ShouldContainSubstring, "REST")
+				}
+				var trendingID int64
+				So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+					trendingID = h.Tag().Search(env, q.Tag().Name().Equals("Trending")).ID()
+				}), ShouldBeNil)
+				code, _ = srv.request(user, http.MethodGet, fmt.Sprintf("%s/%d", tagsPath, trendingID), nil)
+				So(code, ShouldEqual, http.StatusNotFound)
+			})
+			Convey("Users should only create the records allowed by the rules", func() {
+				code, _ := srv.request(user, http.MethodPost, tagsPath, map[string]interface{}{"name": "REST Tag Editable"})
+				So(code, ShouldEqual, http.StatusCreated)
+				code, res := srv.request(user, http.MethodPost, tagsPath, map[string]interface{}{"name": "Other Tag"})
+				So(code, ShouldEqual, http.StatusForbidden)
+				So(res["error"], ShouldEqual, "You are not allowed to access these records")
+			})
+			Convey("Users should only write the fields allowed by the rules", func() {
+				recordPath := fmt.Sprintf("%s/%d", tagsPath, ids[1])
+				code, _ := srv.request(user, http.MethodPatch, recordPath, map[string]interface{}{"name": "REST Tag A2"})
+				So(code, ShouldEqual, http.StatusOK)
+				code, res := srv.request(user, http.MethodPatch, recordPath, map[string]interface{}{"description": "Forbidden"})
+				So(code, ShouldEqual, http.StatusForbidden)
+				So(res["error"], ShouldEqual, "You are not allowed to access these records")
+			})
+		})
+		Convey("Exposed methods should be called", func() {
+			models.Registry.MustGet("User").Methods().MustGet("PrefixedUser").Expose()
+			code, res := srv.request(admin, http.MethodGet, "/api/v1/User?fields=name&order=id&limit=1", nil)
+			So(code, ShouldEqual, http.StatusOK)
+			record := res["records"].([]interface{})[0].(map[string]interface{})
+			callPath := "/api/v1/User/call/PrefixedUser"
+			code, res = srv.request(admin, http.MethodPost, callPath, map[string]interface{}{
+				"ids":  []interface{}{record["id"]},
+				"args": []interface{}{"Hello"},
+			})
+			So(code, ShouldEqual, http.StatusOK)
+			So(res["result"], ShouldResemble, []interface{}{fmt.Sprintf("Hello: %s", record["name"])})
+			code, _ = srv.request(admin, http.MethodPost, callPath, map[string]interface{}{
+				"ids":  []interface{}{record["id"]},
+				"args": []interface{}{},
+			})
+			So(code, ShouldEqual, http.StatusBadRequest)
+			code, _ = srv.request(admin, http.MethodPost, callPath, map[string]interface{}{
+				"ids":  []interface{}{-1},
+				"args": []interface{}{"Hello"},
+			})
+			So(code, ShouldEqual, http.StatusNotFound)
+			code, _ = srv.request(admin, http.MethodPost, "/api/v1/User/call/RecursiveMethod", map[string]interface{}{})
+			So(code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package tests
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/pool/h"
+	"github.com/Pedro-lmso-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// graphQL executes the given GraphQL query with the given variables in a
+// POST request with the given API key token and returns the status code,
+// the data and the error messages of the response.
+func (srv *apiTestServer) graphQL(token, query string, variables map[string]interface{}) (int, map[string]interface{}, []string) {
+	code, res := srv.request(token, http.MethodPost, "/graphql", map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	})
+	data, _ := res["data"].(map[string]interface{})
+	return code, data, graphQLErrors(res)
+}
+
+// graphQLErrors returns the error messages of the given GraphQL response
+func graphQLErrors(res map[string]interface{}) []string {
+	var msgs []string
+	errs, _ := res["errors"].([]interface{})
+	for _, err := range errs {
+		msgs = append(msgs, err.(map[string]interface{})["message"].(string))
+	}
+	return msgs
+}
+
+func TestGraphQL(t *testing.T) {
+	srv := newAPITestServer()
+	admin := srv.token(security.SuperUserID)
+	Convey("Testing GraphQL API", t, func() {
+		// Create test records
+		var postID int64
+		tagIDs := make(map[string]int64)
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			parent := h.Tag().Create(env, h.Tag().NewData().SetName("GraphQL Parent").SetRate(8))
+			tags := h.Tag().Create(env, h.Tag().NewData().SetName("GraphQL Tag A").SetRate(3).SetParent(parent))
+			tags = tags.Union(h.Tag().Create(env, h.Tag().NewData().SetName("GraphQL Tag B").SetRate(6).SetParent(parent)))
+			for _, tag := range tags.Union(parent).Records() {
+				tagIDs[tag.Name()] = tag.ID()
+			}
+			user := h.User().Create(env, h.User().NewData().
+				SetName("GraphQL User").
+				SetEmail("graphql@example.com"))
+			post := h.Post().Create(env, h.Post().NewData().
+				SetTitle("GraphQL Post").
+				SetUser(user).
+				SetTags(tags))
+			postID = post.ID()
+		})
+		Reset(func() {
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				h.Post().Search(env, q.Post().Title().Contains("GraphQL")).Unlink()
+				h.User().Search(env, q.User().Name().Contains("GraphQL")).Unlink()
+				h.Tag().Search(env, q.Tag().Name().Contains("GraphQL")).Unlink()
+			})
+		})
+		Convey("Unauthenticated requests should be refused", func() {
+			code, _, errs := srv.graphQL("", "{ TagCount }", nil)
+			So(code, ShouldEqual, http.StatusUnauthorized)
+			So(errs, ShouldHaveLength, 1)
+		})
+		Convey("Search queries should filter, order and paginate records", func() {
+			code, data, errs := srv.graphQL(admin, `{
+				TagSearch(filter: {name: {like: "GraphQL Tag"}}, order: ["name desc"]) { name rate }
+				TagCount(filter: {name: {like: "GraphQL"}, rate: {gt: 5}})
+			}`, nil)
+			So(code, ShouldEqual, http.StatusOK)
+			So(errs, ShouldBeEmpty)
+			So(recordNames(data["TagSearch"]), ShouldResemble, []string{"GraphQL Tag B", "GraphQL Tag A"})
+			So(data["TagCount"], ShouldEqual, 2)
+			_, data, errs = srv.graphQL(admin, `{
+				TagSearch(filter: {name: {like: "GraphQL"}, or: [{name: {eq: "GraphQL Tag A"}}, {rate: {gte: 8}}], not: {parent_id: {isNull: false}}}) { name }
+			}`, nil)
+			So(errs, ShouldBeEmpty)
+			So(recordNames(data["TagSearch"]), ShouldResemble, []string{"GraphQL Parent"})
+			_, data, errs = srv.graphQL(admin, `{
+				TagSearch(filter: {name: {like: "GraphQL"}}, order: ["name"], limit: 1, offset: 1) { name }
+			}`, nil)
+			So(errs, ShouldBeEmpty)
+			So(recordNames(data["TagSearch"]), ShouldResemble, []string{"GraphQL Tag A"})
+		})
+		Convey("Records should be read by their id, given as a number or a string", func() {
+			query := `query($id: Int64!) { Tag(id: $id) { id name } }`
+			_, data, errs := srv.graphQL(admin, query, map[string]interface{}{"id": tagIDs["GraphQL Tag A"]})
+			So(errs, ShouldBeEmpty)
+			tag := data["Tag"].(map[string]interface{})
+			So(tag["id"], ShouldEqual, tagIDs["GraphQL Tag A"])
+			So(tag["name"], ShouldEqual, "GraphQL Tag A")
+			_, data, errs = srv.graphQL(admin, query, map[string]interface{}{"id": strconv.FormatInt(tagIDs["GraphQL Tag B"], 10)})
+			So(errs, ShouldBeEmpty)
+			So(data["Tag"].(map[string]interface{})["name"], ShouldEqual, "GraphQL Tag B")
+			_, data, errs = srv.graphQL(admin, query, map[string]interface{}{"id": int64(1) << 40})
+			So(errs, ShouldBeEmpty)
+			So(data["Tag"], ShouldBeNil)
+		})
+		Convey("Relation fields should resolve to the related records", func() {
+			_, data, errs := srv.graphQL(admin, `query($id: Int64!) {
+				Post(id: $id) {
+					title
+					user_id { name posts_ids { title } }
+					tags_ids { name parent_id { name } }
+				}
+			}`, map[string]interface{}{"id": postID})
+			So(errs, ShouldBeEmpty)
+			post := data["Post"].(map[string]interface{})
+			So(post["title"], ShouldEqual, "GraphQL Post")
+			user := post["user_id"].(map[string]interface{})
+			So(user["name"], ShouldEqual, "GraphQL User")
+			So(user["posts_ids"], ShouldHaveLength, 1)
+			tags := post["tags_ids"].([]interface{})
+			So(recordNames(tags), ShouldResemble, []string{"GraphQL Tag A", "GraphQL Tag B"})
+			for _, tag := range tags {
+				So(tag.(map[string]interface{})["parent_id"].(map[string]interface{})["name"], ShouldEqual, "GraphQL Parent")
+			}
+		})
+		Convey("Mutations should create, update and delete records", func() {
+			_, data, errs := srv.graphQL(admin, `mutation {
+				TagCreate(values: {name: "GraphQL New", rate: 2}) { id name }
+			}`, nil)
+			So(errs, ShouldBeEmpty)
+			id := data["TagCreate"].(map[string]interface{})["id"]
+			_, data, errs = srv.graphQL(admin, `mutation($id: Int64!) {
+				TagUpdate(id: $id, values: {description: "Updated"}) { name description }
+			}`, map[string]interface{}{"id": id})
+			So(errs, ShouldBeEmpty)
+			So(data["TagUpdate"].(map[string]interface{})["description"], ShouldEqual, "Updated")
+			_, data, errs = srv.graphQL(admin, `mutation($id: Int64!) { TagDelete(id: $id) }`, map[string]interface{}{"id": id})
+			So(errs, ShouldBeEmpty)
+			So(data["TagDelete"], ShouldBeTrue)
+		})
+		Convey("Requests with errors should roll back all their mutations", func() {
+			code, data, errs := srv.graphQL(admin, `mutation {
+				first: TagCreate(values: {name: "GraphQL Rollback", rate: 2}) { id }
+				second: TagUpdate(id: `+strconv.FormatInt(tagIDs["GraphQL Tag A"], 10)+`, values: {rate: 12}) { id }
+			}`, nil)
+			So(code, ShouldEqual, http.StatusOK)
+			So(data, ShouldBeNil)
+			So(errs, ShouldNotBeEmpty)
+			So(errs[len(errs)-1], ShouldContainSubstring, "rolled back")
+			_, data, _ = srv.graphQL(admin, `{ TagCount(filter: {name: {eq: "GraphQL Rollback"}}) }`, nil)
+			So(data["TagCount"], ShouldEqual, 0)
+		})
+		Convey("Mutations should be refused in GET requests", func() {
+			query := url.QueryEscape(`mutation { TagCreate(values: {name: "GraphQL Get", rate: 2}) { id } }`)
+			code, res := srv.request(admin, http.MethodGet, "/graphql?query="+query, nil)
+			So(code, ShouldEqual, http.StatusOK)
+			So(graphQLErrors(res), ShouldNotBeEmpty)
+			So(graphQLErrors(res)[0], ShouldContainSubstring, "not allowed in GET requests")
+			code, res = srv.request(admin, http.MethodGet, "/graphql?query="+url.QueryEscape(`{ TagCount(filter: {name: {like: "GraphQL"}}) }`), nil)
+			So(code, ShouldEqual, http.StatusOK)
+			So(res["data"].(map[string]interface{})["TagCount"], ShouldEqual, 3)
+		})
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Pedro-lmso-erp/erp/src/models"
+	"github.com/Pedro-lmso-erp/erp/src/models/security"
+	"github.com/Pedro-lmso-erp/erp/src/server"
+	"github.com/Pedro-lmso-erp/pool/h"
+	"github.com/Pedro-lmso-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRPCBatchTransactions(t *testing.T) {
+	// Calls of batches are served by the global server
+	path := "/test/rpc/tags"
+	server.GetServer().Group(path, server.RPCBatch(10)).POST("", func(c *server.Context) {
+		var params struct {
+			Name string  `json:"name"`
+			Rate float32 `json:"rate"`
+		}
+		c.BindRPCParams(&params)
+		if c.IsAborted() {
+			return
+		}
+		var txID int64
+		err := c.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.Tag().Create(env, h.Tag().NewData().SetName(params.Name).SetRate(params.Rate))
+			env.Cr().Get(&txID, "SELECT txid_current()")
+		})
+		c.RPC(http.StatusOK, txID, err)
+	})
+	Convey("Testing transactions of JSON-RPC batch requests", t, func() {
+		Reset(func() {
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				h.Tag().Search(env, q.Tag().Name().Contains("Batch Tag")).Unlink()
+			})
+		})
+		// post sends a batch creating tags with the given rates and returns the
+		// responses. All the calls are executed in a single transaction if shared.
+		post := func(shared bool, rates ...float32) []map[string]interface{} {
+			var calls []interface{}
+			for i, rate := range rates {
+				calls = append(calls, map[string]interface{}{
+					"jsonrpc": "2.0",
+					"id":      i + 1,
+					"params":  map[string]interface{}{"name": "Batch Tag " + string(rune('A'+i)), "rate": rate},
+				})
+			}
+			body, _ := json.Marshal(calls)
+			req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if shared {
+				req.Header.Set(server.RPCBatchTransactionHeader, server.RPCBatchSharedTransaction)
+			}
+			w := httptest.NewRecorder()
+			server.GetServer().ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var responses []map[string]interface{}
+			So(json.Unmarshal(w.Body.Bytes(), &responses), ShouldBeNil)
+			So(responses, ShouldHaveLength, len(rates))
+			return responses
+		}
+		// tagNames returns the names of the tags created by the batches
+		tagNames := func() []string {
+			var res []string
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				for _, tag := range h.Tag().Search(env, q.Tag().Name().Contains("Batch Tag")).OrderBy("Name").Records() {
+					res = append(res, tag.Name())
+				}
+			})
+			return res
+		}
+		Convey("Calls should be executed in their own transaction by default", func() {
+			responses := post(false, 1, 12, 3)
+			So(responses[0]["result"], ShouldNotEqual, responses[2]["result"])
+			So(responses[1], ShouldContainKey, "error")
+			So(tagNames(), ShouldResemble, []string{"Batch Tag A", "Batch Tag C"})
+		})
+		Convey("Calls should share a transaction with the shared header", func() {
+			responses := post(true, 1, 2, 3)
+			So(responses[0]["result"], ShouldEqual, responses[1]["result"])
+			So(responses[1]["result"], ShouldEqual, responses[2]["result"])
+			So(tagNames(), ShouldResemble, []string{"Batch Tag A", "Batch Tag B", "Batch Tag C"})
+		})
+		Convey("Failed calls in a shared transaction should only roll back their changes", func() {
+			responses := post(true, 1, 12, 3)
+			So(responses[0], ShouldContainKey, "result")
+			So(responses[1], ShouldContainKey, "error")
+			So(responses[1], ShouldNotContainKey, "result")
+			So(responses[2]["result"], ShouldEqual, responses[0]["result"])
+			So(tagNames(), ShouldResemble, []string{"Batch Tag A", "Batch Tag C"})
+		})
+	})
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package cron parses cron expressions and computes their activation times.
+//
+// A cron expression has five space separated fields:
+//
+//	minute  hour  day-of-month  month  day-of-week
+//	 0-59   0-23      1-31       1-12      0-7
+//
+// Each field is either '*' or a comma separated list of values or ranges
+// ('a-b'), optionally followed by a step ('*/15', '0-30/10'). Months and
+// days of week can also be given by their three letter English names
+// (JAN-DEC, SUN-SAT). Both 0 and 7 are Sunday. When both the day of month
+// and the day of week are restricted, a day matches if either matches.
+//
+// The following descriptors are also accepted: @yearly (or @annually),
+// @monthly, @weekly, @daily (or @midnight) and @hourly.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxYears is the number of years searched for an activation time
+const maxYears = 5
+
+// descriptors are the shortcuts for common cron expressions
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// monthNames are the names that can be used in the month field
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// dayNames are the names that can be used in the day of week field
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// A field describes the allowed values of a field of a cron expression
+type field struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+// fields are the fields of a cron expression in order
+var fields = [5]field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: monthNames},
+	{name: "day of week", min: 0, max: 7, names: dayNames},
+}
+
+// A bitSet holds the matching values of a field
+type bitSet uint64
+
+// has returns true if the given value is in this bitSet
+func (b bitSet) has(value int) bool {
+	return b&(1<<uint(value)) != 0
+}
+
+// A Schedule is a parsed cron expression
+type Schedule struct {
+	spec    string
+	minute  bitSet
+	hour    bitSet
+	dom     bitSet
+	month   bitSet
+	dow     bitSet
+	domStar bool
+	dowStar bool
+}
+
+// Parse returns the Schedule of the given cron expression
+func Parse(spec string) (*Schedule, error) {
+	expr := strings.TrimSpace(spec)
+	if strings.HasPrefix(expr, "@") {
+		var ok bool
+		expr, ok = descriptors[strings.ToLower(expr)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cron descriptor '%s'", spec)
+		}
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron expression '%s' must have %d fields, got %d", spec, len(fields), len(parts))
+	}
+	var sets [5]bitSet
+	for i, part := range parts {
+		set, err := fields[i].parse(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression '%s': %s", spec, err)
+		}
+		sets[i] = set
+	}
+	// 7 is also Sunday
+	if sets[4].has(7) {
+		sets[4] |= 1
+	}
+	return &Schedule{
+		spec:    spec,
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// MustParse returns the Schedule of the given cron expression.
+// It panics if the expression is invalid.
+func MustParse(spec string) *Schedule {
+	s, err := Parse(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// parse returns the bitSet of the given expression of this field
+func (f field) parse(expr string) (bitSet, error) {
+	var res bitSet
+	for _, item := range strings.Split(expr, ",") {
+		rangeExpr, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			rangeExpr = item[:i]
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step '%s' in %s field", item[i+1:], f.name)
+			}
+		}
+		start, end := f.min, f.max
+		switch {
+		case rangeExpr == "*":
+		case strings.Contains(rangeExpr, "-"):
+			bounds := strings.SplitN(rangeExpr, "-", 2)
+			var err error
+			if start, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if end, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range '%s' in %s field", rangeExpr, f.name)
+			}
+		default:
+			var err error
+			if start, err = f.value(rangeExpr); err != nil {
+				return 0, err
+			}
+			end = start
+			if step > 1 {
+				// 'a/n' means from a to max every n
+				end = f.max
+			}
+		}
+		for v := start; v <= end; v += step {
+			res |= 1 << uint(v)
+		}
+	}
+	if res == 0 {
+		return 0, fmt.Errorf("empty %s field", f.name)
+	}
+	return res, nil
+}
+
+// value returns the numeric value of the given value expression of this field
+func (f field) value(expr string) (int, error) {
+	if v, ok := f.names[strings.ToLower(expr)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(expr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s' in %s field", expr, f.name)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range [%d-%d] in %s field", v, f.min, f.max, f.name)
+	}
+	return v, nil
+}
+
+// String returns the cron expression of this Schedule
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Next returns the first activation time of this Schedule strictly after t,
+// in the location of t. It returns the zero time if there is no activation
+// time in the next years, e.g. for February 30th.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	yearLimit := t.Year() + maxYears
+	for t.Year() <= yearLimit {
+		switch {
+		case !s.month.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !s.hour.has(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !s.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches returns true if the day of t matches the day of
+// month and day of week fields of this Schedule.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom.has(t.Day())
+	dowMatch := s.dow.has(int(t.Weekday()))
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
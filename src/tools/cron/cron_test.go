@@ -0,0 +1,56 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package cron
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCron(t *testing.T) {
+	Convey("Testing cron expressions parsing", t, func() {
+		for _, spec := range []string{"* * * * *", "*/5 0-6,22,23 1 JAN-mar mon-FRI", "0 12 * * 7", "@daily", "@Hourly", "5/15 * * * *"} {
+			_, err := Parse(spec)
+			So(err, ShouldBeNil)
+		}
+		for _, spec := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+			"* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "@never"} {
+			_, err := Parse(spec)
+			So(err, ShouldNotBeNil)
+		}
+		So(func() { MustParse("* * *") }, ShouldPanic)
+		So(MustParse("@weekly").String(), ShouldEqual, "@weekly")
+	})
+	Convey("Testing cron activation times", t, func() {
+		base := time.Date(2020, time.March, 14, 10, 27, 42, 0, time.UTC)
+		next := func(spec string, from time.Time) time.Time {
+			return MustParse(spec).Next(from)
+		}
+		So(next("* * * * *", base), ShouldEqual, time.Date(2020, time.March, 14, 10, 28, 0, 0, time.UTC))
+		So(next("*/15 * * * *", base), ShouldEqual, time.Date(2020, time.March, 14, 10, 30, 0, 0, time.UTC))
+		So(next("5/15 * * * *", base), ShouldEqual, time.Date(2020, time.March, 14, 10, 35, 0, 0, time.UTC))
+		So(next("0 9 * * *", base), ShouldEqual, time.Date(2020, time.March, 15, 9, 0, 0, 0, time.UTC))
+		So(next("@hourly", base), ShouldEqual, time.Date(2020, time.March, 14, 11, 0, 0, 0, time.UTC))
+		So(next("@monthly", base), ShouldEqual, time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC))
+		So(next("@yearly", base), ShouldEqual, time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC))
+		// March 14th 2020 is a Saturday
+		So(next("0 0 * * mon", base), ShouldEqual, time.Date(2020, time.March, 16, 0, 0, 0, 0, time.UTC))
+		So(next("0 0 * * 7", base), ShouldEqual, time.Date(2020, time.March, 15, 0, 0, 0, 0, time.UTC))
+		So(next("0 0 20 * mon", base), ShouldEqual, time.Date(2020, time.March, 16, 0, 0, 0, 0, time.UTC))
+		So(next("0 0 29 2 *", base), ShouldEqual, time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC))
+		So(next("0 0 30 2 *", base).IsZero(), ShouldBeTrue)
+		So(next("27 10 * * *", time.Date(2020, time.March, 14, 10, 27, 0, 0, time.UTC)),
+			ShouldEqual, time.Date(2020, time.March, 15, 10, 27, 0, 0, time.UTC))
+	})
+	Convey("Testing cron activation times across DST changes", t, func() {
+		paris, err := time.LoadLocation("Europe/Paris")
+		So(err, ShouldBeNil)
+		// Clocks go from 02:00 to 03:00 on March 29th 2020 in Paris
+		next := MustParse("30 2 * * *").Next(time.Date(2020, time.March, 28, 12, 0, 0, 0, paris))
+		So(next.Equal(time.Date(2020, time.March, 28, 2, 30, 0, 0, paris)), ShouldBeFalse)
+		So(next.After(time.Date(2020, time.March, 29, 0, 0, 0, 0, paris)), ShouldBeTrue)
+	})
+}
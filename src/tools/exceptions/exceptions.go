@@ -11,6 +11,9 @@ import "fmt"
 type UserError struct {
 	Message string
 	Debug   string
+	// Err is the error value of the panic this UserError
+	// has been created from, if any.
+	Err error
 }
 
 // Error method for the UserError type.
@@ -18,3 +21,8 @@ type UserError struct {
 func (u UserError) Error() string {
 	return fmt.Sprintf("%s\n----------------------------------\n%s", u.Message, u.Debug)
 }
+
+// Unwrap returns the error this UserError has been created from, if any.
+func (u UserError) Unwrap() error {
+	return u.Err
+}
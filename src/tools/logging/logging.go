@@ -16,6 +16,7 @@ package logging
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -181,15 +182,53 @@ func GetLogger(moduleName string) Logger {
 // LogAndPanic so that unwanted panics can still be logged with
 // this function.
 func LogPanicData(panicData interface{}) error {
+	return logPanicData(log, panicData)
+}
+
+// LogPanicDataWith is the same as LogPanicData but logs with the given
+// logger, e.g. a logger with the request ID of the current request.
+func LogPanicDataWith(logger Logger, panicData interface{}) error {
+	return logPanicData(logger, panicData)
+}
+
+// logPanicData logs the panic data with the given logger and returns an
+// error with the panic message and the stacktrace of the caller. If the
+// panic data is an error, it is wrapped in the returned error.
+func logPanicData(logger Logger, panicData interface{}) error {
 	msg := fmt.Sprintf("%v", panicData)
-	log.Error("erp panicked", "msg", msg)
+	logger.Error("erp panicked", "msg", msg)
 
-	stackTrace := stack(1)
+	stackTrace := stack(2)
 	fullMsg := fmt.Sprintf("%s\n\n%s", msg, stackTrace)
+	err, _ := panicData.(error)
 	return exceptions.UserError{
 		Message: msg,
 		Debug:   fullMsg,
+		Err:     err,
+	}
+}
+
+// requestIDKey is the key of the request ID in a context.Context
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx holding the given request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request ID held by ctx or an empty string if none
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// ForRequest returns a child of the given logger that adds the given
+// request ID to all its messages. It returns logger if requestID is empty.
+func ForRequest(logger Logger, requestID string) Logger {
+	if requestID == "" {
+		return logger
 	}
+	return logger.New("request_id", requestID)
 }
 
 // stack returns a nicely formated stack frame, skipping skip frames
@@ -269,7 +308,7 @@ func LogForGin(logger Logger) gin.HandlerFunc {
 
 		status := c.Writer.Status()
 
-		ctxLogger := logger.New(
+		ctxLogger := ForRequest(logger, RequestID(c.Request.Context())).New(
 			"status", status,
 			"method", c.Request.Method,
 			"path", path,
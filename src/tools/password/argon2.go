@@ -0,0 +1,70 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package password
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2KeyLen = 32
+
+var (
+	// Argon2Time is the number of passes over the memory when hashing with Argon2id
+	Argon2Time uint32 = 1
+	// Argon2Memory is the memory in KiB used when hashing with Argon2id
+	Argon2Memory uint32 = 64 * 1024
+	// Argon2Threads is the number of threads used when hashing with Argon2id
+	Argon2Threads uint8 = 4
+)
+
+// argon2Params are the cost parameters of an Argon2id hash
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// currentArgon2Params returns the parameters used to hash new passwords
+func currentArgon2Params() argon2Params {
+	return argon2Params{
+		memory:  Argon2Memory,
+		time:    Argon2Time,
+		threads: Argon2Threads,
+	}
+}
+
+// hashArgon2id returns the formatted Argon2id hash of the given password
+func hashArgon2id(password string, salt []byte, params argon2Params) string {
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, argon2KeyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version,
+		params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// parseArgon2id returns the parameters and the salt of the
+// given split Argon2id hash or an error if it is malformed.
+func parseArgon2id(parts []string) (argon2Params, []byte, error) {
+	var params argon2Params
+	if len(parts) != 5 {
+		return params, nil, fmt.Errorf("%w: expected 5 fields in %s hash", ErrMalformedHash, Argon2id)
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[1], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, fmt.Errorf("%w: unsupported version %q", ErrMalformedHash, parts[1])
+	}
+	if _, err := fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, fmt.Errorf("%w: invalid parameters %q", ErrMalformedHash, parts[2])
+	}
+	if params.memory == 0 || params.time == 0 || params.threads == 0 {
+		return params, nil, fmt.Errorf("%w: invalid parameters %q", ErrMalformedHash, parts[2])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(salt) == 0 || parts[4] == "" {
+		return params, nil, fmt.Errorf("%w: invalid salt", ErrMalformedHash)
+	}
+	return params, salt, nil
+}
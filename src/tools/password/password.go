@@ -1,8 +1,15 @@
 // Copyright 2020 NDP Systèmes. All Rights Reserved.
 // See LICENSE file for full licensing details.
 
-// Package password provides functions to Hash and Verify PBKDF2/SHA256 passwords.
-// The hashes are in '$pbkdf2-sha256$<N iter>$<salt>$<key>' format.
+// Package password provides functions to Hash and Verify passwords.
+//
+// Two algorithms are supported:
+// - PBKDF2/SHA512 with hashes in '$pbkdf2-sha512$<N iter>$<salt>$<key>' format,
+// - Argon2id with hashes in '$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>' format.
+//
+// New hashes are computed with the DefaultAlgorithm. Use NeedsRehash (or
+// VerifyAndRehash) at login to transparently upgrade hashes computed with
+// another algorithm or weaker parameters.
 package password
 
 import (
@@ -10,6 +17,7 @@ import (
 	"crypto/sha512"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -17,46 +25,135 @@ import (
 	"golang.org/x/crypto/pbkdf2"
 )
 
+// An Algorithm is a password hashing algorithm
+type Algorithm string
+
+// Supported password hashing algorithms
+const (
+	PBKDF2SHA512 Algorithm = "pbkdf2-sha512"
+	Argon2id     Algorithm = "argon2id"
+)
+
 const (
 	saltLen        = 16
 	keyLen         = 64
 	encodePassword = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./"
 )
 
-// Iterations is the number of iterations used when hashing a password
-var Iterations = 25000
+var (
+	// ErrMismatch is returned by Verify when the password does not match the hash
+	ErrMismatch = errors.New("password does not match")
+	// ErrMalformedHash is returned by Verify when the hash cannot be parsed
+	ErrMalformedHash = errors.New("malformed password hash")
+)
 
-// Hash returns a hashed string password in PBKDF2/SHA256 format
-func Hash(password string) (string, error) {
-	encoding := base64.NewEncoding(encodePassword).WithPadding(base64.NoPadding)
-	randByte := make([]byte, saltLen)
+var (
+	// DefaultAlgorithm is the algorithm used to hash new passwords
+	DefaultAlgorithm = PBKDF2SHA512
+	// Iterations is the number of iterations used when hashing a password with PBKDF2
+	Iterations = 25000
+)
 
-	_, err := rand.Read(randByte)
-	if err != nil {
+// Hash returns the hash of the given password with the DefaultAlgorithm
+func Hash(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
 		return "", err
 	}
-	salt := make([]byte, encoding.EncodedLen(saltLen))
-	encoding.Encode(salt, randByte)
-	dk := pbkdf2.Key([]byte(password), salt, Iterations, keyLen, sha512.New)
+	switch DefaultAlgorithm {
+	case PBKDF2SHA512:
+		return hashPBKDF2(password, salt), nil
+	case Argon2id:
+		return hashArgon2id(password, salt, currentArgon2Params()), nil
+	}
+	return "", fmt.Errorf("unknown password hashing algorithm %s", DefaultAlgorithm)
+}
+
+// Verify returns nil if the given password matches the given hash, ErrMismatch
+// if it does not, and an error wrapping ErrMalformedHash if the hash is not valid.
+func Verify(password, hash string) error {
+	parts := strings.Split(strings.TrimPrefix(hash, "$"), "$")
+	var expected string
+	switch Algorithm(parts[0]) {
+	case PBKDF2SHA512:
+		iter, err := parsePBKDF2(parts)
+		if err != nil {
+			return err
+		}
+		expected = pbkdf2Hash(password, []byte(parts[2]), iter)
+	case Argon2id:
+		params, salt, err := parseArgon2id(parts)
+		if err != nil {
+			return err
+		}
+		expected = hashArgon2id(password, salt, params)
+	default:
+		return fmt.Errorf("%w: unknown algorithm %q", ErrMalformedHash, parts[0])
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 0 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// NeedsRehash returns true if the given hash has not been computed with the
+// DefaultAlgorithm and its current parameters, and should be replaced by a new
+// hash of the password. Malformed hashes always need rehash.
+func NeedsRehash(hash string) bool {
+	parts := strings.Split(strings.TrimPrefix(hash, "$"), "$")
+	if Algorithm(parts[0]) != DefaultAlgorithm {
+		return true
+	}
+	switch DefaultAlgorithm {
+	case PBKDF2SHA512:
+		iter, err := parsePBKDF2(parts)
+		return err != nil || iter != Iterations
+	case Argon2id:
+		params, _, err := parseArgon2id(parts)
+		return err != nil || params != currentArgon2Params()
+	}
+	return true
+}
 
-	hashedPW := fmt.Sprintf("$pbkdf2-sha512$%d$%s$%s", Iterations, string(salt), encoding.EncodeToString(dk))
-	return hashedPW, nil
+// VerifyAndRehash verifies the given password against the given hash like
+// Verify. If the password matches and the hash needs rehash, it returns the
+// new hash of the password that should be stored instead, otherwise it
+// returns an empty string.
+func VerifyAndRehash(password, hash string) (string, error) {
+	if err := Verify(password, hash); err != nil {
+		return "", err
+	}
+	if !NeedsRehash(hash) {
+		return "", nil
+	}
+	return Hash(password)
 }
 
-// Verify returns true if the given password matches with the given hash.
-func Verify(password, hash string) bool {
+// hashPBKDF2 returns the PBKDF2/SHA512 hash of the given password with a
+// salt encoded from the given random bytes.
+func hashPBKDF2(password string, randBytes []byte) string {
 	encoding := base64.NewEncoding(encodePassword).WithPadding(base64.NoPadding)
-	split := strings.Split(strings.TrimPrefix(hash, "$"), "$")
-	salt := []byte(split[2])
-	iter, _ := strconv.Atoi(split[1])
+	salt := make([]byte, encoding.EncodedLen(len(randBytes)))
+	encoding.Encode(salt, randBytes)
+	return pbkdf2Hash(password, salt, Iterations)
+}
 
+// pbkdf2Hash returns the formatted PBKDF2/SHA512 hash of the given password
+func pbkdf2Hash(password string, salt []byte, iter int) string {
+	encoding := base64.NewEncoding(encodePassword).WithPadding(base64.NoPadding)
 	dk := pbkdf2.Key([]byte(password), salt, iter, keyLen, sha512.New)
+	return fmt.Sprintf("$%s$%d$%s$%s", PBKDF2SHA512, iter, string(salt), encoding.EncodeToString(dk))
+}
 
-	hashedPW := fmt.Sprintf("$pbkdf2-sha512$%d$%s$%s", iter, string(salt), encoding.EncodeToString(dk))
-
-	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashedPW)) == 0 {
-		return false
+// parsePBKDF2 returns the number of iterations of the given
+// split PBKDF2 hash or an error if it is malformed.
+func parsePBKDF2(parts []string) (int, error) {
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return 0, fmt.Errorf("%w: expected 4 fields in %s hash", ErrMalformedHash, PBKDF2SHA512)
 	}
-
-	return true
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return 0, fmt.Errorf("%w: invalid iterations %q", ErrMalformedHash, parts[1])
+	}
+	return iter, nil
 }
@@ -4,6 +4,8 @@
 package password
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -16,12 +18,133 @@ func TestPasswords(t *testing.T) {
 			var err error
 			hashed, err = Hash("secret")
 			So(err, ShouldBeNil)
+			So(hashed, ShouldStartWith, "$pbkdf2-sha512$25000$")
 		})
 		Convey("Verifying the password should work", func() {
-			So(Verify("secret", hashed), ShouldBeTrue)
+			So(Verify("secret", hashed), ShouldBeNil)
 		})
 		Convey("Verifiying with wrong password should fail", func() {
-			So(Verify("wrong-password", hashed), ShouldBeFalse)
+			So(Verify("wrong-password", hashed), ShouldEqual, ErrMismatch)
+		})
+		Convey("Verifying with malformed hashes should return an error", func() {
+			for _, hash := range []string{
+				"",
+				"$",
+				"$pbkdf2-sha512",
+				"$pbkdf2-sha512$25000",
+				"$pbkdf2-sha512$abc$salt$key",
+				"$pbkdf2-sha512$-1$salt$key",
+				"$argon2id$v=19$m=65536,t=1,p=4$c2FsdA",
+				"$argon2id$v=18$m=65536,t=1,p=4$c2FsdA$key",
+				"$argon2id$v=19$m=0,t=1,p=4$c2FsdA$key",
+				"$argon2id$v=19$m=65536,t=1,p=4$!!!$key",
+				"$md5$salt$key",
+			} {
+				err := Verify("secret", hash)
+				So(err, ShouldNotBeNil)
+				So(errors.Is(err, ErrMalformedHash), ShouldBeTrue)
+			}
+		})
+	})
+	Convey("Testing Argon2id hashes", t, func() {
+		defer func(algo Algorithm, memory uint32) {
+			DefaultAlgorithm = algo
+			Argon2Memory = memory
+		}(DefaultAlgorithm, Argon2Memory)
+		DefaultAlgorithm = Argon2id
+		Argon2Memory = 1024
+		hashed, err := Hash("secret")
+		So(err, ShouldBeNil)
+		So(hashed, ShouldStartWith, "$argon2id$v=19$m=1024,t=1,p=4$")
+		So(Verify("secret", hashed), ShouldBeNil)
+		So(Verify("wrong-password", hashed), ShouldEqual, ErrMismatch)
+		So(NeedsRehash(hashed), ShouldBeFalse)
+		Argon2Memory = 2048
+		So(NeedsRehash(hashed), ShouldBeTrue)
+		So(Verify("secret", hashed), ShouldBeNil)
+	})
+	Convey("Testing hash upgrades", t, func() {
+		defer func(algo Algorithm, iter int, memory uint32) {
+			DefaultAlgorithm = algo
+			Iterations = iter
+			Argon2Memory = memory
+		}(DefaultAlgorithm, Iterations, Argon2Memory)
+		Argon2Memory = 1024
+		Iterations = 1000
+		oldHash, _ := Hash("secret")
+		So(NeedsRehash(oldHash), ShouldBeFalse)
+		Convey("Increasing iterations should require rehash", func() {
+			Iterations = 2000
+			So(NeedsRehash(oldHash), ShouldBeTrue)
+			newHash, err := VerifyAndRehash("secret", oldHash)
+			So(err, ShouldBeNil)
+			So(newHash, ShouldStartWith, "$pbkdf2-sha512$2000$")
+			So(NeedsRehash(newHash), ShouldBeFalse)
+			noHash, err := VerifyAndRehash("secret", newHash)
+			So(err, ShouldBeNil)
+			So(noHash, ShouldBeEmpty)
+		})
+		Convey("Changing the default algorithm should require rehash", func() {
+			DefaultAlgorithm = Argon2id
+			So(NeedsRehash(oldHash), ShouldBeTrue)
+			newHash, err := VerifyAndRehash("secret", oldHash)
+			So(err, ShouldBeNil)
+			So(newHash, ShouldStartWith, "$argon2id$")
+		})
+		Convey("Wrong passwords should not be rehashed", func() {
+			Iterations = 2000
+			newHash, err := VerifyAndRehash("wrong-password", oldHash)
+			So(err, ShouldEqual, ErrMismatch)
+			So(newHash, ShouldBeEmpty)
+		})
+		Convey("Malformed hashes should require rehash", func() {
+			So(NeedsRehash("$pbkdf2-sha512$abc"), ShouldBeTrue)
+			So(NeedsRehash(""), ShouldBeTrue)
+		})
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	Convey("Testing password policy", t, func() {
+		policy := Policy{
+			MinLength:        10,
+			MinClasses:       3,
+			BreachedListFile: "testdata/breached.txt",
+		}
+		Convey("Compliant passwords should be accepted", func() {
+			So(policy.Check("correct-Horse-battery"), ShouldBeNil)
+			So(policy.Check("Ünïcödé-pass1"), ShouldBeNil)
+		})
+		Convey("Short passwords should be rejected", func() {
+			err := policy.Check("aB1-")
+			So(err, ShouldHaveSameTypeAs, PolicyError{})
+			So(err.(PolicyError), ShouldHaveLength, 1)
+			So(err.Error(), ShouldContainSubstring, "at least 10 characters")
+		})
+		Convey("Passwords with too few character classes should be rejected", func() {
+			err := policy.Check("onlylowercaseletters")
+			So(err, ShouldHaveSameTypeAs, PolicyError{})
+			So(err.Error(), ShouldContainSubstring, "lowercase letters")
+			err = policy.Check("short")
+			So(err.(PolicyError), ShouldHaveLength, 2)
+		})
+		Convey("Breached passwords should be rejected", func() {
+			policy.MinLength = 0
+			policy.MinClasses = 0
+			So(policy.Check("password1"), ShouldHaveSameTypeAs, PolicyError{})
+			So(policy.Check("Tr0ub4dor&3"), ShouldHaveSameTypeAs, PolicyError{})
+			So(policy.Check("Tr0ub4dor&3").Error(), ShouldContainSubstring, "breached")
+			So(policy.Check("password2"), ShouldBeNil)
+		})
+		Convey("Missing breached list should return an error", func() {
+			policy.BreachedListFile = "testdata/missing.txt"
+			err := policy.Check("correct-Horse-battery")
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotHaveSameTypeAs, PolicyError{})
+		})
+		Convey("Default policy should only require a minimum length", func() {
+			So(DefaultPolicy.Check("abcdefgh"), ShouldBeNil)
+			So(strings.Join(DefaultPolicy.Check("abc").(PolicyError), ""), ShouldContainSubstring, "8 characters")
 		})
 	})
 }
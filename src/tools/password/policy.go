@@ -0,0 +1,115 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// A PolicyError is returned by Policy.Check when a password
+// does not comply with the policy. It lists all the violations.
+type PolicyError []string
+
+// Error returns the error message
+func (pe PolicyError) Error() string {
+	return "Password does not comply with the password policy: " + strings.Join(pe, ", ")
+}
+
+// A Policy defines the requirements of new passwords
+type Policy struct {
+	// MinLength is the minimum number of characters of a password
+	MinLength int
+	// MinClasses is the minimum number of character classes
+	// (lowercase, uppercase, digits, others) of a password.
+	MinClasses int
+	// BreachedListFile is the path of a file listing forbidden passwords, such
+	// as known breached passwords. Each line is either a password or the upper
+	// or lowercase hex SHA1 of a password, optionally followed by ':' and a count
+	// (the format of the 'Have I Been Pwned' lists).
+	BreachedListFile string
+}
+
+// DefaultPolicy is the password policy of the application
+var DefaultPolicy = Policy{
+	MinLength: 8,
+}
+
+// Check returns nil if the given password complies with this Policy or a
+// PolicyError otherwise. An error is also returned if the breached list
+// file cannot be read.
+func (p Policy) Check(password string) error {
+	var violations PolicyError
+	if len([]rune(password)) < p.MinLength {
+		violations = append(violations, fmt.Sprintf("at least %d characters required", p.MinLength))
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		violations = append(violations, fmt.Sprintf("at least %d of lowercase letters, uppercase letters, digits and symbols required", p.MinClasses))
+	}
+	if p.BreachedListFile != "" {
+		breached, err := isInList(p.BreachedListFile, password)
+		if err != nil {
+			return fmt.Errorf("unable to check breached passwords list: %s", err)
+		}
+		if breached {
+			violations = append(violations, "this password is known to have been breached")
+		}
+	}
+	if len(violations) > 0 {
+		return violations
+	}
+	return nil
+}
+
+// characterClasses returns the number of character
+// classes used in the given password.
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// isInList returns true if the given password or its SHA1
+// is a line of the file at the given path.
+//
+// The file is read at each call so that large lists do not stay in memory.
+func isInList(path, password string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	sum := sha1.Sum([]byte(password))
+	digest := hex.EncodeToString(sum[:])
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == password {
+			return true, nil
+		}
+		if i := strings.IndexByte(line, ':'); i == 40 {
+			line = line[:i]
+		}
+		if len(line) == 40 && strings.EqualFold(line, digest) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
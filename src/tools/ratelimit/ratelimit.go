@@ -0,0 +1,129 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package ratelimit provides token bucket rate limiting.
+//
+// Each key (e.g. an IP address or a user) has a bucket holding up to Burst
+// tokens, refilled at the rate of the Limit. Each event takes a token and
+// is refused when the bucket is empty.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A Limit is the rate of a token bucket
+type Limit struct {
+	// Events is the number of events allowed per Period
+	Events int
+	// Period is the period over which Events are allowed
+	Period time.Duration
+	// Burst is the maximum number of events allowed at once.
+	// If not set, it defaults to Events.
+	Burst int
+}
+
+// interval returns the time needed to refill one token
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Events)
+}
+
+// burst returns the capacity of the buckets of this Limit
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Events
+}
+
+// A Store holds the token buckets of rate limited keys.
+//
+// MemoryStore is suitable for a single instance. Deployments with several
+// instances should implement Store over a shared storage so that all
+// instances share the same buckets.
+type Store interface {
+	// Take takes a token from the bucket of the given key with the given
+	// limit. It returns 0 if a token has been taken or the duration to
+	// wait until a token is available.
+	Take(key string, limit Limit) (time.Duration, error)
+}
+
+// bucket is the state of a token bucket. Instead of the number of tokens,
+// it holds the time at which the bucket is full (theoretical arrival time),
+// so that it does not need to be refilled periodically.
+type bucket struct {
+	full time.Time
+}
+
+// take takes a token from this bucket at the given time if possible
+// and returns the duration to wait otherwise.
+func (b *bucket) take(limit Limit, now time.Time) time.Duration {
+	interval := limit.interval()
+	full := b.full
+	if full.Before(now) {
+		full = now
+	}
+	full = full.Add(interval)
+	// The bucket is empty if it is full later than burst tokens from now
+	if wait := full.Sub(now) - time.Duration(limit.burst())*interval; wait > 0 {
+		return wait
+	}
+	b.full = full
+	return 0
+}
+
+// A MemoryStore is a Store that keeps buckets in memory
+type MemoryStore struct {
+	sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+var _ Store = new(MemoryStore)
+
+// NewMemoryStore returns a new empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take takes a token from the bucket of the given key with the given
+// limit. It returns 0 if a token has been taken or the duration to
+// wait until a token is available.
+func (ms *MemoryStore) Take(key string, limit Limit) (time.Duration, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	now := ms.now()
+	ms.prune(now)
+	b, ok := ms.buckets[key]
+	if !ok {
+		b = new(bucket)
+		ms.buckets[key] = b
+	}
+	return b.take(limit, now), nil
+}
+
+// prune removes the full buckets, which are equivalent to missing
+// ones, so that the store does not grow forever.
+func (ms *MemoryStore) prune(now time.Time) {
+	if now.Sub(ms.lastPrune) < time.Minute {
+		return
+	}
+	for key, b := range ms.buckets {
+		if !b.full.After(now) {
+			delete(ms.buckets, key)
+		}
+	}
+	ms.lastPrune = now
+}
+
+// RetryAfter returns the given wait duration as a number of seconds
+// rounded up, suitable for a Retry-After HTTP header.
+func RetryAfter(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
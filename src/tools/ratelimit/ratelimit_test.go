@@ -0,0 +1,73 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRateLimit(t *testing.T) {
+	Convey("Testing token bucket rate limiting", t, func() {
+		now := time.Unix(1600000000, 0)
+		store := NewMemoryStore()
+		store.now = func() time.Time { return now }
+		limit := Limit{Events: 2, Period: time.Second, Burst: 4}
+		take := func(key string) time.Duration {
+			wait, err := store.Take(key, limit)
+			So(err, ShouldBeNil)
+			return wait
+		}
+		Convey("Bursts should be allowed up to the burst size", func() {
+			for i := 0; i < 4; i++ {
+				So(take("a"), ShouldEqual, 0)
+			}
+			So(take("a"), ShouldEqual, 500*time.Millisecond)
+			So(take("a"), ShouldEqual, 500*time.Millisecond)
+		})
+		Convey("Tokens should be refilled at the limit rate", func() {
+			for i := 0; i < 4; i++ {
+				take("a")
+			}
+			now = now.Add(200 * time.Millisecond)
+			So(take("a"), ShouldEqual, 300*time.Millisecond)
+			now = now.Add(300 * time.Millisecond)
+			So(take("a"), ShouldEqual, 0)
+			So(take("a"), ShouldEqual, 500*time.Millisecond)
+			now = now.Add(time.Hour)
+			for i := 0; i < 4; i++ {
+				So(take("a"), ShouldEqual, 0)
+			}
+			So(take("a"), ShouldBeGreaterThan, 0)
+		})
+		Convey("Keys should have separate buckets", func() {
+			for i := 0; i < 4; i++ {
+				take("a")
+			}
+			So(take("a"), ShouldBeGreaterThan, 0)
+			So(take("b"), ShouldEqual, 0)
+		})
+		Convey("Burst should default to the number of events", func() {
+			limit = Limit{Events: 3, Period: time.Minute}
+			for i := 0; i < 3; i++ {
+				So(take("a"), ShouldEqual, 0)
+			}
+			So(take("a"), ShouldEqual, 20*time.Second)
+		})
+		Convey("Full buckets should be pruned", func() {
+			take("a")
+			now = now.Add(time.Minute)
+			take("b")
+			So(store.buckets, ShouldHaveLength, 1)
+			So(store.buckets, ShouldContainKey, "b")
+		})
+		Convey("Retry-After should be rounded up to the second", func() {
+			So(RetryAfter(500*time.Millisecond), ShouldEqual, 1)
+			So(RetryAfter(2*time.Second), ShouldEqual, 2)
+			So(RetryAfter(2001*time.Millisecond), ShouldEqual, 3)
+		})
+	})
+}
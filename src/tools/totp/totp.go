@@ -0,0 +1,159 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package totp provides functions to generate and verify RFC 6238
+// time-based one time passwords (TOTP) and single-use recovery codes.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Pedro-lmso-erp/erp/src/tools/password"
+)
+
+const (
+	secretLen       = 20
+	recoveryCodeLen = 10
+	recoveryChars   = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+var (
+	// Digits is the number of digits of the generated codes
+	Digits = 6
+	// Period is the validity period of a code
+	Period = 30 * time.Second
+	// Skew is the number of periods before and after the current one
+	// for which codes are still accepted to allow for clock drift.
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret encoded in base32.
+func GenerateSecret() (string, error) {
+	key := make([]byte, secretLen)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(key), nil
+}
+
+// Counter returns the time step of the given time
+func Counter(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(Period/time.Second))
+}
+
+// Code returns the code of the given base32 secret at the given time.
+func Code(secret string, t time.Time) (string, error) {
+	return codeAt(secret, Counter(t))
+}
+
+// codeAt returns the HOTP code (RFC 4226) of the given secret for the given counter.
+func codeAt(secret string, counter uint64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.Replace(secret, " ", "", -1)))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %s", err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod), nil
+}
+
+// Verify checks the given code against the given secret at time t, accepting
+// codes of Skew periods before and after t.
+//
+// It returns the time step of the matched code, so that callers can reject
+// a code that has already been used, and false if the code is invalid.
+func Verify(secret, code string, t time.Time) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	counter := Counter(t)
+	for i := -Skew; i <= Skew; i++ {
+		if i < 0 && uint64(-i) > counter {
+			continue
+		}
+		step := uint64(int64(counter) + int64(i))
+		expected, err := codeAt(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningURI returns the otpauth:// URI to be encoded in a QR code
+// for enrolling the given secret in an authenticator application.
+func ProvisioningURI(secret, issuer, account string) string {
+	label := url.PathEscape(account)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	if issuer != "" {
+		params.Set("issuer", issuer)
+	}
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", Digits))
+	params.Set("period", fmt.Sprintf("%d", int(Period/time.Second)))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// GenerateRecoveryCodes returns num new random recovery codes together
+// with their hashes. Only hashes should be stored, codes are meant to be
+// displayed once to the user.
+func GenerateRecoveryCodes(num int) ([]string, []string, error) {
+	codes := make([]string, num)
+	hashes := make([]string, num)
+	for i := range codes {
+		buf := make([]byte, recoveryCodeLen)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		for j, b := range buf {
+			buf[j] = recoveryChars[int(b)%len(recoveryChars)]
+		}
+		codes[i] = fmt.Sprintf("%s-%s", buf[:recoveryCodeLen/2], buf[recoveryCodeLen/2:])
+		hash, err := password.Hash(codes[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[i] = hash
+	}
+	return codes, hashes, nil
+}
+
+// MatchRecoveryCode returns the index in hashes of the given recovery code
+// or -1 if it does not match any hash.
+func MatchRecoveryCode(code string, hashes []string) int {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, hash := range hashes {
+		if password.Verify(code, hash) == nil {
+			return i
+		}
+	}
+	return -1
+}
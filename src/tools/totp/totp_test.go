@@ -0,0 +1,95 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTOTP(t *testing.T) {
+	// Secret of RFC 6238 test vectors for SHA1
+	rfcSecret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	Convey("Testing TOTP codes", t, func() {
+		Convey("Codes should match RFC 6238 test vectors", func() {
+			defer func(digits int) { Digits = digits }(Digits)
+			Digits = 8
+			vectors := map[int64]string{
+				59:          "94287082",
+				1111111109:  "07081804",
+				1111111111:  "14050471",
+				1234567890:  "89005924",
+				2000000000:  "69279037",
+				20000000000: "65353130",
+			}
+			for ts, expected := range vectors {
+				code, err := Code(rfcSecret, time.Unix(ts, 0))
+				So(err, ShouldBeNil)
+				So(code, ShouldEqual, expected)
+			}
+		})
+		Convey("Default codes should have 6 digits", func() {
+			code, err := Code(rfcSecret, time.Unix(59, 0))
+			So(err, ShouldBeNil)
+			So(code, ShouldEqual, "287082")
+		})
+		Convey("Invalid secrets should return an error", func() {
+			_, err := Code("not a base32 secret!", time.Now())
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Verifying codes should accept clock drift within skew", func() {
+			now := time.Unix(1600000000, 0)
+			code, _ := Code(rfcSecret, now)
+			step, ok := Verify(rfcSecret, code, now)
+			So(ok, ShouldBeTrue)
+			So(step, ShouldEqual, Counter(now))
+			_, ok = Verify(rfcSecret, code, now.Add(Period))
+			So(ok, ShouldBeTrue)
+			_, ok = Verify(rfcSecret, code, now.Add(-Period))
+			So(ok, ShouldBeTrue)
+			_, ok = Verify(rfcSecret, code, now.Add(3*Period))
+			So(ok, ShouldBeFalse)
+			_, ok = Verify(rfcSecret, "000000", now)
+			So(ok, ShouldBeFalse)
+			_, ok = Verify(rfcSecret, "12345", now)
+			So(ok, ShouldBeFalse)
+		})
+		Convey("Generated secrets should be usable", func() {
+			secret, err := GenerateSecret()
+			So(err, ShouldBeNil)
+			So(secret, ShouldHaveLength, 32)
+			code, err := Code(secret, time.Now())
+			So(err, ShouldBeNil)
+			_, ok := Verify(secret, code, time.Now())
+			So(ok, ShouldBeTrue)
+		})
+	})
+	Convey("Testing provisioning URI", t, func() {
+		uri := ProvisioningURI("JBSWY3DPEHPK3PXP", "My Company", "jane@example.com")
+		parsed, err := url.Parse(uri)
+		So(err, ShouldBeNil)
+		So(parsed.Scheme, ShouldEqual, "otpauth")
+		So(parsed.Host, ShouldEqual, "totp")
+		So(parsed.Path, ShouldEqual, "/My Company:jane@example.com")
+		So(parsed.Query().Get("secret"), ShouldEqual, "JBSWY3DPEHPK3PXP")
+		So(parsed.Query().Get("issuer"), ShouldEqual, "My Company")
+		So(parsed.Query().Get("digits"), ShouldEqual, "6")
+		So(parsed.Query().Get("period"), ShouldEqual, "30")
+	})
+	Convey("Testing recovery codes", t, func() {
+		codes, hashes, err := GenerateRecoveryCodes(3)
+		So(err, ShouldBeNil)
+		So(codes, ShouldHaveLength, 3)
+		So(hashes, ShouldHaveLength, 3)
+		So(codes[0], ShouldHaveLength, 11)
+		So(codes[0], ShouldNotEqual, codes[1])
+		So(MatchRecoveryCode(codes[1], hashes), ShouldEqual, 1)
+		So(MatchRecoveryCode(" "+codes[2]+" ", hashes), ShouldEqual, 2)
+		So(MatchRecoveryCode("wrong-code", hashes), ShouldEqual, -1)
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// A WriterExporter is an Exporter that writes the spans to an io.Writer
+// as JSON, one span per line. It is meant for local use.
+type WriterExporter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+var _ Exporter = new(WriterExporter)
+
+// NewWriterExporter returns a WriterExporter that writes the spans to w
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// NewStdoutExporter returns a WriterExporter that writes the spans to the standard output
+func NewStdoutExporter() *WriterExporter {
+	return NewWriterExporter(os.Stdout)
+}
+
+// NewFileExporter returns a WriterExporter that appends the spans to the
+// file at the given path, creating it if necessary.
+func NewFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open trace file %s: %s", path, err)
+	}
+	return &WriterExporter{w: f, closer: f}, nil
+}
+
+// ExportSpan writes the given span as a JSON line.
+// Write errors are ignored.
+func (we *WriterExporter) ExportSpan(data SpanData) {
+	line, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	we.w.Write(append(line, '\n'))
+}
+
+// Close closes the underlying file of a WriterExporter created
+// with NewFileExporter. It does nothing otherwise.
+func (we *WriterExporter) Close() error {
+	if we.closer == nil {
+		return nil
+	}
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	return we.closer.Close()
+}
@@ -0,0 +1,318 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package tracing provides OpenTelemetry compatible spans.
+//
+// A span records the duration of an operation. Spans started from a parent
+// span belong to the same trace, so that the spans of a trace form a tree.
+// Ended spans are sent to the Exporter set with SetExporter. When no
+// exporter is set, StartSpan returns nil and all the methods of Span are
+// no-ops on nil spans, so that tracing has almost no cost when disabled.
+//
+// Traces can be propagated between processes with W3C Trace Context
+// traceparent headers (see StartRemoteSpan and Span.TraceParent).
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the W3C Trace Context header used to propagate traces
+const TraceParentHeader = "traceparent"
+
+// A SpanKind describes the relationship between a span and its parent and children
+type SpanKind string
+
+// Available span kinds
+const (
+	KindInternal SpanKind = "internal"
+	KindServer   SpanKind = "server"
+	KindClient   SpanKind = "client"
+)
+
+// A StatusCode is the status of a span
+type StatusCode string
+
+// Available status codes
+const (
+	StatusUnset StatusCode = "unset"
+	StatusOK    StatusCode = "ok"
+	StatusError StatusCode = "error"
+)
+
+// A TraceID identifies a trace
+type TraceID [16]byte
+
+// IsValid returns true if this TraceID is not zero
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// String returns the hex representation of this TraceID
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// MarshalText returns the hex representation of this TraceID
+func (t TraceID) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// A SpanID identifies a span in a trace
+type SpanID [8]byte
+
+// IsValid returns true if this SpanID is not zero
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// String returns the hex representation of this SpanID
+// or an empty string if it is not valid.
+func (s SpanID) String() string {
+	if !s.IsValid() {
+		return ""
+	}
+	return hex.EncodeToString(s[:])
+}
+
+// MarshalText returns the hex representation of this SpanID
+func (s SpanID) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// A Status is the final status of a span
+type Status struct {
+	Code    StatusCode `json:"code"`
+	Message string     `json:"message,omitempty"`
+}
+
+// SpanData is the data of an ended span, as sent to the Exporter
+type SpanData struct {
+	TraceID      TraceID                `json:"trace_id"`
+	SpanID       SpanID                 `json:"span_id"`
+	ParentSpanID SpanID                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         SpanKind               `json:"kind"`
+	StartTime    time.Time              `json:"start_time"`
+	EndTime      time.Time              `json:"end_time"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Status       Status                 `json:"status"`
+}
+
+// Duration returns the duration of the span
+func (sd SpanData) Duration() time.Duration {
+	return sd.EndTime.Sub(sd.StartTime)
+}
+
+// An Exporter sends the ended spans to a tracing backend
+type Exporter interface {
+	// ExportSpan exports the given ended span.
+	// It is called synchronously when the span ends and should not block.
+	ExportSpan(SpanData)
+}
+
+// exporter is the Exporter spans are sent to
+var exporter struct {
+	sync.RWMutex
+	Exporter
+}
+
+// SetExporter sets the Exporter the ended spans are sent to.
+// Setting a nil Exporter disables tracing.
+func SetExporter(e Exporter) {
+	exporter.Lock()
+	defer exporter.Unlock()
+	exporter.Exporter = e
+}
+
+// getExporter returns the current Exporter or nil if tracing is disabled
+func getExporter() Exporter {
+	exporter.RLock()
+	defer exporter.RUnlock()
+	return exporter.Exporter
+}
+
+// Enabled returns true if an Exporter is set
+func Enabled() bool {
+	return getExporter() != nil
+}
+
+// A Span records an operation in a trace.
+//
+// All methods of Span are safe for concurrent use and can be called on
+// a nil Span, which is returned by StartSpan when tracing is disabled.
+type Span struct {
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// StartSpan starts a new span of the given kind with the given name,
+// as a child of parent. If parent is nil, the span is the root of a new
+// trace. It returns nil if tracing is disabled.
+func StartSpan(parent *Span, kind SpanKind, name string) *Span {
+	if parent != nil {
+		return newSpan(parent.data.TraceID, parent.data.SpanID, kind, name)
+	}
+	if !Enabled() {
+		return nil
+	}
+	return newSpan(newTraceID(), SpanID{}, kind, name)
+}
+
+// StartRemoteSpan starts a new span of the given kind with the given name as
+// a child of the remote span described by the given W3C traceparent header.
+// If traceParent is empty or invalid, the span is the root of a new trace.
+// It returns nil if tracing is disabled.
+func StartRemoteSpan(traceParent string, kind SpanKind, name string) *Span {
+	if !Enabled() {
+		return nil
+	}
+	traceID, parentID, ok := parseTraceParent(traceParent)
+	if !ok {
+		return StartSpan(nil, kind, name)
+	}
+	return newSpan(traceID, parentID, kind, name)
+}
+
+// newSpan returns a new started span of the given trace
+func newSpan(traceID TraceID, parentID SpanID, kind SpanKind, name string) *Span {
+	return &Span{
+		data: SpanData{
+			TraceID:      traceID,
+			SpanID:       newSpanID(),
+			ParentSpanID: parentID,
+			Name:         name,
+			Kind:         kind,
+			StartTime:    time.Now(),
+			Status:       Status{Code: StatusUnset},
+		},
+	}
+}
+
+// TraceID returns the id of the trace of this span
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.data.TraceID
+}
+
+// SpanID returns the id of this span
+func (s *Span) SpanID() SpanID {
+	if s == nil {
+		return SpanID{}
+	}
+	return s.data.SpanID
+}
+
+// TraceParent returns the W3C traceparent header value that
+// propagates the trace of this span with this span as parent.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.data.TraceID, s.data.SpanID)
+}
+
+// SetAttribute sets the attribute with the given key to the given value
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetStatus sets the status of this span
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Status = Status{Code: code, Message: message}
+}
+
+// SetError sets the status of this span to StatusError with
+// the given error message. It does nothing if err is nil.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.SetStatus(StatusError, err.Error())
+}
+
+// End ends this span and sends it to the Exporter.
+// Calling End more than once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if e := getExporter(); e != nil {
+		e.ExportSpan(data)
+	}
+}
+
+// parseTraceParent returns the trace id and the parent span id
+// of the given W3C traceparent header value.
+func parseTraceParent(traceParent string) (TraceID, SpanID, bool) {
+	var (
+		traceID TraceID
+		spanID  SpanID
+	)
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != hex.EncodedLen(len(traceID)) || len(parts[2]) != hex.EncodedLen(len(spanID)) {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, false
+	}
+	if !traceID.IsValid() || !spanID.IsValid() {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, true
+}
+
+// newTraceID returns a new random TraceID
+func newTraceID() TraceID {
+	var res TraceID
+	randomBytes(res[:])
+	return res
+}
+
+// newSpanID returns a new random SpanID
+func newSpanID() SpanID {
+	var res SpanID
+	randomBytes(res[:])
+	return res
+}
+
+// randomBytes fills b with random bytes
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("unable to generate random id: %s", err))
+	}
+}
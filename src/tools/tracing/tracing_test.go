@@ -0,0 +1,101 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A recordingExporter keeps the exported spans in memory
+type recordingExporter struct {
+	spans []SpanData
+}
+
+func (re *recordingExporter) ExportSpan(data SpanData) {
+	re.spans = append(re.spans, data)
+}
+
+func TestTracing(t *testing.T) {
+	Convey("Testing disabled tracing", t, func() {
+		SetExporter(nil)
+		span := StartSpan(nil, KindInternal, "disabled")
+		So(span, ShouldBeNil)
+		So(func() {
+			span.SetAttribute("key", "value")
+			span.SetError(errors.New("error"))
+			span.End()
+		}, ShouldNotPanic)
+		So(StartSpan(span, KindInternal, "child"), ShouldBeNil)
+		So(StartRemoteSpan("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", KindServer, "remote"), ShouldBeNil)
+		So(span.TraceParent(), ShouldBeEmpty)
+	})
+	Convey("Testing spans", t, func() {
+		exp := new(recordingExporter)
+		SetExporter(exp)
+		Reset(func() {
+			SetExporter(nil)
+		})
+		root := StartSpan(nil, KindServer, "root")
+		child := StartSpan(root, KindInternal, "child")
+		child.SetAttribute("erp.model", "User")
+		child.SetError(errors.New("failure"))
+		child.End()
+		child.End()
+		root.End()
+		So(exp.spans, ShouldHaveLength, 2)
+		So(exp.spans[0].Name, ShouldEqual, "child")
+		So(exp.spans[0].TraceID, ShouldEqual, root.TraceID())
+		So(exp.spans[0].ParentSpanID, ShouldEqual, root.SpanID())
+		So(exp.spans[0].Attributes["erp.model"], ShouldEqual, "User")
+		So(exp.spans[0].Status, ShouldResemble, Status{Code: StatusError, Message: "failure"})
+		So(exp.spans[1].ParentSpanID.IsValid(), ShouldBeFalse)
+		So(exp.spans[1].Duration(), ShouldBeGreaterThanOrEqualTo, exp.spans[0].Duration())
+		So(root.TraceID(), ShouldNotEqual, StartSpan(nil, KindServer, "other").TraceID())
+	})
+	Convey("Testing trace context propagation", t, func() {
+		SetExporter(new(recordingExporter))
+		Reset(func() {
+			SetExporter(nil)
+		})
+		span := StartRemoteSpan("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", KindServer, "remote")
+		So(span.TraceID().String(), ShouldEqual, "0af7651916cd43dd8448eb211c80319c")
+		So(span.data.ParentSpanID.String(), ShouldEqual, "b7ad6b7169203331")
+		So(span.TraceParent(), ShouldEqual, "00-0af7651916cd43dd8448eb211c80319c-"+span.SpanID().String()+"-01")
+		for _, invalid := range []string{
+			"",
+			"00-0af7651916cd43dd8448eb211c80319c",
+			"00-0af7651916cd43dd8448eb211c80319cff-b7ad6b7169203331-01",
+			"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+			"00-0af7651916cd43dd8448eb211c80319c-zzad6b7169203331-01",
+			"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		} {
+			span := StartRemoteSpan(invalid, KindServer, "remote")
+			So(span.TraceID().IsValid(), ShouldBeTrue)
+			So(span.data.ParentSpanID.IsValid(), ShouldBeFalse)
+		}
+	})
+	Convey("Testing the writer exporter", t, func() {
+		var buf bytes.Buffer
+		SetExporter(NewWriterExporter(&buf))
+		Reset(func() {
+			SetExporter(nil)
+		})
+		span := StartSpan(nil, KindInternal, "written")
+		span.SetAttribute("db.statement", "SELECT 1")
+		span.End()
+		So(strings.Count(buf.String(), "\n"), ShouldEqual, 1)
+		var data map[string]interface{}
+		So(json.Unmarshal(buf.Bytes(), &data), ShouldBeNil)
+		So(data["name"], ShouldEqual, "written")
+		So(data["trace_id"], ShouldEqual, span.TraceID().String())
+		So(data["parent_span_id"], ShouldEqual, "")
+		So(data["attributes"], ShouldResemble, map[string]interface{}{"db.statement": "SELECT 1"})
+	})
+}